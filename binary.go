@@ -0,0 +1,244 @@
+package timemetrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// InvalidEncoding is the error returned when decoding bytes which were not
+// produced by the matching MarshalBinary, or by a newer version of it.
+type InvalidEncoding string
+
+func (err InvalidEncoding) Error() string {
+	return fmt.Sprintf("invalid encoding: %s", string(err))
+}
+
+// Encodings start with a kind byte telling what was encoded, followed by the
+// version of the encoding of that kind.
+const (
+	counterEncoding              byte = 'c'
+	meterEncoding                byte = 'm'
+	histogramEncoding            byte = 'h'
+	gaugeEncoding                byte = 'g'
+	gaugeFloat64Encoding         byte = 'G'
+	timerEncoding                byte = 'T'
+	windowedHistogramEncoding    byte = 'w'
+	bucketHistogramEncoding      byte = 'b'
+	exponentialHistogramEncoding byte = 'x'
+	expDecayEncoding             byte = 'e'
+	uniformEncoding              byte = 'u'
+	slidingWindowEncoding        byte = 's'
+	hdrEncoding                  byte = 'H'
+	tdigestEncoding              byte = 't'
+	ddsketchEncoding             byte = 'd'
+	checkpointEncoding           byte = 'R'
+)
+
+// binaryWriter appends the fields of an encoding to a buffer.
+type binaryWriter struct {
+	buf []byte
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *binaryWriter) putHeader(kind byte, version byte) {
+	w.buf = append(w.buf, kind, version)
+}
+
+func (w *binaryWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binaryWriter) putVarint(v int64) {
+	n := binary.PutVarint(w.tmp[:], v)
+	w.buf = append(w.buf, w.tmp[:n]...)
+}
+
+func (w *binaryWriter) putFloat64(f float64) {
+	binary.LittleEndian.PutUint64(w.tmp[:8], math.Float64bits(f))
+	w.buf = append(w.buf, w.tmp[:8]...)
+}
+
+func (w *binaryWriter) putBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *binaryWriter) putBytes(b []byte) {
+	w.putUvarint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *binaryWriter) putString(s string) {
+	w.putUvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binaryWriter) putTags(tags Tags) {
+	keys := tags.Keys()
+	w.putUvarint(uint64(len(keys)))
+	for _, k := range keys {
+		w.putString(k)
+		w.putString(tags[k])
+	}
+}
+
+// putTimestamp encodes t to the nanosecond, the zero time included.
+func (w *binaryWriter) putTimestamp(t time.Time) {
+	w.putVarint(t.Unix())
+	w.putUvarint(uint64(t.Nanosecond()))
+}
+
+// putDuration encodes d as nanoseconds.
+func (w *binaryWriter) putDuration(d time.Duration) {
+	w.putVarint(int64(d))
+}
+
+// binaryReader reads the fields of an encoding from a buffer.  The first
+// error sticks: later reads return zero values and err tells what went wrong.
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+// header checks the kind of the encoding and returns its version, which is
+// at most maxVersion.
+func (r *binaryReader) header(kind byte, maxVersion byte) byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 2 {
+		r.err = InvalidEncoding("truncated header")
+		return 0
+	}
+	if r.buf[0] != kind {
+		r.err = InvalidEncoding(fmt.Sprintf("kind %q, expected %q", r.buf[0], kind))
+		return 0
+	}
+	version := r.buf[1]
+	if version == 0 || version > maxVersion {
+		r.err = InvalidEncoding(fmt.Sprintf("unsupported version %d of kind %q", version, kind))
+		return 0
+	}
+	r.buf = r.buf[2:]
+	return version
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = InvalidEncoding("truncated or overflowing uvarint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = InvalidEncoding("truncated or overflowing varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *binaryReader) float64() float64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 8 {
+		r.err = InvalidEncoding("truncated float64")
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(r.buf))
+	r.buf = r.buf[8:]
+	return f
+}
+
+func (r *binaryReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.buf) < 1 || r.buf[0] > 1 {
+		r.err = InvalidEncoding("truncated or invalid bool")
+		return false
+	}
+	b := r.buf[0] == 1
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.count(1)
+	if r.err != nil {
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binaryReader) str() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) tags() Tags {
+	n := r.count(2)
+	if 0 == n {
+		return nil
+	}
+	tags := make(Tags, n)
+	for i := 0; i < n; i++ {
+		k := r.str()
+		tags[k] = r.str()
+	}
+	return tags
+}
+
+func (r *binaryReader) timestamp() time.Time {
+	sec := r.varint()
+	nsec := r.uvarint()
+	if r.err == nil && nsec >= uint64(time.Second) {
+		r.err = InvalidEncoding(fmt.Sprintf("%d nanoseconds", nsec))
+	}
+	if r.err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+func (r *binaryReader) duration() time.Duration {
+	return time.Duration(r.varint())
+}
+
+// count reads a number of items each taking at least minSize bytes, failing
+// if the buffer cannot hold them.
+func (r *binaryReader) count(minSize int) int {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.buf)/minSize) {
+		r.err = InvalidEncoding(fmt.Sprintf("%d items do not fit in %d bytes", n, len(r.buf)))
+		return 0
+	}
+	return int(n)
+}
+
+// end fails if bytes are left over, and returns the error of the reader.
+func (r *binaryReader) end() error {
+	if r.err == nil && len(r.buf) > 0 {
+		r.err = InvalidEncoding(fmt.Sprintf("%d trailing bytes", len(r.buf)))
+	}
+	return r.err
+}
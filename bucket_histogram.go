@@ -0,0 +1,387 @@
+package timemetrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IncompatibleBuckets is the error returned when merging bucket histograms
+// whose bounds differ.
+type IncompatibleBuckets string
+
+func (err IncompatibleBuckets) Error() string {
+	return fmt.Sprintf("incompatible buckets: %s", string(err))
+}
+
+// BucketHistograms count values in buckets of fixed upper bounds.  Unlike the
+// samples of a Histogram, buckets add up: histograms of different instances
+// or time ranges are aggregated by merging their counts.
+type BucketHistogram interface {
+	Bounds() []float64
+	BucketCounts() []int64
+	Clear(time.Time)
+	Count() int64
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
+	Merge(BucketHistogram) error
+	SetLateOptions(LateOptions)
+	Sum() int64
+	Update(time.Time, int64)
+	GetMaxTime() time.Time
+	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	NbKeys() int
+	Stale(time.Time) bool
+	PushKeysTime(time.Time) bool
+	Tags() Tags
+	ZeroOut()
+}
+
+// LinearBuckets returns count upper bounds, start and the following ones
+// width apart.
+func LinearBuckets(start float64, width float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start + float64(i)*width
+	}
+	return bounds
+}
+
+// ExponentialBuckets returns count upper bounds, start and the following ones
+// each factor times the previous one.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start * math.Pow(factor, float64(i))
+	}
+	return bounds
+}
+
+// BucketSuffix returns the key suffix the cumulative count of the bucket of
+// upper bound bound is emitted under, e.g. "le_10", "le_0_5" for 0.5, or
+// "le_inf" for the bucket of all values.
+func BucketSuffix(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "le_inf"
+	}
+	return "le_" + strings.Replace(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_", 1)
+}
+
+// GetOrRegisterBucketHistogram returns an existing BucketHistogram or
+// constructs and registers a new StandardBucketHistogram stamped with the
+// event time t.
+func GetOrRegisterBucketHistogram(name string, r Registry, t time.Time, bounds []float64) BucketHistogram {
+	return GetOrRegisterTaggedBucketHistogram(name, nil, r, t, bounds)
+}
+
+// GetOrRegisterTaggedBucketHistogram returns an existing BucketHistogram or
+// constructs and registers a new tagged StandardBucketHistogram stamped with
+// the event time t.
+func GetOrRegisterTaggedBucketHistogram(name string, tags Tags, r Registry, t time.Time, bounds []float64) BucketHistogram {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		h := NewTaggedBucketHistogram(bounds, staleThreshold, tags).(*StandardBucketHistogram)
+		h.lastUpdate = t
+		return h
+	}).(BucketHistogram)
+}
+
+// NewBucketHistogram constructs a new StandardBucketHistogram with the given
+// upper bounds.  The bounds are sorted, duplicates and NaNs are dropped, and
+// a last bucket always counts the values above the highest bound.
+func NewBucketHistogram(bounds []float64, staleThreshold int) BucketHistogram {
+	return NewTaggedBucketHistogram(bounds, staleThreshold, nil)
+}
+
+// NewTaggedBucketHistogram constructs a new StandardBucketHistogram with the
+// given upper bounds and tags.
+func NewTaggedBucketHistogram(bounds []float64, staleThreshold int, tags Tags) BucketHistogram {
+	b := normalizeBounds(bounds)
+	return &StandardBucketHistogram{
+		bounds:         b,
+		counts:         make([]int64, len(b)+1),
+		staleThreshold: staleThreshold,
+		tags:           copyTags(tags),
+	}
+}
+
+// NewRegisteredBucketHistogram constructs and registers a new
+// StandardBucketHistogram with the given upper bounds, stamped with the event
+// time t.  It returns DuplicateMetric if a metric is already registered under
+// name.
+func NewRegisteredBucketHistogram(name string, r Registry, t time.Time, bounds []float64) (BucketHistogram, error) {
+	return NewRegisteredTaggedBucketHistogram(name, nil, r, t, bounds)
+}
+
+// NewRegisteredTaggedBucketHistogram constructs and registers a new tagged
+// StandardBucketHistogram with the given upper bounds, stamped with the event
+// time t.
+func NewRegisteredTaggedBucketHistogram(name string, tags Tags, r Registry, t time.Time, bounds []float64) (BucketHistogram, error) {
+	h := NewTaggedBucketHistogram(bounds, r.StaleThreshold(), tags).(*StandardBucketHistogram)
+	h.lastUpdate = t
+	if err := r.Register(name, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// normalizeBounds returns the sorted, distinct, finite or -Inf bounds.
+func normalizeBounds(bounds []float64) []float64 {
+	b := make([]float64, 0, len(bounds))
+	for _, bound := range bounds {
+		if !math.IsNaN(bound) && !math.IsInf(bound, 1) {
+			b = append(b, bound)
+		}
+	}
+	sort.Float64s(b)
+	n := 0
+	for i, bound := range b {
+		if 0 == i || bound != b[n-1] {
+			b[n] = bound
+			n++
+		}
+	}
+	return b[:n]
+}
+
+// StandardBucketHistogram is the standard implementation of a
+// BucketHistogram.  Its counts are cumulative: like those of a Counter, they
+// are not zeroed out when it goes stale.
+type StandardBucketHistogram struct {
+	lateTracker
+	bounds         []float64
+	counts         []int64 // per bucket, the last one above every bound
+	count          int64
+	sum            int64
+	lastUpdate     time.Time
+	staleThreshold int
+	tags           Tags
+	mutex          sync.Mutex
+}
+
+// Bounds returns the upper bounds of the buckets, but the last one which has
+// none.
+func (h *StandardBucketHistogram) Bounds() []float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	bounds := make([]float64, len(h.bounds))
+	copy(bounds, h.bounds)
+	return bounds
+}
+
+// BucketCounts returns the number of values in each bucket, not cumulative.
+func (h *StandardBucketHistogram) BucketCounts() []int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	counts := make([]int64, len(h.counts))
+	copy(counts, h.counts)
+	return counts
+}
+
+// Clear zeroes the counts, the sum and the count of the histogram.
+func (h *StandardBucketHistogram) Clear(t time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.count, h.sum = 0, 0
+	h.lastUpdate = t
+}
+
+// Count returns the number of values recorded.
+func (h *StandardBucketHistogram) Count() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+// Merge adds the counts of other, whose bounds must be the same, to the
+// histogram.  The histogram is stamped with the newest of both times of last
+// update.
+func (h *StandardBucketHistogram) Merge(other BucketHistogram) error {
+	o, ok := other.(*StandardBucketHistogram)
+	if !ok {
+		return IncompatibleBuckets(fmt.Sprintf("%T", other))
+	}
+	if o == h {
+		return IncompatibleBuckets("merge with itself")
+	}
+	o.mutex.Lock()
+	bounds := o.bounds
+	counts := make([]int64, len(o.counts))
+	copy(counts, o.counts)
+	count, sum, lastUpdate := o.count, o.sum, o.lastUpdate
+	o.mutex.Unlock()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !equalBounds(h.bounds, bounds) {
+		return IncompatibleBuckets(fmt.Sprintf("bounds %v and %v", h.bounds, bounds))
+	}
+	for i, c := range counts {
+		h.counts[i] += c
+	}
+	h.count += count
+	h.sum += sum
+	if lastUpdate.After(h.lastUpdate) {
+		h.lastUpdate = lastUpdate
+	}
+	return nil
+}
+
+func equalBounds(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Sum returns the sum of the values recorded.
+func (h *StandardBucketHistogram) Sum() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sum
+}
+
+// Update counts a value in its bucket, the first whose upper bound is not
+// below it, unless t is late and the late policy discards it.
+func (h *StandardBucketHistogram) Update(t time.Time, v int64) {
+	if !h.admit(t, h.GetMaxTime()) {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[sort.SearchFloat64s(h.bounds, float64(v))]++
+	h.count++
+	h.sum += v
+	if t.After(h.lastUpdate) {
+		h.lastUpdate = t
+	}
+}
+
+func (h *StandardBucketHistogram) GetMaxTime() time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.lastUpdate
+}
+
+func (h *StandardBucketHistogram) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, h.GetDatapoints(ct, currentTime))
+}
+
+// GetDatapoints returns the cumulative count of each bucket, under the
+// BucketSuffix of its upper bound, then the count and the sum.
+func (h *StandardBucketHistogram) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	t := datapointTime(h, ct, currentTime)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dps := make([]Datapoint, 0, h.NbKeys())
+	var cumulative int64
+	for i, c := range h.counts {
+		cumulative += c
+		bound := math.Inf(1)
+		if i < len(h.bounds) {
+			bound = h.bounds[i]
+		}
+		dps = append(dps, intDatapoint(BucketSuffix(bound), t, HistogramKind, cumulative))
+	}
+	dps = append(dps, intDatapoint("count", t, HistogramKind, h.count))
+	dps = append(dps, intDatapoint("sum", t, HistogramKind, h.sum))
+	return tagDatapoints(dps, h.tags)
+}
+
+func (h *StandardBucketHistogram) NbKeys() int {
+	return len(h.bounds) + 3
+}
+
+func (h *StandardBucketHistogram) Stale(t time.Time) bool {
+	return t.Sub(h.GetMaxTime()) > time.Duration(h.staleThreshold)*time.Minute
+}
+
+func (h *StandardBucketHistogram) PushKeysTime(t time.Time) bool {
+	return h.GetMaxTime().After(t)
+}
+
+func (h *StandardBucketHistogram) Tags() Tags {
+	return h.tags
+}
+
+func (h *StandardBucketHistogram) ZeroOut() {
+	// Nothing to do for cumulative counts
+}
+
+// bucketHistogramEncodingVersion is the version of the encoding of
+// StandardBucketHistograms.
+const bucketHistogramEncodingVersion = 1
+
+// MarshalBinary encodes the histogram, its bounds and counts included.
+func (h *StandardBucketHistogram) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.putHeader(bucketHistogramEncoding, bucketHistogramEncodingVersion)
+	h.mutex.Lock()
+	w.putUvarint(uint64(len(h.bounds)))
+	for _, bound := range h.bounds {
+		w.putFloat64(bound)
+	}
+	for _, c := range h.counts {
+		w.putUvarint(uint64(c))
+	}
+	w.putVarint(h.sum)
+	w.putTimestamp(h.lastUpdate)
+	h.mutex.Unlock()
+	w.putVarint(int64(h.staleThreshold))
+	w.putTags(h.tags)
+	h.lateTracker.marshal(w)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the histogram by the one encoded in data by
+// MarshalBinary.
+func (h *StandardBucketHistogram) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(bucketHistogramEncoding, bucketHistogramEncodingVersion)
+	bounds := make([]float64, r.count(8))
+	for i := range bounds {
+		bounds[i] = r.float64()
+	}
+	counts := make([]int64, len(bounds)+1)
+	var count int64
+	for i := range counts {
+		counts[i] = int64(r.uvarint())
+		count += counts[i]
+	}
+	sum := r.varint()
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	if err := r.end(); err != nil {
+		return err
+	}
+	if !equalBounds(bounds, normalizeBounds(bounds)) {
+		return InvalidEncoding(fmt.Sprintf("bounds %v", bounds))
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.bounds = bounds
+	h.counts = counts
+	h.count = count
+	h.sum = sum
+	h.lastUpdate = lastUpdate
+	h.staleThreshold = staleThreshold
+	h.tags = tags
+	h.lateTracker.restore(late, dropped)
+	return nil
+}
@@ -0,0 +1,147 @@
+package timemetrics
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketHistogramBounds(t *testing.T) {
+	if bounds := LinearBuckets(10, 5, 4); !reflect.DeepEqual([]float64{10, 15, 20, 25}, bounds) {
+		t.Errorf("LinearBuckets(10, 5, 4): [10 15 20 25] != %v\n", bounds)
+	}
+	if bounds := ExponentialBuckets(1, 10, 4); !reflect.DeepEqual([]float64{1, 10, 100, 1000}, bounds) {
+		t.Errorf("ExponentialBuckets(1, 10, 4): [1 10 100 1000] != %v\n", bounds)
+	}
+	h := NewBucketHistogram([]float64{5, 1, math.NaN(), 5, math.Inf(1), 2.5}, 10)
+	if bounds := h.Bounds(); !reflect.DeepEqual([]float64{1, 2.5, 5}, bounds) {
+		t.Errorf("h.Bounds(): [1 2.5 5] != %v\n", bounds)
+	}
+	for bound, expected := range map[float64]string{10: "le_10", 0.5: "le_0_5", -2: "le_-2", 1e6: "le_1000000", math.Inf(1): "le_inf"} {
+		if suffix := BucketSuffix(bound); expected != suffix {
+			t.Errorf("BucketSuffix(%v): %v != %v\n", bound, expected, suffix)
+		}
+	}
+}
+
+func TestBucketHistogramUpdate(t *testing.T) {
+	h := NewTaggedBucketHistogram([]float64{1, 2.5, 5}, 10, Tags{"host": "web1"})
+	for i, v := range []int64{0, 1, 2, 3, 5, 6, 100} {
+		h.Update(time.Unix(int64(600+i), 0), v)
+	}
+	if counts := h.BucketCounts(); !reflect.DeepEqual([]int64{2, 1, 2, 2}, counts) {
+		t.Errorf("h.BucketCounts(): [2 1 2 2] != %v\n", counts)
+	}
+	if count, sum := h.Count(), h.Sum(); 7 != count || 117 != sum {
+		t.Errorf("h.Count(), h.Sum(): 7, 117 != %v, %v\n", count, sum)
+	}
+	expected := []string{
+		"put foo.le_1 606 2 host=web1\n",
+		"put foo.le_2_5 606 3 host=web1\n",
+		"put foo.le_5 606 5 host=web1\n",
+		"put foo.le_inf 606 7 host=web1\n",
+		"put foo.count 606 7 host=web1\n",
+		"put foo.sum 606 117 host=web1\n",
+	}
+	if keys := h.GetKeys(time.Unix(660, 0), "put foo.%s %d %s\n", false); !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h.GetKeys(): %v != %v\n", expected, keys)
+	}
+	if nbKeys := h.NbKeys(); len(expected) != nbKeys {
+		t.Errorf("h.NbKeys(): %v != %v\n", len(expected), nbKeys)
+	}
+
+	// Counts are cumulative and survive going stale.
+	h.ZeroOut()
+	if count := h.Count(); 7 != count {
+		t.Errorf("h.Count(): 7 != %v after ZeroOut\n", count)
+	}
+	if !h.PushKeysTime(time.Unix(605, 0)) || h.PushKeysTime(time.Unix(606, 0)) {
+		t.Error("h.PushKeysTime(): expected true before the last update only\n")
+	}
+	h.Clear(time.Unix(700, 0))
+	if count, sum := h.Count(), h.Sum(); 0 != count || 0 != sum {
+		t.Errorf("h.Count(), h.Sum(): 0, 0 != %v, %v after Clear\n", count, sum)
+	}
+}
+
+func TestBucketHistogramMerge(t *testing.T) {
+	bounds := LinearBuckets(10, 10, 5)
+	a, b := NewBucketHistogram(bounds, 10), NewBucketHistogram(bounds, 10)
+	whole := NewBucketHistogram(bounds, 10)
+	for i := int64(0); i < 100; i++ {
+		if i%3 == 0 {
+			a.Update(time.Unix(600+i, 0), i)
+		} else {
+			b.Update(time.Unix(600+i, 0), i)
+		}
+		whole.Update(time.Unix(600+i, 0), i)
+	}
+	if err := a.Merge(b); nil != err {
+		t.Fatal(err)
+	}
+	if expected, counts := whole.BucketCounts(), a.BucketCounts(); !reflect.DeepEqual(expected, counts) {
+		t.Errorf("a.BucketCounts(): %v != %v\n", expected, counts)
+	}
+	if whole.Count() != a.Count() || whole.Sum() != a.Sum() {
+		t.Errorf("a.Count(), a.Sum(): %v, %v != %v, %v\n", whole.Count(), whole.Sum(), a.Count(), a.Sum())
+	}
+	if !a.GetMaxTime().Equal(time.Unix(699, 0)) {
+		t.Errorf("a.GetMaxTime(): %v != %v\n", time.Unix(699, 0), a.GetMaxTime())
+	}
+
+	if err := a.Merge(NewBucketHistogram(LinearBuckets(10, 10, 4), 10)); nil == err {
+		t.Error("a.Merge(other bounds): expected an error\n")
+	} else if _, ok := err.(IncompatibleBuckets); !ok {
+		t.Errorf("a.Merge(other bounds): %v is not an IncompatibleBuckets\n", err)
+	}
+	if err := a.Merge(a); nil == err {
+		t.Error("a.Merge(a): expected an error\n")
+	}
+}
+
+func TestBucketHistogramRegistry(t *testing.T) {
+	r := NewRegistry(60, 10)
+	t0 := time.Unix(600, 0)
+	h := GetOrRegisterTaggedBucketHistogram("latency", Tags{"host": "web1"}, r, t0, []float64{0.5, 1})
+	h.Update(t0, 1)
+	if h2 := GetOrRegisterTaggedBucketHistogram("latency", Tags{"host": "web1"}, r, t0, nil); h != h2 {
+		t.Error("GetOrRegisterTaggedBucketHistogram(): registered a second histogram\n")
+	}
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, r, false); nil != err {
+		t.Fatal(err)
+	}
+	expected := `# TYPE latency histogram
+latency_bucket{host="web1",le="0.5"} 0 600000
+latency_bucket{host="web1",le="1"} 1 600000
+latency_bucket{host="web1",le="+Inf"} 1 600000
+latency_sum{host="web1"} 1 600000
+latency_count{host="web1"} 1 600000
+`
+	if expected != buf.String() {
+		t.Errorf("WritePrometheus():\n%s\n!=\n%s\n", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := r.Checkpoint(&buf); nil != err {
+		t.Fatal(err)
+	}
+	r2 := NewRegistry(60, 10)
+	if err := r2.Restore(&buf); nil != err {
+		t.Fatal(err)
+	}
+	h2 := r2.Get("latency", Tags{"host": "web1"}).(BucketHistogram)
+	if !reflect.DeepEqual(h.BucketCounts(), h2.BucketCounts()) || !reflect.DeepEqual(h.Bounds(), h2.Bounds()) {
+		t.Errorf("restored histogram: %v %v != %v %v\n", h.Bounds(), h.BucketCounts(), h2.Bounds(), h2.BucketCounts())
+	}
+	data, _ := h2.(*StandardBucketHistogram).MarshalBinary()
+	// Both bounds 0.5.
+	copy(data[11:19], data[3:11])
+	if err := h2.(*StandardBucketHistogram).UnmarshalBinary(data); nil == err || !strings.Contains(err.Error(), "invalid encoding") {
+		t.Errorf("h2.UnmarshalBinary(corrupted): expected an InvalidEncoding, got %v\n", err)
+	}
+}
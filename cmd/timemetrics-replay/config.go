@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/mathpl/go-timemetrics"
+)
+
+// config is the JSON configuration of a replay.
+type config struct {
+	// Format of the records, "json" or "regex".
+	Format string `json:"format"`
+	// Regex matching the records of the regex format, whose named groups are
+	// the fields of the record.
+	Regex string `json:"regex"`
+	// Field holding the event time of a record, "time" by default.
+	TimeField string `json:"time_field"`
+	// Layout of the event times, in the syntax of time.Parse, or one of
+	// "unix", "unix_ms", "unix_us" and "unix_ns".  RFC 3339 by default.
+	TimeLayout string `json:"time_layout"`
+	// Location of the event times whose layout has no zone, UTC by default.
+	TimeLocation string `json:"time_location"`
+	// Encoder of the datapoints: "opentsdb", "graphite" or "influxdb".
+	Encoder string `json:"encoder"`
+	// Event-time interval between flushes, one minute by default.
+	Interval duration `json:"interval"`
+	// Period after which metrics without updates are stale, and then
+	// unregistered, ten minutes by default.
+	StaleThreshold duration `json:"stale_threshold"`
+	// Stamp datapoints with the time of the flush rather than with the time
+	// of the last update of their metric.
+	CurrentTime bool `json:"current_time"`
+	// Metrics updated by the records.
+	Metrics []metricConfig `json:"metrics"`
+
+	regex    *regexp.Regexp
+	location *time.Location
+}
+
+// metricConfig maps the fields of records to a metric.
+type metricConfig struct {
+	Name string `json:"name"`
+	// Type of the metric: "counter", "meter" or "histogram".
+	Type string `json:"type"`
+	// Field holding the value of the metric.  Counters and meters count
+	// records when it is empty; histograms require it.
+	Field string `json:"field"`
+	// Scale the values are multiplied by before being rounded to integers,
+	// e.g. 1000 for durations logged in seconds and recorded in ms.
+	Scale float64 `json:"scale"`
+	// Static tags of the metric.
+	Tags timemetrics.Tags `json:"tags"`
+	// Fields whose values tag the metric, under the name of the field.
+	TagFields []string `json:"tag_fields"`
+	// Regexes the given fields must match for a record to update the
+	// metric.
+	Match map[string]string `json:"match"`
+	// Percentiles emitted by histograms, the default ones if empty.
+	Percentiles []float64 `json:"percentiles"`
+	// Sample of histograms.
+	Sample sampleConfig `json:"sample"`
+
+	match map[string]*regexp.Regexp
+}
+
+// sampleConfig selects the Sample of a histogram.
+type sampleConfig struct {
+	// Type of the sample: "expdecay" (the default), "uniform", "sliding",
+	// "tdigest" or "ddsketch".
+	Type string `json:"type"`
+	// Reservoir size of the expdecay and uniform samples, 1028 by default.
+	Size int `json:"size"`
+	// Alpha of the expdecay sample, 0.015 by default.
+	Alpha float64 `json:"alpha"`
+	// Window of the sliding sample, the flush interval by default.
+	Window duration `json:"window"`
+	// Compression of the tdigest sample, 100 by default.
+	Compression float64 `json:"compression"`
+	// Relative accuracy of the ddsketch sample, 0.01 by default.
+	Accuracy float64 `json:"accuracy"`
+}
+
+// duration is a time.Duration read from JSON strings such as "90s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration %s: expected a string such as \"90s\"", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads a configuration, fills in its defaults and validates it.
+func loadConfig(r io.Reader) (*config, error) {
+	c := &config{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	if err := c.init(); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	return c, nil
+}
+
+func (c *config) init() error {
+	var err error
+	switch c.Format {
+	case "", "json":
+		c.Format = "json"
+	case "regex":
+		if c.regex, err = regexp.Compile(c.Regex); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+	if "" == c.TimeField {
+		c.TimeField = "time"
+	}
+	if c.regex != nil && c.regex.SubexpIndex(c.TimeField) < 0 {
+		return fmt.Errorf("regex has no %q group", c.TimeField)
+	}
+	if "" == c.TimeLayout {
+		c.TimeLayout = time.RFC3339Nano
+	}
+	if c.location, err = time.LoadLocation(c.TimeLocation); err != nil {
+		return err
+	}
+	if _, err := newEncoder(c.Encoder); err != nil {
+		return err
+	}
+	if 0 == c.Interval {
+		c.Interval = duration(time.Minute)
+	}
+	if 0 == c.StaleThreshold {
+		c.StaleThreshold = duration(10 * time.Minute)
+	}
+	if c.Interval < duration(time.Second) || c.StaleThreshold < duration(time.Minute) {
+		return fmt.Errorf("interval below 1s or stale_threshold below 1m")
+	}
+	if 0 == len(c.Metrics) {
+		return fmt.Errorf("no metrics")
+	}
+	for i := range c.Metrics {
+		if err := c.Metrics[i].init(); err != nil {
+			return fmt.Errorf("metric %q: %v", c.Metrics[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *metricConfig) init() error {
+	if "" == m.Name {
+		return fmt.Errorf("no name")
+	}
+	switch m.Type {
+	case "counter", "meter":
+	case "histogram":
+		if "" == m.Field {
+			return fmt.Errorf("histogram without field")
+		}
+		if err := m.Sample.init(); err != nil {
+			return err
+		}
+		for _, p := range m.Percentiles {
+			if p < 0 || p > 1 {
+				return fmt.Errorf("percentile %v out of [0, 1]", p)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q", m.Type)
+	}
+	if 0 == m.Scale {
+		m.Scale = 1
+	}
+	m.match = make(map[string]*regexp.Regexp, len(m.Match))
+	for field, expr := range m.Match {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		m.match[field] = re
+	}
+	return nil
+}
+
+// histogramOptions returns the options of histograms.
+func (m *metricConfig) histogramOptions() timemetrics.HistogramOptions {
+	opts := timemetrics.DefaultHistogramOptions()
+	if len(m.Percentiles) > 0 {
+		opts.Percentiles = m.Percentiles
+	}
+	return opts
+}
+
+// init validates the sample.  Zero values are left to newSample defaults.
+func (s *sampleConfig) init() error {
+	switch {
+	case s.Size < 0:
+		return fmt.Errorf("sample size %d below 0", s.Size)
+	case s.Alpha < 0:
+		return fmt.Errorf("sample alpha %v below 0", s.Alpha)
+	case s.Window < 0:
+		return fmt.Errorf("sample window %v below 0", time.Duration(s.Window))
+	case s.Compression < 0:
+		return fmt.Errorf("sample compression %v below 0", s.Compression)
+	case s.Accuracy < 0 || s.Accuracy >= 1:
+		return fmt.Errorf("sample accuracy %v out of [0, 1)", s.Accuracy)
+	}
+	_, err := s.newSample(time.Time{}, time.Minute)
+	return err
+}
+
+// newSample builds the sample of a histogram first updated at t.
+func (s sampleConfig) newSample(t time.Time, interval time.Duration) (timemetrics.Sample, error) {
+	size := s.Size
+	if 0 == size {
+		size = 1028
+	}
+	switch s.Type {
+	case "", "expdecay":
+		alpha := s.Alpha
+		if 0 == alpha {
+			alpha = 0.015
+		}
+		return timemetrics.NewExpDecaySample(t, size, alpha, 60), nil
+	case "uniform":
+		return timemetrics.NewUniformSample(size), nil
+	case "sliding":
+		window := time.Duration(s.Window)
+		if 0 == window {
+			window = interval
+		}
+		return timemetrics.NewSlidingTimeWindowSample(window), nil
+	case "tdigest":
+		compression := s.Compression
+		if 0 == compression {
+			compression = 100
+		}
+		return timemetrics.NewTDigestSample(compression), nil
+	case "ddsketch":
+		accuracy := s.Accuracy
+		if 0 == accuracy {
+			accuracy = 0.01
+		}
+		return timemetrics.NewDDSketchSample(accuracy), nil
+	}
+	return nil, fmt.Errorf("unknown sample type %q", s.Type)
+}
+
+// newEncoder returns the encoder of the given name, OpenTSDB by default.
+func newEncoder(name string) (timemetrics.KeyEncoder, error) {
+	switch name {
+	case "", "opentsdb":
+		return timemetrics.NewOpenTSDBEncoder(), nil
+	case "graphite":
+		return timemetrics.NewGraphiteEncoder(), nil
+	case "influxdb":
+		return timemetrics.NewInfluxDBEncoder(), nil
+	}
+	return nil, fmt.Errorf("unknown encoder %q", name)
+}
@@ -0,0 +1,109 @@
+// Command timemetrics-replay turns timestamped log records into metrics.
+//
+// It reads records, one per line, from the given files or from stdin, updates
+// the counters, meters and histograms of its configuration at the event time
+// of each record, and writes the encoded datapoints to stdout every time the
+// event time crosses a flush interval:
+//
+//	timemetrics-replay -config access.json access.log.1 access.log
+//
+// Records are either JSON objects, nested fields being named with dots, or
+// lines matched by a regex whose named groups are the fields.  A config for
+// an access log could be:
+//
+//	{
+//	  "format": "regex",
+//	  "regex": "^(?P<time>\\S+) (?P<method>\\S+) (?P<status>\\d+) (?P<seconds>[\\d.]+)$",
+//	  "time_layout": "2006-01-02T15:04:05Z07:00",
+//	  "encoder": "graphite",
+//	  "interval": "10s",
+//	  "metrics": [
+//	    {"name": "http.requests", "type": "meter", "tag_fields": ["method"]},
+//	    {"name": "http.errors", "type": "counter", "match": {"status": "^5"}},
+//	    {"name": "http.latency", "type": "histogram", "field": "seconds",
+//	     "scale": 1000, "sample": {"type": "tdigest"}}
+//	  ]
+//	}
+//
+// Records which cannot be parsed are reported on stderr and skipped, unless
+// -strict is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path of the JSON configuration")
+	encoder := flag.String("encoder", "", "encoder overriding the one of the configuration: opentsdb, graphite or influxdb")
+	strict := flag.Bool("strict", false, "stop at the first record which cannot be parsed")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -config <file> [flags] [file...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if "" == *configPath {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*configPath, *encoder, *strict, flag.Args(), os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "timemetrics-replay: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run replays the given files, or stdin if there are none or for "-", in
+// that order.
+func run(configPath string, encoder string, strict bool, paths []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	c, err := loadConfig(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if encoder != "" {
+		if _, err := newEncoder(encoder); err != nil {
+			return err
+		}
+		c.Encoder = encoder
+	}
+
+	p := newReplayer(c, stdout, func(err error) {
+		fmt.Fprintf(stderr, "timemetrics-replay: skipped %v\n", err)
+	}, strict)
+	if 0 == len(paths) {
+		paths = []string{"-"}
+	}
+	for _, path := range paths {
+		if err := replayFile(p, path, stdin); err != nil {
+			p.close()
+			return err
+		}
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+	if p.skipped > 0 {
+		fmt.Fprintf(stderr, "timemetrics-replay: skipped %d of %d records\n", p.skipped, p.lines)
+	}
+	return nil
+}
+
+func replayFile(p *replayer, path string, stdin io.Reader) error {
+	if "-" == path {
+		return p.replay("stdin", stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.replay(path, f)
+}
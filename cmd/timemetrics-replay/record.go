@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// record is a parsed input line: its event time and its fields.
+type record struct {
+	time   time.Time
+	fields map[string]string
+}
+
+// parseRecord parses a line in the format of the configuration.
+func (c *config) parseRecord(line string) (record, error) {
+	var fields map[string]string
+	if c.regex != nil {
+		match := c.regex.FindStringSubmatch(line)
+		if nil == match {
+			return record{}, fmt.Errorf("no match")
+		}
+		fields = make(map[string]string, len(match))
+		for i, name := range c.regex.SubexpNames() {
+			if name != "" && i < len(match) {
+				fields[name] = match[i]
+			}
+		}
+	} else {
+		var v map[string]interface{}
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return record{}, err
+		}
+		fields = make(map[string]string, len(v))
+		flatten(fields, "", v)
+	}
+
+	ts, ok := fields[c.TimeField]
+	if !ok {
+		return record{}, fmt.Errorf("no %q field", c.TimeField)
+	}
+	t, err := c.parseTime(ts)
+	if err != nil {
+		return record{}, err
+	}
+	return record{time: t, fields: fields}, nil
+}
+
+// flatten stores the scalar values of a JSON object in fields, the values of
+// nested objects under dotted names, e.g. "request.method".
+func flatten(fields map[string]string, prefix string, v map[string]interface{}) {
+	for k, value := range v {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flatten(fields, prefix+k+".", value)
+		case string:
+			fields[prefix+k] = value
+		case json.Number:
+			fields[prefix+k] = value.String()
+		case bool:
+			fields[prefix+k] = strconv.FormatBool(value)
+		}
+	}
+}
+
+// parseTime parses an event time in the layout of the configuration.
+func (c *config) parseTime(s string) (time.Time, error) {
+	switch c.TimeLayout {
+	case "unix":
+		return parseUnix(s, 0)
+	case "unix_ms":
+		return parseUnix(s, 3)
+	case "unix_us":
+		return parseUnix(s, 6)
+	case "unix_ns":
+		return parseUnix(s, 9)
+	}
+	return time.ParseInLocation(c.TimeLayout, s, c.location)
+}
+
+// parseUnix parses a decimal number of seconds since the epoch, multiplied by
+// 10^exp, without losing the nanoseconds to floating point.  Digits beyond
+// the nanosecond are truncated.
+func parseUnix(s string, exp int) (time.Time, error) {
+	digits, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		digits, fraction = s[:i], s[i+1:]
+	}
+	if "" == strings.TrimLeft(digits, "+-") || strings.Trim(fraction, "0123456789") != "" {
+		return time.Time{}, fmt.Errorf("invalid unix time %q", s)
+	}
+	// Move the decimal point to have nanoseconds.
+	fraction += strings.Repeat("0", 9-exp)
+	ns, err := strconv.ParseInt(digits+fraction[:9-exp], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid unix time %q", s)
+	}
+	return time.Unix(0, ns), nil
+}
+
+// value parses a field as a number, multiplied by scale and rounded.
+func value(s string, scale float64) (int64, error) {
+	if 1 == scale {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v, nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	f = math.Round(f * scale)
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("value %q out of range", s)
+	}
+	return int64(f), nil
+}
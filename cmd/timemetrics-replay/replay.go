@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mathpl/go-timemetrics"
+)
+
+// replayer updates the metrics of a configuration from records and writes
+// their datapoints as the event time of the records advances.
+type replayer struct {
+	config   *config
+	registry timemetrics.Registry
+	flusher  *timemetrics.Flusher
+	out      *bufio.Writer
+	warn     func(error)
+	strict   bool
+	newest   time.Time
+	lines    int
+	records  int
+	skipped  int
+}
+
+// newReplayer constructs a new replayer writing datapoints to out and
+// reporting the records it skips to warn.  With strict, the first bad record
+// stops the replay instead.
+func newReplayer(c *config, out io.Writer, warn func(error), strict bool) *replayer {
+	interval := time.Duration(c.Interval)
+	staleThreshold := time.Duration(c.StaleThreshold)
+	r := timemetrics.NewRegistry(int(interval/time.Second), int(staleThreshold/time.Minute))
+	// Every encoder was validated by loadConfig.
+	e, _ := newEncoder(c.Encoder)
+	return &replayer{
+		config:   c,
+		registry: r,
+		flusher:  timemetrics.NewFlusher(r, interval, staleThreshold, timemetrics.EncoderKeys(e, c.CurrentTime)),
+		out:      bufio.NewWriter(out),
+		warn:     warn,
+		strict:   strict,
+	}
+}
+
+// replay reads the records of in, named name in warnings, one per line.
+func (p *replayer) replay(name string, in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if 0 == len(scanner.Bytes()) {
+			continue
+		}
+		p.lines++
+		rec, err := p.config.parseRecord(scanner.Text())
+		if nil == err {
+			p.records++
+			if rec.time.After(p.newest) {
+				p.newest = rec.time
+			}
+			// The first record starts the interval it falls in.  Later ones
+			// flush the intervals which ended before them, as metrics updated
+			// at the time of a flush are left for the next one.
+			at := rec.time
+			if p.records > 1 {
+				at = at.Add(-time.Nanosecond)
+			}
+			if err := p.write(p.flusher.Advance(at)); err != nil {
+				return err
+			}
+			err = p.update(rec)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s:%d: %v", name, line, err)
+			if p.strict {
+				return err
+			}
+			p.skipped++
+			p.warn(err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// update updates the metrics of the configuration from a record, after
+// the intervals its event time closed were flushed.
+func (p *replayer) update(rec record) error {
+	for i := range p.config.Metrics {
+		if err := p.updateMetric(&p.config.Metrics[i], rec); err != nil {
+			return fmt.Errorf("metric %q: %v", p.config.Metrics[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// updateMetric updates the metric of mc from a record, unless the record
+// misses one of its fields or does not match.
+func (p *replayer) updateMetric(mc *metricConfig, rec record) error {
+	for field, re := range mc.match {
+		if v, ok := rec.fields[field]; !ok || !re.MatchString(v) {
+			return nil
+		}
+	}
+	var tags timemetrics.Tags
+	if len(mc.Tags) > 0 || len(mc.TagFields) > 0 {
+		tags = make(timemetrics.Tags, len(mc.Tags)+len(mc.TagFields))
+		for k, v := range mc.Tags {
+			tags[k] = v
+		}
+		for _, field := range mc.TagFields {
+			v, ok := rec.fields[field]
+			if !ok {
+				return nil
+			}
+			tags[field] = v
+		}
+	}
+	v := int64(1)
+	if mc.Field != "" {
+		s, ok := rec.fields[mc.Field]
+		if !ok {
+			return nil
+		}
+		var err error
+		if v, err = value(s, mc.Scale); err != nil {
+			return err
+		}
+	}
+
+	t := rec.time
+	switch mc.Type {
+	case "counter":
+		timemetrics.GetOrRegisterTaggedCounter(mc.Name, tags, p.registry, t).Inc(t, v)
+	case "meter":
+		timemetrics.GetOrRegisterTaggedMeter(mc.Name, tags, p.registry, t).Mark(t, v)
+	case "histogram":
+		p.registry.GetOrRegister(mc.Name, tags, t, func(t time.Time, tags timemetrics.Tags, interval int, staleThreshold int) timemetrics.Metric {
+			// The sample was validated by loadConfig.
+			s, _ := mc.Sample.newSample(t, time.Duration(p.config.Interval))
+			return timemetrics.NewHistogramWithOptions(s, staleThreshold, tags, mc.histogramOptions())
+		}).Update(t, v)
+	}
+	return nil
+}
+
+// close flushes the metrics updated since the last flush at the newest event
+// time seen, and the output.
+func (p *replayer) close() error {
+	if p.records > 0 {
+		if err := p.write(p.flusher.Flush(p.newest)); err != nil {
+			return err
+		}
+	}
+	return p.out.Flush()
+}
+
+// write writes the keys of a flush, right away so that they are not held
+// back until the next one.
+func (p *replayer) write(keys []string) error {
+	if 0 == len(keys) {
+		return nil
+	}
+	for _, key := range keys {
+		p.out.WriteString(key + "\n")
+	}
+	return p.out.Flush()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig(t *testing.T, s string) *config {
+	c, err := loadConfig(strings.NewReader(s))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReplayJSON(t *testing.T) {
+	c := testConfig(t, `{
+		"encoder": "graphite",
+		"interval": "1m",
+		"metrics": [
+			{"name": "requests", "type": "counter", "tag_fields": ["req.method"]},
+			{"name": "errors", "type": "counter", "match": {"status": "^5"}},
+			{"name": "bytes", "type": "histogram", "field": "bytes", "percentiles": [0.5],
+			 "sample": {"type": "uniform", "size": 10}}
+		]
+	}`)
+	in := strings.Join([]string{
+		`{"time": "1970-01-01T00:10:00Z", "req": {"method": "GET"}, "status": 200, "bytes": 10}`,
+		`{"time": "1970-01-01T00:10:30Z", "req": {"method": "GET"}, "status": 500, "bytes": 30}`,
+		`{"time": "1970-01-01T00:10:20Z", "req": {"method": "PUT"}, "status": 200, "bytes": 20}`,
+		``,
+		`{"time": "1970-01-01T00:11:10Z", "req": {"method": "GET"}, "status": 200}`,
+	}, "\n")
+	var out bytes.Buffer
+	p := newReplayer(c, &out, func(err error) { t.Error(err) }, true)
+	if err := p.replay("test", strings.NewReader(in)); nil != err {
+		t.Fatal(err)
+	}
+	// The first interval is flushed by the record at 00:11:10.
+	lines := strings.Split(out.String(), "\n")
+	expected := []string{
+		"bytes.max 30 630",
+		"bytes.mean 20.000000 630",
+		"bytes.min 10 630",
+		"bytes.p50 20 630",
+		"bytes.sample_size 3 630",
+		"bytes.std-dev 8.164966 630",
+		"errors.count 1 630",
+		"requests.count;req.method=GET 2 630",
+		"requests.count;req.method=PUT 1 620",
+	}
+	if got := sortedLines(lines); strings.Join(expected, "\n") != strings.Join(got, "\n") {
+		t.Errorf("replay(): %v != %v\n", expected, got)
+	}
+
+	out.Reset()
+	if err := p.close(); nil != err {
+		t.Fatal(err)
+	}
+	if "requests.count;req.method=GET 3 670\n" != out.String() {
+		t.Errorf("close(): requests.count;req.method=GET 3 670 != %q\n", out.String())
+	}
+}
+
+func TestReplayRegex(t *testing.T) {
+	c := testConfig(t, `{
+		"format": "regex",
+		"regex": "^(?P<time>[\\d.]+) (?P<host>\\S+) (?P<seconds>[\\d.]+)$",
+		"time_layout": "unix",
+		"interval": "10s",
+		"metrics": [
+			{"name": "latency", "type": "histogram", "field": "seconds", "scale": 1000,
+			 "tags": {"dc": "east"}, "percentiles": [0.99], "sample": {"type": "sliding"}},
+			{"name": "hits", "type": "meter", "tag_fields": ["host"]}
+		]
+	}`)
+	in := "100.5 web1 0.250\nnot a record\n101.25 web1 0.0005\n"
+	var out bytes.Buffer
+	var warnings []error
+	p := newReplayer(c, &out, func(err error) { warnings = append(warnings, err) }, false)
+	if err := p.replay("test", strings.NewReader(in)); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(warnings) || "test:2: no match" != warnings[0].Error() {
+		t.Errorf("warnings: [test:2: no match] != %v\n", warnings)
+	}
+	if err := p.close(); nil != err {
+		t.Fatal(err)
+	}
+	lines := sortedLines(strings.Split(out.String(), "\n"))
+	for _, expected := range []string{
+		"put hits.count 101 2 host=web1",
+		"put latency.max 101 250 dc=east",
+		"put latency.min 101 1 dc=east",
+	} {
+		found := false
+		for _, line := range lines {
+			found = found || expected == line
+		}
+		if !found {
+			t.Errorf("close(): %q not in %v\n", expected, lines)
+		}
+	}
+	if 2 != p.records || 1 != p.skipped || 3 != p.lines {
+		t.Errorf("p.records, p.skipped, p.lines: 2, 1, 3 != %v, %v, %v\n", p.records, p.skipped, p.lines)
+	}
+}
+
+func TestReplayStrict(t *testing.T) {
+	c := testConfig(t, `{"metrics": [{"name": "foo", "type": "counter", "field": "n"}]}`)
+	p := newReplayer(c, &bytes.Buffer{}, func(err error) { t.Error(err) }, true)
+	in := `{"time": "1970-01-01T00:00:00Z", "n": 1}` + "\n" + `{"time": "1970-01-01T00:00:01Z", "n": "x"}`
+	err := p.replay("test", strings.NewReader(in))
+	if nil == err || !strings.HasPrefix(err.Error(), `test:2: metric "foo"`) {
+		t.Errorf("replay(): expected an error on line 2, got %v\n", err)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	c := testConfig(t, `{"metrics": [{"name": "foo", "type": "counter"}]}`)
+	for layout, cases := range map[string]map[string]time.Time{
+		"unix":                 {"1500000000": time.Unix(1500000000, 0), "1500000000.1234567891": time.Unix(1500000000, 123456789), "-1.5": time.Unix(-2, 500000000)},
+		"unix_ms":              {"1500000000123": time.Unix(1500000000, 123000000), "1500000000123.5": time.Unix(1500000000, 123500000), "-1.5": time.Unix(-1, 998500000)},
+		"unix_us":              {"1500000000123456": time.Unix(1500000000, 123456000)},
+		"unix_ns":              {"1500000000123456789": time.Unix(1500000000, 123456789)},
+		"02/Jan/2006:15:04:05": {"14/Jul/2017:02:40:00": time.Unix(1500000000, 0)},
+	} {
+		c.TimeLayout = layout
+		for s, expected := range cases {
+			if ts, err := c.parseTime(s); nil != err || !ts.Equal(expected) {
+				t.Errorf("parseTime(%q, %q): %v != %v (%v)\n", layout, s, expected, ts, err)
+			}
+		}
+	}
+	c.TimeLayout = "unix"
+	for _, s := range []string{"", "abc", "1.2.3", "1.x", "-", "."} {
+		if _, err := c.parseTime(s); nil == err {
+			t.Errorf("parseTime(unix, %q): expected an error\n", s)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, s := range []string{
+		`{}`,
+		`{"metrics": [{"name": "foo", "type": "gauge"}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram"}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"type": "nope"}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"size": -1}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"type": "uniform", "size": -1}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"alpha": -0.5}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"type": "sliding", "window": "-1m"}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"type": "tdigest", "compression": -1}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "sample": {"type": "ddsketch", "accuracy": 1}}]}`,
+		`{"metrics": [{"name": "foo", "type": "histogram", "field": "x", "percentiles": [0.5, 1.5]}]}`,
+		`{"metrics": [{"type": "counter"}]}`,
+		`{"format": "csv", "metrics": [{"name": "foo", "type": "counter"}]}`,
+		`{"format": "regex", "regex": "(?P<ts>.*)", "metrics": [{"name": "foo", "type": "counter"}]}`,
+		`{"encoder": "statsd", "metrics": [{"name": "foo", "type": "counter"}]}`,
+		`{"interval": 60, "metrics": [{"name": "foo", "type": "counter"}]}`,
+		`{"interval": "1ms", "metrics": [{"name": "foo", "type": "counter"}]}`,
+		`{"metrics": [{"name": "foo", "type": "counter", "typo": 1}]}`,
+	} {
+		if _, err := loadConfig(strings.NewReader(s)); nil == err {
+			t.Errorf("loadConfig(%s): expected an error\n", s)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.json")
+	logPath := filepath.Join(dir, "log")
+	if err := os.WriteFile(configPath, []byte(`{"metrics": [{"name": "foo", "type": "counter"}]}`), 0600); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(logPath, []byte(`{"time": "1970-01-01T00:00:10Z"}`+"\n"+`oops`+"\n"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	stdin := strings.NewReader(`{"time": "1970-01-01T00:00:20Z"}`)
+	if err := run(configPath, "influxdb", false, []string{logPath, "-"}, stdin, &stdout, &stderr); nil != err {
+		t.Fatal(err)
+	}
+	if "foo count=2i 20000000000\n" != stdout.String() {
+		t.Errorf("stdout: %q\n", stdout.String())
+	}
+	if !strings.HasSuffix(stderr.String(), "skipped 1 of 3 records\n") {
+		t.Errorf("stderr: %q\n", stderr.String())
+	}
+
+	if err := run(configPath, "nope", false, nil, stdin, &stdout, &stderr); nil == err {
+		t.Error("run(encoder nope): expected an error\n")
+	}
+	var pathErr *os.PathError
+	if err := run(configPath, "", false, []string{filepath.Join(dir, "missing")}, stdin, &stdout, &stderr); !errors.As(err, &pathErr) {
+		t.Errorf("run(missing file): expected a PathError, got %v\n", err)
+	}
+}
+
+func sortedLines(lines []string) []string {
+	var sorted []string
+	for _, line := range lines {
+		if line != "" {
+			sorted = append(sorted, line)
+		}
+	}
+	for i := 1; i < len(sorted); i++ {
+		for j := i; j > 0 && sorted[j] < sorted[j-1]; j-- {
+			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
+		}
+	}
+	return sorted
+}
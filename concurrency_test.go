@@ -0,0 +1,249 @@
+package timemetrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests are meant to be run with go test -race: they hammer every
+// metric and sample type with concurrent updates and reads.
+
+const (
+	stressGoroutines = 8
+	stressUpdates    = 1000
+)
+
+// stress runs update from stressGoroutines goroutines stressUpdates times
+// each, while read runs concurrently until they are done.
+func stress(update func(g int, i int), read func(i int)) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				read(i)
+			}
+		}
+	}()
+	for g := 0; g < stressGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < stressUpdates; i++ {
+				update(g, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	<-readerDone
+}
+
+func stressTime(i int) time.Time {
+	return time.Unix(int64(i), 0)
+}
+
+func stressMetric(t *testing.T, m Metric) {
+	stress(func(g int, i int) {
+		m.Update(stressTime(i), int64(i))
+	}, func(i int) {
+		ct := stressTime(i)
+		m.GetKeys(ct, "%s %d %s", i%2 == 0)
+		m.GetMaxTime()
+		m.PushKeysTime(ct)
+		m.Stale(ct)
+		if i%100 == 0 {
+			m.ZeroOut()
+		}
+	})
+}
+
+func TestCounterConcurrent(t *testing.T) {
+	c := NewCounter(time.Unix(0, 0), 10)
+	stressMetric(t, c)
+	if count, expected := c.Count(), int64(stressGoroutines*(stressUpdates-1)*stressUpdates/2); expected != count {
+		t.Errorf("c.Count(): %v != %v\n", expected, count)
+	}
+	if maxTime := c.GetMaxTime(); !maxTime.Equal(stressTime(stressUpdates - 1)) {
+		t.Errorf("c.GetMaxTime(): %v\n", maxTime)
+	}
+}
+
+func TestCounterDeltaConcurrent(t *testing.T) {
+	c := NewCounter(time.Unix(0, 0), 10)
+	c.SetTemporality(Delta)
+	var mutex sync.Mutex
+	var sum int64
+	collect := func() {
+		delta := c.GetDatapoints(stressTime(0), false)[0].Int
+		if delta < 0 {
+			t.Errorf("delta: %v < 0\n", delta)
+		}
+		mutex.Lock()
+		sum += delta
+		mutex.Unlock()
+	}
+	// Two flushers race each other and the updates.
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				collect()
+			}
+		}
+	}()
+	stress(func(g int, i int) {
+		c.Inc(stressTime(i), 1)
+	}, func(i int) {
+		collect()
+	})
+	close(stop)
+	<-done
+	collect()
+	if stressGoroutines*stressUpdates != sum {
+		t.Errorf("sum of deltas: %v != %v\n", stressGoroutines*stressUpdates, sum)
+	}
+}
+
+func TestMeterConcurrent(t *testing.T) {
+	m := NewMeter(time.Unix(0, 0), 1, 10)
+	stress(func(g int, i int) {
+		m.Mark(stressTime(i), 1)
+	}, func(i int) {
+		m.GetDatapoints(stressTime(i), false)
+		m.CrunchEWMA(stressTime(i))
+		m.Rates()
+		m.PushKeysTime(stressTime(i))
+		if i%100 == 0 {
+			m.ZeroOut()
+		}
+	})
+	if count := m.Count(); stressGoroutines*stressUpdates != count {
+		t.Errorf("m.Count(): %v != %v\n", stressGoroutines*stressUpdates, count)
+	}
+}
+
+func TestEWMAConcurrent(t *testing.T) {
+	a := NewEWMAWindow(time.Unix(0, 0), time.Minute)
+	var ticked int64
+	stress(func(g int, i int) {
+		a.Update(1)
+	}, func(i int) {
+		a.Tick(stressTime(i + 1))
+		a.Rate()
+		ticked = int64(i + 1)
+	})
+	a.Tick(stressTime(int(ticked) + 1))
+	if rate := a.Rate(); 0 >= rate {
+		t.Errorf("a.Rate(): 0 >= %v\n", rate)
+	}
+}
+
+func TestHistogramConcurrent(t *testing.T) {
+	for name, sample := range map[string]struct {
+		s       Sample
+		maxSize int
+	}{
+		"ExpDecaySample":          {NewExpDecaySample(time.Unix(0, 0), 100, 0.015, 1), 100},
+		"UniformSample":           {NewUniformSample(100), 100},
+		"SlidingTimeWindowSample": {NewSlidingTimeWindowSample(100 * time.Second), 100 * stressGoroutines},
+		"HDRSample":               {NewHDRSample(1, 1000*1000, 3), stressGoroutines * stressUpdates},
+		"TDigestSample":           {NewTDigestSample(100), stressGoroutines * stressUpdates},
+		"DDSketchSample":          {NewDDSketchSample(0.01), stressGoroutines * stressUpdates},
+	} {
+		h := NewHistogram(sample.s, 10)
+		stress(func(g int, i int) {
+			h.Update(stressTime(i), int64(i))
+		}, func(i int) {
+			h.GetDatapoints(stressTime(i), true)
+			h.PushKeysTime(stressTime(i))
+			if i%100 == 0 {
+				h.ZeroOut()
+			}
+		})
+		if count := h.Count(); stressGoroutines*stressUpdates != count {
+			t.Errorf("%s h.Count(): %v != %v\n", name, stressGoroutines*stressUpdates, count)
+		}
+		if size := h.Sample().Size(); sample.maxSize < size {
+			t.Errorf("%s h.Sample().Size(): %v < %v\n", name, sample.maxSize, size)
+		}
+	}
+}
+
+func TestGaugesConcurrent(t *testing.T) {
+	stressMetric(t, NewGauge(time.Unix(0, 0), 10))
+	stressMetric(t, NewGaugeFloat64(time.Unix(0, 0), 10))
+}
+
+func TestTimerConcurrent(t *testing.T) {
+	tm := NewTimer(time.Unix(0, 0), NewExpDecaySample(time.Unix(0, 0), 100, 0.015, 1), 1, 10, time.Millisecond)
+	stressMetric(t, tm)
+	if count := tm.Count(); stressGoroutines*stressUpdates != count {
+		t.Errorf("tm.Count(): %v != %v\n", stressGoroutines*stressUpdates, count)
+	}
+}
+
+func TestBucketHistogramConcurrent(t *testing.T) {
+	h := NewBucketHistogram(LinearBuckets(0, 100, 10), 10)
+	stressMetric(t, h)
+	if count := h.Count(); stressGoroutines*stressUpdates != count {
+		t.Errorf("h.Count(): %v != %v\n", stressGoroutines*stressUpdates, count)
+	}
+	merged := NewBucketHistogram(LinearBuckets(0, 100, 10), 10)
+	stress(func(g int, i int) {
+		h.Update(stressTime(i), int64(i))
+	}, func(i int) {
+		merged.Merge(h)
+		h.Merge(NewBucketHistogram(LinearBuckets(0, 100, 10), 10))
+	})
+}
+
+func TestExponentialHistogramConcurrent(t *testing.T) {
+	h := NewExponentialHistogram(DefaultExponentialMaxSize, 10)
+	stressMetric(t, h)
+	// Zeroed out along the way.
+	if count := h.Count(); count > stressGoroutines*stressUpdates {
+		t.Errorf("h.Count(): %v > %v\n", count, stressGoroutines*stressUpdates)
+	}
+	merged := NewExponentialHistogram(DefaultExponentialMaxSize, 10)
+	stress(func(g int, i int) {
+		h.Update(stressTime(i), int64(i*i-g))
+	}, func(i int) {
+		merged.Merge(h)
+		h.Percentiles(DefaultPercentiles)
+	})
+}
+
+func TestRegistryFlusherConcurrent(t *testing.T) {
+	r := NewRegistry(1, 1)
+	f := NewFlusher(r, time.Second, time.Minute, EncoderKeys(NewOpenTSDBEncoder(), false))
+	names := []string{"a", "b", "c", "d"}
+	stress(func(g int, i int) {
+		ts := stressTime(i)
+		name := names[(g+i)%len(names)]
+		GetOrRegisterCounter(name, r, ts).Inc(ts, 1)
+		GetOrRegisterTaggedMeter(name, Tags{"g": names[g%len(names)]}, r, ts).Mark(ts, 1)
+	}, func(i int) {
+		f.Advance(stressTime(i))
+	})
+	// Stale counters may have been evicted along the way.
+	var total int64
+	r.Each(func(name string, m Metric) {
+		if c, ok := m.(Counter); ok {
+			total += c.Count()
+		}
+	})
+	if stressGoroutines*stressUpdates < total {
+		t.Errorf("total count: %v < %v\n", stressGoroutines*stressUpdates, total)
+	}
+}
@@ -1,7 +1,7 @@
 package timemetrics
 
 import (
-	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -11,32 +11,84 @@ type Counter interface {
 	Clear(time.Time)
 	Count() int64
 	Dec(time.Time, int64)
+	Dropped() int64
 	Inc(time.Time, int64)
+	Late() int64
+	LateOptions() LateOptions
+	SetLateOptions(LateOptions)
+	SetTemporality(Temporality)
+	Temporality() Temporality
 	Update(time.Time, int64)
 	GetMaxTime() time.Time
 	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	GetDatapointsWithTemporality(time.Time, bool, Temporality) []Datapoint
 	NbKeys() int
 	Stale(time.Time) bool
 	PushKeysTime(time.Time) bool
+	Tags() Tags
 	ZeroOut()
 }
 
+// GetOrRegisterCounter returns an existing Counter or constructs and registers
+// a new StandardCounter stamped with the event time t.
+func GetOrRegisterCounter(name string, r Registry, t time.Time) Counter {
+	return GetOrRegisterTaggedCounter(name, nil, r, t)
+}
+
+// GetOrRegisterTaggedCounter returns an existing Counter or constructs and
+// registers a new tagged StandardCounter stamped with the event time t.
+func GetOrRegisterTaggedCounter(name string, tags Tags, r Registry, t time.Time) Counter {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		return NewTaggedCounter(t, staleThreshold, tags)
+	}).(Counter)
+}
+
 // NewCounter constructs a new StandardCounter.
 func NewCounter(t time.Time, staleThreshold int) Counter {
-	return &StandardCounter{0, t, staleThreshold}
+	return NewTaggedCounter(t, staleThreshold, nil)
+}
+
+// NewTaggedCounter constructs a new StandardCounter with the given tags.
+func NewTaggedCounter(t time.Time, staleThreshold int, tags Tags) Counter {
+	return &StandardCounter{lastUpdate: t, staleThreshold: staleThreshold, tags: copyTags(tags)}
+}
+
+// NewRegisteredCounter constructs and registers a new StandardCounter.  It
+// returns DuplicateMetric if a metric is already registered under name.
+func NewRegisteredCounter(name string, r Registry, t time.Time) (Counter, error) {
+	return NewRegisteredTaggedCounter(name, nil, r, t)
+}
+
+// NewRegisteredTaggedCounter constructs and registers a new tagged
+// StandardCounter.
+func NewRegisteredTaggedCounter(name string, tags Tags, r Registry, t time.Time) (Counter, error) {
+	c := NewTaggedCounter(t, r.StaleThreshold(), tags)
+	if err := r.Register(name, c); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // StandardCounter is the standard implementation of a Counter and uses the
-// sync/atomic package to manage a single int64 value.
+// sync/atomic package to manage a single int64 value, and a mutex to manage
+// the time of its last update.
 type StandardCounter struct {
-	count          int64
+	count int64 // /!\ this should be the first member to ensure 64-bit alignment
+	deltaTracker
+	lateTracker
 	lastUpdate     time.Time
 	staleThreshold int
+	tags           Tags
+	mutex          sync.Mutex
 }
 
-// Clear sets the counter to zero.
+// Clear sets the counter, and the baseline of its deltas, to zero.
 func (c *StandardCounter) Clear(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	atomic.StoreInt64(&c.count, 0)
+	atomic.StoreInt64(&c.baseline, 0)
 	c.lastUpdate = t
 }
 
@@ -47,15 +99,22 @@ func (c *StandardCounter) Count() int64 {
 
 // Dec decrements the counter by the given amount.
 func (c *StandardCounter) Dec(t time.Time, i int64) {
-	atomic.AddInt64(&c.count, -i)
-	if t.After(c.lastUpdate) {
-		c.lastUpdate = t
-	}
+	c.Inc(t, -i)
 }
 
-// Inc increments the counter by the given amount.
+// Inc increments the counter by the given amount, unless t is late and the
+// late policy discards it.
 func (c *StandardCounter) Inc(t time.Time, i int64) {
+	if c.admit(t, c.GetMaxTime()) {
+		c.add(t, i)
+	}
+}
+
+// add increments the counter at t whatever its late policy.
+func (c *StandardCounter) add(t time.Time, i int64) {
 	atomic.AddInt64(&c.count, i)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if t.After(c.lastUpdate) {
 		c.lastUpdate = t
 	}
@@ -66,21 +125,29 @@ func (c *StandardCounter) Update(t time.Time, i int64) {
 }
 
 func (c *StandardCounter) GetMaxTime() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.lastUpdate
 }
 
 func (c *StandardCounter) GetKeys(ct time.Time, name string, currentTime bool) []string {
-	var t int64
-	if currentTime {
-		t = ct.Unix()
-	} else {
-		t = c.GetMaxTime().Unix()
-	}
+	return formatDatapoints(name, c.GetDatapoints(ct, currentTime))
+}
 
-	keys := make([]string, 1)
-	keys[0] = fmt.Sprintf(name, "count", t, fmt.Sprintf("%d", c.Count()))
+// GetDatapoints returns the count, with the Temporality of the counter.
+func (c *StandardCounter) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	return c.GetDatapointsWithTemporality(ct, currentTime, c.Temporality())
+}
+
+// GetDatapointsWithTemporality returns the count, with the given temporality
+// rather than that of the counter.
+func (c *StandardCounter) GetDatapointsWithTemporality(ct time.Time, currentTime bool, temporality Temporality) []Datapoint {
+	t := datapointTime(c, ct, currentTime)
 
-	return keys
+	dps := make([]Datapoint, 1)
+	dps[0] = intDatapoint("count", t, CounterKind, c.emit(&c.count, temporality))
+
+	return tagDatapoints(dps, c.tags)
 }
 
 func (c *StandardCounter) NbKeys() int {
@@ -92,10 +159,60 @@ func (c *StandardCounter) Stale(t time.Time) bool {
 }
 
 func (c *StandardCounter) PushKeysTime(t time.Time) bool {
-	return c.lastUpdate.After(t)
+	return c.GetMaxTime().After(t)
+}
+
+func (c *StandardCounter) Tags() Tags {
+	return c.tags
 }
 
 func (c *StandardCounter) ZeroOut() {
 	//Nothing to do for counters
 	return
 }
+
+// counterEncodingVersion is the version of the encoding of StandardCounters.
+const counterEncodingVersion = 1
+
+// MarshalBinary encodes the counter, its time of last update and the
+// baseline of its deltas included.  Its Temporality is a setting rather than
+// state, and is not encoded.
+func (c *StandardCounter) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.putHeader(counterEncoding, counterEncodingVersion)
+	c.mutex.Lock()
+	w.putVarint(atomic.LoadInt64(&c.count))
+	w.putVarint(atomic.LoadInt64(&c.baseline))
+	w.putTimestamp(c.lastUpdate)
+	c.mutex.Unlock()
+	w.putVarint(int64(c.staleThreshold))
+	w.putTags(c.tags)
+	c.lateTracker.marshal(w)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the counter by the one encoded in data by
+// MarshalBinary.
+func (c *StandardCounter) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(counterEncoding, counterEncodingVersion)
+	count := r.varint()
+	baseline := r.varint()
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	if err := r.end(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	atomic.StoreInt64(&c.count, count)
+	atomic.StoreInt64(&c.baseline, baseline)
+	c.lastUpdate = lastUpdate
+	c.staleThreshold = staleThreshold
+	c.tags = tags
+	c.lateTracker.restore(late, dropped)
+	return nil
+}
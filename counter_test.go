@@ -6,7 +6,7 @@ import (
 )
 
 func BenchmarkCounter(b *testing.B) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		c.Inc(time.Now(), 1)
@@ -14,16 +14,16 @@ func BenchmarkCounter(b *testing.B) {
 }
 
 func TestCounterClear(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	c.Inc(time.Now(), 1)
-	c.Clear()
+	c.Clear(time.Now())
 	if count := c.Count(); 0 != count {
 		t.Errorf("c.Count(): 0 != %v\n", count)
 	}
 }
 
 func TestCounterDec1(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	c.Dec(time.Now(), 1)
 	if count := c.Count(); -1 != count {
 		t.Errorf("c.Count(): -1 != %v\n", count)
@@ -31,7 +31,7 @@ func TestCounterDec1(t *testing.T) {
 }
 
 func TestCounterDec2(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	c.Dec(time.Now(), 2)
 	if count := c.Count(); -2 != count {
 		t.Errorf("c.Count(): -2 != %v\n", count)
@@ -39,7 +39,7 @@ func TestCounterDec2(t *testing.T) {
 }
 
 func TestCounterInc1(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	c.Inc(time.Now(), 1)
 	if count := c.Count(); 1 != count {
 		t.Errorf("c.Count(): 1 != %v\n", count)
@@ -47,7 +47,7 @@ func TestCounterInc1(t *testing.T) {
 }
 
 func TestCounterInc2(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	c.Inc(time.Now(), 2)
 	if count := c.Count(); 2 != count {
 		t.Errorf("c.Count(): 2 != %v\n", count)
@@ -55,9 +55,12 @@ func TestCounterInc2(t *testing.T) {
 }
 
 func TestCounterSnapshot(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	c.Inc(time.Now(), 1)
-	snapshot := c.Snapshot()
+	snapshot := &StandardCounter{}
+	if err := snapshot.UnmarshalBinary(mustSnapshot(t, c)); nil != err {
+		t.Fatal(err)
+	}
 	c.Inc(time.Now(), 1)
 	if count := snapshot.Count(); 1 != count {
 		t.Errorf("c.Count(): 1 != %v\n", count)
@@ -65,16 +68,20 @@ func TestCounterSnapshot(t *testing.T) {
 }
 
 func TestCounterZero(t *testing.T) {
-	c := NewCounter()
+	c := NewCounter(time.Now(), 10)
 	if count := c.Count(); 0 != count {
 		t.Errorf("c.Count(): 0 != %v\n", count)
 	}
 }
 
 func TestGetOrRegisterCounter(t *testing.T) {
-	r := NewRegistry()
-	NewRegisteredCounter("foo", r).Inc(47)
-	if c := GetOrRegisterCounter("foo", r); 47 != c.Count() {
+	r := NewRegistry(60, 10)
+	c, err := NewRegisteredCounter("foo", r, time.Now())
+	if nil != err {
+		t.Fatal(err)
+	}
+	c.Inc(time.Now(), 47)
+	if c := GetOrRegisterCounter("foo", r, time.Now()); 47 != c.Count() {
 		t.Fatal(c)
 	}
 }
@@ -0,0 +1,106 @@
+package timemetrics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MetricKind identifies the type of metric which produced a Datapoint.
+type MetricKind int
+
+const (
+	CounterKind MetricKind = iota
+	MeterKind
+	HistogramKind
+	GaugeKind
+	TimerKind
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case CounterKind:
+		return "counter"
+	case MeterKind:
+		return "meter"
+	case HistogramKind:
+		return "histogram"
+	case GaugeKind:
+		return "gauge"
+	case TimerKind:
+		return "timer"
+	}
+	return fmt.Sprintf("MetricKind(%d)", int(k))
+}
+
+// Datapoint is a single typed value emitted by a metric.  Suffix is appended
+// to the name of the metric by encoders, e.g. "count" or "p99", and Tags are
+// those of the metric.
+type Datapoint struct {
+	Suffix  string
+	Time    time.Time
+	Kind    MetricKind
+	IsFloat bool
+	Int     int64
+	Float   float64
+	Tags    Tags
+}
+
+func intDatapoint(suffix string, t time.Time, kind MetricKind, v int64) Datapoint {
+	return Datapoint{Suffix: suffix, Time: t, Kind: kind, Int: v}
+}
+
+func floatDatapoint(suffix string, t time.Time, kind MetricKind, v float64) Datapoint {
+	return Datapoint{Suffix: suffix, Time: t, Kind: kind, IsFloat: true, Float: v}
+}
+
+// Value returns the value of the datapoint as a float64.
+func (dp Datapoint) Value() float64 {
+	if dp.IsFloat {
+		return dp.Float
+	}
+	return float64(dp.Int)
+}
+
+// FormatValue renders the value of the datapoint, integers in decimal and
+// floats with six decimals.
+func (dp Datapoint) FormatValue() string {
+	if dp.IsFloat {
+		return fmt.Sprintf("%.6f", dp.Float)
+	}
+	return fmt.Sprintf("%d", dp.Int)
+}
+
+// tagDatapoints stamps datapoints with the tags of the metric which emitted
+// them.
+func tagDatapoints(dps []Datapoint, tags Tags) []Datapoint {
+	for i := range dps {
+		dps[i].Tags = tags
+	}
+	return dps
+}
+
+// datapointTime returns the time datapoints are stamped with: ct if
+// currentTime is set, the time of the last update of the metric otherwise.
+func datapointTime(m Metric, ct time.Time, currentTime bool) time.Time {
+	if currentTime {
+		return ct
+	}
+	return m.GetMaxTime()
+}
+
+// formatDatapoints renders datapoints through a printf format taking the
+// suffix, the unix timestamp and the formatted value, in that order.  Tags
+// are appended OpenTSDB style, before the trailing newline if any.
+func formatDatapoints(name string, dps []Datapoint) []string {
+	keys := make([]string, len(dps))
+	for i, dp := range dps {
+		key := fmt.Sprintf(name, dp.Suffix, dp.Time.Unix(), dp.FormatValue())
+		if len(dp.Tags) > 0 {
+			line := strings.TrimRight(key, "\n")
+			key = line + " " + dp.Tags.join("=", " ", sanitizeOpenTSDB) + key[len(line):]
+		}
+		keys[i] = key
+	}
+	return keys
+}
@@ -0,0 +1,83 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDatapointFormatValue(t *testing.T) {
+	now := time.Unix(60, 0)
+	if s := intDatapoint("count", now, CounterKind, 42).FormatValue(); "42" != s {
+		t.Errorf("int FormatValue(): 42 != %v\n", s)
+	}
+	if s := floatDatapoint("mean", now, HistogramKind, 1.5).FormatValue(); "1.500000" != s {
+		t.Errorf("float FormatValue(): 1.500000 != %v\n", s)
+	}
+	if v := intDatapoint("count", now, CounterKind, 42).Value(); 42.0 != v {
+		t.Errorf("int Value(): 42 != %v\n", v)
+	}
+}
+
+func TestCounterGetDatapoints(t *testing.T) {
+	c := NewCounter(time.Unix(60, 0), 10)
+	c.Inc(time.Unix(90, 0), 3)
+	dps := c.GetDatapoints(time.Unix(120, 0), false)
+	expected := []Datapoint{intDatapoint("count", time.Unix(90, 0), CounterKind, 3)}
+	if !reflect.DeepEqual(expected, dps) {
+		t.Fatal(dps)
+	}
+	keys := c.GetKeys(time.Unix(120, 0), "put foo.%s %d %s", true)
+	if !reflect.DeepEqual([]string{"put foo.count 120 3"}, keys) {
+		t.Fatal(keys)
+	}
+}
+
+func TestMeterGetDatapoints(t *testing.T) {
+	m := NewMeter(time.Unix(0, 0), 60, 10)
+	m.Mark(time.Unix(30, 0), 120)
+	keys := m.GetKeys(time.Unix(60, 0), "put foo.%s %d %s", false)
+	expected := []string{
+		"put foo.count 30 120",
+		"put foo.rate._1min 30 2.000000",
+		"put foo.rate._5min 30 2.000000",
+		"put foo.rate._15min 30 2.000000",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatal(keys)
+	}
+
+	// No EWMA crunch before the interval elapsed.
+	dps := m.GetDatapoints(time.Unix(90, 0), true)
+	if 1 != len(dps) || MeterKind != dps[0].Kind || 120 != dps[0].Int {
+		t.Fatal(dps)
+	}
+}
+
+func TestHistogramGetDatapoints(t *testing.T) {
+	h := NewHistogram(NewUniformSample(100), 10)
+	for i := 1; i <= 10; i++ {
+		h.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	keys := h.GetKeys(time.Unix(60, 0), "put foo.%s %d %s", false)
+	expected := []string{
+		"put foo.min 10 1",
+		"put foo.max 10 10",
+		"put foo.mean 10 5.500000",
+		"put foo.std-dev 10 2.872281",
+		"put foo.p50 10 5",
+		"put foo.p75 10 8",
+		"put foo.p95 10 10",
+		"put foo.p99 10 10",
+		"put foo.p999 10 10",
+		"put foo.sample_size 10 10",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatal(keys)
+	}
+	for _, dp := range h.GetDatapoints(time.Unix(60, 0), false) {
+		if HistogramKind != dp.Kind {
+			t.Errorf("%s kind: histogram != %v\n", dp.Suffix, dp.Kind)
+		}
+	}
+}
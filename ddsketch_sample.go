@@ -0,0 +1,400 @@
+package timemetrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DDSketchSample is a MergeableSample backed by a DDSketch: values are
+// counted in buckets growing exponentially with their magnitude, so any
+// percentile is within the configured relative error of the true value,
+// whether values are bytes or terabytes.  Negative values are counted in
+// buckets of their own and zeros apart.  Min, max, count, sum, mean and
+// variance are exact.  See Masson et al's "DDSketch: A Fast and Fully-Mergeable
+// Quantile Sketch with Relative-Error Guarantees".
+//
+// <https://arxiv.org/abs/1908.10693>
+type DDSketchSample struct {
+	count            int64 // /!\ this should be the first member to ensure 64-bit alignment
+	relativeAccuracy float64
+	gamma            float64
+	logGamma         float64
+	positive         ddStore
+	negative         ddStore // of the absolute values
+	zeros            int64
+	stats            sampleStats
+	mutex            sync.Mutex
+}
+
+// ddStore counts values by bucket index, from offset on.
+type ddStore struct {
+	offset int
+	counts []int64
+}
+
+// ddsketchEncodingVersion is the version of the encoding of DDSketchSamples.
+const ddsketchEncodingVersion = 1
+
+// NewDDSketchSample constructs a new DDSketchSample whose percentiles are
+// within relativeAccuracy of the true values, e.g. 0.01 for 1%.  The
+// accuracy is clamped between 0.0001 and 0.5.
+func NewDDSketchSample(relativeAccuracy float64) Sample {
+	if !(relativeAccuracy >= 0.0001) {
+		relativeAccuracy = 0.0001
+	} else if relativeAccuracy > 0.5 {
+		relativeAccuracy = 0.5
+	}
+	s := &DDSketchSample{}
+	s.setRelativeAccuracy(relativeAccuracy)
+	s.stats.reset()
+	return s
+}
+
+// Clear clears all samples.
+func (s *DDSketchSample) Clear(time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, 0)
+	s.reset()
+}
+
+// Count returns the number of samples recorded, merged ones included.
+func (s *DDSketchSample) Count() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+// Max returns the exact maximum value recorded.
+func (s *DDSketchSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.maxValue()
+}
+
+// Mean returns the exact mean of the values recorded.
+func (s *DDSketchSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.mean
+}
+
+// Merge adds the values summarized by other, which must be a DDSketchSample
+// of the same relative accuracy, to the sketch.
+func (s *DDSketchSample) Merge(other Sample) error {
+	o, ok := other.(*DDSketchSample)
+	if !ok {
+		return IncompatibleSample(fmt.Sprintf("cannot merge %T into %T", other, s))
+	}
+	if o == s {
+		return IncompatibleSample("cannot merge a DDSketchSample into itself")
+	}
+	if o.relativeAccuracy != s.relativeAccuracy {
+		return IncompatibleSample(fmt.Sprintf("cannot merge a DDSketchSample of relative accuracy %v into one of %v", o.relativeAccuracy, s.relativeAccuracy))
+	}
+
+	o.mutex.Lock()
+	positive := o.positive.copy()
+	negative := o.negative.copy()
+	zeros := o.zeros
+	stats := o.stats
+	count := atomic.LoadInt64(&o.count)
+	o.mutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, count)
+	s.stats.merge(stats)
+	s.positive.merge(positive)
+	s.negative.merge(negative)
+	s.zeros += zeros
+	return nil
+}
+
+// Min returns the exact minimum value recorded.
+func (s *DDSketchSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.minValue()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded, within
+// the relative accuracy of the sketch.
+func (s *DDSketchSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (s *DDSketchSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scores := make([]float64, len(ps))
+	if 0 == s.stats.n {
+		return scores
+	}
+	for i, p := range ps {
+		scores[i] = s.quantile(p)
+	}
+	return scores
+}
+
+// RelativeAccuracy returns the relative accuracy of the percentiles.
+func (s *DDSketchSample) RelativeAccuracy() float64 {
+	return s.relativeAccuracy
+}
+
+// Size returns the number of values in the sketch.
+func (s *DDSketchSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(s.stats.n)
+}
+
+// StdDev returns the exact standard deviation of the values recorded.
+func (s *DDSketchSample) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+// Sum returns the exact sum of the values recorded.
+func (s *DDSketchSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.sum
+}
+
+// Update records a new value.
+func (s *DDSketchSample) Update(t time.Time, v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, 1)
+	s.stats.update(v)
+	switch {
+	case v > 0:
+		s.positive.add(s.index(float64(v)), 1)
+	case v < 0:
+		s.negative.add(s.index(-float64(v)), 1)
+	default:
+		s.zeros++
+	}
+}
+
+// Values returns the values in the sketch, each the rounded value its bucket
+// stands for.  It allocates Size values: prefer the other methods.
+func (s *DDSketchSample) Values() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values := make([]int64, 0, s.stats.n)
+	for i := len(s.negative.counts) - 1; i >= 0; i-- {
+		v := -int64(math.Floor(s.value(s.negative.offset+i) + 0.5))
+		for c := s.negative.counts[i]; c > 0; c-- {
+			values = append(values, v)
+		}
+	}
+	for c := s.zeros; c > 0; c-- {
+		values = append(values, 0)
+	}
+	for i, c := range s.positive.counts {
+		v := int64(math.Floor(s.value(s.positive.offset+i) + 0.5))
+		for ; c > 0; c-- {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Variance returns the exact variance of the values recorded.
+func (s *DDSketchSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.variance()
+}
+
+func (s *DDSketchSample) GetWindow() time.Duration {
+	return 0
+}
+
+func (s *DDSketchSample) ZeroOut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reset()
+}
+
+// MarshalBinary encodes the sketch compactly: its relative accuracy, count,
+// exact statistics, zeros, then the counts of the positive and negative
+// buckets as varints.
+func (s *DDSketchSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w := &binaryWriter{}
+	w.putHeader(ddsketchEncoding, ddsketchEncodingVersion)
+	w.putFloat64(s.relativeAccuracy)
+	w.putUvarint(uint64(atomic.LoadInt64(&s.count)))
+	s.stats.marshal(w)
+	w.putUvarint(uint64(s.zeros))
+	s.positive.marshal(w)
+	s.negative.marshal(w)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the sketch by the one encoded in data by
+// MarshalBinary.
+func (s *DDSketchSample) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(ddsketchEncoding, ddsketchEncodingVersion)
+	relativeAccuracy := r.float64()
+	count := r.uvarint()
+	var stats sampleStats
+	stats.unmarshal(r)
+	zeros := r.uvarint()
+	var positive, negative ddStore
+	positive.unmarshal(r)
+	negative.unmarshal(r)
+	if err := r.end(); err != nil {
+		return err
+	}
+	if !(relativeAccuracy >= 0.0001 && relativeAccuracy <= 0.5) {
+		return InvalidEncoding(fmt.Sprintf("relative accuracy %v", relativeAccuracy))
+	}
+
+	// Values are integers: bucket indexes go from 0, for 1, to that of the
+	// largest int64.
+	decoded := &DDSketchSample{}
+	decoded.setRelativeAccuracy(relativeAccuracy)
+	maxIndex := decoded.index(math.MaxInt64)
+	for _, d := range []ddStore{positive, negative} {
+		if d.offset < 0 || d.offset+len(d.counts)-1 > maxIndex {
+			return InvalidEncoding(fmt.Sprintf("buckets %d to %d", d.offset, d.offset+len(d.counts)-1))
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setRelativeAccuracy(relativeAccuracy)
+	atomic.StoreInt64(&s.count, int64(count))
+	s.stats = stats
+	s.zeros = int64(zeros)
+	s.positive = positive
+	s.negative = negative
+	return nil
+}
+
+func (s *DDSketchSample) setRelativeAccuracy(relativeAccuracy float64) {
+	s.relativeAccuracy = relativeAccuracy
+	s.gamma = (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	s.logGamma = math.Log(s.gamma)
+}
+
+// reset empties the sketch and the exact statistics, with the mutex held.
+func (s *DDSketchSample) reset() {
+	s.positive = ddStore{}
+	s.negative = ddStore{}
+	s.zeros = 0
+	s.stats.reset()
+}
+
+// index returns the index of the bucket of v > 0, which holds the values in
+// (gamma^(index-1), gamma^index].
+func (s *DDSketchSample) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the value within the relative accuracy of every value in the
+// bucket of the given index.
+func (s *DDSketchSample) value(index int) float64 {
+	return 2 * math.Pow(s.gamma, float64(index)) / (s.gamma + 1)
+}
+
+// quantile returns the value of the bucket holding the value of rank
+// p*(n-1), negative values first from the largest magnitude, then zeros,
+// then positive values, bounded by the exact min and max, with the mutex
+// held.
+func (s *DDSketchSample) quantile(p float64) float64 {
+	if p <= 0 {
+		return float64(s.stats.min)
+	}
+	if p >= 1 {
+		return float64(s.stats.max)
+	}
+	rank := p * float64(s.stats.n-1)
+
+	var v float64
+	var total float64
+	found := false
+	for i := len(s.negative.counts) - 1; i >= 0 && !found; i-- {
+		total += float64(s.negative.counts[i])
+		if total > rank {
+			v, found = -s.value(s.negative.offset+i), true
+		}
+	}
+	if !found {
+		total += float64(s.zeros)
+		if total > rank {
+			v, found = 0, true
+		}
+	}
+	for i := 0; i < len(s.positive.counts) && !found; i++ {
+		total += float64(s.positive.counts[i])
+		if total > rank {
+			v, found = s.value(s.positive.offset+i), true
+		}
+	}
+	if !found || v > float64(s.stats.max) {
+		v = float64(s.stats.max)
+	}
+	if v < float64(s.stats.min) {
+		v = float64(s.stats.min)
+	}
+	return v
+}
+
+// add counts n values in the bucket of the given index, growing the store as
+// needed.
+func (d *ddStore) add(index int, n int64) {
+	if 0 == len(d.counts) {
+		d.offset = index
+		d.counts = []int64{n}
+		return
+	}
+	if index < d.offset {
+		counts := make([]int64, d.offset-index+len(d.counts))
+		copy(counts[d.offset-index:], d.counts)
+		d.counts = counts
+		d.offset = index
+	} else if last := d.offset + len(d.counts) - 1; index > last {
+		d.counts = append(d.counts, make([]int64, index-last)...)
+	}
+	d.counts[index-d.offset] += n
+}
+
+func (d *ddStore) copy() ddStore {
+	counts := make([]int64, len(d.counts))
+	copy(counts, d.counts)
+	return ddStore{offset: d.offset, counts: counts}
+}
+
+func (d *ddStore) merge(o ddStore) {
+	for i, c := range o.counts {
+		if c > 0 {
+			d.add(o.offset+i, c)
+		}
+	}
+}
+
+func (d *ddStore) marshal(w *binaryWriter) {
+	w.putVarint(int64(d.offset))
+	w.putUvarint(uint64(len(d.counts)))
+	for _, c := range d.counts {
+		w.putUvarint(uint64(c))
+	}
+}
+
+func (d *ddStore) unmarshal(r *binaryReader) {
+	d.offset = int(r.varint())
+	d.counts = make([]int64, r.count(1))
+	for i := range d.counts {
+		d.counts[i] = int64(r.uvarint())
+	}
+}
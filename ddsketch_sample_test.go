@@ -0,0 +1,147 @@
+package timemetrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDDSketchSampleRelativeAccuracy(t *testing.T) {
+	// Bytes transferred, from a few bytes to terabytes.
+	r := rand.New(rand.NewSource(1))
+	values := make([]int64, 100000)
+	s := NewDDSketchSample(0.01)
+	for i := range values {
+		values[i] = int64(math.Exp(r.Float64() * 28))
+		s.Update(time.Unix(int64(i), 0), values[i])
+	}
+	ps := []float64{0.01, 0.25, 0.5, 0.75, 0.99, 0.999}
+	sorted := make(int64Slice, len(values))
+	copy(sorted, values)
+	sort.Sort(sorted)
+	for i, p := range s.Percentiles(ps) {
+		// The sketch ranks values at p*(n-1), without interpolation.
+		exact := float64(sorted[int(ps[i]*float64(len(values)-1))])
+		if math.Abs(p-exact) > 0.01*exact+0.5 {
+			t.Errorf("s.Percentile(%v): %v not within 1%% of %v\n", ps[i], p, exact)
+		}
+	}
+}
+
+func TestDDSketchSampleNegativeAndZero(t *testing.T) {
+	s := NewDDSketchSample(0.01)
+	for _, v := range []int64{-1000, -10, 0, 0, 10, 1000} {
+		s.Update(time.Unix(0, 0), v)
+	}
+	if min := s.Min(); -1000 != min {
+		t.Errorf("s.Min(): -1000 != %v\n", min)
+	}
+	if max := s.Max(); 1000 != max {
+		t.Errorf("s.Max(): 1000 != %v\n", max)
+	}
+	if mean := s.Mean(); math.Abs(mean) > 1e-9 {
+		t.Errorf("s.Mean(): 0 != %v\n", mean)
+	}
+	for p, expected := range map[float64]float64{0.2: -10, 0.5: 0, 0.8: 10, 0: -1000, 1: 1000} {
+		if v := s.Percentile(p); math.Abs(v-expected) > 0.01*math.Abs(expected) {
+			t.Errorf("s.Percentile(%v): %v != %v\n", p, expected, v)
+		}
+	}
+	expected := []int64{-1000, -10, 0, 0, 10, 1000}
+	values := s.Values()
+	if len(expected) != len(values) {
+		t.Fatalf("s.Values(): %v != %v\n", expected, values)
+	}
+	for i, v := range values {
+		if math.Abs(float64(v-expected[i])) > 0.01*math.Abs(float64(expected[i]))+0.5 {
+			t.Errorf("s.Values(): %v not within 1%% of %v\n", values, expected)
+		}
+	}
+}
+
+func TestDDSketchSampleMerge(t *testing.T) {
+	a, b := NewDDSketchSample(0.02).(*DDSketchSample), NewDDSketchSample(0.02)
+	whole := NewDDSketchSample(0.02)
+	for i := -5000; i <= 5000; i++ {
+		if i%2 == 0 {
+			a.Update(time.Unix(0, 0), int64(i*i*i))
+		} else {
+			b.Update(time.Unix(0, 0), int64(i*i*i))
+		}
+		whole.Update(time.Unix(0, 0), int64(i*i*i))
+	}
+	if err := a.Merge(b); nil != err {
+		t.Fatal(err)
+	}
+	if count := a.Count(); 10001 != count {
+		t.Errorf("a.Count(): 10001 != %v\n", count)
+	}
+	ps := []float64{0.1, 0.5, 0.9, 0.99}
+	expected, merged := whole.Percentiles(ps), a.Percentiles(ps)
+	for i := range ps {
+		if expected[i] != merged[i] {
+			t.Errorf("a.Percentile(%v): %v != %v\n", ps[i], expected[i], merged[i])
+		}
+	}
+	if err := a.Merge(NewDDSketchSample(0.01)); nil == err {
+		t.Error("a.Merge(0.01 sketch): expected an error\n")
+	}
+	if err := a.Merge(NewTDigestSample(100)); nil == err {
+		t.Error("a.Merge(TDigestSample): expected an error\n")
+	}
+}
+
+func TestDDSketchSampleBinary(t *testing.T) {
+	s := NewDDSketchSample(0.01).(*DDSketchSample)
+	for i := -1000; i < 100000; i++ {
+		s.Update(time.Unix(0, 0), int64(i))
+	}
+	data, err := s.MarshalBinary()
+	if nil != err {
+		t.Fatal(err)
+	}
+	s2 := NewDDSketchSample(0.05).(*DDSketchSample)
+	if err := s2.UnmarshalBinary(data); nil != err {
+		t.Fatal(err)
+	}
+	if ra := s2.RelativeAccuracy(); 0.01 != ra {
+		t.Errorf("s2.RelativeAccuracy(): 0.01 != %v\n", ra)
+	}
+	if count := s2.Count(); 101000 != count {
+		t.Errorf("s2.Count(): 101000 != %v\n", count)
+	}
+	ps := []float64{0.001, 0.5, 0.99}
+	expected, got := s.Percentiles(ps), s2.Percentiles(ps)
+	for i := range ps {
+		if expected[i] != got[i] {
+			t.Errorf("s2.Percentile(%v): %v != %v\n", ps[i], expected[i], got[i])
+		}
+	}
+
+	if err := s2.UnmarshalBinary(data[:len(data)-1]); nil == err {
+		t.Error("s2.UnmarshalBinary(truncated): expected an error\n")
+	}
+	tdigest, _ := NewTDigestSample(100).(*TDigestSample).MarshalBinary()
+	if err := s2.UnmarshalBinary(tdigest); nil == err {
+		t.Error("s2.UnmarshalBinary(t-digest): expected an error\n")
+	}
+	if count := s2.Count(); 101000 != count {
+		t.Errorf("s2.Count(): 101000 != %v after failed decodings\n", count)
+	}
+}
+
+func TestDDSketchSampleHistogram(t *testing.T) {
+	h := NewHistogram(NewDDSketchSample(0.01), 10)
+	for i := 1; i <= 1000; i++ {
+		h.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	if p := h.Percentile(0.5); math.Abs(p-500) > 5 {
+		t.Errorf("h.Percentile(0.5): %v not within 1%% of 500\n", p)
+	}
+	h.ZeroOut()
+	if size := h.Sample().Size(); 0 != size {
+		t.Errorf("h.Sample().Size(): 0 != %v\n", size)
+	}
+}
@@ -0,0 +1,130 @@
+package timemetrics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// KeyEncoders render the datapoints of a named metric in the line syntax of a
+// backend, without trailing newline.  Fetch the datapoints of a metric once
+// with GetDatapoints and hand them to EncodeDatapoints for every backend they
+// are shipped to.
+type KeyEncoder interface {
+	Encode(string, Datapoint) string
+}
+
+// EncodeDatapoints renders datapoints of the metric name through e.
+func EncodeDatapoints(e KeyEncoder, name string, dps []Datapoint) []string {
+	keys := make([]string, len(dps))
+	for i, dp := range dps {
+		keys[i] = e.Encode(name, dp)
+	}
+	return keys
+}
+
+// EncodeKeys renders the datapoints of m through e, stamped like GetKeys.
+func EncodeKeys(e KeyEncoder, name string, m Metric, ct time.Time, currentTime bool) []string {
+	return EncodeDatapoints(e, name, m.GetDatapoints(ct, currentTime))
+}
+
+// EncoderKeys returns a KeysFunc rendering metrics through e, for use with a
+// Flusher.
+func EncoderKeys(e KeyEncoder, currentTime bool) KeysFunc {
+	return func(name string, m Metric, t time.Time) []string {
+		return EncodeKeys(e, name, m, t, currentTime)
+	}
+}
+
+// OpenTSDBEncoder renders datapoints as OpenTSDB telnet put commands:
+//
+//	put <name>.<suffix> <unix seconds> <value> <k1>=<v1> <k2>=<v2>
+type OpenTSDBEncoder struct{}
+
+// NewOpenTSDBEncoder constructs a new OpenTSDBEncoder.
+func NewOpenTSDBEncoder() KeyEncoder {
+	return &OpenTSDBEncoder{}
+}
+
+func (e *OpenTSDBEncoder) Encode(name string, dp Datapoint) string {
+	key := fmt.Sprintf("put %s %d %s",
+		sanitizeOpenTSDB(name+"."+dp.Suffix), dp.Time.Unix(), dp.FormatValue())
+	if len(dp.Tags) > 0 {
+		key += " " + dp.Tags.join("=", " ", sanitizeOpenTSDB)
+	}
+	return key
+}
+
+// GraphiteEncoder renders datapoints in the Graphite plaintext protocol, tags
+// following the path as in Graphite 1.1 tagged series:
+//
+//	<name>.<suffix>;<k1>=<v1>;<k2>=<v2> <value> <unix seconds>
+type GraphiteEncoder struct{}
+
+// NewGraphiteEncoder constructs a new GraphiteEncoder.
+func NewGraphiteEncoder() KeyEncoder {
+	return &GraphiteEncoder{}
+}
+
+func (e *GraphiteEncoder) Encode(name string, dp Datapoint) string {
+	path := sanitizeGraphite(name + "." + dp.Suffix)
+	if len(dp.Tags) > 0 {
+		path += ";" + dp.Tags.join("=", ";", sanitizeGraphite)
+	}
+	return fmt.Sprintf("%s %s %d", path, dp.FormatValue(), dp.Time.Unix())
+}
+
+// InfluxDBEncoder renders datapoints in the InfluxDB line protocol, the name
+// of the metric being the measurement and the suffix the field:
+//
+//	<name>,<k1>=<v1>,<k2>=<v2> <suffix>=<value> <unix nanoseconds>
+type InfluxDBEncoder struct{}
+
+// NewInfluxDBEncoder constructs a new InfluxDBEncoder.
+func NewInfluxDBEncoder() KeyEncoder {
+	return &InfluxDBEncoder{}
+}
+
+func (e *InfluxDBEncoder) Encode(name string, dp Datapoint) string {
+	value := dp.FormatValue()
+	if !dp.IsFloat {
+		value += "i"
+	}
+	measurement := influxMeasurementEscaper.Replace(name)
+	if len(dp.Tags) > 0 {
+		measurement += "," + dp.Tags.join("=", ",", influxKeyEscaper.Replace)
+	}
+	return fmt.Sprintf("%s %s=%s %d",
+		measurement, influxKeyEscaper.Replace(dp.Suffix), value, dp.Time.UnixNano())
+}
+
+// sanitizeOpenTSDB replaces the characters OpenTSDB rejects in metric names.
+func sanitizeOpenTSDB(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// sanitizeGraphite replaces the characters which break Graphite paths.
+func sanitizeGraphite(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
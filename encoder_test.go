@@ -0,0 +1,69 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenTSDBEncoder(t *testing.T) {
+	e := NewOpenTSDBEncoder()
+	now := time.Unix(120, 0)
+	if s := e.Encode("web front:latency", floatDatapoint("p99", now, HistogramKind, 1.5)); "put web_front_latency.p99 120 1.500000" != s {
+		t.Error(s)
+	}
+	c := NewCounter(now, 10)
+	c.Inc(now, 3)
+	if keys := EncodeKeys(e, "foo", c, now, false); !reflect.DeepEqual(c.GetKeys(now, "put foo.%s %d %s", false), keys) {
+		t.Fatal(keys)
+	}
+}
+
+func TestGraphiteEncoder(t *testing.T) {
+	e := NewGraphiteEncoder()
+	now := time.Unix(120, 0)
+	if s := e.Encode("web front/latency", intDatapoint("count", now, CounterKind, 7)); "web_front_latency.count 7 120" != s {
+		t.Error(s)
+	}
+}
+
+func TestInfluxDBEncoder(t *testing.T) {
+	e := NewInfluxDBEncoder()
+	now := time.Unix(120, 5)
+	if s := e.Encode("web front,a", intDatapoint("count", now, CounterKind, 7)); `web\ front\,a count=7i 120000000005` != s {
+		t.Error(s)
+	}
+	if s := e.Encode("foo", floatDatapoint("rate._1min", now, MeterKind, 0.25)); "foo rate._1min=0.250000 120000000005" != s {
+		t.Error(s)
+	}
+}
+
+func TestEncodeDatapointsTwoBackends(t *testing.T) {
+	now := time.Unix(120, 0)
+	m := NewMeter(time.Unix(0, 0), 60, 10)
+	m.Mark(now, 60)
+
+	// Datapoints are fetched, and the EWMA crunched, only once.
+	dps := m.GetDatapoints(now, true)
+	tsdb := EncodeDatapoints(NewOpenTSDBEncoder(), "foo", dps)
+	graphite := EncodeDatapoints(NewGraphiteEncoder(), "foo", dps)
+	if 4 != len(tsdb) || 4 != len(graphite) {
+		t.Fatal(tsdb, graphite)
+	}
+	if "put foo.rate._1min 120 0.500000" != tsdb[1] {
+		t.Error(tsdb[1])
+	}
+	if "foo.rate._1min 0.500000 120" != graphite[1] {
+		t.Error(graphite[1])
+	}
+}
+
+func TestFlusherEncoderKeys(t *testing.T) {
+	r := NewRegistry(60, 10)
+	f := NewFlusher(r, time.Minute, time.Minute, EncoderKeys(NewGraphiteEncoder(), true))
+	now := time.Unix(600, 0)
+	GetOrRegisterCounter("foo", r, now).Inc(now, 2)
+	if keys := f.Flush(now); !reflect.DeepEqual([]string{"foo.count 2 600"}, keys) {
+		t.Fatal(keys)
+	}
+}
@@ -3,6 +3,8 @@ package timemetrics
 import (
 	//"fmt"
 	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,13 +13,27 @@ import (
 type EWMA interface {
 	Rate() float64
 	Tick(time.Time)
+	Unit() time.Duration
 	Update(int64)
+	Window() time.Duration
 	ZeroOut()
 }
 
-// NewEWMA constructs a new EWMA with the given alpha.
+// NewEWMA constructs a new EWMA averaging over the given number of minutes.
 func NewEWMA(t time.Time, over int) EWMA {
-	return &StandardEWMA{lastUpdate: t, over: over}
+	return NewEWMAWindow(t, time.Duration(over)*time.Minute)
+}
+
+// NewEWMAWindow constructs a new EWMA averaging over the given window, its
+// rate being a number of events per second.
+func NewEWMAWindow(t time.Time, window time.Duration) EWMA {
+	return NewEWMAWithUnit(t, window, time.Second)
+}
+
+// NewEWMAWithUnit constructs a new EWMA averaging over the given window, its
+// rate being a number of events per unit, e.g. time.Minute.
+func NewEWMAWithUnit(t time.Time, window time.Duration, unit time.Duration) EWMA {
+	return &StandardEWMA{lastUpdate: t, window: window, unit: unit}
 }
 
 // NewEWMA1 constructs a new EWMA for a one-minute moving average.
@@ -37,52 +53,96 @@ func NewEWMA15(t time.Time) EWMA {
 
 // StandardEWMA is the standard implementation of an EWMA and tracks the number
 // of uncounted events and processes them on each tick.  It uses the
-// sync/atomic package to manage uncounted events.
+// sync/atomic package to manage uncounted events and a mutex to manage the
+// rate.
 type StandardEWMA struct {
 	uncounted  int64 // /!\ this should be the first member to ensure 64-bit alignment
 	rate       float64
 	init       bool
-	over       int
+	window     time.Duration
+	unit       time.Duration
 	lastUpdate time.Time
+	mutex      sync.Mutex
 }
 
-// Rate returns the moving average rate of events per minute.
+// Rate returns the moving average rate of events per unit.
 func (a *StandardEWMA) Rate() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	return a.rate
 }
 
-// Tick ticks the clock to update the moving average.  It assumes it is called
-// every five seconds.
-// FIXME: tick only when it's time.
+// Tick ticks the clock to update the moving average.  Ticks may come at any,
+// irregular, interval: the events counted since the previous tick are
+// averaged over the exact time elapsed, and weighted by how much of the
+// window that time covers.
 func (a *StandardEWMA) Tick(t time.Time) {
-	diff_time := t.Sub(a.lastUpdate)
-	if diff_time > 0 {
-		diff_time_sec := diff_time / 1e9
-
-		instantRate := float64(a.uncounted) / float64(diff_time_sec)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	elapsed := t.Sub(a.lastUpdate).Seconds()
+	if elapsed > 0 {
+		instantRate := float64(atomic.SwapInt64(&a.uncounted, 0)) / elapsed * a.unit.Seconds()
 
 		//Recalculate alpha
-		alpha := float64(1 - math.Exp(float64(-diff_time_sec)/60.0/float64(a.over)))
+		alpha := 1 - math.Exp(-elapsed/a.window.Seconds())
 
-		//fmt.Printf("instant: %f / %f = %f\n", float64(a.uncounted), float64(diff_time/1e9), float64(a.uncounted)/float64(diff_time/1e9))
-		//fmt.Printf("alpha: (1 - Exp(%f / 30 / %f) ) = %f\n", float64(-diff_time_sec), float64(a.over), float64(1-math.Exp(float64(-diff_time)/60.0/float64(a.over))))
-		//fmt.Printf("rate: %f * (%f - %f)  =  %f -> +%f = %f\n", alpha, instantRate, a.rate, alpha*(instantRate-a.rate), a.rate, a.rate+alpha*(instantRate-a.rate))
 		if a.init {
 			a.rate += alpha * (instantRate - a.rate)
 		} else {
 			a.init = true
 			a.rate = instantRate
 		}
-		a.uncounted = 0
 		a.lastUpdate = t
 	}
 }
 
+// Unit returns the unit of time the rate is a number of events per.
+func (a *StandardEWMA) Unit() time.Duration {
+	return a.unit
+}
+
 // Update adds n uncounted events.
 func (a *StandardEWMA) Update(n int64) {
-	a.uncounted += n
+	atomic.AddInt64(&a.uncounted, n)
+}
+
+// Window returns the window the moving average is computed over.
+func (a *StandardEWMA) Window() time.Duration {
+	return a.window
 }
 
 func (a *StandardEWMA) ZeroOut() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	a.rate = 0
 }
+
+// minEWMAEncodedSize is the smallest size of a StandardEWMA encoded by
+// marshal: a byte for each varint and for the bool, two for the timestamp and
+// eight for the rate.
+const minEWMAEncodedSize = 14
+
+// marshal encodes the moving average, its uncounted events and the time of
+// its last tick included.
+func (a *StandardEWMA) marshal(w *binaryWriter) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	w.putVarint(atomic.LoadInt64(&a.uncounted))
+	w.putFloat64(a.rate)
+	w.putBool(a.init)
+	w.putDuration(a.window)
+	w.putDuration(a.unit)
+	w.putTimestamp(a.lastUpdate)
+}
+
+// unmarshalEWMA decodes a StandardEWMA encoded by marshal.
+func unmarshalEWMA(r *binaryReader) *StandardEWMA {
+	return &StandardEWMA{
+		uncounted:  r.varint(),
+		rate:       r.float64(),
+		init:       r.bool(),
+		window:     r.duration(),
+		unit:       r.duration(),
+		lastUpdate: r.timestamp(),
+	}
+}
@@ -1,225 +1,355 @@
 package timemetrics
 
-import "testing"
+import (
+	"math"
+	"testing"
+	"time"
+)
 
 func BenchmarkEWMA(b *testing.B) {
-	a := NewEWMA1()
+	now := time.Unix(0, 0)
+	a := NewEWMA1(now)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		a.Update(1)
-		a.Tick()
+		now = now.Add(5 * time.Second)
+		a.Tick(now)
 	}
 }
 
 func TestEWMA1(t *testing.T) {
-	a := NewEWMA1()
+	now := time.Unix(0, 0)
+	a := NewEWMA1(now)
 	a.Update(3)
-	a.Tick()
-	if rate := a.Rate(); 0.6 != rate {
+	now = now.Add(5 * time.Second)
+	a.Tick(now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.6, rate) {
 		t.Errorf("initial a.Rate(): 0.6 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.22072766470286553 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.22072766470286553, rate) {
 		t.Errorf("1 minute a.Rate(): 0.22072766470286553 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.08120116994196772 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.08120116994196772, rate) {
 		t.Errorf("2 minute a.Rate(): 0.08120116994196772 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.029872241020718428 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.029872241020718428, rate) {
 		t.Errorf("3 minute a.Rate(): 0.029872241020718428 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.01098938333324054 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.01098938333324054, rate) {
 		t.Errorf("4 minute a.Rate(): 0.01098938333324054 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.004042768199451294 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.004042768199451294, rate) {
 		t.Errorf("5 minute a.Rate(): 0.004042768199451294 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.0014872513059998212 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.0014872513059998212, rate) {
 		t.Errorf("6 minute a.Rate(): 0.0014872513059998212 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.0005471291793327122 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.0005471291793327122, rate) {
 		t.Errorf("7 minute a.Rate(): 0.0005471291793327122 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.00020127757674150815 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.00020127757674150815, rate) {
 		t.Errorf("8 minute a.Rate(): 0.00020127757674150815 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 7.404588245200814e-05 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(7.404588245200814e-05, rate) {
 		t.Errorf("9 minute a.Rate(): 7.404588245200814e-05 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 2.7239957857491083e-05 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(2.7239957857491083e-05, rate) {
 		t.Errorf("10 minute a.Rate(): 2.7239957857491083e-05 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 1.0021020474147462e-05 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(1.0021020474147462e-05, rate) {
 		t.Errorf("11 minute a.Rate(): 1.0021020474147462e-05 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 3.6865274119969525e-06 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(3.6865274119969525e-06, rate) {
 		t.Errorf("12 minute a.Rate(): 3.6865274119969525e-06 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 1.3561976441886433e-06 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(1.3561976441886433e-06, rate) {
 		t.Errorf("13 minute a.Rate(): 1.3561976441886433e-06 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 4.989172314621449e-07 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(4.989172314621449e-07, rate) {
 		t.Errorf("14 minute a.Rate(): 4.989172314621449e-07 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 1.8354139230109722e-07 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(1.8354139230109722e-07, rate) {
 		t.Errorf("15 minute a.Rate(): 1.8354139230109722e-07 != %v\n", rate)
 	}
 }
 
 func TestEWMA5(t *testing.T) {
-	a := NewEWMA5()
+	now := time.Unix(0, 0)
+	a := NewEWMA5(now)
 	a.Update(3)
-	a.Tick()
-	if rate := a.Rate(); 0.6 != rate {
+	now = now.Add(5 * time.Second)
+	a.Tick(now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.6, rate) {
 		t.Errorf("initial a.Rate(): 0.6 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.49123845184678905 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.49123845184678905, rate) {
 		t.Errorf("1 minute a.Rate(): 0.49123845184678905 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.4021920276213837 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.4021920276213837, rate) {
 		t.Errorf("2 minute a.Rate(): 0.4021920276213837 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.32928698165641596 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.32928698165641596, rate) {
 		t.Errorf("3 minute a.Rate(): 0.32928698165641596 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.269597378470333 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.269597378470333, rate) {
 		t.Errorf("4 minute a.Rate(): 0.269597378470333 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.2207276647028654 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.2207276647028654, rate) {
 		t.Errorf("5 minute a.Rate(): 0.2207276647028654 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.18071652714732128 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.18071652714732128, rate) {
 		t.Errorf("6 minute a.Rate(): 0.18071652714732128 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.14795817836496392 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.14795817836496392, rate) {
 		t.Errorf("7 minute a.Rate(): 0.14795817836496392 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.12113791079679326 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.12113791079679326, rate) {
 		t.Errorf("8 minute a.Rate(): 0.12113791079679326 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.09917933293295193 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.09917933293295193, rate) {
 		t.Errorf("9 minute a.Rate(): 0.09917933293295193 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.08120116994196763 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.08120116994196763, rate) {
 		t.Errorf("10 minute a.Rate(): 0.08120116994196763 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.06648189501740036 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.06648189501740036, rate) {
 		t.Errorf("11 minute a.Rate(): 0.06648189501740036 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.05443077197364752 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.05443077197364752, rate) {
 		t.Errorf("12 minute a.Rate(): 0.05443077197364752 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.04456414692860035 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.04456414692860035, rate) {
 		t.Errorf("13 minute a.Rate(): 0.04456414692860035 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.03648603757513079 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.03648603757513079, rate) {
 		t.Errorf("14 minute a.Rate(): 0.03648603757513079 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.0298722410207183831020718428 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.0298722410207183831020718428, rate) {
 		t.Errorf("15 minute a.Rate(): 0.0298722410207183831020718428 != %v\n", rate)
 	}
 }
 
 func TestEWMA15(t *testing.T) {
-	a := NewEWMA15()
+	now := time.Unix(0, 0)
+	a := NewEWMA15(now)
 	a.Update(3)
-	a.Tick()
-	if rate := a.Rate(); 0.6 != rate {
+	now = now.Add(5 * time.Second)
+	a.Tick(now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.6, rate) {
 		t.Errorf("initial a.Rate(): 0.6 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.5613041910189706 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.5613041910189706, rate) {
 		t.Errorf("1 minute a.Rate(): 0.5613041910189706 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.5251039914257684 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.5251039914257684, rate) {
 		t.Errorf("2 minute a.Rate(): 0.5251039914257684 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.4912384518467888184678905 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.4912384518467888184678905, rate) {
 		t.Errorf("3 minute a.Rate(): 0.4912384518467888184678905 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.459557003018789 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.459557003018789, rate) {
 		t.Errorf("4 minute a.Rate(): 0.459557003018789 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.4299187863442732 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.4299187863442732, rate) {
 		t.Errorf("5 minute a.Rate(): 0.4299187863442732 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.4021920276213831 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.4021920276213831, rate) {
 		t.Errorf("6 minute a.Rate(): 0.4021920276213831 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.37625345116383313 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.37625345116383313, rate) {
 		t.Errorf("7 minute a.Rate(): 0.37625345116383313 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.3519877317060185 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.3519877317060185, rate) {
 		t.Errorf("8 minute a.Rate(): 0.3519877317060185 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.3292869816564153165641596 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.3292869816564153165641596, rate) {
 		t.Errorf("9 minute a.Rate(): 0.3292869816564153165641596 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.3080502714195546 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.3080502714195546, rate) {
 		t.Errorf("10 minute a.Rate(): 0.3080502714195546 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.2881831806538789 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.2881831806538789, rate) {
 		t.Errorf("11 minute a.Rate(): 0.2881831806538789 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.26959737847033216 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.26959737847033216, rate) {
 		t.Errorf("12 minute a.Rate(): 0.26959737847033216 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.2522102307052083 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.2522102307052083, rate) {
 		t.Errorf("13 minute a.Rate(): 0.2522102307052083 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.23594443252115815 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.23594443252115815, rate) {
 		t.Errorf("14 minute a.Rate(): 0.23594443252115815 != %v\n", rate)
 	}
-	elapseMinute(a)
-	if rate := a.Rate(); 0.2207276647028646247028654470286553 != rate {
+	now = elapseMinute(a, now)
+	if rate := a.Rate(); !ewmaAlmostEqual(0.2207276647028646247028654470286553, rate) {
 		t.Errorf("15 minute a.Rate(): 0.2207276647028646247028654470286553 != %v\n", rate)
 	}
 }
 
-func elapseMinute(a EWMA) {
+func elapseMinute(a EWMA, t time.Time) time.Time {
 	for i := 0; i < 12; i++ {
-		a.Tick()
+		t = t.Add(5 * time.Second)
+		a.Tick(t)
+	}
+	return t
+}
+
+func ewmaAlmostEqual(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestEWMASubSecondTicks(t *testing.T) {
+	start := time.Unix(0, 0)
+	a := NewEWMAWindow(start, time.Minute)
+	for i := 1; i <= 20; i++ {
+		a.Update(1)
+		a.Tick(start.Add(time.Duration(i) * 250 * time.Millisecond))
+	}
+	if rate := a.Rate(); !ewmaAlmostEqual(4, rate) {
+		t.Errorf("a.Rate(): 4 != %v\n", rate)
+	}
+}
+
+func TestEWMAFractionalTick(t *testing.T) {
+	start := time.Unix(0, 0)
+	a := NewEWMAWindow(start, time.Minute)
+	a.Update(19)
+	a.Tick(start.Add(1900 * time.Millisecond))
+	if rate := a.Rate(); !ewmaAlmostEqual(10, rate) {
+		t.Errorf("a.Rate(): 10 != %v\n", rate)
+	}
+}
+
+func TestEWMAIrregularDecay(t *testing.T) {
+	// Without events the rate decays by exp(-elapsed/window), however the
+	// elapsed time is split between ticks.
+	ticks := [][]time.Duration{
+		{60 * time.Second},
+		{time.Second, 59 * time.Second},
+		{300 * time.Millisecond, 1700 * time.Millisecond, 13 * time.Second, 45 * time.Second},
+		{10 * time.Millisecond, 990 * time.Millisecond, 1900 * time.Millisecond, 57100 * time.Millisecond},
+	}
+	for _, intervals := range ticks {
+		start := time.Unix(0, 0)
+		a := NewEWMAWindow(start, 5*time.Minute)
+		a.Update(600)
+		a.Tick(start.Add(time.Minute))
+		now := start.Add(time.Minute)
+		for _, d := range intervals {
+			now = now.Add(d)
+			a.Tick(now)
+		}
+		expected := 10 * math.Exp(-60.0/300.0)
+		if rate := a.Rate(); !ewmaAlmostEqual(expected, rate) {
+			t.Errorf("%v: a.Rate(): %v != %v\n", intervals, expected, rate)
+		}
+	}
+}
+
+func TestEWMAIrregularConstantRate(t *testing.T) {
+	// A constant flow of events keeps the rate constant, whatever the ticks.
+	start := time.Unix(0, 0)
+	a := NewEWMAWindow(start, time.Minute)
+	now := start
+	for _, d := range []time.Duration{
+		time.Second, 100 * time.Millisecond, 2500 * time.Millisecond, 7 * time.Second, 400 * time.Millisecond,
+	} {
+		now = now.Add(d)
+		a.Update(int64(d / (10 * time.Millisecond)))
+		a.Tick(now)
+		if rate := a.Rate(); !ewmaAlmostEqual(100, rate) {
+			t.Errorf("after %v: a.Rate(): 100 != %v\n", d, rate)
+		}
+	}
+}
+
+func TestEWMATickNoElapsedTime(t *testing.T) {
+	start := time.Unix(0, 0)
+	a := NewEWMAWindow(start, time.Minute)
+	a.Update(5)
+	a.Tick(start)
+	a.Tick(start.Add(-time.Second))
+	if rate := a.Rate(); 0 != rate {
+		t.Errorf("a.Rate(): 0 != %v\n", rate)
+	}
+	a.Tick(start.Add(time.Second))
+	if rate := a.Rate(); !ewmaAlmostEqual(5, rate) {
+		t.Errorf("a.Rate(): 5 != %v\n", rate)
+	}
+}
+
+func TestEWMAUnit(t *testing.T) {
+	start := time.Unix(0, 0)
+	perSecond := NewEWMAWindow(start, time.Minute)
+	perMinute := NewEWMAWithUnit(start, time.Minute, time.Minute)
+	for _, a := range []EWMA{perSecond, perMinute} {
+		a.Update(30)
+		a.Tick(start.Add(15 * time.Second))
+	}
+	if rate := perSecond.Rate(); !ewmaAlmostEqual(2, rate) {
+		t.Errorf("perSecond.Rate(): 2 != %v\n", rate)
+	}
+	if rate := perMinute.Rate(); !ewmaAlmostEqual(120, rate) {
+		t.Errorf("perMinute.Rate(): 120 != %v\n", rate)
+	}
+	if unit := perMinute.Unit(); time.Minute != unit {
+		t.Errorf("perMinute.Unit(): 1m != %v\n", unit)
+	}
+}
+
+func TestMeterRateUnit(t *testing.T) {
+	opts := MeterOptions{Windows: []time.Duration{time.Minute}, RateUnit: time.Minute}
+	m := NewMeterWithOptions(time.Unix(0, 0), 1, 10, nil, opts)
+	m.Mark(time.Unix(0, 500000000), 3)
+	m.CrunchEWMA(time.Unix(1, 0))
+	if rate := m.Rate1(); !ewmaAlmostEqual(180, rate) {
+		t.Errorf("m.Rate1(): 180 != %v\n", rate)
+	}
+	if unit := m.RateUnit(); time.Minute != unit {
+		t.Errorf("m.RateUnit(): 1m != %v\n", unit)
 	}
 }
@@ -0,0 +1,580 @@
+package timemetrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bounds of the scale of ExponentialHistograms, as in OpenTelemetry: at
+// MinExponentialScale a bucket spans every int64.
+const (
+	MaxExponentialScale = 20
+	MinExponentialScale = -10
+)
+
+// DefaultExponentialMaxSize is the default maximum number of positive, and of
+// negative, buckets of an ExponentialHistogram.
+const DefaultExponentialMaxSize = 160
+
+// ExponentialHistograms count values in the base-2 exponential buckets of the
+// OpenTelemetry data model.  At scale s, the base is 2^(2^-s) and the bucket
+// of index i counts the values whose magnitude is in (base^i, base^(i+1)].
+// Positive and negative values are counted in ranges of buckets of their
+// own, zeros apart.  Histograms start at MaxExponentialScale and halve their
+// scale, merging buckets pairwise, whenever a range would exceed the maximum
+// number of buckets: the relative error of the buckets adapts to the range of
+// the values.  Count, sum, min and max are exact.
+type ExponentialHistogram interface {
+	Clear(time.Time)
+	Count() int64
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
+	Max() int64
+	MaxSize() int
+	Mean() float64
+	Merge(ExponentialHistogram) error
+	Min() int64
+	Negative() ExponentialHistogramBuckets
+	Percentile(float64) float64
+	Percentiles([]float64) []float64
+	Positive() ExponentialHistogramBuckets
+	Scale() int
+	SetLateOptions(LateOptions)
+	Sum() int64
+	Update(time.Time, int64)
+	ZeroCount() int64
+	GetMaxTime() time.Time
+	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	NbKeys() int
+	Stale(time.Time) bool
+	PushKeysTime(time.Time) bool
+	Tags() Tags
+	ZeroOut()
+}
+
+// ExponentialHistogramBuckets is a range of buckets of an
+// ExponentialHistogram: Counts[i] is the count of the bucket of index
+// Offset+i.
+type ExponentialHistogramBuckets struct {
+	Offset int
+	Counts []int64
+}
+
+// GetOrRegisterExponentialHistogram returns an existing ExponentialHistogram
+// or constructs and registers a new StandardExponentialHistogram stamped with
+// the event time t.
+func GetOrRegisterExponentialHistogram(name string, r Registry, t time.Time, maxSize int) ExponentialHistogram {
+	return GetOrRegisterTaggedExponentialHistogram(name, nil, r, t, maxSize)
+}
+
+// GetOrRegisterTaggedExponentialHistogram returns an existing
+// ExponentialHistogram or constructs and registers a new tagged
+// StandardExponentialHistogram stamped with the event time t.
+func GetOrRegisterTaggedExponentialHistogram(name string, tags Tags, r Registry, t time.Time, maxSize int) ExponentialHistogram {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		h := NewTaggedExponentialHistogram(maxSize, staleThreshold, tags).(*StandardExponentialHistogram)
+		h.lastUpdate = t
+		return h
+	}).(ExponentialHistogram)
+}
+
+// NewExponentialHistogram constructs a new StandardExponentialHistogram of at
+// most maxSize positive and maxSize negative buckets, at least 2 of each.
+func NewExponentialHistogram(maxSize int, staleThreshold int) ExponentialHistogram {
+	return NewTaggedExponentialHistogram(maxSize, staleThreshold, nil)
+}
+
+// NewTaggedExponentialHistogram constructs a new tagged
+// StandardExponentialHistogram of at most maxSize positive and maxSize
+// negative buckets.
+func NewTaggedExponentialHistogram(maxSize int, staleThreshold int, tags Tags) ExponentialHistogram {
+	if maxSize < 2 {
+		maxSize = 2
+	}
+	h := &StandardExponentialHistogram{
+		scale:          MaxExponentialScale,
+		maxSize:        maxSize,
+		staleThreshold: staleThreshold,
+		tags:           copyTags(tags),
+	}
+	h.stats.reset()
+	return h
+}
+
+// NewRegisteredExponentialHistogram constructs and registers a new
+// StandardExponentialHistogram stamped with the event time t.  It returns
+// DuplicateMetric if a metric is already registered under name.
+func NewRegisteredExponentialHistogram(name string, r Registry, t time.Time, maxSize int) (ExponentialHistogram, error) {
+	return NewRegisteredTaggedExponentialHistogram(name, nil, r, t, maxSize)
+}
+
+// NewRegisteredTaggedExponentialHistogram constructs and registers a new
+// tagged StandardExponentialHistogram stamped with the event time t.
+func NewRegisteredTaggedExponentialHistogram(name string, tags Tags, r Registry, t time.Time, maxSize int) (ExponentialHistogram, error) {
+	h := NewTaggedExponentialHistogram(maxSize, r.StaleThreshold(), tags).(*StandardExponentialHistogram)
+	h.lastUpdate = t
+	if err := r.Register(name, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// StandardExponentialHistogram is the standard implementation of an
+// ExponentialHistogram.  Like a Histogram, it is emptied when it goes stale.
+type StandardExponentialHistogram struct {
+	lateTracker
+	scale          int
+	maxSize        int
+	positive       ddStore
+	negative       ddStore // of the absolute values
+	zeros          int64
+	stats          sampleStats
+	lastUpdate     time.Time
+	staleThreshold int
+	tags           Tags
+	mutex          sync.Mutex
+}
+
+// Clear empties the histogram and brings it back to MaxExponentialScale.
+func (h *StandardExponentialHistogram) Clear(t time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reset()
+	h.lastUpdate = t
+}
+
+// Count returns the number of values recorded.
+func (h *StandardExponentialHistogram) Count() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats.n
+}
+
+// Max returns the exact maximum value recorded.
+func (h *StandardExponentialHistogram) Max() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats.maxValue()
+}
+
+// MaxSize returns the maximum number of positive, and of negative, buckets.
+func (h *StandardExponentialHistogram) MaxSize() int {
+	return h.maxSize
+}
+
+// Mean returns the exact mean of the values recorded.
+func (h *StandardExponentialHistogram) Mean() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats.mean
+}
+
+// Merge adds the counts of other to the histogram, whatever their scales:
+// both are brought to the largest scale at which their buckets merged fit
+// in the maximum size of the histogram.  The histogram is stamped with the
+// newest of both times of last update.
+func (h *StandardExponentialHistogram) Merge(other ExponentialHistogram) error {
+	o, ok := other.(*StandardExponentialHistogram)
+	if !ok {
+		return IncompatibleBuckets(fmt.Sprintf("%T", other))
+	}
+	if o == h {
+		return IncompatibleBuckets("merge with itself")
+	}
+	o.mutex.Lock()
+	scale := o.scale
+	positive := o.positive.copy()
+	negative := o.negative.copy()
+	zeros, stats, lastUpdate := o.zeros, o.stats, o.lastUpdate
+	o.mutex.Unlock()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if scale > h.scale {
+		positive.downscale(scale - h.scale)
+		negative.downscale(scale - h.scale)
+		scale = h.scale
+	} else {
+		h.downscale(h.scale - scale)
+	}
+	change := 0
+	for _, s := range [][2]*ddStore{{&h.positive, &positive}, {&h.negative, &negative}} {
+		if 0 == len(s[1].counts) {
+			continue
+		}
+		low, high := s[1].offset, s[1].offset+len(s[1].counts)-1
+		if c := h.scaleChange(s[0], low, high); c > change {
+			change = c
+		}
+	}
+	h.downscale(change)
+	positive.downscale(change)
+	negative.downscale(change)
+
+	h.positive.merge(positive)
+	h.negative.merge(negative)
+	h.zeros += zeros
+	h.stats.merge(stats)
+	if lastUpdate.After(h.lastUpdate) {
+		h.lastUpdate = lastUpdate
+	}
+	return nil
+}
+
+// Min returns the exact minimum value recorded.
+func (h *StandardExponentialHistogram) Min() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats.minValue()
+}
+
+// Negative returns the buckets of the negative values, indexed by their
+// absolute values.
+func (h *StandardExponentialHistogram) Negative() ExponentialHistogramBuckets {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.negative.buckets()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded, within
+// the relative error of the buckets.
+func (h *StandardExponentialHistogram) Percentile(p float64) float64 {
+	return h.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (h *StandardExponentialHistogram) Percentiles(ps []float64) []float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	scores := make([]float64, len(ps))
+	if 0 == h.stats.n {
+		return scores
+	}
+	for i, p := range ps {
+		scores[i] = h.quantile(p)
+	}
+	return scores
+}
+
+// Positive returns the buckets of the positive values.
+func (h *StandardExponentialHistogram) Positive() ExponentialHistogramBuckets {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.positive.buckets()
+}
+
+// Scale returns the current scale of the buckets.
+func (h *StandardExponentialHistogram) Scale() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.scale
+}
+
+// Sum returns the exact sum of the values recorded.
+func (h *StandardExponentialHistogram) Sum() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stats.sum
+}
+
+// Update counts a value in its bucket, downscaling the histogram first if
+// needed, unless t is late and the late policy discards it.
+func (h *StandardExponentialHistogram) Update(t time.Time, v int64) {
+	if !h.admit(t, h.GetMaxTime()) {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.stats.update(v)
+	switch {
+	case v > 0:
+		h.record(&h.positive, float64(v))
+	case v < 0:
+		h.record(&h.negative, -float64(v))
+	default:
+		h.zeros++
+	}
+	if t.After(h.lastUpdate) {
+		h.lastUpdate = t
+	}
+}
+
+// ZeroCount returns the number of zeros recorded.
+func (h *StandardExponentialHistogram) ZeroCount() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.zeros
+}
+
+func (h *StandardExponentialHistogram) GetMaxTime() time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.lastUpdate
+}
+
+func (h *StandardExponentialHistogram) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, h.GetDatapoints(ct, currentTime))
+}
+
+// GetDatapoints returns the count, sum, min, max, zero count and scale of the
+// histogram, then its DefaultPercentiles.
+func (h *StandardExponentialHistogram) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	t := datapointTime(h, ct, currentTime)
+	ps := h.Percentiles(DefaultPercentiles)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	dps := make([]Datapoint, 0, 6+len(ps))
+	dps = append(dps, intDatapoint("count", t, HistogramKind, h.stats.n))
+	dps = append(dps, intDatapoint("sum", t, HistogramKind, h.stats.sum))
+	dps = append(dps, intDatapoint("min", t, HistogramKind, h.stats.minValue()))
+	dps = append(dps, intDatapoint("max", t, HistogramKind, h.stats.maxValue()))
+	dps = append(dps, intDatapoint("zero_count", t, HistogramKind, h.zeros))
+	dps = append(dps, intDatapoint("scale", t, HistogramKind, int64(h.scale)))
+	for i, p := range DefaultPercentiles {
+		dps = append(dps, intDatapoint(PercentileSuffix(p), t, HistogramKind, int64(ps[i])))
+	}
+	return tagDatapoints(dps, h.tags)
+}
+
+func (h *StandardExponentialHistogram) NbKeys() int {
+	return 6 + len(DefaultPercentiles)
+}
+
+func (h *StandardExponentialHistogram) Stale(t time.Time) bool {
+	return t.Sub(h.GetMaxTime()) > time.Duration(h.staleThreshold)*time.Minute
+}
+
+func (h *StandardExponentialHistogram) PushKeysTime(t time.Time) bool {
+	return h.GetMaxTime().After(t)
+}
+
+func (h *StandardExponentialHistogram) Tags() Tags {
+	return h.tags
+}
+
+func (h *StandardExponentialHistogram) ZeroOut() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reset()
+}
+
+// exponentialHistogramEncodingVersion is the version of the encoding of
+// StandardExponentialHistograms.
+const exponentialHistogramEncodingVersion = 1
+
+// MarshalBinary encodes the histogram, its scale and buckets included.
+func (h *StandardExponentialHistogram) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.putHeader(exponentialHistogramEncoding, exponentialHistogramEncodingVersion)
+	w.putUvarint(uint64(h.maxSize))
+	h.mutex.Lock()
+	w.putVarint(int64(h.scale))
+	h.stats.marshal(w)
+	w.putUvarint(uint64(h.zeros))
+	h.positive.marshal(w)
+	h.negative.marshal(w)
+	w.putTimestamp(h.lastUpdate)
+	h.mutex.Unlock()
+	w.putVarint(int64(h.staleThreshold))
+	w.putTags(h.tags)
+	h.lateTracker.marshal(w)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the histogram by the one encoded in data by
+// MarshalBinary.
+func (h *StandardExponentialHistogram) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(exponentialHistogramEncoding, exponentialHistogramEncodingVersion)
+	maxSize := int(r.uvarint())
+	scale := int(r.varint())
+	var stats sampleStats
+	stats.unmarshal(r)
+	zeros := int64(r.uvarint())
+	var positive, negative ddStore
+	positive.unmarshal(r)
+	negative.unmarshal(r)
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	if err := r.end(); err != nil {
+		return err
+	}
+	if scale < MinExponentialScale || scale > MaxExponentialScale {
+		return InvalidEncoding(fmt.Sprintf("scale %d", scale))
+	}
+	if maxSize < 2 || len(positive.counts) > maxSize || len(negative.counts) > maxSize {
+		return InvalidEncoding(fmt.Sprintf("%d and %d buckets of at most %d", len(positive.counts), len(negative.counts), maxSize))
+	}
+	count := zeros
+	for _, d := range []ddStore{positive, negative} {
+		for _, c := range d.counts {
+			count += c
+		}
+	}
+	if count != stats.n {
+		return InvalidEncoding(fmt.Sprintf("%d values in buckets, %d counted", count, stats.n))
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.maxSize = maxSize
+	h.scale = scale
+	h.stats = stats
+	h.zeros = zeros
+	h.positive = positive
+	h.negative = negative
+	h.lastUpdate = lastUpdate
+	h.staleThreshold = staleThreshold
+	h.tags = tags
+	h.lateTracker.restore(late, dropped)
+	return nil
+}
+
+// reset empties the histogram, with the mutex held.
+func (h *StandardExponentialHistogram) reset() {
+	h.scale = MaxExponentialScale
+	h.positive = ddStore{}
+	h.negative = ddStore{}
+	h.zeros = 0
+	h.stats.reset()
+}
+
+// record counts a value of magnitude m > 0 in d, with the mutex held.
+func (h *StandardExponentialHistogram) record(d *ddStore, m float64) {
+	index := exponentialIndex(m, h.scale)
+	if change := h.scaleChange(d, index, index); change > 0 {
+		h.downscale(change)
+		index >>= uint(change)
+	}
+	d.add(index, 1)
+}
+
+// scaleChange returns by how much the scale must go down for the buckets of d
+// and those from low to high to fit in the maximum size, with the mutex held.
+func (h *StandardExponentialHistogram) scaleChange(d *ddStore, low int, high int) int {
+	if len(d.counts) > 0 {
+		if d.offset < low {
+			low = d.offset
+		}
+		if last := d.offset + len(d.counts) - 1; last > high {
+			high = last
+		}
+	}
+	change := 0
+	for high-low >= h.maxSize {
+		low >>= 1
+		high >>= 1
+		change++
+	}
+	return change
+}
+
+// downscale lowers the scale by change, merging buckets, with the mutex held.
+func (h *StandardExponentialHistogram) downscale(change int) {
+	h.scale -= change
+	h.positive.downscale(change)
+	h.negative.downscale(change)
+}
+
+// quantile returns the value of the bucket holding the value of rank
+// p*(n-1), negative values first from the largest magnitude, then zeros,
+// then positive values, bounded by the exact min and max, with the mutex
+// held.
+func (h *StandardExponentialHistogram) quantile(p float64) float64 {
+	if p <= 0 {
+		return float64(h.stats.min)
+	}
+	if p >= 1 {
+		return float64(h.stats.max)
+	}
+	rank := p * float64(h.stats.n-1)
+
+	var v float64
+	var total float64
+	found := false
+	for i := len(h.negative.counts) - 1; i >= 0 && !found; i-- {
+		total += float64(h.negative.counts[i])
+		if total > rank {
+			v, found = -exponentialValue(h.negative.offset+i, h.scale), true
+		}
+	}
+	if !found {
+		total += float64(h.zeros)
+		if total > rank {
+			v, found = 0, true
+		}
+	}
+	for i := 0; i < len(h.positive.counts) && !found; i++ {
+		total += float64(h.positive.counts[i])
+		if total > rank {
+			v, found = exponentialValue(h.positive.offset+i, h.scale), true
+		}
+	}
+	if !found || v > float64(h.stats.max) {
+		v = float64(h.stats.max)
+	}
+	if v < float64(h.stats.min) {
+		v = float64(h.stats.min)
+	}
+	return v
+}
+
+// exponentialIndex returns the index of the bucket of m > 0 at the given
+// scale, the one whose bounds are (base^index, base^(index+1)].  Powers of
+// two are indexed exactly, the others within the precision of math.Log.
+func exponentialIndex(m float64, scale int) int {
+	frac, exp := math.Frexp(m)
+	if scale <= 0 {
+		if 0.5 == frac {
+			return (exp - 2) >> uint(-scale)
+		}
+		return (exp - 1) >> uint(-scale)
+	}
+	if 0.5 == frac {
+		return ((exp - 1) << uint(scale)) - 1
+	}
+	return int(math.Ceil(math.Log(m)*math.Ldexp(math.Log2E, scale))) - 1
+}
+
+// exponentialLowerBound returns the lower bound, base^index, of the bucket of
+// the given index at the given scale.
+func exponentialLowerBound(index int, scale int) float64 {
+	if scale <= 0 {
+		return math.Ldexp(1, index<<uint(-scale))
+	}
+	return math.Exp(float64(index) * math.Ldexp(math.Ln2, -scale))
+}
+
+// exponentialValue returns the value within the least relative error of
+// every value in the bucket of the given index, 2*base^(index+1)/(base+1).
+func exponentialValue(index int, scale int) float64 {
+	base := exponentialLowerBound(1, scale)
+	return 2 * exponentialLowerBound(index+1, scale) / (base + 1)
+}
+
+// downscale merges the buckets of d for a scale lower by change: the bucket
+// of index i goes to i>>change.
+func (d *ddStore) downscale(change int) {
+	if change <= 0 || 0 == len(d.counts) {
+		return
+	}
+	offset := d.offset >> uint(change)
+	last := (d.offset + len(d.counts) - 1) >> uint(change)
+	counts := make([]int64, last-offset+1)
+	for i, c := range d.counts {
+		counts[(d.offset+i)>>uint(change)-offset] += c
+	}
+	d.offset, d.counts = offset, counts
+}
+
+func (d *ddStore) buckets() ExponentialHistogramBuckets {
+	c := d.copy()
+	return ExponentialHistogramBuckets{Offset: c.offset, Counts: c.counts}
+}
@@ -0,0 +1,176 @@
+package timemetrics
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExponentialHistogramIndex(t *testing.T) {
+	for _, c := range []struct {
+		m     float64
+		scale int
+		index int
+	}{
+		{1, 0, -1}, {2, 0, 0}, {3, 0, 1}, {4, 0, 1}, {5, 0, 2},
+		{1, -1, -1}, {4, -1, 0}, {5, -1, 1}, {16, -1, 1}, {17, -1, 2},
+		{2, 1, 1}, {3, 1, 3}, {1, MaxExponentialScale, -1}, {2, MaxExponentialScale, 1<<MaxExponentialScale - 1},
+		{math.MaxInt64, MinExponentialScale, 0},
+	} {
+		if index := exponentialIndex(c.m, c.scale); c.index != index {
+			t.Errorf("exponentialIndex(%v, %v): %v != %v\n", c.m, c.scale, c.index, index)
+		}
+	}
+	for _, scale := range []int{-3, 0, 3, 8, MaxExponentialScale} {
+		for m := 1.0; m < 1e12; m *= 1.37 {
+			index := exponentialIndex(m, scale)
+			low, high := exponentialLowerBound(index, scale), exponentialLowerBound(index+1, scale)
+			if m <= low*(1-1e-12) || m > high*(1+1e-12) {
+				t.Errorf("exponentialIndex(%v, %v): %v not in (%v, %v]\n", m, scale, m, low, high)
+			}
+		}
+	}
+}
+
+func TestExponentialHistogramUpdate(t *testing.T) {
+	h := NewTaggedExponentialHistogram(4, 10, Tags{"host": "web1"})
+	for i, v := range []int64{1, 2, 4, 8} {
+		h.Update(time.Unix(int64(600+i), 0), v)
+	}
+	if scale, positive := h.Scale(), h.Positive(); 0 != scale || !reflect.DeepEqual(ExponentialHistogramBuckets{-1, []int64{1, 1, 1, 1}}, positive) {
+		t.Errorf("h.Scale(), h.Positive(): 0 {-1 [1 1 1 1]} != %v %v\n", scale, positive)
+	}
+	// A fifth bucket halves the scale: (1/4, 1], (1, 4], (4, 16].
+	h.Update(time.Unix(604, 0), 16)
+	h.Update(time.Unix(605, 0), 0)
+	h.Update(time.Unix(606, 0), -3)
+	if scale, positive := h.Scale(), h.Positive(); -1 != scale || !reflect.DeepEqual(ExponentialHistogramBuckets{-1, []int64{1, 2, 2}}, positive) {
+		t.Errorf("h.Scale(), h.Positive(): -1 {-1 [1 2 2]} != %v %v\n", scale, positive)
+	}
+	if negative := h.Negative(); !reflect.DeepEqual(ExponentialHistogramBuckets{0, []int64{1}}, negative) {
+		t.Errorf("h.Negative(): {0 [1]} != %v\n", negative)
+	}
+	if count, sum, zeros := h.Count(), h.Sum(), h.ZeroCount(); 7 != count || 28 != sum || 1 != zeros {
+		t.Errorf("h.Count(), h.Sum(), h.ZeroCount(): 7, 28, 1 != %v, %v, %v\n", count, sum, zeros)
+	}
+	if min, max := h.Min(), h.Max(); -3 != min || 16 != max {
+		t.Errorf("h.Min(), h.Max(): -3, 16 != %v, %v\n", min, max)
+	}
+	// The median, 2, is in (1, 4], whose value is 2*4/(4+1).
+	if p := h.Percentile(0.5); 1.6 != p {
+		t.Errorf("h.Percentile(0.5): 1.6 != %v\n", p)
+	}
+
+	expected := []string{
+		"put foo.count 606 7 host=web1\n",
+		"put foo.sum 606 28 host=web1\n",
+		"put foo.min 606 -3 host=web1\n",
+		"put foo.max 606 16 host=web1\n",
+		"put foo.zero_count 606 1 host=web1\n",
+		"put foo.scale 606 -1 host=web1\n",
+		"put foo.p50 606 1 host=web1\n",
+		"put foo.p75 606 1 host=web1\n",
+		"put foo.p95 606 6 host=web1\n",
+		"put foo.p99 606 6 host=web1\n",
+		"put foo.p999 606 6 host=web1\n",
+	}
+	if keys := h.GetKeys(time.Unix(660, 0), "put foo.%s %d %s\n", false); !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h.GetKeys(): %v != %v\n", expected, keys)
+	}
+	if nbKeys := h.NbKeys(); len(expected) != nbKeys {
+		t.Errorf("h.NbKeys(): %v != %v\n", len(expected), nbKeys)
+	}
+
+	if !h.PushKeysTime(time.Unix(605, 0)) || h.PushKeysTime(time.Unix(606, 0)) {
+		t.Error("h.PushKeysTime(): expected true before the last update only\n")
+	}
+	if h.Stale(time.Unix(1206, 0)) || !h.Stale(time.Unix(1207, 0)) {
+		t.Error("h.Stale(): expected stale 10 minutes after the last update\n")
+	}
+	h.ZeroOut()
+	if count, scale := h.Count(), h.Scale(); 0 != count || MaxExponentialScale != scale {
+		t.Errorf("h.Count(), h.Scale(): 0, %v != %v, %v after ZeroOut\n", MaxExponentialScale, count, scale)
+	}
+}
+
+func TestExponentialHistogramMerge(t *testing.T) {
+	a, b := NewExponentialHistogram(20, 10), NewExponentialHistogram(20, 10)
+	whole := NewExponentialHistogram(20, 10)
+	for i := int64(0); i < 1000; i++ {
+		ts := time.Unix(600+i, 0)
+		// a sees values close to each other, at a fine scale, b values
+		// far apart, at a coarse one.
+		a.Update(ts, 1000+i%10)
+		b.Update(ts, (i-500)*(i-500)*i)
+		whole.Update(ts, 1000+i%10)
+		whole.Update(ts, (i-500)*(i-500)*i)
+	}
+	if a.Scale() <= b.Scale() {
+		t.Fatalf("a.Scale(), b.Scale(): %v <= %v\n", a.Scale(), b.Scale())
+	}
+	if err := a.Merge(b); nil != err {
+		t.Fatal(err)
+	}
+	if whole.Scale() != a.Scale() || !reflect.DeepEqual(whole.Positive(), a.Positive()) || !reflect.DeepEqual(whole.Negative(), a.Negative()) {
+		t.Errorf("a: %v %v %v != %v %v %v\n", whole.Scale(), whole.Positive(), whole.Negative(), a.Scale(), a.Positive(), a.Negative())
+	}
+	if whole.Count() != a.Count() || whole.Sum() != a.Sum() || whole.ZeroCount() != a.ZeroCount() {
+		t.Errorf("a.Count(), a.Sum(), a.ZeroCount(): %v, %v, %v != %v, %v, %v\n", whole.Count(), whole.Sum(), whole.ZeroCount(), a.Count(), a.Sum(), a.ZeroCount())
+	}
+	if !a.GetMaxTime().Equal(time.Unix(1599, 0)) {
+		t.Errorf("a.GetMaxTime(): %v != %v\n", time.Unix(1599, 0), a.GetMaxTime())
+	}
+
+	// Merging a finer histogram within the range of a downscales it.
+	c := NewExponentialHistogram(20, 10)
+	c.Update(time.Unix(600, 0), 1000000)
+	scale := a.Scale()
+	if err := a.Merge(c); nil != err {
+		t.Fatal(err)
+	}
+	if scale != a.Scale() || whole.Count()+1 != a.Count() {
+		t.Errorf("a.Scale(), a.Count(): %v, %v != %v, %v\n", scale, whole.Count()+1, a.Scale(), a.Count())
+	}
+	if err := a.Merge(a); nil == err {
+		t.Error("a.Merge(a): expected an error\n")
+	}
+}
+
+func TestExponentialHistogramRegistry(t *testing.T) {
+	r := NewRegistry(60, 10)
+	t0 := time.Unix(600, 0)
+	h := GetOrRegisterTaggedExponentialHistogram("latency", Tags{"host": "web1"}, r, t0, DefaultExponentialMaxSize)
+	for i := int64(-100); i < 1000; i += 7 {
+		h.Update(t0, i*i*i)
+	}
+	if h2 := GetOrRegisterTaggedExponentialHistogram("latency", Tags{"host": "web1"}, r, t0, 2); h != h2 {
+		t.Error("GetOrRegisterTaggedExponentialHistogram(): registered a second histogram\n")
+	}
+
+	var buf bytes.Buffer
+	if err := r.Checkpoint(&buf); nil != err {
+		t.Fatal(err)
+	}
+	r2 := NewRegistry(60, 10)
+	if err := r2.Restore(&buf); nil != err {
+		t.Fatal(err)
+	}
+	h2 := r2.Get("latency", Tags{"host": "web1"}).(ExponentialHistogram)
+	if h.Scale() != h2.Scale() || !reflect.DeepEqual(h.Positive(), h2.Positive()) || !reflect.DeepEqual(h.Negative(), h2.Negative()) {
+		t.Errorf("restored histogram: %v %v %v != %v %v %v\n", h.Scale(), h.Positive(), h.Negative(), h2.Scale(), h2.Positive(), h2.Negative())
+	}
+	if expected, keys := h.GetKeys(t0, "put foo.%s %d %s\n", false), h2.GetKeys(t0, "put foo.%s %d %s\n", false); !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h2.GetKeys(): %v != %v\n", expected, keys)
+	}
+
+	data, _ := h2.(*StandardExponentialHistogram).MarshalBinary()
+	// A maximum size of 2 buckets.
+	data[2] = 2
+	if err := h2.(*StandardExponentialHistogram).UnmarshalBinary(data); nil == err {
+		t.Error("h2.UnmarshalBinary(corrupted): expected an error\n")
+	} else if _, ok := err.(InvalidEncoding); !ok {
+		t.Errorf("h2.UnmarshalBinary(corrupted): %v is not an InvalidEncoding\n", err)
+	}
+}
@@ -0,0 +1,141 @@
+package timemetrics
+
+import (
+	"sync"
+	"time"
+)
+
+// KeysFunc renders the keys of the metric registered under name, flushed at
+// time t.
+type KeysFunc func(name string, m Metric, t time.Time) []string
+
+// FormatKeys returns a KeysFunc which calls GetKeys with the format string
+// returned by format for each metric name.
+func FormatKeys(format func(string) string, currentTime bool) KeysFunc {
+	return func(name string, m Metric, t time.Time) []string {
+		return m.GetKeys(t, format(name), currentTime)
+	}
+}
+
+// Flusher walks the metrics of a Registry once per event-time interval and
+// emits the keys of the metrics whose PushKeysTime is true.  Metrics which go
+// Stale are zeroed out and, once they stayed stale for the grace period,
+// unregistered.
+//
+// The Flusher has no clock of its own: it is driven either by wall-clock
+// ticks through Run or by replayed event times through Advance.
+type Flusher struct {
+	registry    Registry
+	interval    time.Duration
+	gracePeriod time.Duration
+	keys        KeysFunc
+	temporality *Temporality
+	baselines   deltaBaselines
+	lastFlush   time.Time
+	nextFlush   time.Time
+	zeroed      map[string]time.Time // keyed by metricKey
+	mutex       sync.Mutex
+}
+
+// NewFlusher constructs a new Flusher over the given registry which flushes
+// every interval and evicts stale metrics after gracePeriod.
+func NewFlusher(r Registry, interval time.Duration, gracePeriod time.Duration, keys KeysFunc) *Flusher {
+	return &Flusher{
+		registry:    r,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		keys:        keys,
+		zeroed:      make(map[string]time.Time),
+	}
+}
+
+// Advance moves the event-time clock of the flusher to t.  Flushes are
+// aligned on multiples of the interval: if t crossed the next one, the
+// registry is flushed at t and the emitted keys are returned.  Otherwise
+// Advance returns nil.
+func (f *Flusher) Advance(t time.Time) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.nextFlush.IsZero() {
+		f.nextFlush = t.Truncate(f.interval).Add(f.interval)
+	}
+	if t.Before(f.nextFlush) {
+		return nil
+	}
+	f.nextFlush = t.Truncate(f.interval).Add(f.interval)
+	return f.flush(t)
+}
+
+// Flush walks the registry at time t regardless of the interval and returns
+// the emitted keys.
+func (f *Flusher) Flush(t time.Time) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.flush(t)
+}
+
+// SetTemporality makes the flusher emit the counts of every TemporalMetric,
+// Counters and Meters, with the given temporality rather than their own.
+// The metrics are then wrapped when given to the KeysFunc of the flusher,
+// and deltas are against the counts of its previous flushes, whatever other
+// flushers or GetKeys calls emit.
+func (f *Flusher) SetTemporality(t Temporality) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.temporality = &t
+}
+
+// LastFlush returns the time of the last flush.
+func (f *Flusher) LastFlush() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lastFlush
+}
+
+// Run calls Advance for every time received on c, typically the C of a
+// time.Ticker, and passes the keys of each flush to out.  It returns once c
+// is closed.
+func (f *Flusher) Run(c <-chan time.Time, out func([]string)) {
+	for t := range c {
+		if keys := f.Advance(t); len(keys) > 0 {
+			out(keys)
+		}
+	}
+}
+
+func (f *Flusher) flush(t time.Time) []string {
+	var keys []string
+	var evicted []registryEntry
+	f.registry.Each(func(name string, m Metric) {
+		key := metricKey(name, m.Tags())
+		if m.Stale(t) {
+			zeroedAt, ok := f.zeroed[key]
+			if ok {
+				if t.Sub(zeroedAt) >= f.gracePeriod {
+					evicted = append(evicted, registryEntry{name: name, metric: m})
+				}
+				return
+			}
+			m.ZeroOut()
+			f.zeroed[key] = t
+		} else {
+			delete(f.zeroed, key)
+		}
+
+		if m.PushKeysTime(f.lastFlush) {
+			if tm, ok := m.(TemporalMetric); ok && f.temporality != nil {
+				m = temporalMetric{tm, *f.temporality, &f.baselines, key}
+			}
+			keys = append(keys, f.keys(name, m, t)...)
+		}
+	})
+
+	for _, e := range evicted {
+		f.registry.Unregister(e.name, e.metric.Tags())
+		delete(f.zeroed, metricKey(e.name, e.metric.Tags()))
+		f.baselines.forget(metricKey(e.name, e.metric.Tags()))
+	}
+	f.lastFlush = t
+
+	return keys
+}
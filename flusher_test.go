@@ -0,0 +1,137 @@
+package timemetrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testFormat(name string) string {
+	return "put " + name + ".%s %d %s"
+}
+
+func TestFlusherAdvance(t *testing.T) {
+	r := NewRegistry(60, 1)
+	f := NewFlusher(r, time.Minute, 5*time.Minute, FormatKeys(testFormat, false))
+	start := time.Unix(600, 0)
+
+	GetOrRegisterCounter("foo", r, start).Inc(start, 1)
+	if keys := f.Advance(start); nil != keys {
+		t.Fatal(keys)
+	}
+	if keys := f.Advance(start.Add(30 * time.Second)); nil != keys {
+		t.Fatal(keys)
+	}
+	keys := f.Advance(start.Add(time.Minute))
+	if 1 != len(keys) || "put foo.count 600 1" != keys[0] {
+		t.Fatal(keys)
+	}
+
+	// Nothing changed since the last flush.
+	if keys := f.Advance(start.Add(2 * time.Minute)); 0 != len(keys) {
+		t.Fatal(keys)
+	}
+}
+
+func TestFlusherPushKeysTime(t *testing.T) {
+	r := NewRegistry(60, 10)
+	f := NewFlusher(r, time.Minute, time.Minute, FormatKeys(testFormat, true))
+	start := time.Unix(600, 0)
+
+	GetOrRegisterCounter("foo", r, start).Inc(start, 1)
+	GetOrRegisterCounter("bar", r, start).Inc(start, 1)
+	f.Flush(start.Add(time.Minute))
+
+	GetOrRegisterCounter("foo", r, start).Inc(start.Add(90*time.Second), 1)
+	keys := f.Flush(start.Add(2 * time.Minute))
+	if 1 != len(keys) || "put foo.count 720 2" != keys[0] {
+		t.Fatal(keys)
+	}
+}
+
+func TestFlusherStale(t *testing.T) {
+	r := NewRegistry(60, 1)
+	f := NewFlusher(r, time.Minute, 2*time.Minute, FormatKeys(testFormat, true))
+	start := time.Unix(600, 0)
+
+	m := GetOrRegisterMeter("foo", r, start)
+	m.Mark(start, 10)
+	f.Flush(start.Add(time.Minute))
+	if 0 == m.Rate1() {
+		t.Fatal(m.Rate1())
+	}
+
+	// Stale: zeroed out and its zero rates pushed once.
+	keys := f.Flush(start.Add(3 * time.Minute))
+	if 4 != len(keys) {
+		t.Fatal(keys)
+	}
+	if rate := m.Rate1(); 0 != rate {
+		t.Errorf("m.Rate1(): 0 != %v\n", rate)
+	}
+	if nil == r.Get("foo", nil) {
+		t.Fatal("evicted before the grace period")
+	}
+
+	// Still stale after the grace period: evicted.
+	if keys := f.Flush(start.Add(5 * time.Minute)); 0 != len(keys) {
+		t.Fatal(keys)
+	}
+	if m := r.Get("foo", nil); nil != m {
+		t.Fatal(m)
+	}
+}
+
+func TestFlusherStaleRevived(t *testing.T) {
+	r := NewRegistry(60, 1)
+	f := NewFlusher(r, time.Minute, 2*time.Minute, FormatKeys(testFormat, true))
+	start := time.Unix(600, 0)
+
+	c := GetOrRegisterCounter("foo", r, start)
+	c.Inc(start, 1)
+	f.Flush(start.Add(3 * time.Minute))
+	c.Inc(start.Add(4*time.Minute), 1)
+	f.Flush(start.Add(4 * time.Minute))
+	f.Flush(start.Add(5*time.Minute + time.Second))
+	if nil == r.Get("foo", nil) {
+		t.Fatal("revived metric evicted")
+	}
+}
+
+func TestFlusherRun(t *testing.T) {
+	r := NewRegistry(60, 10)
+	f := NewFlusher(r, time.Minute, time.Minute, FormatKeys(testFormat, false))
+	start := time.Unix(600, 0)
+	GetOrRegisterCounter("foo", r, start).Inc(start, 3)
+
+	c := make(chan time.Time, 3)
+	c <- start
+	c <- start.Add(time.Minute)
+	c <- start.Add(2 * time.Minute)
+	close(c)
+
+	var out []string
+	f.Run(c, func(keys []string) { out = append(out, keys...) })
+	if 1 != len(out) || "put foo.count 600 3" != out[0] {
+		t.Fatal(out)
+	}
+	if last := f.LastFlush(); !last.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("f.LastFlush(): %v != %v\n", start.Add(2*time.Minute), last)
+	}
+}
+
+func ExampleFlusher() {
+	r := NewRegistry(60, 10)
+	f := NewFlusher(r, time.Minute, 10*time.Minute, FormatKeys(func(name string) string {
+		return "put " + name + ".%s %d %s host=example"
+	}, false))
+
+	events := []time.Time{time.Unix(0, 0), time.Unix(30, 0), time.Unix(65, 0)}
+	for _, t := range events {
+		GetOrRegisterCounter("requests", r, t).Inc(t, 1)
+		for _, key := range f.Advance(t) {
+			fmt.Println(key)
+		}
+	}
+	// Output: put requests.count 65 3 host=example
+}
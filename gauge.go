@@ -0,0 +1,180 @@
+package timemetrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Gauges hold the int64 value with the latest event time.  Updates older than
+// the current value are ignored whatever the LatePolicy, which only decides
+// whether those beyond the allowed lateness are routed to a late Counter.
+type Gauge interface {
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
+	SetLateOptions(LateOptions)
+	Update(time.Time, int64)
+	Value() int64
+	GetMaxTime() time.Time
+	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	NbKeys() int
+	Stale(time.Time) bool
+	PushKeysTime(time.Time) bool
+	Tags() Tags
+	ZeroOut()
+}
+
+// GetOrRegisterGauge returns an existing Gauge or constructs and registers a
+// new StandardGauge stamped with the event time t.
+func GetOrRegisterGauge(name string, r Registry, t time.Time) Gauge {
+	return GetOrRegisterTaggedGauge(name, nil, r, t)
+}
+
+// GetOrRegisterTaggedGauge returns an existing Gauge or constructs and
+// registers a new tagged StandardGauge stamped with the event time t.
+func GetOrRegisterTaggedGauge(name string, tags Tags, r Registry, t time.Time) Gauge {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		return NewTaggedGauge(t, staleThreshold, tags)
+	}).(Gauge)
+}
+
+// NewGauge constructs a new StandardGauge.
+func NewGauge(t time.Time, staleThreshold int) Gauge {
+	return NewTaggedGauge(t, staleThreshold, nil)
+}
+
+// NewTaggedGauge constructs a new StandardGauge with the given tags.
+func NewTaggedGauge(t time.Time, staleThreshold int, tags Tags) Gauge {
+	return &StandardGauge{lastUpdate: t, staleThreshold: staleThreshold, tags: copyTags(tags)}
+}
+
+// NewRegisteredGauge constructs and registers a new StandardGauge.  It
+// returns DuplicateMetric if a metric is already registered under name.
+func NewRegisteredGauge(name string, r Registry, t time.Time) (Gauge, error) {
+	return NewRegisteredTaggedGauge(name, nil, r, t)
+}
+
+// NewRegisteredTaggedGauge constructs and registers a new tagged
+// StandardGauge.
+func NewRegisteredTaggedGauge(name string, tags Tags, r Registry, t time.Time) (Gauge, error) {
+	g := NewTaggedGauge(t, r.StaleThreshold(), tags)
+	if err := r.Register(name, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// StandardGauge is the standard implementation of a Gauge and uses a mutex to
+// keep its value and the event time of that value consistent.
+type StandardGauge struct {
+	lateTracker
+	value          int64
+	lastUpdate     time.Time
+	staleThreshold int
+	tags           Tags
+	mutex          sync.Mutex
+}
+
+// Update updates the gauge's value if t is not older than the current value.
+func (g *StandardGauge) Update(t time.Time, v int64) {
+	if !g.admit(t, g.GetMaxTime()) {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if t.Before(g.lastUpdate) {
+		return
+	}
+	g.value = v
+	g.lastUpdate = t
+}
+
+// Value returns the gauge's current value.
+func (g *StandardGauge) Value() int64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value
+}
+
+func (g *StandardGauge) GetMaxTime() time.Time {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.lastUpdate
+}
+
+func (g *StandardGauge) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, g.GetDatapoints(ct, currentTime))
+}
+
+func (g *StandardGauge) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	t := datapointTime(g, ct, currentTime)
+
+	dps := make([]Datapoint, 1)
+	dps[0] = intDatapoint("value", t, GaugeKind, g.Value())
+
+	return tagDatapoints(dps, g.tags)
+}
+
+func (g *StandardGauge) NbKeys() int {
+	return 1
+}
+
+func (g *StandardGauge) Stale(t time.Time) bool {
+	return t.Sub(g.GetMaxTime()) > time.Duration(g.staleThreshold)*time.Minute
+}
+
+func (g *StandardGauge) PushKeysTime(t time.Time) bool {
+	return g.GetMaxTime().After(t)
+}
+
+func (g *StandardGauge) Tags() Tags {
+	return g.tags
+}
+
+func (g *StandardGauge) ZeroOut() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = 0
+}
+
+// gaugeEncodingVersion is the version of the encoding of StandardGauges.
+const gaugeEncodingVersion = 1
+
+// MarshalBinary encodes the gauge, the event time of its value included.
+func (g *StandardGauge) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.putHeader(gaugeEncoding, gaugeEncodingVersion)
+	g.mutex.Lock()
+	w.putVarint(g.value)
+	w.putTimestamp(g.lastUpdate)
+	g.mutex.Unlock()
+	w.putVarint(int64(g.staleThreshold))
+	w.putTags(g.tags)
+	g.lateTracker.marshal(w)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the gauge by the one encoded in data by
+// MarshalBinary.
+func (g *StandardGauge) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(gaugeEncoding, gaugeEncodingVersion)
+	value := r.varint()
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	if err := r.end(); err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = value
+	g.lastUpdate = lastUpdate
+	g.staleThreshold = staleThreshold
+	g.tags = tags
+	g.lateTracker.restore(late, dropped)
+	return nil
+}
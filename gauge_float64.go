@@ -0,0 +1,191 @@
+package timemetrics
+
+import (
+	"sync"
+	"time"
+)
+
+// GaugeFloat64s hold the float64 value with the latest event time.  Updates
+// older than the current value are ignored whatever the LatePolicy, which only
+// decides whether those beyond the allowed lateness are routed to a late
+// Counter.
+type GaugeFloat64 interface {
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
+	SetLateOptions(LateOptions)
+	Update(time.Time, int64)
+	UpdateFloat64(time.Time, float64)
+	Value() float64
+	GetMaxTime() time.Time
+	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	NbKeys() int
+	Stale(time.Time) bool
+	PushKeysTime(time.Time) bool
+	Tags() Tags
+	ZeroOut()
+}
+
+// GetOrRegisterGaugeFloat64 returns an existing GaugeFloat64 or constructs and
+// registers a new StandardGaugeFloat64 stamped with the event time t.
+func GetOrRegisterGaugeFloat64(name string, r Registry, t time.Time) GaugeFloat64 {
+	return GetOrRegisterTaggedGaugeFloat64(name, nil, r, t)
+}
+
+// GetOrRegisterTaggedGaugeFloat64 returns an existing GaugeFloat64 or
+// constructs and registers a new tagged StandardGaugeFloat64 stamped with the
+// event time t.
+func GetOrRegisterTaggedGaugeFloat64(name string, tags Tags, r Registry, t time.Time) GaugeFloat64 {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		return NewTaggedGaugeFloat64(t, staleThreshold, tags)
+	}).(GaugeFloat64)
+}
+
+// NewGaugeFloat64 constructs a new StandardGaugeFloat64.
+func NewGaugeFloat64(t time.Time, staleThreshold int) GaugeFloat64 {
+	return NewTaggedGaugeFloat64(t, staleThreshold, nil)
+}
+
+// NewTaggedGaugeFloat64 constructs a new StandardGaugeFloat64 with the given
+// tags.
+func NewTaggedGaugeFloat64(t time.Time, staleThreshold int, tags Tags) GaugeFloat64 {
+	return &StandardGaugeFloat64{lastUpdate: t, staleThreshold: staleThreshold, tags: copyTags(tags)}
+}
+
+// NewRegisteredGaugeFloat64 constructs and registers a new
+// StandardGaugeFloat64.  It returns DuplicateMetric if a metric is already
+// registered under name.
+func NewRegisteredGaugeFloat64(name string, r Registry, t time.Time) (GaugeFloat64, error) {
+	return NewRegisteredTaggedGaugeFloat64(name, nil, r, t)
+}
+
+// NewRegisteredTaggedGaugeFloat64 constructs and registers a new tagged
+// StandardGaugeFloat64.
+func NewRegisteredTaggedGaugeFloat64(name string, tags Tags, r Registry, t time.Time) (GaugeFloat64, error) {
+	g := NewTaggedGaugeFloat64(t, r.StaleThreshold(), tags)
+	if err := r.Register(name, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// StandardGaugeFloat64 is the standard implementation of a GaugeFloat64 and
+// uses a mutex to keep its value and the event time of that value consistent.
+type StandardGaugeFloat64 struct {
+	lateTracker
+	value          float64
+	lastUpdate     time.Time
+	staleThreshold int
+	tags           Tags
+	mutex          sync.Mutex
+}
+
+// Update updates the gauge's value if t is not older than the current value.
+func (g *StandardGaugeFloat64) Update(t time.Time, v int64) {
+	g.UpdateFloat64(t, float64(v))
+}
+
+// UpdateFloat64 updates the gauge's value if t is not older than the current
+// value.
+func (g *StandardGaugeFloat64) UpdateFloat64(t time.Time, v float64) {
+	if !g.admit(t, g.GetMaxTime()) {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if t.Before(g.lastUpdate) {
+		return
+	}
+	g.value = v
+	g.lastUpdate = t
+}
+
+// Value returns the gauge's current value.
+func (g *StandardGaugeFloat64) Value() float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.value
+}
+
+func (g *StandardGaugeFloat64) GetMaxTime() time.Time {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.lastUpdate
+}
+
+func (g *StandardGaugeFloat64) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, g.GetDatapoints(ct, currentTime))
+}
+
+func (g *StandardGaugeFloat64) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	t := datapointTime(g, ct, currentTime)
+
+	dps := make([]Datapoint, 1)
+	dps[0] = floatDatapoint("value", t, GaugeKind, g.Value())
+
+	return tagDatapoints(dps, g.tags)
+}
+
+func (g *StandardGaugeFloat64) NbKeys() int {
+	return 1
+}
+
+func (g *StandardGaugeFloat64) Stale(t time.Time) bool {
+	return t.Sub(g.GetMaxTime()) > time.Duration(g.staleThreshold)*time.Minute
+}
+
+func (g *StandardGaugeFloat64) PushKeysTime(t time.Time) bool {
+	return g.GetMaxTime().After(t)
+}
+
+func (g *StandardGaugeFloat64) Tags() Tags {
+	return g.tags
+}
+
+func (g *StandardGaugeFloat64) ZeroOut() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = 0
+}
+
+// gaugeFloat64EncodingVersion is the version of the encoding of StandardGaugeFloat64s.
+const gaugeFloat64EncodingVersion = 1
+
+// MarshalBinary encodes the gauge, the event time of its value included.
+func (g *StandardGaugeFloat64) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.putHeader(gaugeFloat64Encoding, gaugeFloat64EncodingVersion)
+	g.mutex.Lock()
+	w.putFloat64(g.value)
+	w.putTimestamp(g.lastUpdate)
+	g.mutex.Unlock()
+	w.putVarint(int64(g.staleThreshold))
+	w.putTags(g.tags)
+	g.lateTracker.marshal(w)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the gauge by the one encoded in data by
+// MarshalBinary.
+func (g *StandardGaugeFloat64) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(gaugeFloat64Encoding, gaugeFloat64EncodingVersion)
+	value := r.float64()
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	if err := r.end(); err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.value = value
+	g.lastUpdate = lastUpdate
+	g.staleThreshold = staleThreshold
+	g.tags = tags
+	g.lateTracker.restore(late, dropped)
+	return nil
+}
@@ -0,0 +1,62 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func BenchmarkGaugeFloat64(b *testing.B) {
+	g := NewGaugeFloat64(time.Unix(0, 0), 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.UpdateFloat64(time.Unix(int64(i), 0), float64(i))
+	}
+}
+
+func TestGaugeFloat64(t *testing.T) {
+	g := NewGaugeFloat64(time.Unix(0, 0), 10)
+	g.UpdateFloat64(time.Unix(10, 0), 47.5)
+	if v := g.Value(); 47.5 != v {
+		t.Errorf("g.Value(): 47.5 != %v\n", v)
+	}
+	g.Update(time.Unix(11, 0), 3)
+	if v := g.Value(); 3.0 != v {
+		t.Errorf("g.Value(): 3.0 != %v\n", v)
+	}
+}
+
+func TestGaugeFloat64OutOfOrder(t *testing.T) {
+	g := NewGaugeFloat64(time.Unix(0, 0), 10)
+	g.UpdateFloat64(time.Unix(20, 0), 2.5)
+	g.UpdateFloat64(time.Unix(10, 0), 1.5)
+	if v := g.Value(); 2.5 != v {
+		t.Errorf("g.Value(): 2.5 != %v\n", v)
+	}
+}
+
+func TestGaugeFloat64GetDatapoints(t *testing.T) {
+	g := NewTaggedGaugeFloat64(time.Unix(0, 0), 10, Tags{"host": "web1"})
+	g.UpdateFloat64(time.Unix(10, 0), 0.25)
+	dps := g.GetDatapoints(time.Unix(30, 0), true)
+	if 1 != len(dps) || GaugeKind != dps[0].Kind || !dps[0].IsFloat || 0.25 != dps[0].Float {
+		t.Fatal(dps)
+	}
+	keys := g.GetKeys(time.Unix(30, 0), "put foo.%s %d %s", false)
+	if !reflect.DeepEqual([]string{"put foo.value 10 0.250000 host=web1"}, keys) {
+		t.Fatal(keys)
+	}
+}
+
+func TestGetOrRegisterGaugeFloat64(t *testing.T) {
+	r := NewRegistry(60, 10)
+	now := time.Unix(10, 0)
+	g, err := NewRegisteredGaugeFloat64("foo", r, now)
+	if nil != err {
+		t.Fatal(err)
+	}
+	g.UpdateFloat64(now, 47.5)
+	if g := GetOrRegisterGaugeFloat64("foo", r, now); 47.5 != g.Value() {
+		t.Fatal(g)
+	}
+}
@@ -0,0 +1,68 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func BenchmarkGauge(b *testing.B) {
+	g := NewGauge(time.Unix(0, 0), 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Update(time.Unix(int64(i), 0), int64(i))
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge(time.Unix(0, 0), 10)
+	g.Update(time.Unix(10, 0), 47)
+	if v := g.Value(); 47 != v {
+		t.Errorf("g.Value(): 47 != %v\n", v)
+	}
+}
+
+func TestGaugeOutOfOrder(t *testing.T) {
+	g := NewGauge(time.Unix(0, 0), 10)
+	g.Update(time.Unix(20, 0), 2)
+	g.Update(time.Unix(10, 0), 1)
+	if v := g.Value(); 2 != v {
+		t.Errorf("g.Value(): 2 != %v\n", v)
+	}
+	if maxTime := g.GetMaxTime(); !maxTime.Equal(time.Unix(20, 0)) {
+		t.Errorf("g.GetMaxTime(): 20 != %v\n", maxTime.Unix())
+	}
+	g.Update(time.Unix(20, 0), 3)
+	if v := g.Value(); 3 != v {
+		t.Errorf("g.Value(): 3 != %v\n", v)
+	}
+}
+
+func TestGaugeStaleZeroOut(t *testing.T) {
+	g := NewGauge(time.Unix(0, 0), 1)
+	g.Update(time.Unix(10, 0), 5)
+	if !g.PushKeysTime(time.Unix(0, 0)) || g.PushKeysTime(time.Unix(10, 0)) {
+		t.Error("g.PushKeysTime()")
+	}
+	if g.Stale(time.Unix(70, 0)) || !g.Stale(time.Unix(71, 0)) {
+		t.Error("g.Stale()")
+	}
+	g.ZeroOut()
+	keys := g.GetKeys(time.Unix(80, 0), "put foo.%s %d %s", false)
+	if !reflect.DeepEqual([]string{"put foo.value 10 0"}, keys) {
+		t.Fatal(keys)
+	}
+}
+
+func TestGetOrRegisterGauge(t *testing.T) {
+	r := NewRegistry(60, 10)
+	now := time.Unix(10, 0)
+	g, err := NewRegisteredGauge("foo", r, now)
+	if nil != err {
+		t.Fatal(err)
+	}
+	g.Update(now, 47)
+	if g := GetOrRegisterGauge("foo", r, now); 47 != g.Value() {
+		t.Fatal(g)
+	}
+}
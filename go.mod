@@ -0,0 +1,3 @@
+module github.com/mathpl/go-timemetrics
+
+go 1.24
@@ -0,0 +1,408 @@
+package timemetrics
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HDRSample is a Sample backed by an HdrHistogram: every value is counted in
+// a bucket whose width keeps its relative error within the configured number
+// of significant digits, so percentiles are bounded-error over the whole
+// stream rather than reservoir estimates.  Min, max, count, sum, mean and
+// variance are exact.  See Gil Tene's HdrHistogram.
+//
+// <http://hdrhistogram.org/>
+//
+// Values below zero are counted as zero and values above the highest
+// trackable value as that value in the buckets, while the exact statistics
+// still see them as they are.
+type HDRSample struct {
+	count                       int64 // /!\ this should be the first member to ensure 64-bit alignment
+	lowest                      int64
+	highest                     int64
+	significantFigures          int
+	unitMagnitude               uint
+	subBucketHalfCountMagnitude uint
+	subBucketCount              int
+	subBucketHalfCount          int
+	subBucketMask               int64
+	counts                      []int64
+	stats                       sampleStats
+	mutex                       sync.Mutex
+}
+
+// NewHDRSample constructs a new HDRSample tracking values from lowest, the
+// smallest value to tell apart from zero, to highest, with the given number
+// of significant figures between 1 and 5.  Out of range arguments are clamped.
+func NewHDRSample(lowest int64, highest int64, significantFigures int) Sample {
+	if significantFigures < 1 {
+		significantFigures = 1
+	} else if significantFigures > 5 {
+		significantFigures = 5
+	}
+	subBucketCountMagnitude := hdrSubBucketCountMagnitude(significantFigures)
+	if lowest < 1 {
+		lowest = 1
+	} else if hdrMaxMagnitude < hdrUnitMagnitude(lowest)+subBucketCountMagnitude {
+		lowest = 1<<(hdrMaxMagnitude-subBucketCountMagnitude+1) - 1
+	}
+	if highest/2 < lowest {
+		highest = 2 * lowest
+	}
+
+	s := &HDRSample{
+		lowest:             lowest,
+		highest:            highest,
+		significantFigures: significantFigures,
+	}
+
+	s.subBucketHalfCountMagnitude = subBucketCountMagnitude - 1
+	s.unitMagnitude = hdrUnitMagnitude(lowest)
+	s.subBucketCount = 1 << (s.subBucketHalfCountMagnitude + 1)
+	s.subBucketHalfCount = s.subBucketCount / 2
+	s.subBucketMask = int64(s.subBucketCount-1) << s.unitMagnitude
+
+	// Each bucket covers twice the range of the previous one.
+	smallestUntrackable := int64(s.subBucketCount) << s.unitMagnitude
+	bucketCount := 1
+	for smallestUntrackable <= highest {
+		if smallestUntrackable > math.MaxInt64/2 {
+			bucketCount++
+			break
+		}
+		smallestUntrackable <<= 1
+		bucketCount++
+	}
+	s.counts = make([]int64, (bucketCount+1)*s.subBucketHalfCount)
+	s.reset()
+
+	return s
+}
+
+// hdrMaxMagnitude is the largest magnitude of the values a sub-bucket of an
+// HDRSample may cover, so that bucket bounds fit an int64.
+const hdrMaxMagnitude = 62
+
+// hdrSubBucketCountMagnitude returns the magnitude of the number of
+// sub-buckets of an HDRSample with the given significant figures.
+func hdrSubBucketCountMagnitude(significantFigures int) uint {
+	largestSingleUnit := 2 * int64(math.Pow10(significantFigures))
+	return uint(math.Ceil(math.Log2(float64(largestSingleUnit))))
+}
+
+// hdrUnitMagnitude returns the magnitude of the smallest value an HDRSample
+// tells apart from zero.
+func hdrUnitMagnitude(lowest int64) uint {
+	return uint(bits.Len64(uint64(lowest)) - 1)
+}
+
+// Clear clears all samples.
+func (s *HDRSample) Clear(time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, 0)
+	s.reset()
+}
+
+// Count returns the number of samples recorded.
+func (s *HDRSample) Count() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+// Max returns the exact maximum value recorded.
+func (s *HDRSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.maxValue()
+}
+
+// Mean returns the exact mean of the values recorded.
+func (s *HDRSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.mean
+}
+
+// Min returns the exact minimum value recorded.
+func (s *HDRSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.minValue()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded, within
+// the relative error of the significant figures.
+func (s *HDRSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (s *HDRSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	scores := make([]float64, len(ps))
+	if 0 == s.stats.n {
+		return scores
+	}
+	for i, p := range ps {
+		scores[i] = float64(s.valueAtPercentile(p))
+	}
+	return scores
+}
+
+// SignificantFigures returns the number of significant figures percentiles
+// are accurate to.
+func (s *HDRSample) SignificantFigures() int {
+	return s.significantFigures
+}
+
+// Size returns the number of values in the buckets.
+func (s *HDRSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(s.stats.n)
+}
+
+// StdDev returns the exact standard deviation of the values recorded.
+func (s *HDRSample) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+// Sum returns the exact sum of the values recorded.
+func (s *HDRSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.sum
+}
+
+// Update records a new value.
+func (s *HDRSample) Update(t time.Time, v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, 1)
+	s.stats.update(v)
+
+	if v < 0 {
+		v = 0
+	} else if v > s.highest {
+		v = s.highest
+	}
+	s.counts[s.countsIndex(v)]++
+}
+
+// Values returns the values in the buckets, each the median of the values
+// its bucket stands for.  It allocates Size values: prefer the other
+// methods.
+func (s *HDRSample) Values() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values := make([]int64, 0, s.stats.n)
+	for i, c := range s.counts {
+		if 0 == c {
+			continue
+		}
+		v := s.medianEquivalentValue(s.valueFromIndex(i))
+		for ; c > 0; c-- {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Variance returns the exact variance of the values recorded.
+func (s *HDRSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.variance()
+}
+
+func (s *HDRSample) GetWindow() time.Duration {
+	return 0
+}
+
+func (s *HDRSample) ZeroOut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reset()
+}
+
+// hdrEncodingVersion is the version of the encoding of HDRSamples.
+const hdrEncodingVersion = 1
+
+// MarshalBinary encodes the sample: its range and significant figures, count,
+// exact statistics, then the non-empty buckets as varint index deltas and
+// counts.
+func (s *HDRSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w := &binaryWriter{}
+	w.putHeader(hdrEncoding, hdrEncodingVersion)
+	w.putUvarint(uint64(s.lowest))
+	w.putUvarint(uint64(s.highest))
+	w.putUvarint(uint64(s.significantFigures))
+	w.putUvarint(uint64(atomic.LoadInt64(&s.count)))
+	s.stats.marshal(w)
+
+	buckets := 0
+	for _, c := range s.counts {
+		if c > 0 {
+			buckets++
+		}
+	}
+	w.putUvarint(uint64(buckets))
+	previous := 0
+	for i, c := range s.counts {
+		if c > 0 {
+			w.putUvarint(uint64(i - previous))
+			w.putUvarint(uint64(c))
+			previous = i
+		}
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the sample by the one encoded in data by
+// MarshalBinary.
+func (s *HDRSample) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(hdrEncoding, hdrEncodingVersion)
+	lowest := int64(r.uvarint())
+	highest := int64(r.uvarint())
+	significantFigures := int(r.uvarint())
+	count := r.uvarint()
+	var stats sampleStats
+	stats.unmarshal(r)
+	if r.err != nil {
+		return r.err
+	}
+	if lowest < 1 || highest/2 < lowest || significantFigures < 1 || significantFigures > 5 ||
+		hdrMaxMagnitude < hdrUnitMagnitude(lowest)+hdrSubBucketCountMagnitude(significantFigures) {
+		return InvalidEncoding(fmt.Sprintf("range %d to %d with %d significant figures", lowest, highest, significantFigures))
+	}
+
+	decoded := NewHDRSample(lowest, highest, significantFigures).(*HDRSample)
+	index := 0
+	for n := r.count(2); n > 0 && r.err == nil; n-- {
+		index += int(r.uvarint())
+		c := int64(r.uvarint())
+		if r.err == nil && index >= len(decoded.counts) {
+			return InvalidEncoding(fmt.Sprintf("bucket %d out of %d", index, len(decoded.counts)))
+		}
+		if r.err == nil {
+			decoded.counts[index] = c
+		}
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, int64(count))
+	s.lowest = decoded.lowest
+	s.highest = decoded.highest
+	s.significantFigures = decoded.significantFigures
+	s.unitMagnitude = decoded.unitMagnitude
+	s.subBucketHalfCountMagnitude = decoded.subBucketHalfCountMagnitude
+	s.subBucketCount = decoded.subBucketCount
+	s.subBucketHalfCount = decoded.subBucketHalfCount
+	s.subBucketMask = decoded.subBucketMask
+	s.counts = decoded.counts
+	s.stats = stats
+	return nil
+}
+
+// reset empties the buckets and the exact statistics, with the mutex held.
+func (s *HDRSample) reset() {
+	for i := range s.counts {
+		s.counts[i] = 0
+	}
+	s.stats.reset()
+}
+
+// valueAtPercentile returns the highest value equivalent to the bucket in
+// which the cumulated count reaches p of the values, bounded by the exact
+// min and max, with the mutex held.
+func (s *HDRSample) valueAtPercentile(p float64) int64 {
+	if p < 0 {
+		p = 0
+	} else if p > 1 {
+		p = 1
+	}
+	target := int64(p*float64(s.stats.n) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+
+	var total int64
+	for i, c := range s.counts {
+		total += c
+		if total >= target {
+			v := s.highestEquivalentValue(s.valueFromIndex(i))
+			if v > s.stats.max {
+				v = s.stats.max
+			}
+			if v < s.stats.min {
+				v = s.stats.min
+			}
+			return v
+		}
+	}
+	return s.stats.max
+}
+
+func (s *HDRSample) bucketIndex(v int64) int {
+	pow2Ceiling := bits.Len64(uint64(v | s.subBucketMask))
+	return pow2Ceiling - int(s.unitMagnitude) - int(s.subBucketHalfCountMagnitude+1)
+}
+
+func (s *HDRSample) subBucketIndex(v int64, bucketIdx int) int {
+	return int(v >> (uint(bucketIdx) + s.unitMagnitude))
+}
+
+func (s *HDRSample) countsIndex(v int64) int {
+	bucketIdx := s.bucketIndex(v)
+	subBucketIdx := s.subBucketIndex(v, bucketIdx)
+	bucketBaseIdx := (bucketIdx + 1) << s.subBucketHalfCountMagnitude
+	return bucketBaseIdx + subBucketIdx - s.subBucketHalfCount
+}
+
+// valueFromIndex returns the lowest value counted at index i of the counts.
+func (s *HDRSample) valueFromIndex(i int) int64 {
+	bucketIdx := (i >> s.subBucketHalfCountMagnitude) - 1
+	subBucketIdx := (i & (s.subBucketHalfCount - 1)) + s.subBucketHalfCount
+	if bucketIdx < 0 {
+		subBucketIdx -= s.subBucketHalfCount
+		bucketIdx = 0
+	}
+	return int64(subBucketIdx) << (uint(bucketIdx) + s.unitMagnitude)
+}
+
+// equivalentRange returns the number of values counted in the same bucket as
+// v.
+func (s *HDRSample) equivalentRange(v int64) int64 {
+	bucketIdx := s.bucketIndex(v)
+	if s.subBucketIndex(v, bucketIdx) >= s.subBucketCount {
+		bucketIdx++
+	}
+	return 1 << (s.unitMagnitude + uint(bucketIdx))
+}
+
+func (s *HDRSample) lowestEquivalentValue(v int64) int64 {
+	bucketIdx := s.bucketIndex(v)
+	subBucketIdx := s.subBucketIndex(v, bucketIdx)
+	return int64(subBucketIdx) << (uint(bucketIdx) + s.unitMagnitude)
+}
+
+func (s *HDRSample) highestEquivalentValue(v int64) int64 {
+	return s.lowestEquivalentValue(v) + s.equivalentRange(v) - 1
+}
+
+func (s *HDRSample) medianEquivalentValue(v int64) int64 {
+	return s.lowestEquivalentValue(v) + s.equivalentRange(v)>>1
+}
@@ -0,0 +1,139 @@
+package timemetrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestHDRSampleExact(t *testing.T) {
+	s := NewHDRSample(1, 3600*1000*1000, 3)
+	for i := 1; i <= 10000; i++ {
+		s.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	s.Update(time.Unix(10001, 0), 123456789)
+	if count := s.Count(); 10001 != count {
+		t.Errorf("s.Count(): 10001 != %v\n", count)
+	}
+	if size := s.Size(); 10001 != size {
+		t.Errorf("s.Size(): 10001 != %v\n", size)
+	}
+	if min := s.Min(); 1 != min {
+		t.Errorf("s.Min(): 1 != %v\n", min)
+	}
+	if max := s.Max(); 123456789 != max {
+		t.Errorf("s.Max(): 123456789 != %v\n", max)
+	}
+	if sum := s.Sum(); 50005000+123456789 != sum {
+		t.Errorf("s.Sum(): %v != %v\n", 50005000+123456789, sum)
+	}
+	if mean := s.Mean(); math.Abs(float64(50005000+123456789)/10001-mean) > 1e-6 {
+		t.Errorf("s.Mean(): %v != %v\n", float64(50005000+123456789)/10001, mean)
+	}
+	if p := s.Percentile(1); 123456789 != p {
+		t.Errorf("s.Percentile(1): 123456789 != %v\n", p)
+	}
+}
+
+func TestHDRSamplePercentiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]int64, 100000)
+	s := NewHDRSample(1, 3600*1000*1000, 3)
+	for i := range values {
+		values[i] = r.Int63n(10 * 1000 * 1000)
+		s.Update(time.Unix(int64(i), 0), values[i])
+	}
+	ps := []float64{0.5, 0.75, 0.99, 0.999}
+	exact := SamplePercentiles(values, ps)
+	for i, p := range s.Percentiles(ps) {
+		if math.Abs(p-exact[i])/exact[i] > 0.001 {
+			t.Errorf("s.Percentile(%v): %v too far from %v\n", ps[i], p, exact[i])
+		}
+	}
+}
+
+func TestHDRSampleSignificantFigures(t *testing.T) {
+	s := NewHDRSample(1, 1000*1000, 1)
+	s.Update(time.Unix(0, 0), 1000)
+	s.Update(time.Unix(0, 0), 1049)
+	if p := s.Percentile(0.5); math.Abs(p-1000)/1000 > 0.1 {
+		t.Errorf("s.Percentile(0.5): %v too far from 1000\n", p)
+	}
+	if sf := s.(*HDRSample).SignificantFigures(); 1 != sf {
+		t.Errorf("s.SignificantFigures(): 1 != %v\n", sf)
+	}
+}
+
+func TestHDRSampleOutOfRange(t *testing.T) {
+	s := NewHDRSample(1, 1000, 2)
+	s.Update(time.Unix(0, 0), -5)
+	s.Update(time.Unix(0, 0), 5000)
+	if min := s.Min(); -5 != min {
+		t.Errorf("s.Min(): -5 != %v\n", min)
+	}
+	if max := s.Max(); 5000 != max {
+		t.Errorf("s.Max(): 5000 != %v\n", max)
+	}
+	if values := s.Values(); 2 != len(values) || 0 != values[0] || 1000 > values[1] {
+		t.Errorf("s.Values(): [0 ~1000] != %v\n", values)
+	}
+}
+
+func TestHDRSampleLargeLowest(t *testing.T) {
+	s := NewHDRSample(1<<62, math.MaxInt64, 3).(*HDRSample)
+	if 62 < s.unitMagnitude+s.subBucketHalfCountMagnitude+1 {
+		t.Errorf("s.unitMagnitude: %v overflows\n", s.unitMagnitude)
+	}
+	s.Update(time.Unix(0, 0), math.MaxInt64)
+	if values := s.Values(); 1 != len(values) || 0 >= values[0] {
+		t.Errorf("s.Values(): [~MaxInt64] != %v\n", values)
+	}
+
+	w := &binaryWriter{}
+	w.putHeader(hdrEncoding, hdrEncodingVersion)
+	w.putUvarint(1 << 62)
+	w.putUvarint(math.MaxInt64)
+	w.putUvarint(3)
+	w.putUvarint(0)
+	var stats sampleStats
+	stats.marshal(w)
+	w.putUvarint(0)
+	if err := (&HDRSample{}).UnmarshalBinary(w.buf); nil == err {
+		t.Error("s.UnmarshalBinary(): expected an InvalidEncoding\n")
+	} else if _, ok := err.(InvalidEncoding); !ok {
+		t.Errorf("s.UnmarshalBinary(): %v is not an InvalidEncoding\n", err)
+	}
+}
+
+func TestHDRSampleZeroOut(t *testing.T) {
+	s := NewHDRSample(1, 1000, 3)
+	s.Update(time.Unix(0, 0), 10)
+	s.ZeroOut()
+	if size := s.Size(); 0 != size {
+		t.Errorf("s.Size(): 0 != %v\n", size)
+	}
+	if count := s.Count(); 1 != count {
+		t.Errorf("s.Count(): 1 != %v\n", count)
+	}
+	if max := s.Max(); 0 != max {
+		t.Errorf("s.Max(): 0 != %v\n", max)
+	}
+	s.Clear(time.Unix(0, 0))
+	if count := s.Count(); 0 != count {
+		t.Errorf("s.Count(): 0 != %v\n", count)
+	}
+}
+
+func TestHDRSampleHistogram(t *testing.T) {
+	h := NewHistogram(NewHDRSample(1, 1000*1000, 3), 10)
+	for i := 1; i <= 1000; i++ {
+		h.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	if max := h.Max(); 1000 != max {
+		t.Errorf("h.Max(): 1000 != %v\n", max)
+	}
+	if p := h.Percentile(0.99); 990 != p {
+		t.Errorf("h.Percentile(0.99): 990 != %v\n", p)
+	}
+}
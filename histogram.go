@@ -1,7 +1,9 @@
 package timemetrics
 
 import (
-	"fmt"
+	"encoding"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -9,34 +11,103 @@ import (
 type Histogram interface {
 	Clear(time.Time)
 	Count() int64
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
 	Max() int64
 	Mean() float64
 	Min() int64
 	Percentile(float64) float64
 	Percentiles([]float64) []float64
+	Options() HistogramOptions
 	Sample() Sample
+	SetLateOptions(LateOptions)
 	StdDev() float64
 	Update(time.Time, int64)
 	Variance() float64
 	GetMaxTime() time.Time
 	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
 	NbKeys() int
 	Stale(time.Time) bool
 	PushKeysTime(time.Time) bool
+	Tags() Tags
 	ZeroOut()
 }
 
 // StandardHistogram is the standard implementation of a Histogram and uses a
 // Sample to bound its memory use.
 type StandardHistogram struct {
+	lateTracker
 	sample         Sample
 	lastUpdate     time.Time
 	staleThreshold int
+	tags           Tags
+	options        HistogramOptions
+	mutex          sync.Mutex
+}
+
+// GetOrRegisterHistogram returns an existing Histogram or constructs and
+// registers a new StandardHistogram.
+func GetOrRegisterHistogram(name string, r Registry, t time.Time, s Sample) Histogram {
+	return GetOrRegisterTaggedHistogram(name, nil, r, t, s)
+}
+
+// GetOrRegisterTaggedHistogram returns an existing Histogram or constructs and
+// registers a new tagged StandardHistogram.
+func GetOrRegisterTaggedHistogram(name string, tags Tags, r Registry, t time.Time, s Sample) Histogram {
+	return GetOrRegisterHistogramWithOptions(name, tags, r, t, s, DefaultHistogramOptions())
+}
+
+// GetOrRegisterHistogramWithOptions returns an existing Histogram or
+// constructs and registers a new tagged StandardHistogram emitting the keys
+// selected by opts.
+func GetOrRegisterHistogramWithOptions(name string, tags Tags, r Registry, t time.Time, s Sample, opts HistogramOptions) Histogram {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		h := NewHistogramWithOptions(s, staleThreshold, tags, opts).(*StandardHistogram)
+		h.lastUpdate = t
+		return h
+	}).(Histogram)
 }
 
 // NewHistogram constructs a new StandardHistogram from a Sample.
 func NewHistogram(s Sample, staleThreshold int) Histogram {
-	return &StandardHistogram{sample: s, staleThreshold: staleThreshold}
+	return NewTaggedHistogram(s, staleThreshold, nil)
+}
+
+// NewTaggedHistogram constructs a new StandardHistogram with the given tags
+// from a Sample.
+func NewTaggedHistogram(s Sample, staleThreshold int, tags Tags) Histogram {
+	return NewHistogramWithOptions(s, staleThreshold, tags, DefaultHistogramOptions())
+}
+
+// NewHistogramWithOptions constructs a new tagged StandardHistogram from a
+// Sample, emitting the keys selected by opts.
+func NewHistogramWithOptions(s Sample, staleThreshold int, tags Tags, opts HistogramOptions) Histogram {
+	return &StandardHistogram{
+		sample:         s,
+		staleThreshold: staleThreshold,
+		tags:           copyTags(tags),
+		options:        opts.copy(),
+	}
+}
+
+// NewRegisteredHistogram constructs and registers a new StandardHistogram from
+// a Sample, stamped with the event time t.  It returns DuplicateMetric if a
+// metric is already registered under name.
+func NewRegisteredHistogram(name string, r Registry, t time.Time, s Sample) (Histogram, error) {
+	return NewRegisteredTaggedHistogram(name, nil, r, t, s)
+}
+
+// NewRegisteredTaggedHistogram constructs and registers a new tagged
+// StandardHistogram from a Sample, stamped with the event time t.
+func NewRegisteredTaggedHistogram(name string, tags Tags, r Registry, t time.Time, s Sample) (Histogram, error) {
+	h := NewTaggedHistogram(s, r.StaleThreshold(), tags).(*StandardHistogram)
+	h.lastUpdate = t
+	if err := r.Register(name, h); err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
 // Clear clears the histogram and its sample.
@@ -66,52 +137,50 @@ func (h *StandardHistogram) Percentiles(ps []float64) []float64 {
 	return h.sample.Percentiles(ps)
 }
 
+// Options returns the selection of keys emitted by the histogram.
+func (h *StandardHistogram) Options() HistogramOptions { return h.options.copy() }
+
 // Sample returns the Sample underlying the histogram.
 func (h *StandardHistogram) Sample() Sample { return h.sample }
 
 // StdDev returns the standard deviation of the values in the sample.
 func (h *StandardHistogram) StdDev() float64 { return h.sample.StdDev() }
 
-// Update samples a new value.
+// Update samples a new value, unless t is late and the late policy discards
+// it.
 func (h *StandardHistogram) Update(t time.Time, v int64) {
+	if !h.admit(t, h.GetMaxTime()) {
+		return
+	}
+	h.mutex.Lock()
 	if t.After(h.lastUpdate) {
 		h.lastUpdate = t
 	}
+	h.mutex.Unlock()
 	h.sample.Update(t, v)
 }
 
 // Variance returns the variance of the values in the sample.
 func (h *StandardHistogram) Variance() float64 { return h.sample.Variance() }
 
-func (h *StandardHistogram) GetMaxTime() time.Time { return h.lastUpdate }
+func (h *StandardHistogram) GetMaxTime() time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.lastUpdate
+}
 
 func (h *StandardHistogram) GetKeys(ct time.Time, name string, currentTime bool) []string {
-	var t int64
-	if currentTime {
-		t = ct.Unix()
-	} else {
-		t = h.GetMaxTime().Unix()
-	}
-	ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
-
-	keys := make([]string, 10)
-
-	keys[0] = fmt.Sprintf(name, "min", t, fmt.Sprintf("%d", h.Min()))
-	keys[1] = fmt.Sprintf(name, "max", t, fmt.Sprintf("%d", h.Max()))
-	keys[2] = fmt.Sprintf(name, "mean", t, fmt.Sprintf("%.6f", h.Mean()))
-	keys[3] = fmt.Sprintf(name, "std-dev", t, fmt.Sprintf("%.6f", h.StdDev()))
-	keys[4] = fmt.Sprintf(name, "p50", t, fmt.Sprintf("%d", int64(ps[0])))
-	keys[5] = fmt.Sprintf(name, "p75", t, fmt.Sprintf("%d", int64(ps[1])))
-	keys[6] = fmt.Sprintf(name, "p95", t, fmt.Sprintf("%d", int64(ps[2])))
-	keys[7] = fmt.Sprintf(name, "p99", t, fmt.Sprintf("%d", int64(ps[3])))
-	keys[8] = fmt.Sprintf(name, "p999", t, fmt.Sprintf("%d", int64(ps[4])))
-	keys[9] = fmt.Sprintf(name, "sample_size", t, fmt.Sprintf("%d", h.Sample().Size()))
+	return formatDatapoints(name, h.GetDatapoints(ct, currentTime))
+}
 
-	return keys
+func (h *StandardHistogram) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	t := datapointTime(h, ct, currentTime)
+	dps := h.options.datapoints(h, t, HistogramKind, 0)
+	return tagDatapoints(dps, h.tags)
 }
 
 func (h *StandardHistogram) NbKeys() int {
-	return 10
+	return h.options.nbKeys()
 }
 
 func (h *StandardHistogram) Stale(t time.Time) bool {
@@ -119,9 +188,74 @@ func (h *StandardHistogram) Stale(t time.Time) bool {
 }
 
 func (h *StandardHistogram) PushKeysTime(t time.Time) bool {
-	return h.lastUpdate.After(t)
+	return h.GetMaxTime().After(t)
+}
+
+func (h *StandardHistogram) Tags() Tags {
+	return h.tags
 }
 
 func (h *StandardHistogram) ZeroOut() {
 	h.sample.ZeroOut()
 }
+
+// histogramEncodingVersion is the version of the encoding of
+// StandardHistograms.
+const histogramEncodingVersion = 1
+
+// MarshalBinary encodes the histogram and its sample, which must be one of
+// this package.
+func (h *StandardHistogram) MarshalBinary() ([]byte, error) {
+	sample, err := snapshot(h.sample)
+	if err != nil {
+		return nil, err
+	}
+	w := &binaryWriter{}
+	w.putHeader(histogramEncoding, histogramEncodingVersion)
+	w.putTimestamp(h.GetMaxTime())
+	w.putVarint(int64(h.staleThreshold))
+	w.putTags(h.tags)
+	h.options.marshal(w)
+	h.lateTracker.marshal(w)
+	w.putBytes(sample)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the histogram and its sample by the ones encoded
+// in data by MarshalBinary.  It must not run concurrently with updates.
+func (h *StandardHistogram) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(histogramEncoding, histogramEncodingVersion)
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	options := unmarshalHistogramOptions(r)
+	late, dropped := unmarshalLateCounts(r)
+	encoded := r.bytes()
+	if err := r.end(); err != nil {
+		return err
+	}
+	sample, err := unmarshalSample(encoded)
+	if err != nil {
+		return err
+	}
+
+	// A sample of the same type is restored in place, so that references to
+	// it from Sample stay valid.
+	if reflect.TypeOf(h.sample) == reflect.TypeOf(sample) {
+		if err := h.sample.(encoding.BinaryUnmarshaler).UnmarshalBinary(encoded); err != nil {
+			return err
+		}
+	} else {
+		h.sample = sample
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastUpdate = lastUpdate
+	h.staleThreshold = staleThreshold
+	h.tags = tags
+	h.options = options
+	h.lateTracker.restore(late, dropped)
+	return nil
+}
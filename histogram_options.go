@@ -0,0 +1,126 @@
+package timemetrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistogramStat selects statistics emitted by a Histogram, other than its
+// percentiles.
+type HistogramStat int
+
+const (
+	StatMin HistogramStat = 1 << iota
+	StatMax
+	StatMean
+	StatStdDev
+	StatSampleSize
+
+	DefaultHistogramStats = StatMin | StatMax | StatMean | StatStdDev | StatSampleSize
+)
+
+// DefaultPercentiles are the percentiles emitted by default.
+var DefaultPercentiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// HistogramOptions select the keys emitted by a Histogram: the statistics in
+// Stats and, named after them, the Percentiles (0.99 is emitted as "p99",
+// 0.9999 as "p9999").
+type HistogramOptions struct {
+	Stats       HistogramStat
+	Percentiles []float64
+}
+
+// DefaultHistogramOptions returns the options emitting min, max, mean,
+// std-dev, p50, p75, p95, p99, p999 and sample_size.
+func DefaultHistogramOptions() HistogramOptions {
+	return HistogramOptions{
+		Stats:       DefaultHistogramStats,
+		Percentiles: DefaultPercentiles,
+	}.copy()
+}
+
+// PercentileSuffix returns the key suffix a percentile is emitted under, e.g.
+// "p50" for 0.5 or "p999" for 0.999.
+func PercentileSuffix(p float64) string {
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	if p >= 1 || !strings.HasPrefix(s, "0.") {
+		return "p" + strconv.FormatFloat(p*100, 'f', -1, 64)
+	}
+	digits := s[2:]
+	if len(digits) < 2 {
+		digits += "0"
+	}
+	return "p" + digits
+}
+
+func (o HistogramOptions) copy() HistogramOptions {
+	ps := make([]float64, len(o.Percentiles))
+	copy(ps, o.Percentiles)
+	return HistogramOptions{Stats: o.Stats, Percentiles: ps}
+}
+
+func (o HistogramOptions) nbKeys() int {
+	n := len(o.Percentiles)
+	for s := o.Stats; s != 0; s &= s - 1 {
+		n++
+	}
+	return n
+}
+
+func (o HistogramOptions) marshal(w *binaryWriter) {
+	w.putUvarint(uint64(o.Stats))
+	w.putUvarint(uint64(len(o.Percentiles)))
+	for _, p := range o.Percentiles {
+		w.putFloat64(p)
+	}
+}
+
+func unmarshalHistogramOptions(r *binaryReader) HistogramOptions {
+	o := HistogramOptions{Stats: HistogramStat(r.uvarint())}
+	o.Percentiles = make([]float64, r.count(8))
+	for i := range o.Percentiles {
+		o.Percentiles[i] = r.float64()
+	}
+	return o
+}
+
+// datapoints returns the keys of h selected by the options, stamped with t.
+// If unit is not zero, values are durations in nanoseconds emitted as floats
+// in that unit.
+func (o HistogramOptions) datapoints(h Histogram, t time.Time, kind MetricKind, unit time.Duration) []Datapoint {
+	value := func(suffix string, v float64) Datapoint {
+		if unit == 0 {
+			return intDatapoint(suffix, t, kind, int64(v))
+		}
+		return floatDatapoint(suffix, t, kind, v/float64(unit))
+	}
+	scale := 1.0
+	if unit != 0 {
+		scale = float64(unit)
+	}
+
+	dps := make([]Datapoint, 0, o.nbKeys())
+	if o.Stats&StatMin != 0 {
+		dps = append(dps, value("min", float64(h.Min())))
+	}
+	if o.Stats&StatMax != 0 {
+		dps = append(dps, value("max", float64(h.Max())))
+	}
+	if o.Stats&StatMean != 0 {
+		dps = append(dps, floatDatapoint("mean", t, kind, h.Mean()/scale))
+	}
+	if o.Stats&StatStdDev != 0 {
+		dps = append(dps, floatDatapoint("std-dev", t, kind, h.StdDev()/scale))
+	}
+	if len(o.Percentiles) > 0 {
+		ps := h.Percentiles(o.Percentiles)
+		for i, p := range o.Percentiles {
+			dps = append(dps, value(PercentileSuffix(p), ps[i]))
+		}
+	}
+	if o.Stats&StatSampleSize != 0 {
+		dps = append(dps, intDatapoint("sample_size", t, kind, int64(h.Sample().Size())))
+	}
+	return dps
+}
@@ -0,0 +1,80 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPercentileSuffix(t *testing.T) {
+	for p, suffix := range map[float64]string{
+		0.5:    "p50",
+		0.75:   "p75",
+		0.9:    "p90",
+		0.99:   "p99",
+		0.999:  "p999",
+		0.9999: "p9999",
+		0.05:   "p05",
+		1:      "p100",
+	} {
+		if s := PercentileSuffix(p); suffix != s {
+			t.Errorf("PercentileSuffix(%v): %v != %v\n", p, suffix, s)
+		}
+	}
+}
+
+func TestHistogramDefaultOptions(t *testing.T) {
+	h := NewHistogram(NewUniformSample(100), 10)
+	if n := h.NbKeys(); 10 != n {
+		t.Errorf("h.NbKeys(): 10 != %v\n", n)
+	}
+	if n := len(h.GetDatapoints(time.Unix(0, 0), true)); 10 != n {
+		t.Errorf("len(h.GetDatapoints()): 10 != %v\n", n)
+	}
+}
+
+func TestHistogramWithOptions(t *testing.T) {
+	opts := HistogramOptions{
+		Stats:       StatMin | StatMax | StatSampleSize,
+		Percentiles: []float64{0.9, 0.9999},
+	}
+	h := NewHistogramWithOptions(NewUniformSample(100000), 10, nil, opts)
+	for i := 1; i <= 10000; i++ {
+		h.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	keys := h.GetKeys(time.Unix(0, 0), "%s %d %s", false)
+	expected := []string{
+		"min 10000 1",
+		"max 10000 10000",
+		"p90 10000 9000",
+		"p9999 10000 9999",
+		"sample_size 10000 10000",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatal(keys)
+	}
+	if n := h.NbKeys(); len(expected) != n {
+		t.Errorf("h.NbKeys(): %v != %v\n", len(expected), n)
+	}
+
+	// The histogram owns its options.
+	opts.Percentiles[0] = 0.5
+	if p := h.Options().Percentiles[0]; 0.9 != p {
+		t.Errorf("h.Options().Percentiles[0]: 0.9 != %v\n", p)
+	}
+}
+
+func TestTimerWithOptions(t *testing.T) {
+	opts := HistogramOptions{Stats: StatMax, Percentiles: []float64{0.99}}
+	tm := NewTimerWithOptions(time.Unix(0, 0), NewUniformSample(100), 60, 10, time.Millisecond, nil, opts)
+	tm.Update(time.Unix(1, 0), int64(3*time.Millisecond))
+	keys := tm.GetKeys(time.Unix(1, 0), "%s %d %s", true)
+	expected := []string{
+		"count 1 1",
+		"max 1 3.000000",
+		"p99 1 3.000000",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatal(keys)
+	}
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func BenchmarkHistogram(b *testing.B) {
-	h := NewHistogram(NewUniformSample(100))
+	h := NewHistogram(NewUniformSample(100), 10)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		h.Update(time.Now(), int64(i))
@@ -14,16 +14,36 @@ func BenchmarkHistogram(b *testing.B) {
 }
 
 func TestGetOrRegisterHistogram(t *testing.T) {
-	r := NewRegistry()
+	r := NewRegistry(60, 10)
 	s := NewUniformSample(100)
-	NewRegisteredHistogram("foo", r, s).Update(time.Now(), 47)
-	if h := GetOrRegisterHistogram("foo", r, s); 1 != h.Count() {
+	h, err := NewRegisteredHistogram("foo", r, time.Now(), s)
+	if nil != err {
+		t.Fatal(err)
+	}
+	h.Update(time.Now(), 47)
+	if h := GetOrRegisterHistogram("foo", r, time.Now(), s); 1 != h.Count() {
 		t.Fatal(h)
 	}
 }
 
+func TestNewRegisteredHistogram(t *testing.T) {
+	r := NewRegistry(60, 10)
+	created := time.Unix(600, 0)
+	h, err := NewRegisteredHistogram("foo", r, created, NewUniformSample(100))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if c := h.GetMaxTime(); !created.Equal(c) {
+		t.Errorf("h.GetMaxTime(): %v != %v\n", created, c)
+	}
+	h, err = NewRegisteredHistogram("foo", r, created, NewUniformSample(100))
+	if _, ok := err.(DuplicateMetric); !ok || nil != h {
+		t.Errorf("NewRegisteredHistogram(): DuplicateMetric != %v, %v\n", h, err)
+	}
+}
+
 func TestHistogram10000(t *testing.T) {
-	h := NewHistogram(NewUniformSample(100000))
+	h := NewHistogram(NewUniformSample(100000), 10)
 	for i := 1; i <= 10000; i++ {
 		h.Update(time.Now(), int64(i))
 	}
@@ -31,7 +51,7 @@ func TestHistogram10000(t *testing.T) {
 }
 
 func TestHistogramEmpty(t *testing.T) {
-	h := NewHistogram(NewUniformSample(100))
+	h := NewHistogram(NewUniformSample(100), 10)
 	if count := h.Count(); 0 != count {
 		t.Errorf("h.Count(): 0 != %v\n", count)
 	}
@@ -60,11 +80,14 @@ func TestHistogramEmpty(t *testing.T) {
 }
 
 func TestHistogramSnapshot(t *testing.T) {
-	h := NewHistogram(NewUniformSample(100000))
+	h := NewHistogram(NewUniformSample(100000), 10)
 	for i := 1; i <= 10000; i++ {
 		h.Update(time.Now(), int64(i))
 	}
-	snapshot := h.Snapshot()
+	snapshot := &StandardHistogram{}
+	if err := snapshot.UnmarshalBinary(mustSnapshot(t, h)); nil != err {
+		t.Fatal(err)
+	}
 	h.Update(time.Now(), 0)
 	testHistogram10000(t, snapshot)
 }
@@ -0,0 +1,138 @@
+package timemetrics
+
+import (
+	"sync"
+	"time"
+)
+
+// LatePolicy selects what a metric does with a late event, older than its
+// newest event by more than the allowed lateness.
+type LatePolicy int
+
+const (
+	// AcceptLate records late events like any other.
+	AcceptLate LatePolicy = iota
+	// DropLate discards late events.
+	DropLate
+	// CountLate discards late events and routes them to the Counter of the
+	// LateOptions, if any.
+	CountLate
+)
+
+// String returns the name of the policy.
+func (p LatePolicy) String() string {
+	switch p {
+	case AcceptLate:
+		return "accept"
+	case DropLate:
+		return "drop"
+	case CountLate:
+		return "count"
+	}
+	return "unknown"
+}
+
+// LateOptions configure how a metric handles events arriving out of order.
+// Events up to AllowedLateness older than the newest event of the metric are
+// recorded whatever the Policy.  With CountLate, Counter, when not nil, is
+// incremented at the time of each late event, e.g. a Counter registered as
+// "<name>.late" so the late events are flushed along with the metric.  A
+// StandardCounter counts them whatever its own LateOptions, so it may even
+// be the metric itself.
+type LateOptions struct {
+	Policy          LatePolicy
+	AllowedLateness time.Duration
+	Counter         Counter
+}
+
+// lateTracker applies the LateOptions of a metric and counts its late and
+// dropped events.  Metrics embed it to expose Late, Dropped, LateOptions and
+// SetLateOptions.
+type lateTracker struct {
+	late    int64
+	dropped int64
+	options LateOptions
+	mutex   sync.Mutex
+}
+
+// Dropped returns the number of late events discarded by the DropLate and
+// CountLate policies.
+func (l *lateTracker) Dropped() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.dropped
+}
+
+// Late returns the number of late events seen, whatever the policy.
+func (l *lateTracker) Late() int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.late
+}
+
+// LateOptions returns the options applied to late events.
+func (l *lateTracker) LateOptions() LateOptions {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.options
+}
+
+// SetLateOptions sets the options applied to late events.
+func (l *lateTracker) SetLateOptions(opts LateOptions) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.options = opts
+}
+
+// admit reports whether an event at t is to be recorded by a metric whose
+// newest event is at newest, counting it if it is late.
+func (l *lateTracker) admit(t time.Time, newest time.Time) bool {
+	l.mutex.Lock()
+	if !t.Before(newest.Add(-l.options.AllowedLateness)) {
+		l.mutex.Unlock()
+		return true
+	}
+	l.late++
+	opts := l.options
+	if opts.Policy != AcceptLate {
+		l.dropped++
+	}
+	l.mutex.Unlock()
+
+	switch opts.Policy {
+	case DropLate:
+		return false
+	case CountLate:
+		// Late events are counted as they come: admitting them again could
+		// loop back here.
+		if c, ok := opts.Counter.(*StandardCounter); ok {
+			c.add(t, 1)
+		} else if opts.Counter != nil {
+			opts.Counter.Inc(t, 1)
+		}
+		return false
+	}
+	return true
+}
+
+// marshal encodes the counts of late and dropped events.  The LateOptions
+// are settings of the metric rather than state, and are not encoded.
+func (l *lateTracker) marshal(w *binaryWriter) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	w.putUvarint(uint64(l.late))
+	w.putUvarint(uint64(l.dropped))
+}
+
+// unmarshalLateCounts decodes the counts encoded by lateTracker.marshal.
+func unmarshalLateCounts(r *binaryReader) (late int64, dropped int64) {
+	return int64(r.uvarint()), int64(r.uvarint())
+}
+
+// restore sets the counts of late and dropped events.
+func (l *lateTracker) restore(late int64, dropped int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.late = late
+	l.dropped = dropped
+}
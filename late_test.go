@@ -0,0 +1,129 @@
+package timemetrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLateAccept(t *testing.T) {
+	c := NewCounter(time.Unix(0, 0), 10)
+	c.Inc(time.Unix(100, 0), 1)
+	c.Inc(time.Unix(10, 0), 1)
+	if n := c.Count(); 2 != n {
+		t.Errorf("c.Count(): 2 != %v\n", n)
+	}
+	if n := c.Late(); 1 != n {
+		t.Errorf("c.Late(): 1 != %v\n", n)
+	}
+	if n := c.Dropped(); 0 != n {
+		t.Errorf("c.Dropped(): 0 != %v\n", n)
+	}
+	if m := c.GetMaxTime(); !time.Unix(100, 0).Equal(m) {
+		t.Errorf("c.GetMaxTime(): %v != %v\n", time.Unix(100, 0), m)
+	}
+}
+
+func TestLateDrop(t *testing.T) {
+	h := NewHistogram(NewUniformSample(100), 10)
+	h.SetLateOptions(LateOptions{Policy: DropLate, AllowedLateness: 30 * time.Second})
+	h.Update(time.Unix(100, 0), 1)
+	h.Update(time.Unix(70, 0), 2)
+	h.Update(time.Unix(69, 0), 3)
+	if n := h.Count(); 2 != n {
+		t.Errorf("h.Count(): 2 != %v\n", n)
+	}
+	if n := h.Max(); 2 != n {
+		t.Errorf("h.Max(): 2 != %v\n", n)
+	}
+	if n := h.Late(); 1 != n {
+		t.Errorf("h.Late(): 1 != %v\n", n)
+	}
+	if n := h.Dropped(); 1 != n {
+		t.Errorf("h.Dropped(): 1 != %v\n", n)
+	}
+}
+
+func TestLateCount(t *testing.T) {
+	r := NewRegistry(60, 10)
+	late := GetOrRegisterCounter("foo.late", r, time.Unix(0, 0))
+	m := GetOrRegisterMeter("foo", r, time.Unix(0, 0))
+	m.SetLateOptions(LateOptions{Policy: CountLate, Counter: late})
+	m.Mark(time.Unix(100, 0), 1)
+	m.Mark(time.Unix(50, 0), 1)
+	m.Mark(time.Unix(60, 0), 1)
+	if n := m.Count(); 1 != n {
+		t.Errorf("m.Count(): 1 != %v\n", n)
+	}
+	if n := m.Late(); 2 != n {
+		t.Errorf("m.Late(): 2 != %v\n", n)
+	}
+	if n := m.Dropped(); 2 != n {
+		t.Errorf("m.Dropped(): 2 != %v\n", n)
+	}
+	if n := late.Count(); 2 != n {
+		t.Errorf("late.Count(): 2 != %v\n", n)
+	}
+	if lt := late.GetMaxTime(); !time.Unix(60, 0).Equal(lt) {
+		t.Errorf("late.GetMaxTime(): %v != %v\n", time.Unix(60, 0), lt)
+	}
+}
+
+func TestLateCountItself(t *testing.T) {
+	c := NewCounter(time.Unix(0, 0), 10)
+	c.SetLateOptions(LateOptions{Policy: CountLate, Counter: c})
+	c.Inc(time.Unix(100, 0), 5)
+	c.Inc(time.Unix(10, 0), 3)
+	if n := c.Count(); 6 != n {
+		t.Errorf("c.Count(): 6 != %v\n", n)
+	}
+	if n, d := c.Late(), c.Dropped(); 1 != n || 1 != d {
+		t.Errorf("c.Late(), c.Dropped(): 1 1 != %v %v\n", n, d)
+	}
+}
+
+func TestLateCountWithoutCounter(t *testing.T) {
+	tm := NewTimer(time.Unix(0, 0), NewUniformSample(100), 60, 10, time.Millisecond)
+	tm.SetLateOptions(LateOptions{Policy: CountLate})
+	tm.Update(time.Unix(100, 0), int64(time.Millisecond))
+	tm.Update(time.Unix(99, 0), int64(time.Millisecond))
+	if n := tm.Count(); 1 != n {
+		t.Errorf("tm.Count(): 1 != %v\n", n)
+	}
+	if n := tm.Late(); 1 != n {
+		t.Errorf("tm.Late(): 1 != %v\n", n)
+	}
+}
+
+func TestLateGauge(t *testing.T) {
+	g := NewGauge(time.Unix(0, 0), 10)
+	g.SetLateOptions(LateOptions{Policy: AcceptLate, AllowedLateness: time.Minute})
+	g.Update(time.Unix(100, 0), 1)
+	g.Update(time.Unix(90, 0), 2)
+	g.Update(time.Unix(30, 0), 3)
+	if v := g.Value(); 1 != v {
+		t.Errorf("g.Value(): 1 != %v\n", v)
+	}
+	if n := g.Late(); 1 != n {
+		t.Errorf("g.Late(): 1 != %v\n", n)
+	}
+}
+
+func TestMeterMarkOutOfOrder(t *testing.T) {
+	m := NewMeter(time.Unix(0, 0), 60, 10)
+	m.Mark(time.Unix(100, 0), 1)
+	m.Mark(time.Unix(50, 0), 1)
+	if mt := m.GetMaxTime(); !time.Unix(100, 0).Equal(mt) {
+		t.Errorf("m.GetMaxTime(): %v != %v\n", time.Unix(100, 0), mt)
+	}
+	if n := m.Count(); 2 != n {
+		t.Errorf("m.Count(): 2 != %v\n", n)
+	}
+}
+
+func TestLatePolicyString(t *testing.T) {
+	for p, s := range map[LatePolicy]string{AcceptLate: "accept", DropLate: "drop", CountLate: "count"} {
+		if p.String() != s {
+			t.Errorf("%d.String(): %v != %v\n", p, s, p.String())
+		}
+	}
+}
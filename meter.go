@@ -2,25 +2,40 @@ package timemetrics
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Meters count events to produce exponentially-weighted moving average rates
-// at one-, five-, and fifteen-minutes and a mean rate.
+// over a set of windows, by default one-, five-, and fifteen-minutes.
 type Meter interface {
 	Count() int64
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
 	Mark(time.Time, int64)
 	CrunchEWMA(time.Time)
+	Rate(time.Duration) float64
 	Rate1() float64
 	Rate5() float64
 	Rate15() float64
+	RateUnit() time.Duration
+	Rates() []float64
+	SetLateOptions(LateOptions)
+	SetTemporality(Temporality)
+	Temporality() Temporality
+	Windows() []time.Duration
 	GetMaxTime() time.Time
 	GetMaxEWMATime() time.Time
 	Update(time.Time, int64)
 	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	GetDatapointsWithTemporality(time.Time, bool, Temporality) []Datapoint
 	NbKeys() int
 	Stale(time.Time) bool
 	PushKeysTime(t time.Time) bool
+	Tags() Tags
 	ZeroOut()
 }
 
@@ -29,130 +44,371 @@ type timeValueTuple struct {
 	t time.Time
 }
 
+// MeterOptions select the windows of the moving average rates of a Meter,
+// and the RateUnit they are a number of events per (per second if zero).
+// Each rate is emitted under a key named after its window, e.g. "rate._1min"
+// for a minute, "rate._10s" or "rate._1h".
+type MeterOptions struct {
+	Windows  []time.Duration
+	RateUnit time.Duration
+}
+
+// DefaultMeterOptions returns the options of one-, five-, and fifteen-minute
+// moving average rates of events per second.
+func DefaultMeterOptions() MeterOptions {
+	return MeterOptions{
+		Windows:  []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute},
+		RateUnit: time.Second,
+	}
+}
+
+// WindowSuffix returns the key suffix the rate over window is emitted under.
+func WindowSuffix(window time.Duration) string {
+	switch {
+	case window%time.Hour == 0:
+		return fmt.Sprintf("rate._%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("rate._%dmin", window/time.Minute)
+	case window%time.Second == 0:
+		return fmt.Sprintf("rate._%ds", window/time.Second)
+	}
+	return fmt.Sprintf("rate._%dms", window/time.Millisecond)
+}
+
+// GetOrRegisterMeter returns an existing Meter or constructs and registers a
+// new StandardMeter stamped with the event time t.
+func GetOrRegisterMeter(name string, r Registry, t time.Time) Meter {
+	return GetOrRegisterTaggedMeter(name, nil, r, t)
+}
+
+// GetOrRegisterTaggedMeter returns an existing Meter or constructs and
+// registers a new tagged StandardMeter stamped with the event time t.
+func GetOrRegisterTaggedMeter(name string, tags Tags, r Registry, t time.Time) Meter {
+	return GetOrRegisterMeterWithOptions(name, tags, r, t, DefaultMeterOptions())
+}
+
+// GetOrRegisterMeterWithOptions returns an existing Meter or constructs and
+// registers a new tagged StandardMeter with the rate windows of opts.
+func GetOrRegisterMeterWithOptions(name string, tags Tags, r Registry, t time.Time, opts MeterOptions) Meter {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		return NewMeterWithOptions(t, interval, staleThreshold, tags, opts)
+	}).(Meter)
+}
+
 // NewMeter constructs a new StandardMeter and launches a goroutine.
 func NewMeter(t time.Time, interval int, staleThreshold int) Meter {
+	return NewTaggedMeter(t, interval, staleThreshold, nil)
+}
+
+// NewTaggedMeter constructs a new StandardMeter with the given tags.
+func NewTaggedMeter(t time.Time, interval int, staleThreshold int, tags Tags) Meter {
+	return NewMeterWithOptions(t, interval, staleThreshold, tags, DefaultMeterOptions())
+}
+
+// NewMeterWithOptions constructs a new tagged StandardMeter with the rate
+// windows of opts.  It panics unless there is at least one window, all
+// positive and emitted under distinct keys.
+func NewMeterWithOptions(t time.Time, interval int, staleThreshold int, tags Tags, opts MeterOptions) Meter {
+	if 0 == len(opts.Windows) {
+		panic("meter without rate windows")
+	}
+	suffixes := make(map[string]bool, len(opts.Windows))
+	for _, window := range opts.Windows {
+		if window <= 0 {
+			panic(fmt.Sprintf("meter rate window %v is not positive", window))
+		}
+		suffix := WindowSuffix(window)
+		if suffixes[suffix] {
+			panic(fmt.Sprintf("meter rate window %v emitted twice as %s", window, suffix))
+		}
+		suffixes[suffix] = true
+	}
+
 	m := &StandardMeter{
-		0,
-		NewEWMA1(t),
-		NewEWMA5(t),
-		NewEWMA15(t),
-		t,
-		t,
-		interval,
-		staleThreshold,
+		lastUpdate:     t,
+		lastEWMAUpdate: t,
+		ewmaInterval:   interval,
+		staleThreshold: staleThreshold,
+		tags:           copyTags(tags),
+	}
+	m.rateUnit = opts.RateUnit
+	if m.rateUnit == 0 {
+		m.rateUnit = time.Second
+	}
+	for _, window := range opts.Windows {
+		m.ewmas = append(m.ewmas, NewEWMAWithUnit(t, window, m.rateUnit))
 	}
 
 	return m
 }
 
-// StandardMeter is the standard implementation of a Meter and uses a
-// goroutine to synchronize its calculations and a time.Ticker to pass time.
+// NewRegisteredMeter constructs and registers a new StandardMeter.  It
+// returns DuplicateMetric if a metric is already registered under name.
+func NewRegisteredMeter(name string, r Registry, t time.Time) (Meter, error) {
+	return NewRegisteredTaggedMeter(name, nil, r, t)
+}
+
+// NewRegisteredTaggedMeter constructs and registers a new tagged
+// StandardMeter.
+func NewRegisteredTaggedMeter(name string, tags Tags, r Registry, t time.Time) (Meter, error) {
+	m := NewTaggedMeter(t, r.Interval(), r.StaleThreshold(), tags)
+	if err := r.Register(name, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// StandardMeter is the standard implementation of a Meter and uses the
+// sync/atomic package to count events and a mutex to manage its times and
+// the ticks of its EWMAs.
 type StandardMeter struct {
-	count          int64
-	a1             EWMA
-	a5             EWMA
-	a15            EWMA
+	count int64 // /!\ this should be the first member to ensure 64-bit alignment
+	deltaTracker
+	lateTracker
+	ewmas          []EWMA
+	rateUnit       time.Duration
 	lastUpdate     time.Time
 	lastEWMAUpdate time.Time
 	ewmaInterval   int
 	staleThreshold int
+	tags           Tags
+	mutex          sync.Mutex
 }
 
 // Count returns the number of events recorded.
 func (m *StandardMeter) Count() int64 {
-	return m.count
+	return atomic.LoadInt64(&m.count)
 }
 
-// Mark records the occurance of n events.
+// Mark records the occurance of n events, unless t is late and the late
+// policy discards them.
 func (m *StandardMeter) Mark(t time.Time, n int64) {
-	m.a1.Update(n)
-	m.a5.Update(n)
-	m.a15.Update(n)
+	if !m.admit(t, m.GetMaxTime()) {
+		return
+	}
+	for _, a := range m.ewmas {
+		a.Update(n)
+	}
 
-	m.count += n
-	m.lastUpdate = t
+	atomic.AddInt64(&m.count, n)
+	m.mutex.Lock()
+	if t.After(m.lastUpdate) {
+		m.lastUpdate = t
+	}
+	m.mutex.Unlock()
 }
 
 func (m *StandardMeter) Update(t time.Time, i int64) {
 	m.Mark(t, i)
 }
 
-// Rate1 returns the one-minute moving average rate of events per minute.
+// Rate returns the moving average rate of events per rate unit over the given
+// window, zero if the meter has no such window.
+func (m *StandardMeter) Rate(window time.Duration) float64 {
+	for _, a := range m.ewmas {
+		if a.Window() == window {
+			return a.Rate()
+		}
+	}
+	return 0
+}
+
+// Rate1 returns the one-minute moving average rate of events per rate unit.
 func (m *StandardMeter) Rate1() float64 {
-	return m.a1.Rate()
+	return m.Rate(time.Minute)
 }
 
-// Rate5 returns the five-minute moving average rate of events per minute.
+// Rate5 returns the five-minute moving average rate of events per rate unit.
 func (m *StandardMeter) Rate5() float64 {
-	return m.a5.Rate()
+	return m.Rate(5 * time.Minute)
 }
 
-// Rate15 returns the fifteen-minute moving average rate of events per minute.
+// Rate15 returns the fifteen-minute moving average rate of events per rate unit.
 func (m *StandardMeter) Rate15() float64 {
-	return m.a15.Rate()
+	return m.Rate(15 * time.Minute)
+}
+
+// RateUnit returns the unit of time the rates are a number of events per.
+func (m *StandardMeter) RateUnit() time.Duration {
+	return m.rateUnit
+}
+
+// Rates returns the moving average rates of events, in the order of Windows.
+func (m *StandardMeter) Rates() []float64 {
+	rates := make([]float64, len(m.ewmas))
+	for i, a := range m.ewmas {
+		rates[i] = a.Rate()
+	}
+	return rates
+}
+
+// Windows returns the windows of the moving average rates.
+func (m *StandardMeter) Windows() []time.Duration {
+	windows := make([]time.Duration, len(m.ewmas))
+	for i, a := range m.ewmas {
+		windows[i] = a.Window()
+	}
+	return windows
 }
 
 func (m *StandardMeter) GetMaxTime() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.lastUpdate
 }
 
 func (m *StandardMeter) GetMaxEWMATime() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.lastEWMAUpdate
 }
 
 func (m *StandardMeter) CrunchEWMA(t time.Time) {
-	m.a1.Tick(t)
-	m.a5.Tick(t)
-	m.a15.Tick(t)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.crunchEWMA(t)
+}
+
+// crunchEWMA ticks the EWMAs, with the mutex held.
+func (m *StandardMeter) crunchEWMA(t time.Time) {
+	for _, a := range m.ewmas {
+		a.Tick(t)
+	}
 
 	m.lastEWMAUpdate = t
 }
 
 func (m *StandardMeter) GetKeys(ct time.Time, name string, currentTime bool) []string {
-	var t int64
-	if currentTime {
-		t = ct.Unix()
-	} else {
-		t = m.GetMaxTime().Unix()
-	}
+	return formatDatapoints(name, m.GetDatapoints(ct, currentTime))
+}
+
+// GetDatapoints returns the count, with the Temporality of the meter, and
+// the rates once per EWMA interval.
+func (m *StandardMeter) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	return m.GetDatapointsWithTemporality(ct, currentTime, m.Temporality())
+}
 
-	var keys []string
+// GetDatapointsWithTemporality returns the count, with the given temporality
+// rather than that of the meter, and the rates once per EWMA interval.
+func (m *StandardMeter) GetDatapointsWithTemporality(ct time.Time, currentTime bool, temporality Temporality) []Datapoint {
+	t := datapointTime(m, ct, currentTime)
+
+	// Hold the mutex so concurrent flushes crunch the EWMAs only once.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var dps []Datapoint
 	if ct.Sub(m.lastEWMAUpdate) >= time.Duration(m.ewmaInterval)*time.Second {
-		//fmt.Printf("%s - %s = %s > %s\n", ct, m.GetMaxEWMATime(), ct.Sub(m.GetMaxEWMATime()), time.Duration(m.ewmaInterval)*time.Second)
-		//fmt.Printf("CRUNCH TIME: %s > %s\n", ct, time.Duration(m.ewmaInterval))
-		m.CrunchEWMA(ct)
-		keys = make([]string, 4)
-
-		keys[1] = fmt.Sprintf(name, "rate._1min", t, fmt.Sprintf("%.6f", m.Rate1()))
-		keys[2] = fmt.Sprintf(name, "rate._5min", t, fmt.Sprintf("%.6f", m.Rate5()))
-		keys[3] = fmt.Sprintf(name, "rate._15min", t, fmt.Sprintf("%.6f", m.Rate15()))
+		m.crunchEWMA(ct)
+		dps = make([]Datapoint, 1+len(m.ewmas))
+
+		for i, a := range m.ewmas {
+			dps[i+1] = floatDatapoint(WindowSuffix(a.Window()), t, MeterKind, a.Rate())
+		}
 	} else {
-		keys = make([]string, 1)
+		dps = make([]Datapoint, 1)
 	}
 
-	keys[0] = fmt.Sprintf(name, "count", t, fmt.Sprintf("%d", m.Count()))
+	dps[0] = intDatapoint("count", t, MeterKind, m.emit(&m.count, temporality))
 
-	return keys
+	return tagDatapoints(dps, m.tags)
 }
 
 func (m *StandardMeter) NbKeys() int {
-	return 4
+	return 1 + len(m.ewmas)
 }
 
 func (m *StandardMeter) Stale(t time.Time) bool {
-	//fmt.Printf("cur diff: %s vs max diff: %s", t.Sub(m.GetMaxTime()), time.Duration(m.staleThreshold)*time.Minute)
 	return t.Sub(m.GetMaxTime()) > time.Duration(m.staleThreshold)*time.Minute
 }
 
 func (m *StandardMeter) PushKeysTime(t time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return m.lastUpdate.After(t) || t.Sub(m.lastEWMAUpdate) > time.Duration(m.ewmaInterval)*time.Second
 }
 
+func (m *StandardMeter) Tags() Tags {
+	return m.tags
+}
+
 func (m *StandardMeter) ZeroOut() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	//Force next EWMA push
 	m.lastEWMAUpdate = time.Unix(0, 0)
 
-	m.a1.ZeroOut()
-	m.a5.ZeroOut()
-	m.a15.ZeroOut()
+	for _, a := range m.ewmas {
+		a.ZeroOut()
+	}
+}
+
+// meterEncodingVersion is the version of the encoding of StandardMeters.
+const meterEncodingVersion = 1
+
+// MarshalBinary encodes the meter and its moving averages, the times of the
+// last update and of the last tick, and the baseline of its deltas included.
+// Its Temporality is a setting rather than state, and is not encoded.
+func (m *StandardMeter) MarshalBinary() ([]byte, error) {
+	w := &binaryWriter{}
+	w.putHeader(meterEncoding, meterEncodingVersion)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	w.putVarint(atomic.LoadInt64(&m.count))
+	w.putVarint(atomic.LoadInt64(&m.baseline))
+	w.putDuration(m.rateUnit)
+	w.putTimestamp(m.lastUpdate)
+	w.putTimestamp(m.lastEWMAUpdate)
+	w.putVarint(int64(m.ewmaInterval))
+	w.putVarint(int64(m.staleThreshold))
+	w.putTags(m.tags)
+	m.lateTracker.marshal(w)
+	w.putUvarint(uint64(len(m.ewmas)))
+	for _, a := range m.ewmas {
+		sa, ok := a.(*StandardEWMA)
+		if !ok {
+			return nil, UnsupportedSnapshot(fmt.Sprintf("%T has no MarshalBinary", a))
+		}
+		sa.marshal(w)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the meter and its moving averages by the ones
+// encoded in data by MarshalBinary.  It must not run concurrently with
+// updates.
+func (m *StandardMeter) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(meterEncoding, meterEncodingVersion)
+	count := r.varint()
+	baseline := r.varint()
+	rateUnit := r.duration()
+	lastUpdate := r.timestamp()
+	lastEWMAUpdate := r.timestamp()
+	ewmaInterval := int(r.varint())
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	ewmas := make([]EWMA, r.count(minEWMAEncodedSize))
+	for i := range ewmas {
+		ewmas[i] = unmarshalEWMA(r)
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	atomic.StoreInt64(&m.count, count)
+	atomic.StoreInt64(&m.baseline, baseline)
+	m.ewmas = ewmas
+	m.rateUnit = rateUnit
+	m.lastUpdate = lastUpdate
+	m.lastEWMAUpdate = lastEWMAUpdate
+	m.ewmaInterval = ewmaInterval
+	m.staleThreshold = staleThreshold
+	m.tags = tags
+	m.lateTracker.restore(late, dropped)
+	return nil
 }
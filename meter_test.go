@@ -1,44 +1,126 @@
 package timemetrics
 
 import (
+	"reflect"
 	"testing"
 	"time"
 )
 
 func TestMeterDecay(t *testing.T) {
-	m := &StandardMeter{
-		make(chan int64),
-		make(chan *MeterSnapshot),
-		time.NewTicker(1),
-	}
-	go m.arbiter()
-	m.Mark(1)
-	rateMean := m.RateMean()
-	time.Sleep(1)
-	if m.RateMean() >= rateMean {
-		t.Error("m.RateMean() didn't decrease")
+	m := NewMeter(time.Unix(0, 0), 60, 10)
+	m.Mark(time.Unix(1, 0), 1)
+	m.CrunchEWMA(time.Unix(5, 0))
+	rate1 := m.Rate1()
+	m.CrunchEWMA(time.Unix(10, 0))
+	if m.Rate1() >= rate1 {
+		t.Error("m.Rate1() didn't decrease")
 	}
 }
 
 func TestMeterNonzero(t *testing.T) {
-	m := NewMeter()
-	m.Mark(3)
+	m := NewMeter(time.Now(), 60, 10)
+	m.Mark(time.Now(), 3)
 	if count := m.Count(); 3 != count {
 		t.Errorf("m.Count(): 3 != %v\n", count)
 	}
 }
 
 func TestMeterSnapshot(t *testing.T) {
-	m := NewMeter()
-	m.Mark(1)
-	if snapshot := m.Snapshot(); m.RateMean() != snapshot.RateMean() {
+	m := NewMeter(time.Unix(0, 0), 60, 10)
+	m.Mark(time.Unix(1, 0), 1)
+	m.CrunchEWMA(time.Unix(5, 0))
+	snapshot := &StandardMeter{}
+	if err := snapshot.UnmarshalBinary(mustSnapshot(t, m)); nil != err {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Rates(), snapshot.Rates()) {
 		t.Fatal(snapshot)
 	}
 }
 
 func TestMeterZero(t *testing.T) {
-	m := NewMeter()
+	m := NewMeter(time.Now(), 60, 10)
 	if count := m.Count(); 0 != count {
 		t.Errorf("m.Count(): 0 != %v\n", count)
 	}
 }
+
+func TestMeterDefaultWindows(t *testing.T) {
+	m := NewMeter(time.Unix(0, 0), 60, 10)
+	windows := m.Windows()
+	if 3 != len(windows) || time.Minute != windows[0] || 5*time.Minute != windows[1] || 15*time.Minute != windows[2] {
+		t.Fatal(windows)
+	}
+	if n := m.NbKeys(); 4 != n {
+		t.Errorf("m.NbKeys(): 4 != %v\n", n)
+	}
+}
+
+func TestMeterWithOptions(t *testing.T) {
+	opts := MeterOptions{Windows: []time.Duration{10 * time.Second, time.Minute, time.Hour}}
+	m := NewMeterWithOptions(time.Unix(0, 0), 60, 10, nil, opts)
+	m.Mark(time.Unix(30, 0), 120)
+	keys := m.GetKeys(time.Unix(60, 0), "%s %d %s", false)
+	expected := []string{
+		"count 30 120",
+		"rate._10s 30 2.000000",
+		"rate._1min 30 2.000000",
+		"rate._1h 30 2.000000",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatal(keys)
+	}
+	if n := m.NbKeys(); 4 != n {
+		t.Errorf("m.NbKeys(): 4 != %v\n", n)
+	}
+	if rate := m.Rate(time.Hour); 2.0 != rate {
+		t.Errorf("m.Rate(time.Hour): 2.0 != %v\n", rate)
+	}
+	if rate := m.Rate5(); 0 != rate {
+		t.Errorf("m.Rate5(): 0 != %v\n", rate)
+	}
+	if rates := m.Rates(); 3 != len(rates) {
+		t.Fatal(rates)
+	}
+
+	// The shorter the window, the faster the rate decays.
+	m.CrunchEWMA(time.Unix(120, 0))
+	rates := m.Rates()
+	if !(rates[0] < rates[1] && rates[1] < rates[2]) {
+		t.Fatal(rates)
+	}
+}
+
+func TestMeterWithInvalidOptions(t *testing.T) {
+	for _, windows := range [][]time.Duration{
+		nil,
+		{time.Minute, 0},
+		{-time.Minute},
+		{time.Minute, 60 * time.Second},
+		{1500 * time.Microsecond, 1200 * time.Microsecond},
+	} {
+		func() {
+			defer func() {
+				if nil == recover() {
+					t.Errorf("NewMeterWithOptions(%v): expected a panic\n", windows)
+				}
+			}()
+			NewMeterWithOptions(time.Unix(0, 0), 60, 10, nil, MeterOptions{Windows: windows})
+		}()
+	}
+}
+
+func TestWindowSuffix(t *testing.T) {
+	for window, suffix := range map[time.Duration]string{
+		time.Minute:            "rate._1min",
+		15 * time.Minute:       "rate._15min",
+		10 * time.Second:       "rate._10s",
+		90 * time.Second:       "rate._90s",
+		time.Hour:              "rate._1h",
+		500 * time.Millisecond: "rate._500ms",
+	} {
+		if s := WindowSuffix(window); suffix != s {
+			t.Errorf("WindowSuffix(%v): %v != %v\n", window, suffix, s)
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 type Metric interface {
 	Update(time.Time, int64)
 	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	Tags() Tags
 	GetMaxTime() time.Time
 	NbKeys() int
 	PushKeysTime(time.Time) bool
@@ -0,0 +1,484 @@
+package timemetrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPError is the error returned when an OTLP collector rejects an export,
+// in whole or in part.
+type OTLPError string
+
+func (err OTLPError) Error() string {
+	return fmt.Sprintf("otlp export: %s", string(err))
+}
+
+// OTLPFormat is the encoding of OTLP requests written by WriteOTLP.
+type OTLPFormat int
+
+const (
+	// OTLPProtobuf requests are protobuf messages, each prefixed with its
+	// length as a varint, as written by protobuf's writeDelimitedTo.
+	OTLPProtobuf OTLPFormat = iota
+
+	// OTLPJSON requests are in the OTLP/JSON encoding, each on a line, as
+	// written by the file exporter of the OpenTelemetry collector.
+	OTLPJSON
+)
+
+// otlpExportPath is the gRPC method of the OTLP metrics service.
+const otlpExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// OTLPOptions configure the OTLP requests converted from a Registry and how
+// an OTLPExporter sends them.
+type OTLPOptions struct {
+	// Resource holds the attributes of the resource the metrics are about,
+	// e.g. service.name.
+	Resource Tags
+
+	// ScopeName and ScopeVersion identify the instrumentation scope of the
+	// metrics.
+	ScopeName    string
+	ScopeVersion string
+
+	// Headers are sent along with gRPC exports, e.g. to authenticate.
+	Headers map[string]string
+
+	// TLSConfig is used by gRPC exports over TLS.  Without it, exports are
+	// over unencrypted HTTP/2, as to a local collector.
+	TLSConfig *tls.Config
+
+	// Timeout bounds each gRPC export.  Zero means no timeout.
+	Timeout time.Duration
+}
+
+// DefaultOTLPOptions returns the options naming the scope after this package,
+// with a 10 second timeout.
+func DefaultOTLPOptions() OTLPOptions {
+	return OTLPOptions{
+		ScopeName: "github.com/mathpl/go-timemetrics",
+		Timeout:   10 * time.Second,
+	}
+}
+
+// WriteOTLP converts the metrics of r to an OTLP ExportMetricsServiceRequest
+// and appends it to w in the given format, e.g. to a file.  See
+// MarshalOTLP.
+func WriteOTLP(w io.Writer, r Registry, opts OTLPOptions, format OTLPFormat) error {
+	req := newOTLPRequest(r, opts, nil)
+	var data []byte
+	switch format {
+	case OTLPProtobuf:
+		pw := &protoWriter{}
+		req.marshalProto(pw)
+		bw := &binaryWriter{}
+		bw.putBytes(pw.buf)
+		data = bw.buf
+	case OTLPJSON:
+		var err error
+		if data, err = json.Marshal(req); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf("unknown OTLP format %d", format)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// MarshalOTLP converts the metrics of r to an OTLP
+// ExportMetricsServiceRequest in protobuf.  Every data point starts at the
+// time its metric was registered at, per Registry.Created, is stamped with
+// its GetMaxTime, its event time, and has the tags of its metric as
+// attributes:
+//
+//   - Counters are cumulative, non-monotonic, sums.
+//   - Gauges and GaugeFloat64s are gauges.
+//   - Meters are a cumulative monotonic sum of their count and a
+//     "<name>.rate" gauge of their rates, with their window as attribute,
+//     e.g. window="1min".
+//   - BucketHistograms are cumulative histograms.
+//   - ExponentialHistograms are cumulative exponential histograms.
+//   - Histograms and Timers are summaries of the percentiles of their
+//     options, the sum being estimated from the mean of the sample.  Timers
+//     are in their unit.
+//
+// Metrics sharing a name and a type are data points of a single OTLP
+// metric.  Other metrics are left out.
+//
+// MarshalOTLP keeps no state between calls, so counts are cumulative
+// whatever the Temporality of their metric.  An OTLPExporter sends deltas.
+func MarshalOTLP(r Registry, opts OTLPOptions) []byte {
+	w := &protoWriter{}
+	newOTLPRequest(r, opts, nil).marshalProto(w)
+	return w.buf
+}
+
+// OTLPExporter sends the metrics of a Registry to an OTLP collector over
+// gRPC.
+type OTLPExporter struct {
+	registry  Registry
+	url       string
+	options   OTLPOptions
+	client    *http.Client
+	baselines deltaBaselines // of the last export the collector accepted
+	mutex     sync.Mutex     // serializes exports, whose deltas follow each other
+}
+
+// NewOTLPExporter constructs a new OTLPExporter sending the metrics of r to
+// the gRPC endpoint of a collector, e.g. "localhost:4317".
+func NewOTLPExporter(r Registry, endpoint string, opts OTLPOptions) *OTLPExporter {
+	var protocols http.Protocols
+	scheme := "http"
+	if nil == opts.TLSConfig {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP2(true)
+		scheme = "https"
+	}
+	return &OTLPExporter{
+		registry: r,
+		url:      scheme + "://" + endpoint + otlpExportPath,
+		options:  opts,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: opts.TLSConfig, Protocols: &protocols},
+			Timeout:   opts.Timeout,
+		},
+	}
+}
+
+// Close closes the idle connections of the exporter.
+func (e *OTLPExporter) Close() {
+	e.client.CloseIdleConnections()
+}
+
+// Export sends the metrics of the registry, converted as by MarshalOTLP,
+// except for the counts of Counters and Meters whose Temporality is Delta:
+// they are delta sums of the change since the previous export, which
+// starts at its time.  It returns an OTLPError if the collector rejects any
+// data point.  Deltas are only moved forward once the collector accepted
+// the request: after a failed export, the next one sends the changes of both.
+func (e *OTLPExporter) Export(ctx context.Context) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	baselines := e.baselines.clone()
+	w := &protoWriter{}
+	newOTLPRequest(e.registry, e.options, baselines).marshalProto(w)
+	msg := w.buf
+	// gRPC messages are framed by an uncompressed flag and their length.
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.url, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range e.options.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if http.StatusOK != resp.StatusCode {
+		return OTLPError(fmt.Sprintf("HTTP status %s", resp.Status))
+	}
+
+	// Errors come in trailers, or in headers when there is no message.
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if "" == status {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if "0" != status {
+		if m, err := url.PathUnescape(message); nil == err {
+			message = m
+		}
+		return OTLPError(fmt.Sprintf("grpc-status %q: %s", status, message))
+	}
+	if len(body) < 5 || 0 != body[0] || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return OTLPError("invalid response")
+	}
+	// Data points rejected in a partial success would be rejected again.
+	e.baselines.set(baselines)
+	return otlpPartialSuccess(body[5:])
+}
+
+// otlpPartialSuccess returns an OTLPError if the ExportMetricsServiceResponse
+// encoded in data reports rejected data points.
+func otlpPartialSuccess(data []byte) error {
+	r := &protoReader{binaryReader{buf: data}}
+	var rejected uint64
+	var message string
+	for field, wireType, _, b, ok := r.next(); ok; field, wireType, _, b, ok = r.next() {
+		if 1 != field || protoBytes != wireType {
+			continue
+		}
+		ps := &protoReader{binaryReader{buf: b}}
+		for field, _, v, b, ok := ps.next(); ok; field, _, v, b, ok = ps.next() {
+			switch field {
+			case 1:
+				rejected = v
+			case 2:
+				message = string(b)
+			}
+		}
+		if ps.err != nil {
+			return OTLPError(fmt.Sprintf("invalid response: %v", ps.err))
+		}
+	}
+	if r.err != nil {
+		return OTLPError(fmt.Sprintf("invalid response: %v", r.err))
+	}
+	if rejected > 0 || "" != message {
+		return OTLPError(fmt.Sprintf("%d data points rejected: %s", rejected, message))
+	}
+	return nil
+}
+
+// newOTLPRequest converts the metrics of r to an OTLP request.  With
+// baselines, the counts of Delta metrics are deltas against them.
+func newOTLPRequest(r Registry, opts OTLPOptions, baselines *deltaBaselines) *otlpRequest {
+	var entries []registryEntry
+	r.Each(func(name string, m Metric) {
+		entries = append(entries, registryEntry{name, m, r.Created(name, m.Tags())})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return metricKey(entries[i].name, entries[i].metric.Tags()) < metricKey(entries[j].name, entries[j].metric.Tags())
+	})
+
+	var metrics []*otlpMetric
+	byName := make(map[string]*otlpMetric)
+	keys := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		key := metricKey(e.name, e.metric.Tags())
+		keys[key] = true
+		for _, m := range otlpMetrics(e.name, e.metric, e.created, baselines, key) {
+			key := m.Name + "\x00" + m.kind()
+			if existing, ok := byName[key]; ok {
+				existing.merge(m)
+				continue
+			}
+			byName[key] = m
+			metrics = append(metrics, m)
+		}
+	}
+	if nil != baselines {
+		baselines.retain(keys)
+	}
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: otlpAttributes(opts.Resource)},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: opts.ScopeName, Version: opts.ScopeVersion},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// otlpMetrics returns the OTLP metrics m, registered under key, contributes
+// a data point to.
+func otlpMetrics(name string, m Metric, created time.Time, baselines *deltaBaselines, key string) []*otlpMetric {
+	start, t := otlpTime(created), otlpTime(m.GetMaxTime())
+	attributes := otlpAttributes(m.Tags())
+	number := func(attributes []otlpKeyValue) otlpNumberDataPoint {
+		return otlpNumberDataPoint{Attributes: attributes, StartTimeUnixNano: start, TimeUnixNano: t}
+	}
+	intPoint := func(v int64) []otlpNumberDataPoint {
+		dp := number(attributes)
+		dp.AsInt = &v
+		return []otlpNumberDataPoint{dp}
+	}
+	floatPoint := func(v float64) []otlpNumberDataPoint {
+		dp := number(attributes)
+		dp.AsDouble = otlpFloatPtr(v)
+		return []otlpNumberDataPoint{dp}
+	}
+	// The count of a Delta metric is the change since its previous export,
+	// which starts at the time of that export.
+	sum := func(tm TemporalMetric, count int64, monotonic bool) *otlpMetric {
+		if nil == baselines || Delta != tm.Temporality() {
+			return &otlpMetric{Name: name, Sum: &otlpSum{DataPoints: intPoint(count), AggregationTemporality: otlpCumulative, IsMonotonic: monotonic}}
+		}
+		delta, previous := baselines.delta(key, count, tm.GetMaxTime())
+		dp := number(attributes)
+		if !previous.IsZero() {
+			dp.StartTimeUnixNano = otlpTime(previous)
+		}
+		dp.AsInt = &delta
+		return &otlpMetric{Name: name, Sum: &otlpSum{DataPoints: []otlpNumberDataPoint{dp}, AggregationTemporality: otlpDelta, IsMonotonic: monotonic}}
+	}
+	summary := func(count int64, mean float64, ps []float64, values []float64, scale float64) *otlpSummary {
+		dp := otlpSummaryDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      t,
+			Count:             uint64(count),
+			Sum:               otlpFloat(mean * float64(count) / scale),
+		}
+		for i, p := range ps {
+			dp.QuantileValues = append(dp.QuantileValues, otlpQuantileValue{otlpFloat(p), otlpFloat(values[i] / scale)})
+		}
+		return &otlpSummary{DataPoints: []otlpSummaryDataPoint{dp}}
+	}
+
+	switch m := m.(type) {
+	case Counter:
+		return []*otlpMetric{sum(m, m.Count(), false)}
+	case Gauge:
+		return []*otlpMetric{{Name: name, Gauge: &otlpGauge{DataPoints: intPoint(m.Value())}}}
+	case GaugeFloat64:
+		return []*otlpMetric{{Name: name, Gauge: &otlpGauge{DataPoints: floatPoint(m.Value())}}}
+	case Meter:
+		count := sum(m, m.Count(), true)
+		rates := &otlpMetric{Name: name + ".rate", Gauge: &otlpGauge{}}
+		windows := m.Windows()
+		for i, rate := range m.Rates() {
+			tags := copyTags(m.Tags())
+			if nil == tags {
+				tags = make(Tags, 1)
+			}
+			tags["window"] = strings.TrimPrefix(WindowSuffix(windows[i]), "rate._")
+			dp := number(otlpAttributes(tags))
+			dp.AsDouble = otlpFloatPtr(rate)
+			rates.Gauge.DataPoints = append(rates.Gauge.DataPoints, dp)
+		}
+		return []*otlpMetric{count, rates}
+	case BucketHistogram:
+		dp := otlpHistogramDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      t,
+			Count:             uint64(m.Count()),
+			Sum:               otlpFloatPtr(float64(m.Sum())),
+		}
+		for _, c := range m.BucketCounts() {
+			dp.BucketCounts = append(dp.BucketCounts, otlpUint64(c))
+		}
+		for _, b := range m.Bounds() {
+			dp.ExplicitBounds = append(dp.ExplicitBounds, otlpFloat(b))
+		}
+		return []*otlpMetric{{Name: name, Histogram: &otlpHistogram{DataPoints: []otlpHistogramDataPoint{dp}, AggregationTemporality: otlpCumulative}}}
+	case ExponentialHistogram:
+		dp := otlpExponentialHistogramDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      t,
+			Count:             uint64(m.Count()),
+			Sum:               otlpFloatPtr(float64(m.Sum())),
+			Scale:             m.Scale(),
+			ZeroCount:         uint64(m.ZeroCount()),
+			Positive:          otlpBuckets(m.Positive()),
+			Negative:          otlpBuckets(m.Negative()),
+		}
+		if m.Count() > 0 {
+			dp.Min, dp.Max = otlpFloatPtr(float64(m.Min())), otlpFloatPtr(float64(m.Max()))
+		}
+		return []*otlpMetric{{Name: name, ExponentialHistogram: &otlpExponentialHistogram{DataPoints: []otlpExponentialHistogramDataPoint{dp}, AggregationTemporality: otlpCumulative}}}
+	case Histogram:
+		ps := m.Options().Percentiles
+		return []*otlpMetric{{Name: name, Summary: summary(m.Count(), m.Mean(), ps, m.Percentiles(ps), 1)}}
+	case Timer:
+		ps := m.Options().Percentiles
+		return []*otlpMetric{{Name: name, Unit: otlpUnit(m.Unit()), Summary: summary(m.Count(), m.Mean(), ps, m.Percentiles(ps), float64(m.Unit()))}}
+	}
+	return nil
+}
+
+// kind returns the type of the data of the metric.
+func (m *otlpMetric) kind() string {
+	switch {
+	case nil != m.Gauge:
+		return "gauge"
+	case nil != m.Sum:
+		return fmt.Sprintf("sum %v %d", m.Sum.IsMonotonic, m.Sum.AggregationTemporality)
+	case nil != m.Histogram:
+		return "histogram"
+	case nil != m.ExponentialHistogram:
+		return "exponential histogram"
+	}
+	return "summary " + m.Unit
+}
+
+// merge appends the data points of o, of the same kind, to those of m.
+func (m *otlpMetric) merge(o *otlpMetric) {
+	switch {
+	case nil != m.Gauge:
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, o.Gauge.DataPoints...)
+	case nil != m.Sum:
+		m.Sum.DataPoints = append(m.Sum.DataPoints, o.Sum.DataPoints...)
+	case nil != m.Histogram:
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, o.Histogram.DataPoints...)
+	case nil != m.ExponentialHistogram:
+		m.ExponentialHistogram.DataPoints = append(m.ExponentialHistogram.DataPoints, o.ExponentialHistogram.DataPoints...)
+	case nil != m.Summary:
+		m.Summary.DataPoints = append(m.Summary.DataPoints, o.Summary.DataPoints...)
+	}
+}
+
+func otlpAttributes(tags Tags) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, k := range tags.Keys() {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: tags[k]}})
+	}
+	return kvs
+}
+
+func otlpBuckets(b ExponentialHistogramBuckets) otlpExponentialHistogramBuckets {
+	buckets := otlpExponentialHistogramBuckets{Offset: b.Offset}
+	for _, c := range b.Counts {
+		buckets.BucketCounts = append(buckets.BucketCounts, otlpUint64(c))
+	}
+	return buckets
+}
+
+func otlpFloatPtr(f float64) *otlpFloat {
+	v := otlpFloat(f)
+	return &v
+}
+
+// otlpTime returns t in nanoseconds since the epoch, zero for the zero time
+// and times before the epoch, which OTLP cannot represent.
+func otlpTime(t time.Time) uint64 {
+	if t.IsZero() || t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// otlpUnit returns the UCUM unit of durations in unit, e.g. "ms".
+func otlpUnit(unit time.Duration) string {
+	switch unit {
+	case time.Nanosecond:
+		return "ns"
+	case time.Microsecond:
+		return "us"
+	case time.Millisecond:
+		return "ms"
+	case time.Second:
+		return "s"
+	case time.Minute:
+		return "min"
+	case time.Hour:
+		return "h"
+	}
+	return ""
+}
@@ -0,0 +1,488 @@
+package timemetrics
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// The messages of the OTLP metrics protocol exported, in
+// opentelemetry/proto/collector/metrics/v1/metrics_service.proto and
+// opentelemetry/proto/metrics/v1/metrics.proto, restricted to the fields set
+// by this package.  Their JSON tags follow the OTLP/JSON mapping: 64-bit
+// integers are strings, enums are integers.
+
+// Aggregation temporalities of sums and histograms: otlpDelta values are
+// the change since their start time, otlpCumulative ones accumulate from it.
+const (
+	otlpDelta      = 1
+	otlpCumulative = 2
+)
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpMetric holds one of Gauge, Sum, Histogram, ExponentialHistogram and
+// Summary.
+type otlpMetric struct {
+	Name                 string                    `json:"name"`
+	Unit                 string                    `json:"unit,omitempty"`
+	Gauge                *otlpGauge                `json:"gauge,omitempty"`
+	Sum                  *otlpSum                  `json:"sum,omitempty"`
+	Histogram            *otlpHistogram            `json:"histogram,omitempty"`
+	ExponentialHistogram *otlpExponentialHistogram `json:"exponentialHistogram,omitempty"`
+	Summary              *otlpSummary              `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic,omitempty"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpExponentialHistogram struct {
+	DataPoints             []otlpExponentialHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                                 `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+// otlpNumberDataPoint holds either AsDouble or AsInt.
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string,omitempty"`
+	AsDouble          *otlpFloat     `json:"asDouble,omitempty"`
+	AsInt             *int64         `json:"asInt,string,omitempty"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string,omitempty"`
+	Count             uint64         `json:"count,string,omitempty"`
+	Sum               *otlpFloat     `json:"sum,omitempty"`
+	BucketCounts      []otlpUint64   `json:"bucketCounts,omitempty"`
+	ExplicitBounds    []otlpFloat    `json:"explicitBounds,omitempty"`
+}
+
+type otlpExponentialHistogramDataPoint struct {
+	Attributes        []otlpKeyValue                  `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64                          `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64                          `json:"timeUnixNano,string,omitempty"`
+	Count             uint64                          `json:"count,string,omitempty"`
+	Sum               *otlpFloat                      `json:"sum,omitempty"`
+	Scale             int                             `json:"scale,omitempty"`
+	ZeroCount         uint64                          `json:"zeroCount,string,omitempty"`
+	Positive          otlpExponentialHistogramBuckets `json:"positive"`
+	Negative          otlpExponentialHistogramBuckets `json:"negative"`
+	Min               *otlpFloat                      `json:"min,omitempty"`
+	Max               *otlpFloat                      `json:"max,omitempty"`
+}
+
+type otlpExponentialHistogramBuckets struct {
+	Offset       int          `json:"offset,omitempty"`
+	BucketCounts []otlpUint64 `json:"bucketCounts,omitempty"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64              `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64              `json:"timeUnixNano,string,omitempty"`
+	Count             uint64              `json:"count,string,omitempty"`
+	Sum               otlpFloat           `json:"sum,omitempty"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues,omitempty"`
+}
+
+type otlpQuantileValue struct {
+	Quantile otlpFloat `json:"quantile,omitempty"`
+	Value    otlpFloat `json:"value,omitempty"`
+}
+
+// otlpFloat is a double, rendered in JSON as a number or as "NaN",
+// "Infinity" or "-Infinity".
+type otlpFloat float64
+
+func (f otlpFloat) MarshalJSON() ([]byte, error) {
+	switch v := float64(f); {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return strconv.AppendFloat(nil, float64(f), 'g', -1, 64), nil
+}
+
+// otlpUint64 is an element of a repeated 64-bit integer field, rendered in
+// JSON as a string.
+type otlpUint64 uint64
+
+func (u otlpUint64) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatUint(uint64(u), 10) + `"`), nil
+}
+
+// Wire types of protobuf.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoWriter appends the fields of a protobuf message to a buffer.  Like
+// proto3, it leaves out scalar fields of zero value, but for those of oneofs
+// and optional ones which are written with the must variants.
+type protoWriter struct {
+	binaryWriter
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.putUvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *protoWriter) uvarint(field int, v uint64) {
+	if 0 != v {
+		w.tag(field, protoVarint)
+		w.putUvarint(v)
+	}
+}
+
+// sint is a sint32 or sint64 field, zigzag encoded.
+func (w *protoWriter) sint(field int, v int64) {
+	if 0 != v {
+		w.tag(field, protoVarint)
+		w.putVarint(v)
+	}
+}
+
+func (w *protoWriter) bool(field int, b bool) {
+	if b {
+		w.uvarint(field, 1)
+	}
+}
+
+func (w *protoWriter) fixed64(field int, v uint64) {
+	if 0 != v {
+		w.mustFixed64(field, v)
+	}
+}
+
+func (w *protoWriter) mustFixed64(field int, v uint64) {
+	w.tag(field, protoFixed64)
+	binary.LittleEndian.PutUint64(w.tmp[:8], v)
+	w.buf = append(w.buf, w.tmp[:8]...)
+}
+
+func (w *protoWriter) double(field int, f float64) {
+	if 0 != f {
+		w.mustDouble(field, f)
+	}
+}
+
+func (w *protoWriter) mustDouble(field int, f float64) {
+	w.tag(field, protoFixed64)
+	w.putFloat64(f)
+}
+
+func (w *protoWriter) string(field int, s string) {
+	if "" != s {
+		w.mustString(field, s)
+	}
+}
+
+func (w *protoWriter) mustString(field int, s string) {
+	w.tag(field, protoBytes)
+	w.putString(s)
+}
+
+// message writes m, empty or not.
+func (w *protoWriter) message(field int, m protoMarshaler) {
+	sub := &protoWriter{}
+	m.marshalProto(sub)
+	w.tag(field, protoBytes)
+	w.putBytes(sub.buf)
+}
+
+// packedFixed64 writes a repeated fixed64 or double field, given the bits of
+// its values.
+func (w *protoWriter) packedFixed64(field int, vs []uint64) {
+	if 0 == len(vs) {
+		return
+	}
+	w.tag(field, protoBytes)
+	w.putUvarint(uint64(8 * len(vs)))
+	for _, v := range vs {
+		binary.LittleEndian.PutUint64(w.tmp[:8], v)
+		w.buf = append(w.buf, w.tmp[:8]...)
+	}
+}
+
+func (w *protoWriter) packedUvarint(field int, vs []uint64) {
+	if 0 == len(vs) {
+		return
+	}
+	sub := &protoWriter{}
+	for _, v := range vs {
+		sub.putUvarint(v)
+	}
+	w.tag(field, protoBytes)
+	w.putBytes(sub.buf)
+}
+
+func (w *protoWriter) attributes(field int, kvs []otlpKeyValue) {
+	for i := range kvs {
+		w.message(field, &kvs[i])
+	}
+}
+
+type protoMarshaler interface {
+	marshalProto(w *protoWriter)
+}
+
+func (m *otlpRequest) marshalProto(w *protoWriter) {
+	for i := range m.ResourceMetrics {
+		w.message(1, &m.ResourceMetrics[i])
+	}
+}
+
+func (m *otlpResourceMetrics) marshalProto(w *protoWriter) {
+	w.message(1, &m.Resource)
+	for i := range m.ScopeMetrics {
+		w.message(2, &m.ScopeMetrics[i])
+	}
+}
+
+func (m *otlpResource) marshalProto(w *protoWriter) {
+	w.attributes(1, m.Attributes)
+}
+
+func (m *otlpScopeMetrics) marshalProto(w *protoWriter) {
+	w.message(1, &m.Scope)
+	for _, metric := range m.Metrics {
+		w.message(2, metric)
+	}
+}
+
+func (m *otlpScope) marshalProto(w *protoWriter) {
+	w.string(1, m.Name)
+	w.string(2, m.Version)
+}
+
+func (m *otlpKeyValue) marshalProto(w *protoWriter) {
+	w.string(1, m.Key)
+	w.message(2, &m.Value)
+}
+
+func (m *otlpAnyValue) marshalProto(w *protoWriter) {
+	w.mustString(1, m.StringValue)
+}
+
+func (m *otlpMetric) marshalProto(w *protoWriter) {
+	w.string(1, m.Name)
+	w.string(3, m.Unit)
+	switch {
+	case nil != m.Gauge:
+		w.message(5, m.Gauge)
+	case nil != m.Sum:
+		w.message(7, m.Sum)
+	case nil != m.Histogram:
+		w.message(9, m.Histogram)
+	case nil != m.ExponentialHistogram:
+		w.message(10, m.ExponentialHistogram)
+	case nil != m.Summary:
+		w.message(11, m.Summary)
+	}
+}
+
+func (m *otlpGauge) marshalProto(w *protoWriter) {
+	for i := range m.DataPoints {
+		w.message(1, &m.DataPoints[i])
+	}
+}
+
+func (m *otlpSum) marshalProto(w *protoWriter) {
+	for i := range m.DataPoints {
+		w.message(1, &m.DataPoints[i])
+	}
+	w.uvarint(2, uint64(m.AggregationTemporality))
+	w.bool(3, m.IsMonotonic)
+}
+
+func (m *otlpHistogram) marshalProto(w *protoWriter) {
+	for i := range m.DataPoints {
+		w.message(1, &m.DataPoints[i])
+	}
+	w.uvarint(2, uint64(m.AggregationTemporality))
+}
+
+func (m *otlpExponentialHistogram) marshalProto(w *protoWriter) {
+	for i := range m.DataPoints {
+		w.message(1, &m.DataPoints[i])
+	}
+	w.uvarint(2, uint64(m.AggregationTemporality))
+}
+
+func (m *otlpSummary) marshalProto(w *protoWriter) {
+	for i := range m.DataPoints {
+		w.message(1, &m.DataPoints[i])
+	}
+}
+
+func (m *otlpNumberDataPoint) marshalProto(w *protoWriter) {
+	w.fixed64(2, m.StartTimeUnixNano)
+	w.fixed64(3, m.TimeUnixNano)
+	if nil != m.AsDouble {
+		w.mustDouble(4, float64(*m.AsDouble))
+	}
+	if nil != m.AsInt {
+		w.mustFixed64(6, uint64(*m.AsInt))
+	}
+	w.attributes(7, m.Attributes)
+}
+
+func (m *otlpHistogramDataPoint) marshalProto(w *protoWriter) {
+	w.fixed64(2, m.StartTimeUnixNano)
+	w.fixed64(3, m.TimeUnixNano)
+	w.fixed64(4, m.Count)
+	if nil != m.Sum {
+		w.mustDouble(5, float64(*m.Sum))
+	}
+	counts := make([]uint64, len(m.BucketCounts))
+	for i, c := range m.BucketCounts {
+		counts[i] = uint64(c)
+	}
+	w.packedFixed64(6, counts)
+	bounds := make([]uint64, len(m.ExplicitBounds))
+	for i, b := range m.ExplicitBounds {
+		bounds[i] = math.Float64bits(float64(b))
+	}
+	w.packedFixed64(7, bounds)
+	w.attributes(9, m.Attributes)
+}
+
+func (m *otlpExponentialHistogramDataPoint) marshalProto(w *protoWriter) {
+	w.attributes(1, m.Attributes)
+	w.fixed64(2, m.StartTimeUnixNano)
+	w.fixed64(3, m.TimeUnixNano)
+	w.fixed64(4, m.Count)
+	if nil != m.Sum {
+		w.mustDouble(5, float64(*m.Sum))
+	}
+	w.sint(6, int64(m.Scale))
+	w.fixed64(7, m.ZeroCount)
+	w.message(8, &m.Positive)
+	w.message(9, &m.Negative)
+	if nil != m.Min {
+		w.mustDouble(12, float64(*m.Min))
+	}
+	if nil != m.Max {
+		w.mustDouble(13, float64(*m.Max))
+	}
+}
+
+func (m *otlpExponentialHistogramBuckets) marshalProto(w *protoWriter) {
+	w.sint(1, int64(m.Offset))
+	counts := make([]uint64, len(m.BucketCounts))
+	for i, c := range m.BucketCounts {
+		counts[i] = uint64(c)
+	}
+	w.packedUvarint(2, counts)
+}
+
+func (m *otlpSummaryDataPoint) marshalProto(w *protoWriter) {
+	w.fixed64(2, m.StartTimeUnixNano)
+	w.fixed64(3, m.TimeUnixNano)
+	w.fixed64(4, m.Count)
+	w.double(5, float64(m.Sum))
+	for i := range m.QuantileValues {
+		w.message(6, &m.QuantileValues[i])
+	}
+	w.attributes(7, m.Attributes)
+}
+
+func (m *otlpQuantileValue) marshalProto(w *protoWriter) {
+	w.double(1, float64(m.Quantile))
+	w.double(2, float64(m.Value))
+}
+
+// protoReader iterates over the fields of a protobuf message.  Like a
+// binaryReader, the first error sticks.
+type protoReader struct {
+	binaryReader
+}
+
+// next reads the next field: its number, its wire type and its value, in v
+// for varints and fixed-size fields, in b for length-delimited ones.  It
+// returns false at the end of the message or on error.
+func (r *protoReader) next() (field int, wireType int, v uint64, b []byte, ok bool) {
+	if r.err != nil || 0 == len(r.buf) {
+		return 0, 0, 0, nil, false
+	}
+	key := r.uvarint()
+	field, wireType = int(key>>3), int(key&7)
+	switch wireType {
+	case protoVarint:
+		v = r.uvarint()
+	case protoFixed64:
+		if len(r.buf) < 8 {
+			r.err = InvalidEncoding("truncated fixed64")
+			break
+		}
+		v = binary.LittleEndian.Uint64(r.buf)
+		r.buf = r.buf[8:]
+	case protoFixed32:
+		if len(r.buf) < 4 {
+			r.err = InvalidEncoding("truncated fixed32")
+			break
+		}
+		v = uint64(binary.LittleEndian.Uint32(r.buf))
+		r.buf = r.buf[4:]
+	case protoBytes:
+		b = r.bytes()
+	default:
+		r.err = InvalidEncoding("wire type " + strconv.Itoa(wireType))
+	}
+	return field, wireType, v, b, r.err == nil
+}
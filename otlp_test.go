@@ -0,0 +1,356 @@
+package timemetrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testOTLPRegistry() Registry {
+	r := NewRegistry(60, 10)
+	t0, t := time.Unix(600, 0), time.Unix(660, 500)
+	GetOrRegisterTaggedCounter("http.requests", Tags{"host": "web1"}, r, t0).Inc(t, 3)
+	GetOrRegisterTaggedCounter("http.requests", Tags{"host": "web2"}, r, t0).Inc(t, 4)
+	GetOrRegisterGaugeFloat64("load", r, t0).UpdateFloat64(t, math.NaN())
+	GetOrRegisterBucketHistogram("size", r, t0, []float64{10, 100}).Update(t, 50)
+	tm := GetOrRegisterTimerWithOptions("latency", nil, r, t0, NewUniformSample(100), time.Millisecond, HistogramOptions{Percentiles: []float64{0.5}})
+	tm.Update(t, int64(2*time.Millisecond))
+	tm.Update(t, int64(4*time.Millisecond))
+	return r
+}
+
+func TestWriteOTLPJSON(t *testing.T) {
+	opts := DefaultOTLPOptions()
+	opts.Resource = Tags{"service.name": "api"}
+	var buf bytes.Buffer
+	if err := WriteOTLP(&buf, testOTLPRegistry(), opts, OTLPJSON); nil != err {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "}\n") || 1 != strings.Count(buf.String(), "\n") {
+		t.Errorf("WriteOTLP(): %q is not a line\n", buf.String())
+	}
+	expected := `{"resourceMetrics": [{
+	"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+	"scopeMetrics": [{
+		"scope": {"name": "github.com/mathpl/go-timemetrics"},
+		"metrics": [
+			{"name": "http.requests", "sum": {"aggregationTemporality": 2, "dataPoints": [
+				{"attributes": [{"key": "host", "value": {"stringValue": "web1"}}], "startTimeUnixNano": "600000000000", "timeUnixNano": "660000000500", "asInt": "3"},
+				{"attributes": [{"key": "host", "value": {"stringValue": "web2"}}], "startTimeUnixNano": "600000000000", "timeUnixNano": "660000000500", "asInt": "4"}
+			]}},
+			{"name": "latency", "unit": "ms", "summary": {"dataPoints": [
+				{"startTimeUnixNano": "600000000000", "timeUnixNano": "660000000500", "count": "2", "sum": 6, "quantileValues": [{"quantile": 0.5, "value": 3}]}
+			]}},
+			{"name": "load", "gauge": {"dataPoints": [
+				{"startTimeUnixNano": "600000000000", "timeUnixNano": "660000000500", "asDouble": "NaN"}
+			]}},
+			{"name": "size", "histogram": {"aggregationTemporality": 2, "dataPoints": [
+				{"startTimeUnixNano": "600000000000", "timeUnixNano": "660000000500", "count": "1", "sum": 50, "bucketCounts": ["0", "1", "0"], "explicitBounds": [10, 100]}
+			]}}
+		]
+	}]
+}]}`
+	var got, want interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); nil != err {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(expected), &want); nil != err {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("WriteOTLP():\n%s\n!=\n%s\n", expected, buf.String())
+	}
+}
+
+// protoValue is the value of a field decoded by protoValues.
+type protoValue struct {
+	v uint64
+	b []byte
+}
+
+// protoValues returns the values of the fields at the end of path in the
+// protobuf message data, following the messages of the fields before.
+func protoValues(t *testing.T, data []byte, path ...int) []protoValue {
+	values := []protoValue{{b: data}}
+	for _, field := range path {
+		var next []protoValue
+		for _, value := range values {
+			r := &protoReader{binaryReader{buf: value.b}}
+			for f, _, v, b, ok := r.next(); ok; f, _, v, b, ok = r.next() {
+				if f == field {
+					next = append(next, protoValue{v, b})
+				}
+			}
+			if nil != r.err {
+				t.Fatalf("field %d of %v: %v\n", field, path, r.err)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func TestMarshalOTLP(t *testing.T) {
+	r := testOTLPRegistry()
+	GetOrRegisterMeterWithOptions("events", nil, r, time.Unix(600, 0), MeterOptions{Windows: []time.Duration{time.Minute}, RateUnit: time.Second})
+	h := GetOrRegisterTaggedExponentialHistogram("exp", Tags{"zone": "z"}, r, time.Unix(600, 0), 4)
+	for _, v := range []int64{1, 2, 4, 8, 16, 0, -3} {
+		h.Update(time.Unix(600, 0), v)
+	}
+	data := MarshalOTLP(r, DefaultOTLPOptions())
+
+	if scope := protoValues(t, data, 1, 2, 1, 1); 1 != len(scope) || "github.com/mathpl/go-timemetrics" != string(scope[0].b) {
+		t.Errorf("scope name: %v\n", scope)
+	}
+	var names []string
+	for _, v := range protoValues(t, data, 1, 2, 2, 1) {
+		names = append(names, string(v.b))
+	}
+	if expected := []string{"events", "events.rate", "exp", "http.requests", "latency", "load", "size"}; !reflect.DeepEqual(expected, names) {
+		t.Errorf("metric names: %v != %v\n", expected, names)
+	}
+	metrics := protoValues(t, data, 1, 2, 2)
+
+	// Sums: cumulative temporality, monotonic for meters, as_int values.
+	if v := protoValues(t, metrics[0].b, 7, 3); 1 != len(v) || 1 != v[0].v {
+		t.Errorf("events is_monotonic: %v\n", v)
+	}
+	if v := protoValues(t, metrics[3].b, 7, 3); 0 != len(v) {
+		t.Errorf("http.requests is_monotonic: %v\n", v)
+	}
+	if v := protoValues(t, metrics[3].b, 7, 2); 1 != len(v) || 2 != v[0].v {
+		t.Errorf("http.requests aggregation_temporality: %v\n", v)
+	}
+	var counts []uint64
+	for _, v := range protoValues(t, metrics[3].b, 7, 1, 6) {
+		counts = append(counts, v.v)
+	}
+	if !reflect.DeepEqual([]uint64{3, 4}, counts) {
+		t.Errorf("http.requests as_int: [3 4] != %v\n", counts)
+	}
+	if v := protoValues(t, metrics[3].b, 7, 1, 2); 2 != len(v) || 600e9 != v[0].v {
+		t.Errorf("http.requests start_time_unix_nano: %v\n", v)
+	}
+	if v := protoValues(t, metrics[3].b, 7, 1, 3); 2 != len(v) || 660000000500 != v[0].v {
+		t.Errorf("http.requests time_unix_nano: %v\n", v)
+	}
+
+	// A rate of 0 is written nonetheless, as the value of its oneof.
+	if v := protoValues(t, metrics[1].b, 5, 1, 4); 1 != len(v) || 0 != v[0].v {
+		t.Errorf("events.rate as_double: %v\n", v)
+	}
+	if v := protoValues(t, metrics[1].b, 5, 1, 7, 2, 1); 1 != len(v) || "1min" != string(v[0].b) {
+		t.Errorf("events.rate window: %v\n", v)
+	}
+
+	// Exponential histogram: scale -1, (1/4, 1], (1, 4], (4, 16].
+	dp := protoValues(t, metrics[2].b, 10, 1)[0].b
+	if v := protoValues(t, dp, 6); 1 != len(v) || 1 != v[0].v {
+		t.Errorf("exp scale: zigzag 1 != %v\n", v)
+	}
+	if v := protoValues(t, dp, 7); 1 != len(v) || 1 != v[0].v {
+		t.Errorf("exp zero_count: %v\n", v)
+	}
+	if v := protoValues(t, dp, 8, 1); 1 != len(v) || 1 != v[0].v {
+		t.Errorf("exp positive offset: zigzag -1 != %v\n", v)
+	}
+	if v := protoValues(t, dp, 8, 2); 1 != len(v) || !bytes.Equal([]byte{1, 2, 2}, v[0].b) {
+		t.Errorf("exp positive bucket_counts: [1 2 2] != %v\n", v)
+	}
+	if v := protoValues(t, dp, 12); 1 != len(v) || -3 != math.Float64frombits(v[0].v) {
+		t.Errorf("exp min: %v\n", v)
+	}
+
+	// Histogram: packed bucket counts and bounds.
+	dp = protoValues(t, metrics[6].b, 9, 1)[0].b
+	if v := protoValues(t, dp, 6); 1 != len(v) || 24 != len(v[0].b) || 1 != binary.LittleEndian.Uint64(v[0].b[8:]) {
+		t.Errorf("size bucket_counts: %v\n", v)
+	}
+	if v := protoValues(t, dp, 7); 1 != len(v) || 100 != math.Float64frombits(binary.LittleEndian.Uint64(v[0].b[8:])) {
+		t.Errorf("size explicit_bounds: %v\n", v)
+	}
+
+	// Files of protobuf requests are delimited by their length.
+	var buf bytes.Buffer
+	if err := WriteOTLP(&buf, r, DefaultOTLPOptions(), OTLPProtobuf); nil != err {
+		t.Fatal(err)
+	}
+	br := &binaryReader{buf: buf.Bytes()}
+	if written := br.bytes(); nil != br.end() || !bytes.Equal(data, written) {
+		t.Error("WriteOTLP(): not the delimited request\n")
+	}
+}
+
+// otlpCollector is an in-process stand-in for an OTLP collector, serving the
+// gRPC metrics service over unencrypted HTTP/2.
+type otlpCollector struct {
+	requests chan []byte
+	headers  chan http.Header
+	status   string
+	response []byte
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if 2 != req.ProtoMajor || otlpExportPath != req.URL.Path || "application/grpc" != req.Header.Get("Content-Type") {
+		http.Error(w, "not a gRPC export", http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	if len(body) >= 5 && int(binary.BigEndian.Uint32(body[1:5])) == len(body)-5 {
+		c.requests <- body[5:]
+	}
+	c.headers <- req.Header
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(c.response)))
+	w.Write(append(frame, c.response...))
+	w.Header().Set("Grpc-Status", c.status)
+	if "0" != c.status {
+		w.Header().Set("Grpc-Message", "collector%20unavailable")
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	c := &otlpCollector{requests: make(chan []byte, 1), headers: make(chan http.Header, 1), status: "0"}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: c, Protocols: &protocols}
+	go server.Serve(l)
+	defer server.Close()
+
+	r := testOTLPRegistry()
+	opts := DefaultOTLPOptions()
+	opts.Headers = map[string]string{"Authorization": "Bearer token"}
+	e := NewOTLPExporter(r, l.Addr().String(), opts)
+	defer e.Close()
+	if err := e.Export(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	if msg := <-c.requests; !bytes.Equal(MarshalOTLP(r, opts), msg) {
+		t.Error("collector: not the request of MarshalOTLP\n")
+	}
+	if h := <-c.headers; "Bearer token" != h.Get("Authorization") {
+		t.Errorf("Authorization: %q\n", h.Get("Authorization"))
+	}
+
+	// Partial success: rejected_data_points 2, error_message "bad".
+	c.response = []byte{0x0a, 7, 0x08, 2, 0x12, 3, 'b', 'a', 'd'}
+	err = e.Export(context.Background())
+	if _, ok := err.(OTLPError); !ok || !strings.Contains(err.Error(), "2 data points rejected: bad") {
+		t.Errorf("e.Export(): %v is not a partial success\n", err)
+	}
+	<-c.requests
+	<-c.headers
+
+	c.status, c.response = "14", nil
+	err = e.Export(context.Background())
+	if _, ok := err.(OTLPError); !ok || !strings.Contains(err.Error(), `"14": collector unavailable`) {
+		t.Errorf("e.Export(): %v is not an unavailable collector\n", err)
+	}
+}
+
+func TestOTLPDelta(t *testing.T) {
+	r := NewRegistry(60, 10)
+	c := GetOrRegisterCounter("requests", r, time.Unix(600, 0))
+	c.SetTemporality(Delta)
+	c.Inc(time.Unix(660, 0), 3)
+
+	opts := DefaultOTLPOptions()
+	b := &deltaBaselines{}
+	sum := func() *otlpSum {
+		return newOTLPRequest(r, opts, b).ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum
+	}
+	s := sum()
+	if otlpDelta != s.AggregationTemporality || 3 != *s.DataPoints[0].AsInt || 600e9 != s.DataPoints[0].StartTimeUnixNano {
+		t.Errorf("newOTLPRequest(): %+v is not the first delta\n", s.DataPoints[0])
+	}
+	c.Inc(time.Unix(720, 0), 2)
+	s = sum()
+	if otlpDelta != s.AggregationTemporality || 2 != *s.DataPoints[0].AsInt || 660e9 != s.DataPoints[0].StartTimeUnixNano {
+		t.Errorf("newOTLPRequest(): %+v is not the second delta\n", s.DataPoints[0])
+	}
+	if s = sum(); 0 != *s.DataPoints[0].AsInt {
+		t.Errorf("newOTLPRequest(): %v != 0\n", *s.DataPoints[0].AsInt)
+	}
+
+	s = newOTLPRequest(r, opts, nil).ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum
+	if otlpCumulative != s.AggregationTemporality || 5 != *s.DataPoints[0].AsInt {
+		t.Errorf("newOTLPRequest(): %+v is not cumulative\n", s.DataPoints[0])
+	}
+}
+
+func TestOTLPExporterDeltaRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	c := &otlpCollector{requests: make(chan []byte, 1), headers: make(chan http.Header, 1), status: "14"}
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Handler: c, Protocols: &protocols}
+	go server.Serve(l)
+	defer server.Close()
+
+	r := NewRegistry(60, 10)
+	counter := GetOrRegisterCounter("requests", r, time.Unix(600, 0))
+	counter.SetTemporality(Delta)
+	counter.Inc(time.Unix(660, 0), 3)
+	opts := DefaultOTLPOptions()
+	e := NewOTLPExporter(r, l.Addr().String(), opts)
+	defer e.Close()
+	if err := e.Export(context.Background()); nil == err {
+		t.Fatal("e.Export(): expected an unavailable collector\n")
+	}
+	<-c.requests
+	<-c.headers
+
+	// The failed interval is part of the next delta.
+	counter.Inc(time.Unix(720, 0), 2)
+	c.status = "0"
+	if err := e.Export(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	expected := newOTLPRequest(r, opts, &deltaBaselines{})
+	if s := expected.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum; 5 != *s.DataPoints[0].AsInt || 600e9 != s.DataPoints[0].StartTimeUnixNano {
+		t.Errorf("newOTLPRequest(): %+v is not the delta of both exports\n", s.DataPoints[0])
+	}
+	w := &protoWriter{}
+	expected.marshalProto(w)
+	if msg := <-c.requests; !bytes.Equal(w.buf, msg) {
+		t.Error("collector: not the delta of both exports\n")
+	}
+	<-c.headers
+
+	// Once accepted, the next delta starts there.
+	counter.Inc(time.Unix(780, 0), 1)
+	if err := e.Export(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	b := &deltaBaselines{}
+	b.delta("requests", 5, time.Unix(720, 0))
+	expected = newOTLPRequest(r, opts, b)
+	if s := expected.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum; 1 != *s.DataPoints[0].AsInt || 720e9 != s.DataPoints[0].StartTimeUnixNano {
+		t.Errorf("newOTLPRequest(): %+v is not the delta since the last export\n", s.DataPoints[0])
+	}
+	w = &protoWriter{}
+	expected.marshalProto(w)
+	if msg := <-c.requests; !bytes.Equal(w.buf, msg) {
+		t.Error("collector: not the delta since the last export\n")
+	}
+	<-c.headers
+}
@@ -0,0 +1,330 @@
+package timemetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types of the Prometheus text format and of OpenMetrics.
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// PrometheusHandler is an http.Handler exposing the metrics of a Registry to
+// Prometheus scrapes, in OpenMetrics when the scraper accepts it and in the
+// Prometheus text format otherwise.  See WritePrometheus.
+type PrometheusHandler struct {
+	registry Registry
+}
+
+// NewPrometheusHandler constructs a new PrometheusHandler over the given
+// registry.
+func NewPrometheusHandler(r Registry) *PrometheusHandler {
+	return &PrometheusHandler{registry: r}
+}
+
+func (h *PrometheusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", PrometheusContentType)
+	}
+	WritePrometheus(w, h.registry, openMetrics)
+}
+
+// WritePrometheus renders the metrics of r in the Prometheus text format, or
+// in OpenMetrics.  Every sample is stamped with the GetMaxTime of its metric,
+// its event time, and tagged with the tags of the metric:
+//
+//   - Counters are counters.
+//   - Gauges and GaugeFloat64s are gauges.
+//   - Meters are a counter of their count and a "<name>_rate" gauge of their
+//     rates, labelled with their window, e.g. window="1min".
+//   - BucketHistograms are histograms of cumulative buckets, labelled with
+//     their upper bound, e.g. le="0.5".
+//   - Histograms and Timers are summaries of the percentiles of their
+//     options, labelled with their quantile, the sum being estimated from
+//     the mean of the sample.  Timers are in their unit.
+//
+// Names are sanitized to the Prometheus syntax.  Other metrics, those whose
+// name is taken by a metric of another type, and those with a series, a
+// sample name and labels, already written by another metric once sanitized
+// are left out.
+func WritePrometheus(w io.Writer, r Registry, openMetrics bool) error {
+	var entries []registryEntry
+	r.Each(func(name string, m Metric) {
+		entries = append(entries, registryEntry{name: name, metric: m})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return metricKey(entries[i].name, entries[i].metric.Tags()) < metricKey(entries[j].name, entries[j].metric.Tags())
+	})
+
+	families := make(map[string]*promFamily)
+	written := make(map[string]bool)
+	for _, e := range entries {
+		fs := promFamilies(sanitizePrometheus(e.name, true), e.metric, openMetrics)
+		if promConflict(families, written, fs) {
+			continue
+		}
+		for _, f := range fs {
+			for _, s := range f.samples {
+				written[s.series()] = true
+			}
+		}
+		for _, f := range fs {
+			if existing, ok := families[f.name]; ok {
+				existing.samples = append(existing.samples, f.samples...)
+			} else {
+				families[f.name] = f
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.samples {
+			s.write(bw, openMetrics)
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// promConflict tells whether the families of a metric clash with those
+// already written: a family of another type, or a series written twice.
+func promConflict(families map[string]*promFamily, written map[string]bool, fs []*promFamily) bool {
+	series := make(map[string]bool)
+	for _, f := range fs {
+		if existing, ok := families[f.name]; ok && existing.kind != f.kind {
+			return true
+		}
+		for _, s := range f.samples {
+			key := s.series()
+			if written[key] || series[key] {
+				return true
+			}
+			series[key] = true
+		}
+	}
+	return false
+}
+
+// promFamily is a metric family: samples of one type sharing a name.
+type promFamily struct {
+	name    string
+	kind    string
+	samples []promSample
+}
+
+// promSample is a sample of a family, labelled with the tags of its metric
+// and an optional extra label, e.g. its quantile.
+type promSample struct {
+	name       string
+	tags       Tags
+	label      string
+	labelValue string
+	value      float64
+	time       time.Time
+}
+
+// promFamilies returns the families a metric contributes samples to.
+func promFamilies(name string, m Metric, openMetrics bool) []*promFamily {
+	t := m.GetMaxTime()
+	tags := m.Tags()
+	sample := func(suffix string, v float64) promSample {
+		return promSample{name: name + suffix, tags: tags, value: v, time: t}
+	}
+	counter := func(v int64) *promFamily {
+		if !openMetrics {
+			return &promFamily{name, "counter", []promSample{sample("", float64(v))}}
+		}
+		// OpenMetrics counters are named after their family, which lacks
+		// the _total suffix of their sample.
+		family := strings.TrimSuffix(name, "_total")
+		s := sample("", float64(v))
+		s.name = family + "_total"
+		return &promFamily{family, "counter", []promSample{s}}
+	}
+	summary := func(count int64, mean float64, ps []float64, values []float64, scale float64) *promFamily {
+		f := &promFamily{name: name, kind: "summary"}
+		tags = withoutLabel(tags, "quantile")
+		for i, p := range ps {
+			s := sample("", values[i]/scale)
+			s.label, s.labelValue = "quantile", formatPrometheusFloat(p)
+			f.samples = append(f.samples, s)
+		}
+		f.samples = append(f.samples, sample("_sum", mean*float64(count)/scale), sample("_count", float64(count)))
+		return f
+	}
+
+	switch m := m.(type) {
+	case Counter:
+		return []*promFamily{counter(m.Count())}
+	case Gauge:
+		return []*promFamily{{name, "gauge", []promSample{sample("", float64(m.Value()))}}}
+	case GaugeFloat64:
+		return []*promFamily{{name, "gauge", []promSample{sample("", m.Value())}}}
+	case Meter:
+		count := counter(m.Count())
+		rates := &promFamily{name: name + "_rate", kind: "gauge"}
+		tags = withoutLabel(tags, "window")
+		windows := m.Windows()
+		for i, rate := range m.Rates() {
+			s := sample("_rate", rate)
+			s.label, s.labelValue = "window", strings.TrimPrefix(WindowSuffix(windows[i]), "rate._")
+			rates.samples = append(rates.samples, s)
+		}
+		return []*promFamily{count, rates}
+	case BucketHistogram:
+		f := &promFamily{name: name, kind: "histogram"}
+		tags = withoutLabel(tags, "le")
+		bounds := append(m.Bounds(), math.Inf(1))
+		var cumulative int64
+		for i, c := range m.BucketCounts() {
+			cumulative += c
+			s := sample("_bucket", float64(cumulative))
+			s.label, s.labelValue = "le", formatPrometheusFloat(bounds[i])
+			f.samples = append(f.samples, s)
+		}
+		f.samples = append(f.samples, sample("_sum", float64(m.Sum())), sample("_count", float64(m.Count())))
+		return []*promFamily{f}
+	case Histogram:
+		ps := m.Options().Percentiles
+		return []*promFamily{summary(m.Count(), m.Mean(), ps, m.Percentiles(ps), 1)}
+	case Timer:
+		ps := m.Options().Percentiles
+		return []*promFamily{summary(m.Count(), m.Mean(), ps, m.Percentiles(ps), float64(m.Unit()))}
+	}
+	return nil
+}
+
+// write renders the sample on a line.  The Prometheus text format stamps
+// samples in milliseconds, OpenMetrics in seconds.
+func (s promSample) write(w *bufio.Writer, openMetrics bool) {
+	w.WriteString(s.series())
+	w.WriteByte(' ')
+	w.WriteString(formatPrometheusFloat(s.value))
+	if !s.time.IsZero() {
+		w.WriteByte(' ')
+		if openMetrics {
+			w.WriteString(formatUnixSeconds(s.time))
+		} else {
+			w.WriteString(strconv.FormatInt(s.time.UnixMilli(), 10))
+		}
+	}
+	w.WriteByte('\n')
+}
+
+// series renders the name and labels of the sample, which identify its
+// series.  Tags are sorted by label, so that tags sanitized to the same
+// labels render the same series.
+func (s promSample) series() string {
+	if 0 == len(s.tags) && "" == s.label {
+		return s.name
+	}
+	labels := make([][2]string, 0, len(s.tags))
+	for k, v := range s.tags {
+		label := sanitizePrometheus(k, false)
+		if !strings.HasPrefix(label, "__") {
+			labels = append(labels, [2]string{label, v})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i][0] < labels[j][0] || labels[i][0] == labels[j][0] && labels[i][1] < labels[j][1]
+	})
+	var b strings.Builder
+	b.WriteString(s.name)
+	b.WriteByte('{')
+	sep := ""
+	for _, l := range labels {
+		fmt.Fprintf(&b, "%s%s=\"%s\"", sep, l[0], prometheusEscaper.Replace(l[1]))
+		sep = ","
+	}
+	if s.label != "" {
+		fmt.Fprintf(&b, "%s%s=\"%s\"", sep, s.label, s.labelValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withoutLabel returns tags without the tag named label once sanitized, which
+// is reserved by the family.
+func withoutLabel(tags Tags, label string) Tags {
+	for k := range tags {
+		if sanitizePrometheus(k, false) == label {
+			c := copyTags(tags)
+			delete(c, k)
+			return c
+		}
+	}
+	return tags
+}
+
+// formatPrometheusFloat renders a float in the syntax of Prometheus.
+func formatPrometheusFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// formatUnixSeconds renders t as decimal seconds since the epoch, exactly.
+func formatUnixSeconds(t time.Time) string {
+	sec, ns := t.Unix(), t.Nanosecond()
+	if 0 == ns {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if sec < 0 {
+		// Nanosecond counts forward from the second before t.
+		sec, ns = -(sec + 1), int(time.Second)-ns
+		sign = "-"
+	}
+	return sign + strconv.FormatInt(sec, 10) + strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
+}
+
+// sanitizePrometheus replaces the characters Prometheus rejects in metric
+// names, which unlike label names may hold colons.
+func sanitizePrometheus(s string, metricName bool) string {
+	if "" == s {
+		return "_"
+	}
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r == ':' && metricName:
+			return r
+		}
+		return '_'
+	}, s)
+	if s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,165 @@
+package timemetrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPrometheusRegistry() Registry {
+	r := NewRegistry(60, 10)
+	t := time.Unix(600, 250000000)
+	GetOrRegisterTaggedCounter("http.requests", Tags{"host": "web1", "path": `/a"b`}, r, t).Inc(t, 3)
+	GetOrRegisterTaggedCounter("http.requests", Tags{"host": "web2"}, r, t).Inc(t, 4)
+	GetOrRegisterGauge("queue-depth", r, t).Update(t, 12)
+	GetOrRegisterGaugeFloat64("load", r, t).UpdateFloat64(t, 0.5)
+	GetOrRegisterMeterWithOptions("events", nil, r, t, MeterOptions{Windows: []time.Duration{time.Minute}})
+	h := GetOrRegisterHistogramWithOptions("size", Tags{"quantile": "x"}, r, t, NewUniformSample(100), HistogramOptions{Percentiles: []float64{0.5, 0.9}})
+	for i := 1; i <= 10; i++ {
+		h.Update(t, int64(i))
+	}
+	tm := GetOrRegisterTimerWithOptions("latency", nil, r, t, NewUniformSample(100), time.Millisecond, HistogramOptions{Percentiles: []float64{0.5}})
+	tm.Update(t, int64(2*time.Millisecond))
+	tm.Update(t, int64(4*time.Millisecond))
+	// A counter whose name is taken by the histogram is left out.
+	GetOrRegisterTaggedCounter("size", Tags{"zone": "z"}, r, t).Inc(t, 1)
+	return r
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, testPrometheusRegistry(), false); nil != err {
+		t.Fatal(err)
+	}
+	expected := `# TYPE events counter
+events 0 600250
+# TYPE events_rate gauge
+events_rate{window="1min"} 0 600250
+# TYPE http_requests counter
+http_requests{host="web1",path="/a\"b"} 3 600250
+http_requests{host="web2"} 4 600250
+# TYPE latency summary
+latency{quantile="0.5"} 3 600250
+latency_sum 6 600250
+latency_count 2 600250
+# TYPE load gauge
+load 0.5 600250
+# TYPE queue_depth gauge
+queue_depth 12 600250
+# TYPE size summary
+size{quantile="0.5"} 5.5 600250
+size{quantile="0.9"} 9.9 600250
+size_sum 55 600250
+size_count 10 600250
+`
+	if expected != buf.String() {
+		t.Errorf("WritePrometheus():\n%s\n!=\n%s\n", expected, buf.String())
+	}
+}
+
+func TestWritePrometheusDuplicateSeries(t *testing.T) {
+	r := NewRegistry(60, 10)
+	ts := time.Unix(1000, 0)
+	GetOrRegisterCounter("a.b", r, ts).Inc(ts, 1)
+	GetOrRegisterCounter("a_b", r, ts).Inc(ts, 2)
+	GetOrRegisterTaggedCounter("c", Tags{"x.y": "1"}, r, ts).Inc(ts, 3)
+	GetOrRegisterTaggedCounter("c", Tags{"x_y": "1"}, r, ts).Inc(ts, 4)
+	GetOrRegisterHistogramWithOptions("d", nil, r, ts, NewUniformSample(10), HistogramOptions{Percentiles: []float64{0.5}})
+	GetOrRegisterGauge("d_count", r, ts).Update(ts, 5)
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, r, false); nil != err {
+		t.Fatal(err)
+	}
+	expected := `# TYPE a_b counter
+a_b 1 1000000
+# TYPE c counter
+c{x_y="1"} 3 1000000
+# TYPE d summary
+d{quantile="0.5"} 0 1000000
+d_sum 0 1000000
+d_count 0 1000000
+`
+	if expected != buf.String() {
+		t.Errorf("WritePrometheus():\n%s\n!=\n%s\n", expected, buf.String())
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, testPrometheusRegistry(), true); nil != err {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE http_requests counter\n",
+		`http_requests_total{host="web2"} 4 600.25` + "\n",
+		"events_total 0 600.25\n",
+		"load 0.5 600.25\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("WritePrometheus(): %q not in\n%s\n", line, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("WritePrometheus(): no # EOF in\n%s\n", out)
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	r := NewRegistry(60, 10)
+	GetOrRegisterCounter("foo", r, time.Unix(600, 0)).Inc(time.Unix(600, 0), 1)
+	// Metrics never updated are not stamped.
+	r.Register("bar", NewGauge(time.Time{}, 10))
+	h := NewPrometheusHandler(r)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body, _ := io.ReadAll(rec.Body)
+	if ct := rec.Header().Get("Content-Type"); PrometheusContentType != ct {
+		t.Errorf("Content-Type: %v != %v\n", PrometheusContentType, ct)
+	}
+	if expected := "# TYPE bar gauge\nbar 0\n# TYPE foo counter\nfoo 1 600000\n"; expected != string(body) {
+		t.Errorf("body: %q != %q\n", expected, body)
+	}
+
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body, _ = io.ReadAll(rec.Body)
+	if ct := rec.Header().Get("Content-Type"); OpenMetricsContentType != ct {
+		t.Errorf("Content-Type: %v != %v\n", OpenMetricsContentType, ct)
+	}
+	if expected := "# TYPE bar gauge\nbar 0\n# TYPE foo counter\nfoo_total 1 600\n# EOF\n"; expected != string(body) {
+		t.Errorf("body: %q != %q\n", expected, body)
+	}
+}
+
+func TestPrometheusFormats(t *testing.T) {
+	for s, expected := range map[string]string{
+		"foo.bar-baz": "foo_bar_baz",
+		"a:b":         "a:b",
+		"9lives":      "_9lives",
+		"":            "_",
+	} {
+		if got := sanitizePrometheus(s, true); expected != got {
+			t.Errorf("sanitizePrometheus(%q): %q != %q\n", s, expected, got)
+		}
+	}
+	if got := sanitizePrometheus("a:b", false); "a_b" != got {
+		t.Errorf("sanitizePrometheus(\"a:b\", false): \"a_b\" != %q\n", got)
+	}
+	for ts, expected := range map[time.Time]string{
+		time.Unix(1, 0):          "1",
+		time.Unix(1, 500000000):  "1.5",
+		time.Unix(-2, 500000000): "-1.5",
+		time.Unix(-1, 999999999): "-0.000000001",
+	} {
+		if got := formatUnixSeconds(ts); expected != got {
+			t.Errorf("formatUnixSeconds(%v): %q != %q\n", ts, expected, got)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package timemetrics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DuplicateMetric is the error returned by Registry.Register when a metric
+// already exists.  If you mean to Register that metric you must first
+// Unregister the existing metric.
+type DuplicateMetric string
+
+func (err DuplicateMetric) Error() string {
+	return fmt.Sprintf("duplicate metric: %s", string(err))
+}
+
+// MetricConstructor builds a new Metric with the given tags, stamped with the
+// event time t of its first update, using the EWMA interval (in seconds) and
+// stale threshold (in minutes) of the Registry it is being registered in.
+type MetricConstructor func(t time.Time, tags Tags, interval int, staleThreshold int) Metric
+
+// A Registry holds references to a set of metrics by name and tags and can
+// iterate over them, calling callback functions provided by the user.
+//
+// This is an interface so as to encourage other structs to implement
+// the Registry API as appropriate.
+type Registry interface {
+
+	// Call the given function for each registered metric.
+	Each(func(string, Metric))
+
+	// Event time at which the metric by the given name and tags was
+	// registered, the zero time if none is registered.
+	Created(string, Tags) time.Time
+
+	// Get the metric by the given name and tags or nil if none is registered.
+	Get(string, Tags) Metric
+
+	// Gets an existing metric or builds and registers a new one at the given
+	// event time.
+	GetOrRegister(string, Tags, time.Time, MetricConstructor) Metric
+
+	// Register the given metric under the given name and its tags.
+	Register(string, Metric) error
+
+	// Unregister the metric with the given name and tags.
+	Unregister(string, Tags)
+
+	// Unregister all metrics.
+	UnregisterAll()
+
+	// EWMA interval, in seconds, given to new metrics.
+	Interval() int
+
+	// Stale threshold, in minutes, given to new metrics.
+	StaleThreshold() int
+
+	// Write a snapshot of all metrics.
+	Checkpoint(io.Writer) error
+
+	// Register the metrics of a snapshot written by Checkpoint.
+	Restore(io.Reader) error
+}
+
+// The standard implementation of a Registry is a mutex-protected map
+// of names and sorted tags to metrics.
+type StandardRegistry struct {
+	metrics        map[string]registryEntry
+	mutex          sync.Mutex
+	interval       int
+	staleThreshold int
+}
+
+// NewRegistry constructs a new StandardRegistry whose metrics are built with
+// the given EWMA interval (in seconds) and stale threshold (in minutes).
+func NewRegistry(interval int, staleThreshold int) Registry {
+	return &StandardRegistry{
+		metrics:        make(map[string]registryEntry),
+		interval:       interval,
+		staleThreshold: staleThreshold,
+	}
+}
+
+// Each calls the given function for each registered metric.  The registry is
+// not locked while f runs, so f may register and unregister metrics.
+func (r *StandardRegistry) Each(f func(string, Metric)) {
+	for _, e := range r.registered() {
+		f(e.name, e.metric)
+	}
+}
+
+// Created returns the event time at which the metric by the given name and
+// tags was registered: the time given to GetOrRegister, or the GetMaxTime of
+// the metric when given to Register.  It is the zero time if no metric is
+// registered.
+func (r *StandardRegistry) Created(name string, tags Tags) time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.metrics[metricKey(name, tags)].created
+}
+
+// Get the metric by the given name and tags or nil if none is registered.
+func (r *StandardRegistry) Get(name string, tags Tags) Metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.metrics[metricKey(name, tags)].metric
+}
+
+// GetOrRegister gets an existing metric or, if none is registered under the
+// given name and tags, builds one with the given constructor at event time t
+// and registers it.  This allows for lazy instantiation of metrics in the
+// hot path of event processing.
+func (r *StandardRegistry) GetOrRegister(name string, tags Tags, t time.Time, c MetricConstructor) Metric {
+	key := metricKey(name, tags)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if e, ok := r.metrics[key]; ok {
+		return e.metric
+	}
+	m := c(t, tags, r.interval, r.staleThreshold)
+	r.metrics[key] = registryEntry{name, m, t}
+	return m
+}
+
+// Register the given metric under the given name and its tags.  Returns a
+// DuplicateMetric if a metric by the given name and tags is already
+// registered.
+func (r *StandardRegistry) Register(name string, m Metric) error {
+	key := metricKey(name, m.Tags())
+	created := m.GetMaxTime()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.metrics[key]; ok {
+		return DuplicateMetric(strings.TrimSpace(name + " " + m.Tags().String()))
+	}
+	r.metrics[key] = registryEntry{name, m, created}
+	return nil
+}
+
+// Unregister the metric with the given name and tags.
+func (r *StandardRegistry) Unregister(name string, tags Tags) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.metrics, metricKey(name, tags))
+}
+
+// UnregisterAll unregisters all metrics.
+func (r *StandardRegistry) UnregisterAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = make(map[string]registryEntry)
+}
+
+// Interval returns the EWMA interval, in seconds, given to new metrics.
+func (r *StandardRegistry) Interval() int {
+	return r.interval
+}
+
+// StaleThreshold returns the stale threshold, in minutes, given to new
+// metrics.
+func (r *StandardRegistry) StaleThreshold() int {
+	return r.staleThreshold
+}
+
+func (r *StandardRegistry) registered() []registryEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entries := make([]registryEntry, 0, len(r.metrics))
+	for _, e := range r.metrics {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+type registryEntry struct {
+	name    string
+	metric  Metric
+	created time.Time
+}
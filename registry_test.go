@@ -0,0 +1,148 @@
+package timemetrics
+
+import (
+	"testing"
+	"time"
+)
+
+func BenchmarkRegistry(b *testing.B) {
+	r := NewRegistry(60, 10)
+	r.Register("foo", NewCounter(time.Unix(0, 0), 10))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Each(func(string, Metric) {})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry(60, 10)
+	r.Register("foo", NewCounter(time.Unix(0, 0), 10))
+	i := 0
+	r.Each(func(name string, m Metric) {
+		i++
+		if "foo" != name {
+			t.Fatal(name)
+		}
+		if _, ok := m.(Counter); !ok {
+			t.Fatal(m)
+		}
+	})
+	if 1 != i {
+		t.Fatal(i)
+	}
+	r.Unregister("foo", nil)
+	i = 0
+	r.Each(func(string, Metric) { i++ })
+	if 0 != i {
+		t.Fatal(i)
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	r := NewRegistry(60, 10)
+	if err := r.Register("foo", NewCounter(time.Unix(0, 0), 10)); nil != err {
+		t.Fatal(err)
+	}
+	if err := r.Register("foo", NewCounter(time.Unix(0, 0), 10)); nil == err {
+		t.Fatal(err)
+	}
+	i := 0
+	r.Each(func(string, Metric) { i++ })
+	if 1 != i {
+		t.Fatal(i)
+	}
+}
+
+func TestRegistryGet(t *testing.T) {
+	r := NewRegistry(60, 10)
+	if m := r.Get("foo", nil); nil != m {
+		t.Fatal(m)
+	}
+	r.Register("foo", NewCounter(time.Unix(0, 0), 10))
+	if count := r.Get("foo", nil).(Counter).Count(); 0 != count {
+		t.Fatal(count)
+	}
+	r.Get("foo", nil).(Counter).Inc(time.Unix(1, 0), 1)
+	if count := r.Get("foo", nil).(Counter).Count(); 1 != count {
+		t.Fatal(count)
+	}
+}
+
+func TestRegistryGetOrRegister(t *testing.T) {
+	r := NewRegistry(30, 5)
+	first := time.Unix(100, 0)
+	calls := 0
+	ctor := func(ct time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		calls++
+		if !ct.Equal(first) {
+			t.Errorf("event time: %v != %v\n", first, ct)
+		}
+		if 30 != interval {
+			t.Errorf("interval: 30 != %v\n", interval)
+		}
+		if 5 != staleThreshold {
+			t.Errorf("staleThreshold: 5 != %v\n", staleThreshold)
+		}
+		return NewCounter(ct, staleThreshold)
+	}
+	m1 := r.GetOrRegister("foo", nil, first, ctor)
+	m2 := r.GetOrRegister("foo", nil, time.Unix(200, 0), ctor)
+	if m1 != m2 {
+		t.Fatal(m1, m2)
+	}
+	if 1 != calls {
+		t.Fatal(calls)
+	}
+	if maxTime := m1.GetMaxTime(); !maxTime.Equal(first) {
+		t.Errorf("m.GetMaxTime(): %v != %v\n", first, maxTime)
+	}
+	m1.(Counter).Inc(time.Unix(300, 0), 1)
+	if created := r.Created("foo", nil); !created.Equal(first) {
+		t.Errorf("r.Created(\"foo\"): %v != %v\n", first, created)
+	}
+}
+
+func TestRegistryCreated(t *testing.T) {
+	r := NewRegistry(60, 10)
+	if created := r.Created("foo", nil); !created.IsZero() {
+		t.Errorf("r.Created(\"foo\"): %v is not the zero time\n", created)
+	}
+	r.Register("foo", NewCounter(time.Unix(100, 0), 10))
+	if created := r.Created("foo", nil); !created.Equal(time.Unix(100, 0)) {
+		t.Errorf("r.Created(\"foo\"): %v != %v\n", time.Unix(100, 0), created)
+	}
+}
+
+func TestRegistryUnregisterAll(t *testing.T) {
+	r := NewRegistry(60, 10)
+	r.Register("foo", NewCounter(time.Unix(0, 0), 10))
+	r.Register("bar", NewCounter(time.Unix(0, 0), 10))
+	r.UnregisterAll()
+	i := 0
+	r.Each(func(string, Metric) { i++ })
+	if 0 != i {
+		t.Fatal(i)
+	}
+}
+
+func TestRegistryTypedHelpers(t *testing.T) {
+	r := NewRegistry(60, 10)
+	now := time.Unix(1000, 0)
+	GetOrRegisterCounter("counter", r, now).Inc(now, 47)
+	if c := GetOrRegisterCounter("counter", r, now); 47 != c.Count() {
+		t.Fatal(c)
+	}
+	GetOrRegisterMeter("meter", r, now).Mark(now, 3)
+	if m := GetOrRegisterMeter("meter", r, now); 3 != m.Count() {
+		t.Fatal(m)
+	}
+	s := NewUniformSample(100)
+	GetOrRegisterHistogram("histogram", r, now, s).Update(now, 47)
+	h := GetOrRegisterHistogram("histogram", r, now, s)
+	if 1 != h.Count() {
+		t.Fatal(h)
+	}
+	if h.Stale(now) {
+		t.Error("new histogram is stale")
+	}
+}
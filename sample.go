@@ -2,6 +2,7 @@ package timemetrics
 
 import (
 	"container/heap"
+	"fmt"
 	"math"
 	"math/rand"
 	"sort"
@@ -30,14 +31,33 @@ type Sample interface {
 	ZeroOut()
 }
 
+// MergeableSamples summarize values such that the summaries of several
+// streams, e.g. the same job on different hosts, can be merged into the
+// summary of all of them, and shipped around as bytes to be merged.
+type MergeableSample interface {
+	Sample
+	Merge(Sample) error
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary([]byte) error
+}
+
+// IncompatibleSample is the error returned by MergeableSample.Merge when the
+// other sample is not of the same kind.
+type IncompatibleSample string
+
+func (err IncompatibleSample) Error() string {
+	return fmt.Sprintf("incompatible sample: %s", string(err))
+}
+
 // ExpDecaySample is an exponentially-decaying sample using a forward-decaying
 // priority reservoir.  See Cormode et al's "Forward Decay: A Practical Time
 // Decay Model for Streaming Systems".
 //
 // <http://www.research.att.com/people/Cormode_Graham/library/publications/CormodeShkapenyukSrivastavaXu09.pdf>
 type ExpDecaySample struct {
+	count            int64 // /!\ this should be the first member to ensure 64-bit alignment
 	alpha            float64
-	count            int64
+	mutex            sync.Mutex
 	reservoirSize    int
 	t0, t1           time.Time
 	values           expDecaySampleHeap
@@ -60,7 +80,9 @@ func NewExpDecaySample(t time.Time, reservoirSize int, alpha float64, rescaleThr
 
 // Clear clears all samples.
 func (s *ExpDecaySample) Clear(t time.Time) {
-	s.count = 0
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, 0)
 	s.t0 = t
 	s.t1 = s.t0.Add(s.rescaleThreshold)
 	s.values = make(expDecaySampleHeap, 0, s.reservoirSize)
@@ -102,6 +124,8 @@ func (s *ExpDecaySample) Percentiles(ps []float64) []float64 {
 
 // Size returns the size of the sample, which is at most the reservoir size.
 func (s *ExpDecaySample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return len(s.values)
 }
 
@@ -122,6 +146,8 @@ func (s *ExpDecaySample) Update(t time.Time, v int64) {
 
 // Values returns a copy of the values in the sample.
 func (s *ExpDecaySample) Values() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	values := make([]int64, len(s.values))
 	for i, v := range s.values {
 		values[i] = v.v
@@ -137,12 +163,22 @@ func (s *ExpDecaySample) Variance() float64 {
 // update samples a new value at a particular timestamp.  This is a method all
 // its own to facilitate testing.
 func (s *ExpDecaySample) update(t time.Time, v int64) {
-	s.count++
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, 1)
 	if len(s.values) == s.reservoirSize {
 		heap.Pop(&s.values)
 	}
+	// Priorities grow from the landmark t0.  A value older than t0, as
+	// accepted by the late policy of its metric, is weighted as of t0: its
+	// weight would otherwise shrink to nothing, or zero for old enough
+	// values, which then never make it into the reservoir.
+	elapsed := t.Sub(s.t0).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
 	heap.Push(&s.values, expDecaySample{
-		k: math.Exp(t.Sub(s.t0).Seconds()*s.alpha) / rand.Float64(),
+		k: math.Exp(elapsed*s.alpha) / rand.Float64(),
 		v: v,
 	})
 	if t.After(s.t1) {
@@ -152,7 +188,7 @@ func (s *ExpDecaySample) update(t time.Time, v int64) {
 		s.t0 = t
 		s.t1 = s.t0.Add(s.rescaleThreshold)
 		for _, v := range values {
-			v.k = v.k * math.Exp(-s.alpha*float64(s.t0.Sub(t0)))
+			v.k = v.k * math.Exp(-s.alpha*s.t0.Sub(t0).Seconds())
 			heap.Push(&s.values, v)
 		}
 	}
@@ -163,7 +199,84 @@ func (s *ExpDecaySample) GetWindow() time.Duration {
 }
 
 func (s *ExpDecaySample) ZeroOut() {
-	s.values = make(expDecaySampleHeap, 0, 1)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values = make(expDecaySampleHeap, 0, s.reservoirSize)
+}
+
+// expDecayEncodingVersion is the version of the encoding of ExpDecaySamples.
+const expDecayEncodingVersion = 1
+
+// maxReservoirSize is the largest reservoir size decoded by UnmarshalBinary:
+// reservoirs are allocated up front, a corrupt size must not exhaust memory.
+const maxReservoirSize = 1 << 24
+
+// reservoirSize reads the size of a reservoir, failing unless it is between
+// 1 and maxReservoirSize.
+func (r *binaryReader) reservoirSize() int {
+	size := r.uvarint()
+	if r.err == nil && (size < 1 || size > maxReservoirSize) {
+		r.err = InvalidEncoding(fmt.Sprintf("reservoir of %d values", size))
+		return 0
+	}
+	return int(size)
+}
+
+// MarshalBinary encodes the sample, the landmarks t0 and t1 and the priority
+// of every value included, so it resumes where it left off.
+func (s *ExpDecaySample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w := &binaryWriter{}
+	w.putHeader(expDecayEncoding, expDecayEncodingVersion)
+	w.putUvarint(uint64(atomic.LoadInt64(&s.count)))
+	w.putFloat64(s.alpha)
+	w.putUvarint(uint64(s.reservoirSize))
+	w.putDuration(s.rescaleThreshold)
+	w.putTimestamp(s.t0)
+	w.putTimestamp(s.t1)
+	w.putUvarint(uint64(len(s.values)))
+	for _, v := range s.values {
+		w.putFloat64(v.k)
+		w.putVarint(v.v)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the sample by the one encoded in data by
+// MarshalBinary.
+func (s *ExpDecaySample) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(expDecayEncoding, expDecayEncodingVersion)
+	count := r.uvarint()
+	alpha := r.float64()
+	reservoirSize := r.reservoirSize()
+	rescaleThreshold := r.duration()
+	t0 := r.timestamp()
+	t1 := r.timestamp()
+	n := r.count(9)
+	if r.err == nil && n > reservoirSize {
+		return InvalidEncoding(fmt.Sprintf("%d values in a reservoir of %d", n, reservoirSize))
+	}
+	values := make(expDecaySampleHeap, n, max(n, reservoirSize))
+	for i := range values {
+		values[i].k = r.float64()
+		values[i].v = r.varint()
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+	heap.Init(&values)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, int64(count))
+	s.alpha = alpha
+	s.reservoirSize = reservoirSize
+	s.rescaleThreshold = rescaleThreshold
+	s.t0, s.t1 = t0, t1
+	s.values = values
+	return nil
 }
 
 // SampleMax returns the maximum value of the slice of int64.
@@ -278,7 +391,7 @@ func NewUniformSample(reservoirSize int) Sample {
 func (s *UniformSample) Clear(time.Time) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.count = 0
+	atomic.StoreInt64(&s.count, 0)
 	s.values = make([]int64, 0, s.reservoirSize)
 }
 
@@ -351,7 +464,7 @@ func (s *UniformSample) Sum() int64 {
 func (s *UniformSample) Update(t time.Time, v int64) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.count++
+	atomic.AddInt64(&s.count, 1)
 	if len(s.values) < s.reservoirSize {
 		s.values = append(s.values, v)
 	} else {
@@ -380,9 +493,240 @@ func (s *UniformSample) GetWindow() time.Duration {
 }
 
 func (s *UniformSample) ZeroOut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.values = make([]int64, 1)
 }
 
+// uniformEncodingVersion is the version of the encoding of UniformSamples.
+const uniformEncodingVersion = 1
+
+// MarshalBinary encodes the sample and its values.
+func (s *UniformSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w := &binaryWriter{}
+	w.putHeader(uniformEncoding, uniformEncodingVersion)
+	w.putUvarint(uint64(atomic.LoadInt64(&s.count)))
+	w.putUvarint(uint64(s.reservoirSize))
+	w.putUvarint(uint64(len(s.values)))
+	for _, v := range s.values {
+		w.putVarint(v)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the sample by the one encoded in data by
+// MarshalBinary.
+func (s *UniformSample) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(uniformEncoding, uniformEncodingVersion)
+	count := r.uvarint()
+	reservoirSize := r.reservoirSize()
+	values := make([]int64, r.count(1))
+	for i := range values {
+		values[i] = r.varint()
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+	if len(values) > reservoirSize {
+		return InvalidEncoding(fmt.Sprintf("%d values in a reservoir of %d", len(values), reservoirSize))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, int64(count))
+	s.reservoirSize = reservoirSize
+	s.values = values
+	return nil
+}
+
+// SlidingTimeWindowSample is a sample of exactly the values whose event times
+// fall within the window before the newest event time, e.g. the last 60
+// seconds of log time.  Values may arrive out of order; those which are
+// already out of the window are counted but not kept.
+type SlidingTimeWindowSample struct {
+	count  int64 // /!\ this should be the first member to ensure 64-bit alignment
+	mutex  sync.Mutex
+	window time.Duration
+	newest time.Time
+	values []timeValueTuple // sorted by event time
+	head   int              // index of the first value in the window
+}
+
+// NewSlidingTimeWindowSample constructs a new sliding time window sample
+// keeping the values of the given window.
+func NewSlidingTimeWindowSample(window time.Duration) Sample {
+	return &SlidingTimeWindowSample{window: window}
+}
+
+// Clear clears all samples.
+func (s *SlidingTimeWindowSample) Clear(time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, 0)
+	s.newest = time.Time{}
+	s.values = nil
+	s.head = 0
+}
+
+// Count returns the number of samples recorded, which may exceed the number
+// of values in the window.
+func (s *SlidingTimeWindowSample) Count() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+// Max returns the maximum value in the window.
+func (s *SlidingTimeWindowSample) Max() int64 {
+	return SampleMax(s.Values())
+}
+
+// Mean returns the mean of the values in the window.
+func (s *SlidingTimeWindowSample) Mean() float64 {
+	return SampleMean(s.Values())
+}
+
+// Min returns the minimum value in the window.
+func (s *SlidingTimeWindowSample) Min() int64 {
+	return SampleMin(s.Values())
+}
+
+// Percentile returns an arbitrary percentile of values in the window.
+func (s *SlidingTimeWindowSample) Percentile(p float64) float64 {
+	return SamplePercentile(s.Values(), p)
+}
+
+// Percentiles returns a slice of arbitrary percentiles of values in the
+// window.
+func (s *SlidingTimeWindowSample) Percentiles(ps []float64) []float64 {
+	return SamplePercentiles(s.Values(), ps)
+}
+
+// Size returns the number of values in the window.
+func (s *SlidingTimeWindowSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.values) - s.head
+}
+
+// StdDev returns the standard deviation of the values in the window.
+func (s *SlidingTimeWindowSample) StdDev() float64 {
+	return SampleStdDev(s.Values())
+}
+
+// Sum returns the sum of the values in the window.
+func (s *SlidingTimeWindowSample) Sum() int64 {
+	return SampleSum(s.Values())
+}
+
+// Update samples a new value at event time t and slides the window if t is
+// the newest event time.
+func (s *SlidingTimeWindowSample) Update(t time.Time, v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, 1)
+	if t.After(s.newest) {
+		s.newest = t
+	}
+	start := s.newest.Add(-s.window)
+	if !t.After(start) {
+		return
+	}
+
+	i := s.head + sort.Search(len(s.values)-s.head, func(i int) bool { return s.values[s.head+i].t.After(t) })
+	s.values = append(s.values, timeValueTuple{})
+	copy(s.values[i+1:], s.values[i:])
+	s.values[i] = timeValueTuple{v: v, t: t}
+
+	// Expired values are skipped rather than shifted out one update at a
+	// time, and only dropped once they make up half of the values.
+	s.head += sort.Search(len(s.values)-s.head, func(i int) bool { return s.values[s.head+i].t.After(start) })
+	if s.head > len(s.values)/2 {
+		n := copy(s.values, s.values[s.head:])
+		s.values = s.values[:n]
+		s.head = 0
+	}
+}
+
+// Values returns a copy of the values in the window.
+func (s *SlidingTimeWindowSample) Values() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	values := make([]int64, len(s.values)-s.head)
+	for i, tv := range s.values[s.head:] {
+		values[i] = tv.v
+	}
+	return values
+}
+
+// Variance returns the variance of the values in the window.
+func (s *SlidingTimeWindowSample) Variance() float64 {
+	return SampleVariance(s.Values())
+}
+
+func (s *SlidingTimeWindowSample) GetWindow() time.Duration {
+	return s.window
+}
+
+func (s *SlidingTimeWindowSample) ZeroOut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values = nil
+	s.head = 0
+}
+
+// slidingWindowEncodingVersion is the version of the encoding of
+// SlidingTimeWindowSamples.
+const slidingWindowEncodingVersion = 1
+
+// MarshalBinary encodes the sample and its values with their event times.
+func (s *SlidingTimeWindowSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w := &binaryWriter{}
+	w.putHeader(slidingWindowEncoding, slidingWindowEncodingVersion)
+	w.putUvarint(uint64(atomic.LoadInt64(&s.count)))
+	w.putDuration(s.window)
+	w.putTimestamp(s.newest)
+	w.putUvarint(uint64(len(s.values) - s.head))
+	for _, v := range s.values[s.head:] {
+		w.putTimestamp(v.t)
+		w.putVarint(v.v)
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the sample by the one encoded in data by
+// MarshalBinary.
+func (s *SlidingTimeWindowSample) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(slidingWindowEncoding, slidingWindowEncodingVersion)
+	count := r.uvarint()
+	window := r.duration()
+	newest := r.timestamp()
+	values := make([]timeValueTuple, r.count(3))
+	for i := range values {
+		values[i].t = r.timestamp()
+		values[i].v = r.varint()
+		if r.err == nil && i > 0 && values[i].t.Before(values[i-1].t) {
+			return InvalidEncoding("values out of order")
+		}
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, int64(count))
+	s.window = window
+	s.newest = newest
+	s.values = values
+	s.head = 0
+	return nil
+}
+
 // expDecaySample represents an individual sample in a heap.
 type expDecaySample struct {
 	k float64
@@ -426,3 +770,102 @@ type int64Slice []int64
 func (p int64Slice) Len() int           { return len(p) }
 func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// sampleStats keeps the exact statistics of the values summarized by a
+// Sample which does not keep the values themselves.  The mean and variance
+// are computed with Welford's online algorithm and merged with Chan et al's
+// parallel one.
+type sampleStats struct {
+	n        int64
+	min, max int64
+	sum      int64
+	mean, m2 float64
+}
+
+func (s *sampleStats) reset() {
+	*s = sampleStats{min: math.MaxInt64, max: math.MinInt64}
+}
+
+func (s *sampleStats) update(v int64) {
+	s.n++
+	if v < s.min {
+		s.min = v
+	}
+	if v > s.max {
+		s.max = v
+	}
+	s.sum += v
+	d := float64(v) - s.mean
+	s.mean += d / float64(s.n)
+	s.m2 += d * (float64(v) - s.mean)
+}
+
+func (s *sampleStats) merge(o sampleStats) {
+	if 0 == o.n {
+		return
+	}
+	if 0 == s.n {
+		*s = o
+		return
+	}
+	n := float64(s.n + o.n)
+	d := o.mean - s.mean
+	s.mean += d * float64(o.n) / n
+	s.m2 += o.m2 + d*d*float64(s.n)*float64(o.n)/n
+	s.n += o.n
+	if o.min < s.min {
+		s.min = o.min
+	}
+	if o.max > s.max {
+		s.max = o.max
+	}
+	s.sum += o.sum
+}
+
+// maxValue returns the maximum value, zero if there is none.
+func (s *sampleStats) maxValue() int64 {
+	if 0 == s.n {
+		return 0
+	}
+	return s.max
+}
+
+// minValue returns the minimum value, zero if there is none.
+func (s *sampleStats) minValue() int64 {
+	if 0 == s.n {
+		return 0
+	}
+	return s.min
+}
+
+func (s *sampleStats) variance() float64 {
+	if 0 == s.n {
+		return 0.0
+	}
+	return s.m2 / float64(s.n)
+}
+
+func (s *sampleStats) marshal(w *binaryWriter) {
+	w.putUvarint(uint64(s.n))
+	if 0 == s.n {
+		return
+	}
+	w.putVarint(s.min)
+	w.putVarint(s.max)
+	w.putVarint(s.sum)
+	w.putFloat64(s.mean)
+	w.putFloat64(s.m2)
+}
+
+func (s *sampleStats) unmarshal(r *binaryReader) {
+	s.reset()
+	s.n = int64(r.uvarint())
+	if 0 == s.n {
+		return
+	}
+	s.min = r.varint()
+	s.max = r.varint()
+	s.sum = r.varint()
+	s.mean = r.float64()
+	s.m2 = r.float64()
+}
@@ -1,3 +1,5 @@
+//go:debug randseednop=0
+
 package timemetrics
 
 import (
@@ -55,15 +57,15 @@ func BenchmarkCopy1000000(b *testing.B) {
 }
 
 func BenchmarkExpDecaySample257(b *testing.B) {
-	benchmarkSample(b, NewExpDecaySample(257, 0.015))
+	benchmarkSample(b, NewExpDecaySample(time.Now(), 257, 0.015, 60))
 }
 
 func BenchmarkExpDecaySample514(b *testing.B) {
-	benchmarkSample(b, NewExpDecaySample(514, 0.015))
+	benchmarkSample(b, NewExpDecaySample(time.Now(), 514, 0.015, 60))
 }
 
 func BenchmarkExpDecaySample1028(b *testing.B) {
-	benchmarkSample(b, NewExpDecaySample(1028, 0.015))
+	benchmarkSample(b, NewExpDecaySample(time.Now(), 1028, 0.015, 60))
 }
 
 func BenchmarkUniformSample257(b *testing.B) {
@@ -80,7 +82,7 @@ func BenchmarkUniformSample1028(b *testing.B) {
 
 func TestExpDecaySample10(t *testing.T) {
 	rand.Seed(1)
-	s := NewExpDecaySample(100, 0.99)
+	s := NewExpDecaySample(time.Now(), 100, 0.99, 60)
 	for i := 0; i < 10; i++ {
 		s.Update(time.Now(), int64(i))
 	}
@@ -102,7 +104,7 @@ func TestExpDecaySample10(t *testing.T) {
 
 func TestExpDecaySample100(t *testing.T) {
 	rand.Seed(1)
-	s := NewExpDecaySample(1000, 0.01)
+	s := NewExpDecaySample(time.Now(), 1000, 0.01, 60)
 	for i := 0; i < 100; i++ {
 		s.Update(time.Now(), int64(i))
 	}
@@ -124,7 +126,7 @@ func TestExpDecaySample100(t *testing.T) {
 
 func TestExpDecaySample1000(t *testing.T) {
 	rand.Seed(1)
-	s := NewExpDecaySample(100, 0.99)
+	s := NewExpDecaySample(time.Now(), 100, 0.99, 60)
 	for i := 0; i < 1000; i++ {
 		s.Update(time.Now(), int64(i))
 	}
@@ -144,13 +146,28 @@ func TestExpDecaySample1000(t *testing.T) {
 	}
 }
 
+func TestExpDecaySampleSnapshot(t *testing.T) {
+	now := time.Now()
+	rand.Seed(1)
+	s := NewExpDecaySample(time.Now(), 100, 0.99, 60)
+	for i := 1; i <= 10000; i++ {
+		s.(*ExpDecaySample).update(now.Add(time.Duration(i)), int64(i))
+	}
+	snapshot := &ExpDecaySample{}
+	if err := snapshot.UnmarshalBinary(mustSnapshot(t, s)); nil != err {
+		t.Fatal(err)
+	}
+	s.Update(time.Now(), 1)
+	testExpDecaySampleStatistics(t, snapshot)
+}
+
 // This test makes sure that the sample's priority is not amplified by using
 // nanosecond duration since start rather than second duration since start.
 // The priority becomes +Inf quickly after starting if this is done,
 // effectively freezing the set of samples until a rescale step happens.
 func TestExpDecaySampleNanosecondRegression(t *testing.T) {
 	rand.Seed(1)
-	s := NewExpDecaySample(100, 0.99)
+	s := NewExpDecaySample(time.Now(), 100, 0.99, 60)
 	for i := 0; i < 100; i++ {
 		s.Update(time.Now(), 10)
 	}
@@ -169,22 +186,10 @@ func TestExpDecaySampleNanosecondRegression(t *testing.T) {
 	}
 }
 
-func TestExpDecaySampleSnapshot(t *testing.T) {
-	now := time.Now()
-	rand.Seed(1)
-	s := NewExpDecaySample(100, 0.99)
-	for i := 1; i <= 10000; i++ {
-		s.(*ExpDecaySample).update(now.Add(time.Duration(i)), int64(i))
-	}
-	snapshot := s.Snapshot()
-	s.Update(time.Now(), 1)
-	testExpDecaySampleStatistics(t, snapshot)
-}
-
 func TestExpDecaySampleStatistics(t *testing.T) {
 	now := time.Now()
 	rand.Seed(1)
-	s := NewExpDecaySample(100, 0.99)
+	s := NewExpDecaySample(time.Now(), 100, 0.99, 60)
 	for i := 1; i <= 10000; i++ {
 		s.(*ExpDecaySample).update(now.Add(time.Duration(i)), int64(i))
 	}
@@ -232,11 +237,15 @@ func TestUniformSampleIncludesTail(t *testing.T) {
 }
 
 func TestUniformSampleSnapshot(t *testing.T) {
+	rand.Seed(1)
 	s := NewUniformSample(100)
 	for i := 1; i <= 10000; i++ {
 		s.Update(time.Now(), int64(i))
 	}
-	snapshot := s.Snapshot()
+	snapshot := &UniformSample{}
+	if err := snapshot.UnmarshalBinary(mustSnapshot(t, s)); nil != err {
+		t.Fatal(err)
+	}
 	s.Update(time.Now(), 1)
 	testUniformSampleStatistics(t, snapshot)
 }
@@ -319,3 +328,132 @@ func testUniformSampleStatistics(t *testing.T, s Sample) {
 		t.Errorf("99th percentile: 9999.99 != %v\n", ps[2])
 	}
 }
+
+func BenchmarkSlidingTimeWindowSample(b *testing.B) {
+	s := NewSlidingTimeWindowSample(time.Minute)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Update(time.Unix(0, int64(i)*int64(time.Millisecond)), int64(i))
+	}
+}
+
+func TestSlidingTimeWindowSample(t *testing.T) {
+	s := NewSlidingTimeWindowSample(time.Minute)
+	for i := 1; i <= 120; i++ {
+		s.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	if count := s.Count(); 120 != count {
+		t.Errorf("s.Count(): 120 != %v\n", count)
+	}
+	if size := s.Size(); 60 != size {
+		t.Errorf("s.Size(): 60 != %v\n", size)
+	}
+	if min := s.Min(); 61 != min {
+		t.Errorf("s.Min(): 61 != %v\n", min)
+	}
+	if max := s.Max(); 120 != max {
+		t.Errorf("s.Max(): 120 != %v\n", max)
+	}
+	if window := s.GetWindow(); time.Minute != window {
+		t.Errorf("s.GetWindow(): 1m != %v\n", window)
+	}
+	ps := s.Percentiles([]float64{0.5, 0.99})
+	if 90.5 != ps[0] {
+		t.Errorf("median: 90.5 != %v\n", ps[0])
+	}
+	if 120 != ps[1] {
+		t.Errorf("99th percentile: 120 != %v\n", ps[1])
+	}
+}
+
+func TestSlidingTimeWindowSampleOutOfOrder(t *testing.T) {
+	s := NewSlidingTimeWindowSample(10 * time.Second)
+	s.Update(time.Unix(100, 0), 100)
+	s.Update(time.Unix(95, 0), 95)
+	s.Update(time.Unix(80, 0), 80) // already out of the window
+	if size := s.Size(); 2 != size {
+		t.Errorf("s.Size(): 2 != %v\n", size)
+	}
+	if count := s.Count(); 3 != count {
+		t.Errorf("s.Count(): 3 != %v\n", count)
+	}
+	s.Update(time.Unix(106, 0), 106)
+	if values := s.Values(); 2 != len(values) || 100 != values[0] || 106 != values[1] {
+		t.Errorf("s.Values(): [100 106] != %v\n", values)
+	}
+}
+
+func TestSlidingTimeWindowSampleReplay(t *testing.T) {
+	// Replaying a day of logs: only the last hour matters.
+	s := NewSlidingTimeWindowSample(time.Hour)
+	start := time.Unix(1420070400, 0)
+	for i := 0; i < 24*60; i++ {
+		s.Update(start.Add(time.Duration(i)*time.Minute), int64(i/60))
+	}
+	if size := s.Size(); 60 != size {
+		t.Errorf("s.Size(): 60 != %v\n", size)
+	}
+	if min := s.Min(); 23 != min {
+		t.Errorf("s.Min(): 23 != %v\n", min)
+	}
+	s.ZeroOut()
+	if size := s.Size(); 0 != size {
+		t.Errorf("s.Size(): 0 != %v\n", size)
+	}
+	s.Clear(start)
+	if count := s.Count(); 0 != count {
+		t.Errorf("s.Count(): 0 != %v\n", count)
+	}
+}
+
+func TestSlidingTimeWindowSampleCompaction(t *testing.T) {
+	s := NewSlidingTimeWindowSample(10 * time.Second).(*SlidingTimeWindowSample)
+	for i := 1; i <= 1000; i++ {
+		s.Update(time.Unix(int64(i), 0), int64(i))
+		if 2*10+1 < len(s.values) {
+			t.Fatalf("len(s.values): %v values kept for a window of 10\n", len(s.values))
+		}
+	}
+	s.Update(time.Unix(995, 0), 995)
+	if values := s.Values(); 11 != len(values) || 991 != values[0] || 995 != values[4] || 995 != values[5] || 1000 != values[10] {
+		t.Errorf("s.Values(): [991 ... 995 995 ... 1000] != %v\n", values)
+	}
+}
+
+func TestExpDecaySampleRescalePriorities(t *testing.T) {
+	s := NewExpDecaySample(time.Unix(0, 0), 10, 0.015, 1).(*ExpDecaySample)
+	for i := 0; i < 5; i++ {
+		s.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	s.Update(time.Unix(120, 0), 120)
+	for _, v := range s.values {
+		if 0 >= v.k {
+			t.Errorf("v.k: %v not > 0 after rescale\n", v.k)
+		}
+	}
+}
+
+func TestExpDecaySampleLateValues(t *testing.T) {
+	s := NewExpDecaySample(time.Unix(600, 0), 10, 0.015, 60)
+	s.Update(time.Unix(0, 0), 1)
+	s.Update(time.Unix(600, 0), 2)
+	if size := s.Size(); 2 != size {
+		t.Errorf("s.Size(): 2 != %v\n", size)
+	}
+}
+
+func TestExpDecaySampleOutOfOrder(t *testing.T) {
+	s := NewExpDecaySample(time.Unix(600, 0), 10, 0.015, 60).(*ExpDecaySample)
+	s.Update(time.Unix(630, 0), 1)
+	s.Update(time.Unix(-1000000, 0), 2)
+	s.Update(time.Unix(590, 0), 3)
+	if size := s.Size(); 3 != size {
+		t.Errorf("s.Size(): 3 != %v\n", size)
+	}
+	// Values older than t0 are weighted as of t0.
+	for _, v := range s.values {
+		if !(v.k >= 1) {
+			t.Errorf("v.k: %v < 1 for %v\n", v.k, v.v)
+		}
+	}
+}
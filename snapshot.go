@@ -0,0 +1,178 @@
+package timemetrics
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+)
+
+// UnsupportedSnapshot is the error returned when checkpointing a metric or a
+// sample which cannot be encoded, e.g. a Sample implemented outside of this
+// package without MarshalBinary.
+type UnsupportedSnapshot string
+
+func (err UnsupportedSnapshot) Error() string {
+	return fmt.Sprintf("unsupported snapshot: %s", string(err))
+}
+
+// checkpointEncodingVersion is the version of the encoding of registry
+// checkpoints.
+const checkpointEncodingVersion = 1
+
+// snapshot encodes v, a metric or a sample, with its MarshalBinary method.
+func snapshot(v interface{}) ([]byte, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, UnsupportedSnapshot(fmt.Sprintf("%T has no MarshalBinary", v))
+	}
+	return m.MarshalBinary()
+}
+
+// unmarshalSample decodes a Sample encoded by its MarshalBinary method.
+func unmarshalSample(data []byte) (Sample, error) {
+	if 0 == len(data) {
+		return nil, InvalidEncoding("empty sample")
+	}
+	var s interface {
+		Sample
+		encoding.BinaryUnmarshaler
+	}
+	switch data[0] {
+	case expDecayEncoding:
+		s = &ExpDecaySample{}
+	case uniformEncoding:
+		s = &UniformSample{}
+	case slidingWindowEncoding:
+		s = &SlidingTimeWindowSample{}
+	case hdrEncoding:
+		s = &HDRSample{}
+	case tdigestEncoding:
+		s = &TDigestSample{}
+	case ddsketchEncoding:
+		s = &DDSketchSample{}
+	default:
+		return nil, InvalidEncoding(fmt.Sprintf("unknown sample kind %q", data[0]))
+	}
+	if err := s.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// unmarshalMetric decodes a Metric encoded by its MarshalBinary method.
+func unmarshalMetric(data []byte) (Metric, error) {
+	if 0 == len(data) {
+		return nil, InvalidEncoding("empty metric")
+	}
+	var m interface {
+		Metric
+		encoding.BinaryUnmarshaler
+	}
+	switch data[0] {
+	case counterEncoding:
+		m = &StandardCounter{}
+	case meterEncoding:
+		m = &StandardMeter{}
+	case histogramEncoding:
+		m = &StandardHistogram{}
+	case gaugeEncoding:
+		m = &StandardGauge{}
+	case gaugeFloat64Encoding:
+		m = &StandardGaugeFloat64{}
+	case timerEncoding:
+		m = &StandardTimer{}
+	case windowedHistogramEncoding:
+		m = &StandardWindowedHistogram{}
+	case bucketHistogramEncoding:
+		m = &StandardBucketHistogram{}
+	case exponentialHistogramEncoding:
+		m = &StandardExponentialHistogram{}
+	default:
+		return nil, InvalidEncoding(fmt.Sprintf("unknown metric kind %q", data[0]))
+	}
+	if err := m.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Checkpoint writes a snapshot of every registered metric to w, to be read
+// back by Restore, e.g. when the process restarts.  Every metric must be
+// one of this package and its sample too.
+func (r *StandardRegistry) Checkpoint(w io.Writer) error {
+	entries := r.registered()
+	sort.Slice(entries, func(i, j int) bool {
+		return metricKey(entries[i].name, entries[i].metric.Tags()) < metricKey(entries[j].name, entries[j].metric.Tags())
+	})
+
+	bw := &binaryWriter{}
+	bw.putHeader(checkpointEncoding, checkpointEncodingVersion)
+	bw.putUvarint(uint64(len(entries)))
+	for _, e := range entries {
+		data, err := snapshot(e.metric)
+		if err != nil {
+			return fmt.Errorf("checkpoint of %s: %v", e.name, err)
+		}
+		bw.putString(e.name)
+		bw.putTimestamp(e.created)
+		bw.putBytes(data)
+	}
+	_, err := w.Write(bw.buf)
+	return err
+}
+
+// Restore reads a checkpoint written by Checkpoint and registers its
+// metrics, which resume exactly where they were left off.  A metric
+// registered under the same name and tags, and of the same type, is restored
+// in place, keeping the settings which are not part of snapshots such as its
+// LateOptions.  Any other is replaced.  Nothing is restored unless the whole
+// checkpoint can be decoded.
+//
+// Restore is meant to run before the metrics are updated, typically when the
+// process starts.
+func (r *StandardRegistry) Restore(rd io.Reader) error {
+	data, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+
+	br := &binaryReader{buf: data}
+	br.header(checkpointEncoding, checkpointEncodingVersion)
+	n := br.count(2)
+	entries := make([]registryEntry, 0, n)
+	snapshots := make([][]byte, 0, n)
+	for i := 0; i < n && br.err == nil; i++ {
+		name := br.str()
+		created := br.timestamp()
+		encoded := br.bytes()
+		if br.err != nil {
+			break
+		}
+		m, err := unmarshalMetric(encoded)
+		if err != nil {
+			return fmt.Errorf("restore of %s: %v", name, err)
+		}
+		entries = append(entries, registryEntry{name, m, created})
+		snapshots = append(snapshots, encoded)
+	}
+	if err := br.end(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, e := range entries {
+		key := metricKey(e.name, e.metric.Tags())
+		if existing, ok := r.metrics[key]; ok && reflect.TypeOf(existing.metric) == reflect.TypeOf(e.metric) {
+			if u, ok := existing.metric.(encoding.BinaryUnmarshaler); ok && nil == u.UnmarshalBinary(snapshots[i]) {
+				r.metrics[key] = registryEntry{existing.name, existing.metric, e.created}
+				continue
+			}
+		}
+		r.metrics[key] = e
+	}
+	return nil
+}
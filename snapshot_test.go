@@ -0,0 +1,348 @@
+package timemetrics
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// unencodableSample hides the MarshalBinary method of the Sample it wraps.
+type unencodableSample struct {
+	Sample
+}
+
+func TestSnapshotSamples(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	samples := map[string]Sample{
+		"ExpDecaySample":          NewExpDecaySample(t0, 100, 0.015, 60),
+		"UniformSample":           NewUniformSample(100),
+		"SlidingTimeWindowSample": NewSlidingTimeWindowSample(time.Minute),
+		"HDRSample":               NewHDRSample(1, 1000000, 3),
+		"TDigestSample":           NewTDigestSample(100),
+		"DDSketchSample":          NewDDSketchSample(0.01),
+	}
+	ps := []float64{0.5, 0.75, 0.99}
+	for name, s := range samples {
+		for i := 0; i < 1000; i++ {
+			s.Update(t0.Add(time.Duration(i)*10*time.Millisecond), int64(i*7%1000))
+		}
+		data, err := snapshot(s)
+		if nil != err {
+			t.Fatalf("%s: %v", name, err)
+		}
+		s2, err := unmarshalSample(data)
+		if nil != err {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if reflect.TypeOf(s) != reflect.TypeOf(s2) {
+			t.Errorf("%s: restored a %T\n", name, s2)
+		}
+		// Before Percentiles, which sorts the values of some samples.
+		if data2, _ := snapshot(s2); !bytes.Equal(data, data2) {
+			t.Errorf("%s: snapshot of the restored sample differs\n", name)
+		}
+		if s.Count() != s2.Count() || s.Min() != s2.Min() || s.Max() != s2.Max() || s.Sum() != s2.Sum() {
+			t.Errorf("%s: %v %v %v %v != %v %v %v %v\n", name, s.Count(), s.Min(), s.Max(), s.Sum(), s2.Count(), s2.Min(), s2.Max(), s2.Sum())
+		}
+		if expected, got := s.Percentiles(ps), s2.Percentiles(ps); !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s.Percentiles(): %v != %v\n", name, expected, got)
+		}
+		if _, err := unmarshalSample(data[:len(data)-1]); nil == err {
+			t.Errorf("%s: expected an error decoding a truncated snapshot\n", name)
+		}
+	}
+	if _, err := unmarshalSample([]byte{'x', 1}); nil == err {
+		t.Error("unmarshalSample(unknown kind): expected an error\n")
+	}
+	if _, err := snapshot(unencodableSample{NewUniformSample(10)}); nil == err {
+		t.Error("snapshot(unencodableSample): expected an error\n")
+	} else if _, ok := err.(UnsupportedSnapshot); !ok {
+		t.Errorf("snapshot(unencodableSample): %v is not an UnsupportedSnapshot\n", err)
+	}
+}
+
+func TestSnapshotMetrics(t *testing.T) {
+	t0 := time.Unix(1000, 500)
+	tags := Tags{"host": "web1"}
+	c := NewTaggedCounter(t0, 3, tags)
+	c.SetLateOptions(LateOptions{Policy: DropLate})
+	c.Inc(t0.Add(time.Second), 5)
+	c.Inc(t0, 1)
+	g := NewTaggedGauge(t0, 3, tags)
+	g.Update(t0.Add(time.Second), 42)
+	gf := NewTaggedGaugeFloat64(t0, 3, tags)
+	gf.UpdateFloat64(t0.Add(time.Second), 4.2)
+	m := NewTaggedMeter(t0, 10, 3, tags)
+	h := NewHistogramWithOptions(NewExpDecaySample(t0, 100, 0.015, 60), 3, tags, HistogramOptions{Stats: StatMin | StatMax, Percentiles: []float64{0.9}})
+	tm := NewTaggedTimer(t0, NewUniformSample(100), 10, 3, time.Millisecond, tags)
+	w := NewWindowedHistogram(time.Minute, 10*time.Second, func(t time.Time) Sample { return NewUniformSample(100) }, 3)
+	for i := 0; i < 300; i++ {
+		ti := t0.Add(time.Duration(i) * time.Second)
+		m.Mark(ti, int64(i))
+		h.Update(ti, int64(i))
+		tm.Update(ti, int64(i)*int64(time.Millisecond))
+		w.Update(ti, int64(i))
+	}
+	w.Update(t0, 1)
+
+	metrics := map[string]Metric{
+		"StandardCounter":           c,
+		"StandardGauge":             g,
+		"StandardGaugeFloat64":      gf,
+		"StandardMeter":             m,
+		"StandardHistogram":         h,
+		"StandardTimer":             tm,
+		"StandardWindowedHistogram": w,
+	}
+	for name, metric := range metrics {
+		data, err := snapshot(metric)
+		if nil != err {
+			t.Fatalf("%s: %v", name, err)
+		}
+		m2, err := unmarshalMetric(data)
+		if nil != err {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if reflect.TypeOf(metric) != reflect.TypeOf(m2) {
+			t.Errorf("%s: restored a %T\n", name, m2)
+		}
+		if data2, _ := snapshot(m2); !bytes.Equal(data, data2) {
+			t.Errorf("%s: snapshot of the restored metric differs\n", name)
+		}
+		if !metric.GetMaxTime().Equal(m2.GetMaxTime()) {
+			t.Errorf("%s.GetMaxTime(): %v != %v\n", name, metric.GetMaxTime(), m2.GetMaxTime())
+		}
+		if !reflect.DeepEqual(metric.Tags(), m2.Tags()) {
+			t.Errorf("%s.Tags(): %v != %v\n", name, metric.Tags(), m2.Tags())
+		}
+		ct := t0.Add(time.Hour)
+		if expected, got := metric.GetKeys(ct, "foo", false), m2.GetKeys(ct, "foo", false); !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s.GetKeys(): %v != %v\n", name, expected, got)
+		}
+		if _, err := unmarshalMetric(data[:len(data)-1]); nil == err {
+			t.Errorf("%s: expected an error decoding a truncated snapshot\n", name)
+		}
+	}
+
+	c2, _ := unmarshalMetric(mustSnapshot(t, c))
+	if late, dropped := c2.(Counter).Late(), c2.(Counter).Dropped(); 1 != late || 1 != dropped {
+		t.Errorf("c2.Late(), c2.Dropped(): 1, 1 != %v, %v\n", late, dropped)
+	}
+	if count := c2.(Counter).Count(); 5 != count {
+		t.Errorf("c2.Count(): 5 != %v\n", count)
+	}
+	if _, err := unmarshalMetric([]byte{'x', 1}); nil == err {
+		t.Error("unmarshalMetric(unknown kind): expected an error\n")
+	}
+}
+
+func TestSnapshotMeterResumes(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	m := NewMeter(t0, 10, 3)
+	for i := 0; i < 60; i++ {
+		m.Mark(t0.Add(time.Duration(i)*time.Second), 10)
+	}
+	m2 := &StandardMeter{}
+	if err := m2.UnmarshalBinary(mustSnapshot(t, m)); nil != err {
+		t.Fatal(err)
+	}
+	if !m.GetMaxEWMATime().Equal(m2.GetMaxEWMATime()) {
+		t.Errorf("m2.GetMaxEWMATime(): %v != %v\n", m.GetMaxEWMATime(), m2.GetMaxEWMATime())
+	}
+	for i := 60; i < 120; i++ {
+		ti := t0.Add(time.Duration(i) * time.Second)
+		m.Mark(ti, int64(i))
+		m2.Mark(ti, int64(i))
+	}
+	m.CrunchEWMA(t0.Add(2 * time.Minute))
+	m2.CrunchEWMA(t0.Add(2 * time.Minute))
+	if expected, got := m.Rates(), m2.Rates(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("m2.Rates(): %v != %v\n", expected, got)
+	}
+	if count := m2.Count(); m.Count() != count {
+		t.Errorf("m2.Count(): %v != %v\n", m.Count(), count)
+	}
+}
+
+func TestSnapshotExpDecaySampleResumes(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	s := NewExpDecaySample(t0, 100, 0.015, 1).(*ExpDecaySample)
+	for i := 0; i < 100; i++ {
+		s.Update(t0.Add(time.Duration(i)*time.Second), int64(i))
+	}
+	s2 := &ExpDecaySample{}
+	if err := s2.UnmarshalBinary(mustSnapshot(t, s)); nil != err {
+		t.Fatal(err)
+	}
+	if !s.t0.Equal(s2.t0) || !s.t1.Equal(s2.t1) {
+		t.Errorf("s2.t0, s2.t1: %v, %v != %v, %v\n", s.t0, s.t1, s2.t0, s2.t1)
+	}
+	// An update past t1 rescales the restored sample like the original.
+	ti := s.t1.Add(time.Second)
+	s.Update(ti, 1000)
+	s2.Update(ti, 1000)
+	if !s.t0.Equal(s2.t0) || !s.t1.Equal(s2.t1) {
+		t.Errorf("s2.t0, s2.t1 after rescale: %v, %v != %v, %v\n", s.t0, s.t1, s2.t0, s2.t1)
+	}
+}
+
+func TestSnapshotZeroTime(t *testing.T) {
+	w := &binaryWriter{}
+	w.putTimestamp(time.Time{})
+	w.putTimestamp(time.Unix(-1, 999999999))
+	r := &binaryReader{buf: w.buf}
+	if zero := r.timestamp(); !zero.IsZero() {
+		t.Errorf("r.timestamp(): %v is not the zero time\n", zero)
+	}
+	if ts := r.timestamp(); !ts.Equal(time.Unix(-1, 999999999)) {
+		t.Errorf("r.timestamp(): %v != %v\n", time.Unix(-1, 999999999), ts)
+	}
+	if err := r.end(); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryCheckpointRestore(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	r := NewRegistry(10, 3)
+	c := GetOrRegisterCounter("foo", r, t0)
+	c.Inc(t0.Add(time.Second), 47)
+	h := GetOrRegisterHistogram("bar", r, t0, NewUniformSample(100))
+	for i := 0; i < 10; i++ {
+		h.Update(t0.Add(time.Duration(i)*time.Second), int64(i))
+	}
+	m := GetOrRegisterTaggedMeter("baz", Tags{"host": "web1"}, r, t0)
+	m.Mark(t0.Add(time.Second), 10)
+
+	var buf bytes.Buffer
+	if err := r.Checkpoint(&buf); nil != err {
+		t.Fatal(err)
+	}
+	checkpoint := buf.Bytes()
+
+	// bar is restored in place, foo is replaced by a counter.
+	r2 := NewRegistry(10, 3)
+	h2 := GetOrRegisterHistogram("bar", r2, t0, NewUniformSample(10))
+	sample := h2.Sample()
+	GetOrRegisterGauge("foo", r2, t0)
+	if err := r2.Restore(bytes.NewReader(checkpoint)); nil != err {
+		t.Fatal(err)
+	}
+	if bar := r2.Get("bar", nil); bar != h2 {
+		t.Errorf("r2.Get(\"bar\"): %v != %v\n", h2, bar)
+	}
+	if sample != h2.Sample() {
+		t.Error("h2.Sample(): not restored in place\n")
+	}
+	if count := h2.Count(); 10 != count {
+		t.Errorf("h2.Count(): 10 != %v\n", count)
+	}
+	foo, ok := r2.Get("foo", nil).(Counter)
+	if !ok {
+		t.Fatalf("r2.Get(\"foo\"): %T is not a Counter\n", r2.Get("foo", nil))
+	}
+	if count := foo.Count(); 47 != count {
+		t.Errorf("foo.Count(): 47 != %v\n", count)
+	}
+	baz, ok := r2.Get("baz", Tags{"host": "web1"}).(Meter)
+	if !ok {
+		t.Fatalf("r2.Get(\"baz\"): %T is not a Meter\n", r2.Get("baz", Tags{"host": "web1"}))
+	}
+	if !baz.GetMaxTime().Equal(t0.Add(time.Second)) {
+		t.Errorf("baz.GetMaxTime(): %v != %v\n", t0.Add(time.Second), baz.GetMaxTime())
+	}
+	if created := r2.Created("baz", Tags{"host": "web1"}); !created.Equal(t0) {
+		t.Errorf("r2.Created(\"baz\"): %v != %v\n", t0, created)
+	}
+	buf.Reset()
+	if err := r2.Checkpoint(&buf); nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checkpoint, buf.Bytes()) {
+		t.Error("r2.Checkpoint(): differs from the restored checkpoint\n")
+	}
+
+	// A checkpoint which cannot be decoded restores nothing.
+	r3 := NewRegistry(10, 3)
+	if err := r3.Restore(bytes.NewReader(checkpoint[:len(checkpoint)-1])); nil == err {
+		t.Error("r3.Restore(truncated): expected an error\n")
+	}
+	if err := r3.Restore(bytes.NewReader(nil)); nil == err {
+		t.Error("r3.Restore(empty): expected an error\n")
+	}
+	n := 0
+	r3.Each(func(string, Metric) { n++ })
+	if 0 != n {
+		t.Errorf("r3: 0 metrics != %v after failed restores\n", n)
+	}
+
+	GetOrRegisterHistogram("qux", r, t0, unencodableSample{NewUniformSample(10)})
+	if err := r.Checkpoint(&buf); nil == err {
+		t.Error("r.Checkpoint(unencodable sample): expected an error\n")
+	}
+}
+
+func mustSnapshot(t *testing.T, v interface{}) []byte {
+	data, err := snapshot(v)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRegistryRestoreCorrupt(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	r := NewRegistry(10, 3)
+	samples := map[string]Sample{
+		"expdecay": NewExpDecaySample(t0, 10, 0.015, 60),
+		"uniform":  NewUniformSample(10),
+		"sliding":  NewSlidingTimeWindowSample(time.Minute),
+		"hdr":      NewHDRSample(1, 1000, 2),
+		"tdigest":  NewTDigestSample(10),
+		"ddsketch": NewDDSketchSample(0.05),
+	}
+	for name, s := range samples {
+		GetOrRegisterHistogram(name, r, t0, s)
+	}
+	GetOrRegisterCounter("counter", r, t0)
+	GetOrRegisterMeter("meter", r, t0)
+	GetOrRegisterBucketHistogram("buckets", r, t0, []float64{1, 10})
+	GetOrRegisterExponentialHistogram("exponential", r, t0, 4)
+	for i := 0; i < 20; i++ {
+		r.Each(func(name string, m Metric) {
+			if u, ok := m.(interface {
+				Update(time.Time, int64)
+			}); ok {
+				u.Update(t0.Add(time.Duration(i)*time.Second), int64(i))
+			}
+		})
+	}
+	var buf bytes.Buffer
+	if err := r.Checkpoint(&buf); nil != err {
+		t.Fatal(err)
+	}
+	checkpoint := buf.Bytes()
+
+	// Corrupt bytes fail to restore, or restore metrics which can be used.
+	corrupt := make([]byte, len(checkpoint))
+	for i := range checkpoint {
+		for _, b := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff} {
+			copy(corrupt, checkpoint)
+			corrupt[i] = b
+			r2 := NewRegistry(10, 3)
+			if nil != r2.Restore(bytes.NewReader(corrupt)) {
+				continue
+			}
+			r2.Each(func(name string, m Metric) {
+				if u, ok := m.(interface {
+					Update(time.Time, int64)
+				}); ok {
+					u.Update(t0.Add(time.Minute), 1)
+				}
+				m.GetDatapoints(t0.Add(time.Minute), false)
+				m.ZeroOut()
+			})
+		}
+	}
+}
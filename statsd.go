@@ -0,0 +1,431 @@
+package timemetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InvalidStatsD is the error reported for StatsD lines which cannot be parsed
+// or which conflict with the type of a registered metric.
+type InvalidStatsD string
+
+func (err InvalidStatsD) Error() string {
+	return fmt.Sprintf("invalid statsd line: %s", string(err))
+}
+
+// StatsDOptions configure how a StatsDServer turns StatsD lines into metrics.
+//
+// NewSample builds the samples of the histograms of "ms" and "h" lines, first
+// updated at t.  Sets are counted by Meters marked once for every value first
+// seen in each SetWindow.  Now stamps lines with their arrival time.  Errors,
+// when not nil, is called with the lines which cannot be handled.
+type StatsDOptions struct {
+	NewSample        func(t time.Time) Sample
+	HistogramOptions HistogramOptions
+	SetWindow        time.Duration
+	Now              func() time.Time
+	Errors           func(error)
+}
+
+// DefaultStatsDOptions returns the options recording histograms in
+// exponentially-decaying samples of 1028 values, counting sets per minute
+// and stamping lines with the wall clock.
+func DefaultStatsDOptions() StatsDOptions {
+	return StatsDOptions{
+		NewSample: func(t time.Time) Sample {
+			return NewExpDecaySample(t, 1028, 0.015, 60)
+		},
+		HistogramOptions: DefaultHistogramOptions(),
+		SetWindow:        time.Minute,
+		Now:              time.Now,
+	}
+}
+
+// StatsDServer receives StatsD lines over UDP and TCP and routes them into
+// the metrics of a Registry, stamped with their arrival time:
+//
+//	<name>:<value>|c[|@<rate>]   Counter incremented by value/rate
+//	<name>:<value>|g             GaugeFloat64 set to value
+//	<name>:[+-]<value>|g         GaugeFloat64 moved by value
+//	<name>:<value>|ms[|@<rate>]  Histogram updated 1/rate times with value
+//	<name>:<value>|h[|@<rate>]   Histogram updated 1/rate times with value
+//	<name>:<value>|s             Meter marked for each distinct value
+//
+// Counts which are not whole, e.g. 1/0.3, are rounded and the difference is
+// carried over to the next line of the metric.  Lines may end with DogStatsD
+// tags, "|#k1:v1,k2:v2".  The registry is flushed by a Flusher like any
+// other, through GetKeys or a KeyEncoder.
+type StatsDServer struct {
+	registry  Registry
+	options   StatsDOptions
+	sets      map[string]*statsDSet  // keyed by metricKey
+	carries   map[string]statsDCarry // keyed by metricKey
+	window    time.Time              // newest window of the lines
+	closers   map[io.Closer]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+	gaugeLock sync.Mutex
+	mutex     sync.Mutex
+}
+
+// statsDSet holds the values of a set seen in the current window.
+type statsDSet struct {
+	window time.Time
+	seen   map[string]struct{}
+}
+
+// maxStatsDWeight bounds the number of values a sampled "ms" or "h" line
+// stands for.
+const maxStatsDWeight = 1 << 16
+
+// statsDCarry is the part of a count left over by rounding, carried over to
+// the next line of a metric.
+type statsDCarry struct {
+	name  string
+	tags  Tags
+	count float64
+}
+
+// NewStatsDServer constructs a new StatsDServer feeding the given registry.
+func NewStatsDServer(r Registry, opts StatsDOptions) *StatsDServer {
+	defaults := DefaultStatsDOptions()
+	if nil == opts.NewSample {
+		opts.NewSample = defaults.NewSample
+	}
+	if opts.SetWindow <= 0 {
+		opts.SetWindow = defaults.SetWindow
+	}
+	if nil == opts.Now {
+		opts.Now = defaults.Now
+	}
+	opts.HistogramOptions = opts.HistogramOptions.copy()
+	return &StatsDServer{
+		registry: r,
+		options:  opts,
+		sets:     make(map[string]*statsDSet),
+		carries:  make(map[string]statsDCarry),
+		closers:  make(map[io.Closer]struct{}),
+	}
+}
+
+// ListenAndServe listens on the UDP and TCP address addr, e.g. ":8125", and
+// serves both until Close.
+func (s *StatsDServer) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServeUDP(conn) }()
+	go func() { errs <- s.ServeTCP(l) }()
+	err = <-errs
+	s.Close()
+	if err2 := <-errs; nil == err {
+		err = err2
+	}
+	return err
+}
+
+// ServeUDP handles the datagrams received on conn, each holding one or more
+// lines, until Close.  It returns nil once the server is closed.
+func (s *StatsDServer) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn) {
+		conn.Close()
+		return nil
+	}
+	defer s.untrack(conn)
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if n > 0 {
+			s.HandlePacket(buf[:n])
+		}
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// ServeTCP accepts connections on l and handles their newline-separated lines
+// until Close.  It returns nil once the server is closed.
+func (s *StatsDServer) ServeTCP(l net.Listener) error {
+	if !s.track(l) {
+		l.Close()
+		return nil
+	}
+	defer s.untrack(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+			for scanner.Scan() {
+				s.HandleLine(scanner.Text())
+			}
+			if err := scanner.Err(); err != nil && !s.isClosed() && s.options.Errors != nil {
+				s.options.Errors(err)
+			}
+		}()
+	}
+}
+
+// Close stops the listeners and connections being served and waits for the
+// lines they received to be handled.
+func (s *StatsDServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	var err error
+	for c := range s.closers {
+		if cerr := c.Close(); nil == err {
+			err = cerr
+		}
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// HandlePacket handles the newline-separated lines of a packet.
+func (s *StatsDServer) HandlePacket(p []byte) {
+	for _, line := range strings.Split(string(p), "\n") {
+		s.HandleLine(line)
+	}
+}
+
+// HandleLine updates the metric of a StatsD line at the current time of the
+// server.  Empty lines are ignored; the others which cannot be handled are
+// reported to the Errors function of the options.
+func (s *StatsDServer) HandleLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if "" == line {
+		return
+	}
+	if err := s.handle(s.options.Now(), line); err != nil && s.options.Errors != nil {
+		s.options.Errors(err)
+	}
+}
+
+func (s *StatsDServer) handle(t time.Time, line string) error {
+	pipe := strings.IndexByte(line, '|')
+	if pipe < 0 {
+		return InvalidStatsD(fmt.Sprintf("%q: no type", line))
+	}
+	colon := strings.LastIndexByte(line[:pipe], ':')
+	if colon <= 0 {
+		return InvalidStatsD(fmt.Sprintf("%q: no name", line))
+	}
+	name := line[:colon]
+	fields := strings.Split(line[colon+1:], "|")
+	raw, kind := fields[0], fields[1]
+	rate := 1.0
+	var tags Tags
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			r, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return InvalidStatsD(fmt.Sprintf("%q: sample rate %q", line, field[1:]))
+			}
+			rate = r
+		case strings.HasPrefix(field, "#"):
+			tags = parseStatsDTags(field[1:])
+		default:
+			return InvalidStatsD(fmt.Sprintf("%q: unknown field %q", line, field))
+		}
+	}
+
+	s.prune(t)
+	if "s" == kind {
+		return s.mark(t, name, tags, raw)
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return InvalidStatsD(fmt.Sprintf("%q: value %q", line, raw))
+	}
+	var m Metric
+	switch kind {
+	case "c":
+		m = s.registry.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+			return NewTaggedCounter(t, staleThreshold, tags)
+		})
+		if c, ok := m.(Counter); ok {
+			c.Inc(t, s.round(name, tags, v/rate))
+			return nil
+		}
+	case "g":
+		m = s.registry.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+			return NewTaggedGaugeFloat64(t, staleThreshold, tags)
+		})
+		if g, ok := m.(GaugeFloat64); ok {
+			if '+' == raw[0] || '-' == raw[0] {
+				// Deltas read and update the gauge.
+				s.gaugeLock.Lock()
+				g.UpdateFloat64(t, g.Value()+v)
+				s.gaugeLock.Unlock()
+			} else {
+				g.UpdateFloat64(t, v)
+			}
+			return nil
+		}
+	case "ms", "h":
+		if 1/rate > maxStatsDWeight {
+			return InvalidStatsD(fmt.Sprintf("%q: sample rate %v below 1/%d", line, rate, maxStatsDWeight))
+		}
+		m = s.registry.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+			return NewHistogramWithOptions(s.options.NewSample(t), staleThreshold, tags, s.options.HistogramOptions)
+		})
+		if h, ok := m.(Histogram); ok {
+			// A value sampled at a rate stands for 1/rate values.
+			for n := s.round(name, tags, 1/rate); n > 0; n-- {
+				h.Update(t, int64(math.Round(v)))
+			}
+			return nil
+		}
+	default:
+		return InvalidStatsD(fmt.Sprintf("%q: unknown type %q", line, kind))
+	}
+	return InvalidStatsD(fmt.Sprintf("%q: %s is a %T", line, name, m))
+}
+
+// mark marks the Meter of a set if value was not seen yet in the current
+// window.
+func (s *StatsDServer) mark(t time.Time, name string, tags Tags, value string) error {
+	m := s.registry.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		return NewTaggedMeter(t, interval, staleThreshold, tags)
+	})
+	meter, ok := m.(Meter)
+	if !ok {
+		return InvalidStatsD(fmt.Sprintf("%q: %s is a %T", name+":"+value+"|s", name, m))
+	}
+
+	key := metricKey(name, tags)
+	window := t.Truncate(s.options.SetWindow)
+	s.mutex.Lock()
+	set, ok := s.sets[key]
+	if !ok || set.window.Before(window) {
+		set = &statsDSet{window: window, seen: make(map[string]struct{})}
+		s.sets[key] = set
+	}
+	_, seen := set.seen[value]
+	set.seen[value] = struct{}{}
+	s.mutex.Unlock()
+
+	if !seen {
+		meter.Mark(t, 1)
+	}
+	return nil
+}
+
+// round rounds the count of a line of the metric by the given name and tags,
+// adding the part of the count of its previous line left over.
+func (s *StatsDServer) round(name string, tags Tags, count float64) int64 {
+	key := metricKey(name, tags)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count += s.carries[key].count
+	n := math.Round(count)
+	if n == count {
+		delete(s.carries, key)
+	} else {
+		s.carries[key] = statsDCarry{name, tags, count - n}
+	}
+	return int64(n)
+}
+
+// prune drops, once per SetWindow, the sets of past windows and the carries
+// of the metrics no longer registered, rather than keeping them forever.
+// Sets of past windows are reset by their next value anyway.
+func (s *StatsDServer) prune(t time.Time) {
+	window := t.Truncate(s.options.SetWindow)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !window.After(s.window) {
+		return
+	}
+	for key, set := range s.sets {
+		if set.window.Before(window) {
+			delete(s.sets, key)
+		}
+	}
+	for key, carry := range s.carries {
+		if nil == s.registry.Get(carry.name, carry.tags) {
+			delete(s.carries, key)
+		}
+	}
+	s.window = window
+}
+
+// parseStatsDTags parses DogStatsD tags, "k1:v1,k2:v2".  A tag without value
+// is kept with an empty one.
+func parseStatsDTags(s string) Tags {
+	tags := make(Tags)
+	for _, tag := range strings.Split(s, ",") {
+		if "" == tag {
+			continue
+		}
+		k, v := tag, ""
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			k, v = tag[:i], tag[i+1:]
+		}
+		tags[k] = v
+	}
+	return tags
+}
+
+// track registers c to be closed by Close, unless the server is closed.
+func (s *StatsDServer) track(c io.Closer) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closers[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *StatsDServer) untrack(c io.Closer) {
+	s.mutex.Lock()
+	delete(s.closers, c)
+	s.mutex.Unlock()
+	c.Close()
+	s.wg.Done()
+}
+
+func (s *StatsDServer) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
@@ -0,0 +1,274 @@
+package timemetrics
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStatsDServer(r Registry, errs *[]error) *StatsDServer {
+	opts := DefaultStatsDOptions()
+	opts.Now = func() time.Time { return time.Unix(600, 0) }
+	opts.Errors = func(err error) { *errs = append(*errs, err) }
+	return NewStatsDServer(r, opts)
+}
+
+func TestStatsDHandleLine(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var errs []error
+	s := testStatsDServer(r, &errs)
+	s.HandlePacket([]byte("foo:1|c\nfoo:2|c|@0.5\r\n\nbar:10|g\nbar:-3|g\nbaz:250|ms\nbaz:350|h|@0.1\nqux:1.5|g|#host:web1,env:prod"))
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	if count := r.Get("foo", nil).(Counter).Count(); 5 != count {
+		t.Errorf("foo.Count(): 5 != %v\n", count)
+	}
+	if v := r.Get("bar", nil).(GaugeFloat64).Value(); 7 != v {
+		t.Errorf("bar.Value(): 7 != %v\n", v)
+	}
+	// 350 sampled at 0.1 stands for 10 values.
+	h := r.Get("baz", nil).(Histogram)
+	if count, min, max := h.Count(), h.Min(), h.Max(); 11 != count || 250 != min || 350 != max {
+		t.Errorf("baz: 11 250 350 != %v %v %v\n", count, min, max)
+	}
+	qux := r.Get("qux", Tags{"host": "web1", "env": "prod"})
+	if nil == qux {
+		t.Fatal("qux not registered with its tags")
+	}
+	if v := qux.(GaugeFloat64).Value(); 1.5 != v {
+		t.Errorf("qux.Value(): 1.5 != %v\n", v)
+	}
+	if ts := qux.GetMaxTime(); !ts.Equal(time.Unix(600, 0)) {
+		t.Errorf("qux.GetMaxTime(): %v != %v\n", time.Unix(600, 0), ts)
+	}
+}
+
+func TestStatsDSets(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var errs []error
+	now := time.Unix(600, 0)
+	opts := DefaultStatsDOptions()
+	opts.Now = func() time.Time { return now }
+	opts.Errors = func(err error) { errs = append(errs, err) }
+	s := NewStatsDServer(r, opts)
+	for _, user := range []string{"alice", "bob", "alice", "alice"} {
+		s.HandleLine("users:" + user + "|s")
+	}
+	if count := r.Get("users", nil).(Meter).Count(); 2 != count {
+		t.Errorf("users.Count(): 2 != %v\n", count)
+	}
+	s.HandleLine("admins:alice|s")
+	now = now.Add(time.Minute)
+	s.HandleLine("users:alice|s")
+	if count := r.Get("users", nil).(Meter).Count(); 3 != count {
+		t.Errorf("users.Count(): 3 != %v\n", count)
+	}
+	// The sets of past windows are dropped.
+	if _, ok := s.sets[metricKey("admins", nil)]; ok || 1 != len(s.sets) {
+		t.Errorf("s.sets: [users] != %v\n", s.sets)
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestStatsDSampleRates(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var errs []error
+	now := time.Unix(600, 0)
+	opts := DefaultStatsDOptions()
+	opts.Now = func() time.Time { return now }
+	opts.Errors = func(err error) { errs = append(errs, err) }
+	s := NewStatsDServer(r, opts)
+	for i := 0; i < 10; i++ {
+		s.HandlePacket([]byte("a:1|c|@0.3\nb:1|c|@0.6\nc:0.5|c\nd:5|ms|@0.3\ne:5|h|@0.6"))
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	// Rounding errors do not add up over the lines.
+	for name, expected := range map[string]int64{"a": 33, "b": 17, "c": 5} {
+		if count := r.Get(name, nil).(Counter).Count(); expected != count {
+			t.Errorf("%s.Count(): %v != %v\n", name, expected, count)
+		}
+	}
+	for name, expected := range map[string]int64{"d": 33, "e": 17} {
+		if count := r.Get(name, nil).(Histogram).Count(); expected != count {
+			t.Errorf("%s.Count(): %v != %v\n", name, expected, count)
+		}
+	}
+
+	// The carries of unregistered metrics are dropped with the window.
+	r.Unregister("a", nil)
+	now = now.Add(time.Minute)
+	s.HandleLine("b:1|c")
+	if _, ok := s.carries[metricKey("a", nil)]; ok || 3 != len(s.carries) {
+		t.Errorf("s.carries: [b d e] != %v\n", s.carries)
+	}
+}
+
+func TestStatsDInvalidLines(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var errs []error
+	s := testStatsDServer(r, &errs)
+	s.HandleLine("foo:1|c")
+	lines := []string{
+		"foo",
+		"foo:1",
+		":1|c",
+		"foo:x|c",
+		"foo:1|x",
+		"foo:1|c|@0",
+		"foo:1|c|@2",
+		"foo:1|c|extra",
+		"foo:1|g",
+		"foo:1|ms",
+		"bar:1|ms|@0.00001",
+		"foo:a|s",
+	}
+	for _, line := range lines {
+		s.HandleLine(line)
+	}
+	if len(lines) != len(errs) {
+		t.Fatalf("errs: %v errors != %v\n", len(lines), errs)
+	}
+	for _, err := range errs {
+		if _, ok := err.(InvalidStatsD); !ok {
+			t.Errorf("%v is not an InvalidStatsD\n", err)
+		}
+	}
+	if count := r.Get("foo", nil).(Counter).Count(); 1 != count {
+		t.Errorf("foo.Count(): 1 != %v\n", count)
+	}
+}
+
+func TestStatsDServerLoopback(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var errs []error
+	s := testStatsDServer(r, &errs)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	done := make(chan error, 2)
+	go func() { done <- s.ServeUDP(conn) }()
+	go func() { done <- s.ServeTCP(l) }()
+
+	udp, err := net.Dial("udp", conn.LocalAddr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err := tcp.Write([]byte("hits:1|c\nlatency:100|ms\nlatency:300|ms\n")); nil != err {
+		t.Fatal(err)
+	}
+	tcp.Close()
+
+	// UDP datagrams may be lost: send them until the counter sees one.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, _ := r.Get("hits", nil).(Counter)
+		h, _ := r.Get("latency", nil).(Histogram)
+		if nil != c && nil != h && c.Count() > 1 && 2 == h.Count() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("metrics not received over loopback")
+		}
+		udp.Write([]byte("hits:1|c"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Close(); nil != err {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; nil != err {
+			t.Error(err)
+		}
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	f := NewFlusher(r, time.Minute, time.Minute, FormatKeys(testFormat, false))
+	keys := f.Flush(time.Unix(660, 0))
+	sort.Strings(keys)
+	expected := []string{
+		"put latency.max 600 300",
+		"put latency.mean 600 200.000000",
+		"put latency.min 600 100",
+		"put latency.p50 600 200",
+		"put latency.p75 600 300",
+		"put latency.p95 600 300",
+		"put latency.p99 600 300",
+		"put latency.p999 600 300",
+		"put latency.sample_size 600 2",
+		"put latency.std-dev 600 100.000000",
+	}
+	if len(keys) != len(expected)+1 || !reflect.DeepEqual(expected, keys[1:]) {
+		t.Errorf("f.Flush(): %v != hits.count and %v\n", keys, expected)
+	}
+
+	// Serving a closed server returns right away.
+	if err := s.ServeTCP(l); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestStatsDServerLongLine(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var errs []error
+	s := testStatsDServer(r, &errs)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ServeTCP(l) }()
+
+	tcp, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 100*1024)
+	if _, err := tcp.Write([]byte("hits:1|c|#long:" + long + "\nhits:2|c\n")); nil != err {
+		t.Fatal(err)
+	}
+	tcp.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c, _ := r.Get("hits", nil).(Counter); nil == c || 2 != c.Count(); c, _ = r.Get("hits", nil).(Counter) {
+		if time.Now().After(deadline) {
+			t.Fatal("lines after a long one not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c, _ := r.Get("hits", Tags{"long": long}).(Counter); nil == c || 1 != c.Count() {
+		t.Errorf("hits{long}: 1 != %v\n", c)
+	}
+
+	if err := s.Close(); nil != err {
+		t.Fatal(err)
+	}
+	if err := <-done; nil != err {
+		t.Error(err)
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
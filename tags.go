@@ -0,0 +1,61 @@
+package timemetrics
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tags are the dimensions of a metric, such as its host or endpoint.  They
+// are attached to a metric at creation and must not be modified afterwards.
+type Tags map[string]string
+
+// Keys returns the tag keys in sorted order.
+func (tags Tags) Keys() []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String renders the tags sorted by key, in the "k1=v1 k2=v2" syntax of
+// OpenTSDB.
+func (tags Tags) String() string {
+	return tags.join("=", " ", nil)
+}
+
+// copyTags returns a copy of tags, nil if there are none.
+func copyTags(tags Tags) Tags {
+	if len(tags) == 0 {
+		return nil
+	}
+	c := make(Tags, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+// join renders the tags sorted by key, each key and value mapped through
+// sanitize if not nil.
+func (tags Tags) join(kvSep string, sep string, sanitize func(string) string) string {
+	parts := make([]string, 0, len(tags))
+	for _, k := range tags.Keys() {
+		v := tags[k]
+		if sanitize != nil {
+			k, v = sanitize(k), sanitize(v)
+		}
+		parts = append(parts, k+kvSep+v)
+	}
+	return strings.Join(parts, sep)
+}
+
+// metricKey returns the key a metric is registered under: its name followed
+// by its sorted tags.
+func metricKey(name string, tags Tags) string {
+	if len(tags) == 0 {
+		return name
+	}
+	return name + "\x00" + tags.join("=", "\x00", nil)
+}
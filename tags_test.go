@@ -0,0 +1,101 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTagsString(t *testing.T) {
+	tags := Tags{"host": "web1", "endpoint": "/login", "dc": "east"}
+	if s := tags.String(); "dc=east endpoint=/login host=web1" != s {
+		t.Error(s)
+	}
+	if s := Tags(nil).String(); "" != s {
+		t.Error(s)
+	}
+	if k := metricKey("foo", tags); k != metricKey("foo", Tags{"dc": "east", "host": "web1", "endpoint": "/login"}) {
+		t.Error(k)
+	}
+	if k := metricKey("foo", nil); "foo" != k {
+		t.Error(k)
+	}
+}
+
+func TestTaggedMetricOwnsTags(t *testing.T) {
+	tags := Tags{"host": "web1"}
+	c := NewTaggedCounter(time.Unix(0, 0), 10, tags)
+	tags["host"] = "web2"
+	if host := c.Tags()["host"]; "web1" != host {
+		t.Errorf("c.Tags()[\"host\"]: web1 != %v\n", host)
+	}
+}
+
+func TestRegistryTagged(t *testing.T) {
+	r := NewRegistry(60, 10)
+	now := time.Unix(60, 0)
+	web1 := GetOrRegisterTaggedCounter("foo", Tags{"host": "web1"}, r, now)
+	web2 := GetOrRegisterTaggedCounter("foo", Tags{"host": "web2"}, r, now)
+	untagged := GetOrRegisterCounter("foo", r, now)
+	if web1 == web2 || web1 == untagged {
+		t.Fatal("tagged metrics share an instance")
+	}
+	if m := GetOrRegisterTaggedCounter("foo", Tags{"host": "web1"}, r, now); m != web1 {
+		t.Fatal(m)
+	}
+	if err := r.Register("foo", NewTaggedCounter(now, 10, Tags{"host": "web2"})); nil == err {
+		t.Fatal(err)
+	} else if "duplicate metric: foo host=web2" != err.Error() {
+		t.Error(err)
+	}
+	r.Unregister("foo", Tags{"host": "web1"})
+	if m := r.Get("foo", Tags{"host": "web1"}); nil != m {
+		t.Fatal(m)
+	}
+	if m := r.Get("foo", Tags{"host": "web2"}); m != web2 {
+		t.Fatal(m)
+	}
+}
+
+func TestTaggedGetKeys(t *testing.T) {
+	now := time.Unix(60, 0)
+	c := NewTaggedCounter(now, 10, Tags{"host": "web1", "dc": "east"})
+	c.Inc(now, 2)
+	keys := c.GetKeys(now, "put foo.%s %d %s\n", false)
+	if !reflect.DeepEqual([]string{"put foo.count 60 2 dc=east host=web1\n"}, keys) {
+		t.Fatal(keys)
+	}
+}
+
+func TestTaggedEncoders(t *testing.T) {
+	now := time.Unix(60, 0)
+	dp := intDatapoint("count", now, CounterKind, 2)
+	dp.Tags = Tags{"host": "web 1", "dc": "east"}
+	if s := NewOpenTSDBEncoder().Encode("foo", dp); "put foo.count 60 2 dc=east host=web_1" != s {
+		t.Error(s)
+	}
+	if s := NewGraphiteEncoder().Encode("foo", dp); "foo.count;dc=east;host=web_1 2 60" != s {
+		t.Error(s)
+	}
+	if s := NewInfluxDBEncoder().Encode("foo", dp); `foo,dc=east,host=web\ 1 count=2i 60000000000` != s {
+		t.Error(s)
+	}
+}
+
+func TestFlusherTagged(t *testing.T) {
+	r := NewRegistry(60, 1)
+	f := NewFlusher(r, time.Minute, time.Minute, EncoderKeys(NewOpenTSDBEncoder(), true))
+	now := time.Unix(600, 0)
+	GetOrRegisterTaggedCounter("foo", Tags{"host": "web1"}, r, now).Inc(now, 1)
+	GetOrRegisterTaggedCounter("foo", Tags{"host": "web2"}, r, now).Inc(now, 1)
+	if keys := f.Flush(now); 2 != len(keys) {
+		t.Fatal(keys)
+	}
+	f.Flush(now.Add(2 * time.Minute))
+	f.Flush(now.Add(3 * time.Minute))
+	i := 0
+	r.Each(func(string, Metric) { i++ })
+	if 0 != i {
+		t.Fatal(i)
+	}
+}
@@ -0,0 +1,366 @@
+package timemetrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TDigestSample is a MergeableSample backed by a merging t-digest: values
+// are clustered into centroids, small near the tails and larger around the
+// median, so extreme percentiles stay accurate with a few hundred centroids.
+// Digests of the same stream recorded on several hosts merge into the digest
+// of the whole stream, which percentiles are then computed on.  Min, max,
+// count, sum, mean and variance are exact.  See Dunning and Ertl's
+// "Computing Extremely Accurate Quantiles Using t-Digests".
+//
+// <https://github.com/tdunning/t-digest/blob/master/docs/t-digest-paper/histo.pdf>
+type TDigestSample struct {
+	count       int64 // /!\ this should be the first member to ensure 64-bit alignment
+	compression float64
+	centroids   []centroid // sorted by mean
+	buffer      []centroid // values not merged into the centroids yet
+	stats       sampleStats
+	mutex       sync.Mutex
+}
+
+// centroid is the mean of count values.
+type centroid struct {
+	mean  float64
+	count int64
+}
+
+// tdigestEncodingVersion is the version of the encoding of TDigestSamples.
+const tdigestEncodingVersion = 1
+
+// maxTDigestCompression is the largest compression decoded by UnmarshalBinary:
+// buffers are allocated from it, a corrupt one must not exhaust memory.
+const maxTDigestCompression = 1 << 20
+
+// NewTDigestSample constructs a new TDigestSample of the given compression,
+// bounding the number of centroids to about twice as many.  A compression of
+// 100 is a usual trade-off; it is at least 10.
+func NewTDigestSample(compression float64) Sample {
+	if compression < 10 {
+		compression = 10
+	}
+	s := &TDigestSample{compression: compression}
+	s.stats.reset()
+	return s
+}
+
+// Clear clears all samples.
+func (s *TDigestSample) Clear(time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.StoreInt64(&s.count, 0)
+	s.reset()
+}
+
+// Compression returns the compression of the digest.
+func (s *TDigestSample) Compression() float64 {
+	return s.compression
+}
+
+// Count returns the number of samples recorded, merged ones included.
+func (s *TDigestSample) Count() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+// Max returns the exact maximum value recorded.
+func (s *TDigestSample) Max() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.maxValue()
+}
+
+// Mean returns the exact mean of the values recorded.
+func (s *TDigestSample) Mean() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.mean
+}
+
+// Merge adds the values summarized by other, which must be a TDigestSample,
+// to the digest.
+func (s *TDigestSample) Merge(other Sample) error {
+	o, ok := other.(*TDigestSample)
+	if !ok {
+		return IncompatibleSample(fmt.Sprintf("cannot merge %T into %T", other, s))
+	}
+	if o == s {
+		return IncompatibleSample("cannot merge a TDigestSample into itself")
+	}
+
+	o.mutex.Lock()
+	centroids := make([]centroid, 0, len(o.centroids)+len(o.buffer))
+	centroids = append(centroids, o.centroids...)
+	centroids = append(centroids, o.buffer...)
+	stats := o.stats
+	count := atomic.LoadInt64(&o.count)
+	o.mutex.Unlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, count)
+	s.stats.merge(stats)
+	s.buffer = append(s.buffer, centroids...)
+	s.compress()
+	return nil
+}
+
+// Min returns the exact minimum value recorded.
+func (s *TDigestSample) Min() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.minValue()
+}
+
+// Percentile returns an arbitrary percentile of the values recorded.
+func (s *TDigestSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values
+// recorded.
+func (s *TDigestSample) Percentiles(ps []float64) []float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.compress()
+	scores := make([]float64, len(ps))
+	if 0 == s.stats.n {
+		return scores
+	}
+	for i, p := range ps {
+		scores[i] = s.quantile(p)
+	}
+	return scores
+}
+
+// Size returns the number of values in the digest.
+func (s *TDigestSample) Size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return int(s.stats.n)
+}
+
+// StdDev returns the exact standard deviation of the values recorded.
+func (s *TDigestSample) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+// Sum returns the exact sum of the values recorded.
+func (s *TDigestSample) Sum() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.sum
+}
+
+// Update records a new value.
+func (s *TDigestSample) Update(t time.Time, v int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	atomic.AddInt64(&s.count, 1)
+	s.stats.update(v)
+	s.buffer = append(s.buffer, centroid{mean: float64(v), count: 1})
+	if len(s.buffer) >= s.bufferSize() {
+		s.compress()
+	}
+}
+
+// Values returns the values in the digest, each the rounded mean of its
+// centroid.  It allocates Size values: prefer the other methods.
+func (s *TDigestSample) Values() []int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.compress()
+	values := make([]int64, 0, s.stats.n)
+	for _, c := range s.centroids {
+		v := int64(math.Floor(c.mean + 0.5))
+		for i := int64(0); i < c.count; i++ {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Variance returns the exact variance of the values recorded.
+func (s *TDigestSample) Variance() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats.variance()
+}
+
+func (s *TDigestSample) GetWindow() time.Duration {
+	return 0
+}
+
+func (s *TDigestSample) ZeroOut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reset()
+}
+
+// MarshalBinary encodes the digest compactly: its compression, count, exact
+// statistics, then the centroids as delta-encoded means and varint counts.
+func (s *TDigestSample) MarshalBinary() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.compress()
+
+	w := &binaryWriter{}
+	w.putHeader(tdigestEncoding, tdigestEncodingVersion)
+	w.putFloat64(s.compression)
+	w.putUvarint(uint64(atomic.LoadInt64(&s.count)))
+	s.stats.marshal(w)
+	w.putUvarint(uint64(len(s.centroids)))
+	var previous float64
+	for _, c := range s.centroids {
+		w.putFloat64(c.mean - previous)
+		w.putUvarint(uint64(c.count))
+		previous = c.mean
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the digest by the one encoded in data by
+// MarshalBinary.
+func (s *TDigestSample) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(tdigestEncoding, tdigestEncodingVersion)
+	compression := r.float64()
+	count := r.uvarint()
+	var stats sampleStats
+	stats.unmarshal(r)
+	centroids := make([]centroid, r.count(9))
+	var mean float64
+	for i := range centroids {
+		mean += r.float64()
+		centroids[i] = centroid{mean: mean, count: int64(r.uvarint())}
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+	if compression < 10 || compression > maxTDigestCompression || math.IsNaN(compression) {
+		return InvalidEncoding(fmt.Sprintf("compression %v", compression))
+	}
+	// Centroids of equal means are fine: a repeated value may outweigh the
+	// size of one centroid.
+	var n int64
+	for i, c := range centroids {
+		if c.count < 1 || c.count > stats.n-n || math.IsNaN(c.mean) || (i > 0 && c.mean < centroids[i-1].mean) {
+			return InvalidEncoding(fmt.Sprintf("centroid %d of %d: %v values around %v", i, len(centroids), c.count, c.mean))
+		}
+		n += c.count
+	}
+	if n != stats.n {
+		return InvalidEncoding(fmt.Sprintf("%d values in centroids, %d counted", n, stats.n))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.compression = compression
+	atomic.StoreInt64(&s.count, int64(count))
+	s.stats = stats
+	s.centroids = centroids
+	s.buffer = nil
+	return nil
+}
+
+// bufferSize returns the number of values buffered before they are merged
+// into the centroids.
+func (s *TDigestSample) bufferSize() int {
+	return int(5 * s.compression)
+}
+
+// reset empties the digest and the exact statistics, with the mutex held.
+func (s *TDigestSample) reset() {
+	s.centroids = nil
+	s.buffer = nil
+	s.stats.reset()
+}
+
+// compress merges the buffer into the centroids, with the mutex held.
+// Neighbouring centroids are merged as long as the merged centroid spans at
+// most one unit of the k1 scale function, whose units shrink near the tails.
+func (s *TDigestSample) compress() {
+	if 0 == len(s.buffer) {
+		return
+	}
+	all := append(s.centroids, s.buffer...)
+	s.buffer = s.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	var total int64
+	for _, c := range all {
+		total += c.count
+	}
+
+	merged := make([]centroid, 0, int(2*s.compression))
+	current := all[0]
+	var weightSoFar int64
+	limit := s.quantileLimit(0)
+	for _, c := range all[1:] {
+		q := float64(weightSoFar+current.count+c.count) / float64(total)
+		if q <= limit {
+			current.count += c.count
+			current.mean += (c.mean - current.mean) * float64(c.count) / float64(current.count)
+			continue
+		}
+		weightSoFar += current.count
+		merged = append(merged, current)
+		limit = s.quantileLimit(float64(weightSoFar) / float64(total))
+		current = c
+	}
+	s.centroids = append(merged, current)
+}
+
+// quantileLimit returns the quantile up to which a centroid starting at
+// quantile q may extend.
+func (s *TDigestSample) quantileLimit(q float64) float64 {
+	k := s.compression / (2 * math.Pi) * math.Asin(2*q-1)
+	k++
+	if k >= s.compression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/s.compression) + 1) / 2
+}
+
+// quantile interpolates the value at quantile p between the means of the
+// centroids, each taken at the middle of its weight, and the exact min and
+// max at both ends, with the mutex held and the buffer compressed.
+func (s *TDigestSample) quantile(p float64) float64 {
+	min, max := float64(s.stats.min), float64(s.stats.max)
+	if p <= 0 {
+		return min
+	}
+	if p >= 1 {
+		return max
+	}
+	cs := s.centroids
+	if 1 == len(cs) {
+		return cs[0].mean
+	}
+
+	index := p * float64(s.stats.n)
+	first := float64(cs[0].count) / 2
+	if index < first {
+		return min + (cs[0].mean-min)*index/first
+	}
+	weightSoFar := first
+	for i := 0; i < len(cs)-1; i++ {
+		dw := float64(cs[i].count+cs[i+1].count) / 2
+		if weightSoFar+dw > index {
+			z := (index - weightSoFar) / dw
+			return cs[i].mean + z*(cs[i+1].mean-cs[i].mean)
+		}
+		weightSoFar += dw
+	}
+	last := cs[len(cs)-1]
+	half := float64(last.count) / 2
+	z := (index - weightSoFar) / half
+	return last.mean + z*(max-last.mean)
+}
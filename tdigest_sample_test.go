@@ -0,0 +1,221 @@
+package timemetrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTDigestSamplePercentiles(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]int64, 100000)
+	s := NewTDigestSample(100)
+	for i := range values {
+		values[i] = r.Int63n(1000000)
+		s.Update(time.Unix(int64(i), 0), values[i])
+	}
+	ps := []float64{0.5, 0.9, 0.99, 0.999}
+	exact := SamplePercentiles(values, ps)
+	for i, p := range s.Percentiles(ps) {
+		if math.Abs(p-exact[i]) > 0.01*1000000*math.Min(ps[i], 1-ps[i])+500 {
+			t.Errorf("s.Percentile(%v): %v too far from %v\n", ps[i], p, exact[i])
+		}
+	}
+	if count := s.Count(); 100000 != count {
+		t.Errorf("s.Count(): 100000 != %v\n", count)
+	}
+	if n := len(s.(*TDigestSample).centroids); 2*100 < n {
+		t.Errorf("len(s.centroids): %v > 200\n", n)
+	}
+}
+
+func TestTDigestSampleExact(t *testing.T) {
+	s := NewTDigestSample(100)
+	for i := 1; i <= 1000; i++ {
+		s.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	if min := s.Min(); 1 != min {
+		t.Errorf("s.Min(): 1 != %v\n", min)
+	}
+	if max := s.Max(); 1000 != max {
+		t.Errorf("s.Max(): 1000 != %v\n", max)
+	}
+	if sum := s.Sum(); 500500 != sum {
+		t.Errorf("s.Sum(): 500500 != %v\n", sum)
+	}
+	if p := s.Percentile(0); 1 != p {
+		t.Errorf("s.Percentile(0): 1 != %v\n", p)
+	}
+	if p := s.Percentile(1); 1000 != p {
+		t.Errorf("s.Percentile(1): 1000 != %v\n", p)
+	}
+	if size := len(s.Values()); 1000 != size {
+		t.Errorf("len(s.Values()): 1000 != %v\n", size)
+	}
+}
+
+func TestTDigestSampleMerge(t *testing.T) {
+	// 50 hosts, each seeing a different part of the latencies.
+	r := rand.New(rand.NewSource(2))
+	fleet := NewTDigestSample(100).(*TDigestSample)
+	var values []int64
+	for host := 0; host < 50; host++ {
+		s := NewTDigestSample(100)
+		for i := 0; i < 1000; i++ {
+			v := int64(host*1000) + r.Int63n(1000)
+			values = append(values, v)
+			s.Update(time.Unix(int64(i), 0), v)
+		}
+		if err := fleet.Merge(s); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if count := fleet.Count(); 50000 != count {
+		t.Errorf("fleet.Count(): 50000 != %v\n", count)
+	}
+	if mean, expected := fleet.Mean(), SampleMean(values); math.Abs(mean-expected) > 1e-6 {
+		t.Errorf("fleet.Mean(): %v != %v\n", expected, mean)
+	}
+	if variance, expected := fleet.Variance(), SampleVariance(values); math.Abs(variance-expected)/expected > 1e-9 {
+		t.Errorf("fleet.Variance(): %v != %v\n", expected, variance)
+	}
+	exact := SamplePercentile(values, 0.99)
+	if p := fleet.Percentile(0.99); math.Abs(p-exact) > 100 {
+		t.Errorf("fleet.Percentile(0.99): %v too far from %v\n", p, exact)
+	}
+}
+
+func TestTDigestSampleMergeIncompatible(t *testing.T) {
+	s := NewTDigestSample(100).(*TDigestSample)
+	if err := s.Merge(NewUniformSample(10)); nil == err {
+		t.Error("s.Merge(UniformSample): expected an error\n")
+	}
+	if err := s.Merge(s); nil == err {
+		t.Error("s.Merge(s): expected an error\n")
+	}
+}
+
+func TestTDigestSampleBinary(t *testing.T) {
+	s := NewTDigestSample(100).(*TDigestSample)
+	for i := 0; i < 100000; i++ {
+		s.Update(time.Unix(int64(i), 0), int64(i%5000))
+	}
+	data, err := s.MarshalBinary()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3000 < len(data) {
+		t.Errorf("len(s.MarshalBinary()): %v > 3000\n", len(data))
+	}
+
+	s2 := NewTDigestSample(10).(*TDigestSample)
+	if err := s2.UnmarshalBinary(data); nil != err {
+		t.Fatal(err)
+	}
+	if c := s2.Compression(); 100 != c {
+		t.Errorf("s2.Compression(): 100 != %v\n", c)
+	}
+	if count := s2.Count(); 100000 != count {
+		t.Errorf("s2.Count(): 100000 != %v\n", count)
+	}
+	if max := s2.Max(); 4999 != max {
+		t.Errorf("s2.Max(): 4999 != %v\n", max)
+	}
+	ps := []float64{0.5, 0.99}
+	expected, got := s.Percentiles(ps), s2.Percentiles(ps)
+	for i := range ps {
+		if expected[i] != got[i] {
+			t.Errorf("s2.Percentile(%v): %v != %v\n", ps[i], expected[i], got[i])
+		}
+	}
+
+	if err := s2.UnmarshalBinary(data[:len(data)-1]); nil == err {
+		t.Error("s2.UnmarshalBinary(truncated): expected an error\n")
+	}
+	if err := s2.UnmarshalBinary(append([]byte{'x'}, data[1:]...)); nil == err {
+		t.Error("s2.UnmarshalBinary(other kind): expected an error\n")
+	}
+	if err := s2.UnmarshalBinary(append([]byte{data[0], 99}, data[2:]...)); nil == err {
+		t.Error("s2.UnmarshalBinary(newer version): expected an error\n")
+	}
+}
+
+func TestTDigestSampleEmpty(t *testing.T) {
+	s := NewTDigestSample(100).(*TDigestSample)
+	if p := s.Percentile(0.5); 0 != p {
+		t.Errorf("s.Percentile(0.5): 0 != %v\n", p)
+	}
+	data, err := s.MarshalBinary()
+	if nil != err {
+		t.Fatal(err)
+	}
+	s2 := NewTDigestSample(100).(*TDigestSample)
+	s2.Update(time.Unix(0, 0), 1)
+	if err := s2.UnmarshalBinary(data); nil != err {
+		t.Fatal(err)
+	}
+	if size := s2.Size(); 0 != size {
+		t.Errorf("s2.Size(): 0 != %v\n", size)
+	}
+	if max := s2.Max(); 0 != max {
+		t.Errorf("s2.Max(): 0 != %v\n", max)
+	}
+}
+
+func TestTDigestSampleHistogram(t *testing.T) {
+	h := NewHistogram(NewTDigestSample(100), 10)
+	for i := 1; i <= 1000; i++ {
+		h.Update(time.Unix(int64(i), 0), int64(i))
+	}
+	if p := h.Percentile(0.5); math.Abs(p-500) > 5 {
+		t.Errorf("h.Percentile(0.5): %v too far from 500\n", p)
+	}
+	h.ZeroOut()
+	if size := h.Sample().Size(); 0 != size {
+		t.Errorf("h.Sample().Size(): 0 != %v\n", size)
+	}
+}
+
+func TestTDigestSampleUnmarshalInconsistent(t *testing.T) {
+	s := NewTDigestSample(100).(*TDigestSample)
+	for i := 0; i < 10000; i++ {
+		s.Update(time.Unix(int64(i), 0), 7)
+	}
+	data, err := s.MarshalBinary()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := (&TDigestSample{}).UnmarshalBinary(data); nil != err {
+		t.Errorf("s.UnmarshalBinary(repeated value): %v\n", err)
+	}
+
+	var stats sampleStats
+	stats.reset()
+	stats.update(7)
+	for name, centroids := range map[string][]centroid{
+		"no centroid":     nil,
+		"empty centroid":  {{mean: 7, count: 0}, {mean: 8, count: 1}},
+		"too many values": {{mean: 7, count: 2}},
+		"unsorted means":  {{mean: 7, count: 1}, {mean: 6, count: 0}},
+		"overflow":        {{mean: 7, count: 1}, {mean: 8, count: math.MaxInt64}},
+	} {
+		w := &binaryWriter{}
+		w.putHeader(tdigestEncoding, tdigestEncodingVersion)
+		w.putFloat64(100)
+		w.putUvarint(1)
+		stats.marshal(w)
+		w.putUvarint(uint64(len(centroids)))
+		var previous float64
+		for _, c := range centroids {
+			w.putFloat64(c.mean - previous)
+			w.putUvarint(uint64(c.count))
+			previous = c.mean
+		}
+		if err := (&TDigestSample{}).UnmarshalBinary(w.buf); nil == err {
+			t.Errorf("s.UnmarshalBinary(%s): expected an InvalidEncoding\n", name)
+		} else if _, ok := err.(InvalidEncoding); !ok {
+			t.Errorf("s.UnmarshalBinary(%s): %v is not an InvalidEncoding\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package timemetrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Temporality selects the count a Counter or a Meter emits when flushed: its
+// running total, or its change since the count it last emitted.
+type Temporality int
+
+const (
+	// Cumulative counts are the running total.
+	Cumulative Temporality = iota
+	// Delta counts are the change since the last delta emitted.
+	Delta
+)
+
+// String returns the name of the temporality.
+func (t Temporality) String() string {
+	switch t {
+	case Cumulative:
+		return "cumulative"
+	case Delta:
+		return "delta"
+	}
+	return "unknown"
+}
+
+// TemporalMetric is a Metric whose count is emitted with a Temporality, by
+// default the one set on the metric.  Counters and Meters are
+// TemporalMetrics.
+type TemporalMetric interface {
+	Metric
+	GetDatapointsWithTemporality(time.Time, bool, Temporality) []Datapoint
+	SetTemporality(Temporality)
+	Temporality() Temporality
+}
+
+// deltaTracker keeps the temporality of a count and the baseline of its
+// deltas, the count last emitted as a delta.  Metrics embed it to expose
+// Temporality and SetTemporality.
+type deltaTracker struct {
+	baseline    int64 // /!\ this should be the first member to ensure 64-bit alignment
+	temporality int32
+}
+
+// Temporality returns the temporality of the emitted count.
+func (d *deltaTracker) Temporality() Temporality {
+	return Temporality(atomic.LoadInt32(&d.temporality))
+}
+
+// SetTemporality sets the temporality of the emitted count.
+func (d *deltaTracker) SetTemporality(t Temporality) {
+	atomic.StoreInt32(&d.temporality, int32(t))
+}
+
+// emit returns the current value of count or, if t is Delta, its change
+// since the last delta, making it the baseline of the next one.  The
+// baseline is swapped for a count read after it: a concurrent update is part
+// of exactly one delta.
+func (d *deltaTracker) emit(count *int64, t Temporality) int64 {
+	if Delta != t {
+		return atomic.LoadInt64(count)
+	}
+	for {
+		baseline := atomic.LoadInt64(&d.baseline)
+		c := atomic.LoadInt64(count)
+		if atomic.CompareAndSwapInt64(&d.baseline, baseline, c) {
+			return c - baseline
+		}
+	}
+}
+
+// deltaBaselines keeps the counts last emitted as deltas by one consumer,
+// such as a Flusher, keyed by metricKey.  Unlike the baselines of the
+// metrics, they are not moved by other consumers.
+type deltaBaselines struct {
+	counts map[string]deltaBaseline
+	mutex  sync.Mutex
+}
+
+// deltaBaseline is a count emitted at a time.
+type deltaBaseline struct {
+	count int64
+	time  time.Time
+}
+
+// delta returns the change of count since the count last emitted under key
+// and the time that count was emitted at, zero for the first one.  count,
+// emitted at t, becomes the baseline of the next delta.
+func (b *deltaBaselines) delta(key string, count int64, t time.Time) (int64, time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if nil == b.counts {
+		b.counts = make(map[string]deltaBaseline)
+	}
+	previous := b.counts[key]
+	b.counts[key] = deltaBaseline{count, t}
+	return count - previous.count, previous.time
+}
+
+// clone returns a copy of the baselines.
+func (b *deltaBaselines) clone() *deltaBaselines {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c := &deltaBaselines{counts: make(map[string]deltaBaseline, len(b.counts))}
+	for key, baseline := range b.counts {
+		c.counts[key] = baseline
+	}
+	return c
+}
+
+// set replaces the baselines by those of o, which is not used afterwards.
+func (b *deltaBaselines) set(o *deltaBaselines) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.counts = o.counts
+}
+
+// forget drops the baseline of key, e.g. once its metric is unregistered.
+func (b *deltaBaselines) forget(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.counts, key)
+}
+
+// retain drops the baselines of the keys not in keys.
+func (b *deltaBaselines) retain(keys map[string]bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key := range b.counts {
+		if !keys[key] {
+			delete(b.counts, key)
+		}
+	}
+}
+
+// temporalMetric overrides the temporality of a TemporalMetric.  Its deltas
+// are against the baselines of its consumer, leaving those of the metric
+// alone.
+type temporalMetric struct {
+	TemporalMetric
+	temporality Temporality
+	baselines   *deltaBaselines
+	key         string
+}
+
+func (m temporalMetric) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, m.GetDatapoints(ct, currentTime))
+}
+
+func (m temporalMetric) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	dps := m.GetDatapointsWithTemporality(ct, currentTime, Cumulative)
+	if Delta == m.temporality {
+		for i := range dps {
+			if "count" == dps[i].Suffix {
+				dps[i].Int, _ = m.baselines.delta(m.key, dps[i].Int, dps[i].Time)
+			}
+		}
+	}
+	return dps
+}
@@ -0,0 +1,117 @@
+package timemetrics
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCounterTemporality(t *testing.T) {
+	c := NewCounter(time.Unix(600, 0), 10)
+	if Cumulative != c.Temporality() {
+		t.Errorf("c.Temporality(): %v != %v\n", Cumulative, c.Temporality())
+	}
+	c.SetTemporality(Delta)
+	c.Inc(time.Unix(610, 0), 3)
+	if keys := c.GetKeys(time.Unix(660, 0), "%s %d %s", false); !reflect.DeepEqual([]string{"count 610 3"}, keys) {
+		t.Errorf("c.GetKeys(): [count 610 3] != %v\n", keys)
+	}
+	c.Inc(time.Unix(620, 0), 2)
+	c.Dec(time.Unix(630, 0), 4)
+	if dps := c.GetDatapoints(time.Unix(660, 0), false); -2 != dps[0].Int {
+		t.Errorf("c.GetDatapoints(): -2 != %v\n", dps[0].Int)
+	}
+
+	// Cumulative reads leave the baseline alone.
+	c.Inc(time.Unix(640, 0), 5)
+	if dps := c.GetDatapointsWithTemporality(time.Unix(660, 0), false, Cumulative); 6 != dps[0].Int {
+		t.Errorf("c.GetDatapointsWithTemporality(Cumulative): 6 != %v\n", dps[0].Int)
+	}
+	if dps := c.GetDatapoints(time.Unix(660, 0), false); 5 != dps[0].Int {
+		t.Errorf("c.GetDatapoints(): 5 != %v\n", dps[0].Int)
+	}
+
+	c.Inc(time.Unix(650, 0), 1)
+	c.Clear(time.Unix(650, 0))
+	c.Inc(time.Unix(650, 0), 1)
+	if dps := c.GetDatapoints(time.Unix(660, 0), false); 1 != dps[0].Int {
+		t.Errorf("c.GetDatapoints(): 1 != %v after Clear\n", dps[0].Int)
+	}
+}
+
+func TestMeterTemporality(t *testing.T) {
+	m := NewMeterWithOptions(time.Unix(600, 0), 60, 10, nil, MeterOptions{Windows: []time.Duration{time.Minute}})
+	m.SetTemporality(Delta)
+	m.Mark(time.Unix(610, 0), 3)
+	if dps := m.GetDatapoints(time.Unix(660, 0), false); 2 != len(dps) || 3 != dps[0].Int {
+		t.Errorf("m.GetDatapoints(): count 3 and a rate != %v\n", dps)
+	}
+	m.Mark(time.Unix(670, 0), 4)
+	if dps := m.GetDatapoints(time.Unix(680, 0), false); 1 != len(dps) || 4 != dps[0].Int {
+		t.Errorf("m.GetDatapoints(): count 4 != %v\n", dps)
+	}
+	if count := m.Count(); 7 != count {
+		t.Errorf("m.Count(): 7 != %v\n", count)
+	}
+
+	// The baseline survives snapshots.
+	restored := &StandardMeter{}
+	if err := restored.UnmarshalBinary(mustSnapshot(t, m)); nil != err {
+		t.Fatal(err)
+	}
+	m.Mark(time.Unix(690, 0), 1)
+	restored.Mark(time.Unix(690, 0), 1)
+	if dps := restored.GetDatapointsWithTemporality(time.Unix(700, 0), false, Delta); 1 != dps[0].Int {
+		t.Errorf("restored.GetDatapointsWithTemporality(Delta): 1 != %v\n", dps[0].Int)
+	}
+	if Cumulative != restored.Temporality() {
+		t.Errorf("restored.Temporality(): %v != %v\n", Cumulative, restored.Temporality())
+	}
+}
+
+func TestFlusherTemporality(t *testing.T) {
+	r := NewRegistry(60, 10)
+	var buf bytes.Buffer
+	f := NewFlusher(r, time.Minute, time.Minute, FormatKeys(testFormat, true))
+	f.SetTemporality(Delta)
+	start := time.Unix(600, 0)
+
+	c := GetOrRegisterCounter("foo", r, start)
+	c.Inc(start, 3)
+	GetOrRegisterGauge("bar", r, start).Update(start, 7)
+	keys := f.Flush(start.Add(time.Minute))
+	sort.Strings(keys)
+	if expected := []string{"put bar.value 660 7", "put foo.count 660 3"}; !reflect.DeepEqual(expected, keys) {
+		t.Errorf("f.Flush(): %v != %v\n", expected, keys)
+	}
+
+	// Neither another flusher nor the deltas of the counter itself take
+	// the deltas of the flusher.
+	cumulative := NewFlusher(r, time.Minute, time.Minute, FormatKeys(testFormat, true))
+	cumulative.SetTemporality(Cumulative)
+	c.Inc(start.Add(90*time.Second), 2)
+	keys = cumulative.Flush(start.Add(100 * time.Second))
+	sort.Strings(keys)
+	if expected := []string{"put bar.value 700 7", "put foo.count 700 5"}; !reflect.DeepEqual(expected, keys) {
+		t.Errorf("cumulative.Flush(): %v != %v\n", expected, keys)
+	}
+	c.SetTemporality(Delta)
+	c.GetKeys(start.Add(100*time.Second), "%s %d %s", true)
+	c.SetTemporality(Cumulative)
+	if keys := f.Flush(start.Add(2 * time.Minute)); !reflect.DeepEqual([]string{"put foo.count 720 2"}, keys) {
+		t.Errorf("f.Flush(): [put foo.count 720 2] != %v\n", keys)
+	}
+
+	// The counter keeps its own temporality for other flushes and exports.
+	if Cumulative != c.Temporality() || 5 != c.Count() {
+		t.Errorf("c.Temporality(), c.Count(): %v, 5 != %v, %v\n", Cumulative, c.Temporality(), c.Count())
+	}
+	if err := WritePrometheus(&buf, r, false); nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("foo 5 690000\n")) {
+		t.Errorf("WritePrometheus(): foo 5 not in\n%s\n", buf.String())
+	}
+}
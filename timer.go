@@ -0,0 +1,298 @@
+package timemetrics
+
+import (
+	"time"
+)
+
+// Timers capture the duration and rate of events.  Durations are recorded in
+// nanoseconds and emitted in the unit of the timer.
+type Timer interface {
+	Count() int64
+	Dropped() int64
+	Late() int64
+	LateOptions() LateOptions
+	Max() int64
+	Mean() float64
+	Min() int64
+	Options() HistogramOptions
+	Percentile(float64) float64
+	Percentiles([]float64) []float64
+	Rate1() float64
+	Rate5() float64
+	Rate15() float64
+	SetLateOptions(LateOptions)
+	StdDev() float64
+	Time(time.Time, func())
+	Update(time.Time, int64)
+	UpdateSince(time.Time, time.Time)
+	Unit() time.Duration
+	Variance() float64
+	GetMaxTime() time.Time
+	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	NbKeys() int
+	Stale(time.Time) bool
+	PushKeysTime(time.Time) bool
+	Tags() Tags
+	ZeroOut()
+}
+
+// GetOrRegisterTimer returns an existing Timer or constructs and registers a
+// new StandardTimer stamped with the event time t.
+func GetOrRegisterTimer(name string, r Registry, t time.Time, s Sample, unit time.Duration) Timer {
+	return GetOrRegisterTaggedTimer(name, nil, r, t, s, unit)
+}
+
+// GetOrRegisterTaggedTimer returns an existing Timer or constructs and
+// registers a new tagged StandardTimer stamped with the event time t.
+func GetOrRegisterTaggedTimer(name string, tags Tags, r Registry, t time.Time, s Sample, unit time.Duration) Timer {
+	return GetOrRegisterTimerWithOptions(name, tags, r, t, s, unit, DefaultHistogramOptions())
+}
+
+// GetOrRegisterTimerWithOptions returns an existing Timer or constructs and
+// registers a new tagged StandardTimer whose histogram keys are selected by
+// opts.
+func GetOrRegisterTimerWithOptions(name string, tags Tags, r Registry, t time.Time, s Sample, unit time.Duration, opts HistogramOptions) Timer {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		return NewTimerWithOptions(t, s, interval, staleThreshold, unit, tags, opts)
+	}).(Timer)
+}
+
+// NewTimer constructs a new StandardTimer from a Sample, emitting durations
+// in the given unit, e.g. time.Millisecond.
+func NewTimer(t time.Time, s Sample, interval int, staleThreshold int, unit time.Duration) Timer {
+	return NewTaggedTimer(t, s, interval, staleThreshold, unit, nil)
+}
+
+// NewTaggedTimer constructs a new StandardTimer with the given tags.
+func NewTaggedTimer(t time.Time, s Sample, interval int, staleThreshold int, unit time.Duration, tags Tags) Timer {
+	return NewTimerWithOptions(t, s, interval, staleThreshold, unit, tags, DefaultHistogramOptions())
+}
+
+// NewTimerWithOptions constructs a new tagged StandardTimer whose histogram
+// keys are selected by opts.
+func NewTimerWithOptions(t time.Time, s Sample, interval int, staleThreshold int, unit time.Duration, tags Tags, opts HistogramOptions) Timer {
+	h := NewHistogramWithOptions(s, staleThreshold, nil, opts).(*StandardHistogram)
+	h.lastUpdate = t
+	return &StandardTimer{
+		histogram: h,
+		meter:     NewMeter(t, interval, staleThreshold),
+		unit:      unit,
+		tags:      copyTags(tags),
+	}
+}
+
+// NewRegisteredTimer constructs and registers a new StandardTimer.  It
+// returns DuplicateMetric if a metric is already registered under name.
+func NewRegisteredTimer(name string, r Registry, t time.Time, s Sample, unit time.Duration) (Timer, error) {
+	return NewRegisteredTaggedTimer(name, nil, r, t, s, unit)
+}
+
+// NewRegisteredTaggedTimer constructs and registers a new tagged
+// StandardTimer.
+func NewRegisteredTaggedTimer(name string, tags Tags, r Registry, t time.Time, s Sample, unit time.Duration) (Timer, error) {
+	tm := NewTaggedTimer(t, s, r.Interval(), r.StaleThreshold(), unit, tags)
+	if err := r.Register(name, tm); err != nil {
+		return nil, err
+	}
+	return tm, nil
+}
+
+// StandardTimer is the standard implementation of a Timer and uses a Histogram
+// and Meter.
+type StandardTimer struct {
+	lateTracker
+	histogram Histogram
+	meter     Meter
+	unit      time.Duration
+	tags      Tags
+}
+
+// Count returns the number of events recorded.
+func (t *StandardTimer) Count() int64 {
+	return t.histogram.Count()
+}
+
+// Max returns the maximum value in the sample, in nanoseconds.
+func (t *StandardTimer) Max() int64 {
+	return t.histogram.Max()
+}
+
+// Mean returns the mean of the values in the sample, in nanoseconds.
+func (t *StandardTimer) Mean() float64 {
+	return t.histogram.Mean()
+}
+
+// Min returns the minimum value in the sample, in nanoseconds.
+func (t *StandardTimer) Min() int64 {
+	return t.histogram.Min()
+}
+
+// Options returns the selection of histogram keys emitted by the timer.
+func (t *StandardTimer) Options() HistogramOptions {
+	return t.histogram.Options()
+}
+
+// Percentile returns an arbitrary percentile of the values in the sample, in
+// nanoseconds.
+func (t *StandardTimer) Percentile(p float64) float64 {
+	return t.histogram.Percentile(p)
+}
+
+// Percentiles returns a slice of arbitrary percentiles of the values in the
+// sample, in nanoseconds.
+func (t *StandardTimer) Percentiles(ps []float64) []float64 {
+	return t.histogram.Percentiles(ps)
+}
+
+// Rate1 returns the one-minute moving average rate of events.
+func (t *StandardTimer) Rate1() float64 {
+	return t.meter.Rate1()
+}
+
+// Rate5 returns the five-minute moving average rate of events.
+func (t *StandardTimer) Rate5() float64 {
+	return t.meter.Rate5()
+}
+
+// Rate15 returns the fifteen-minute moving average rate of events.
+func (t *StandardTimer) Rate15() float64 {
+	return t.meter.Rate15()
+}
+
+// StdDev returns the standard deviation of the values in the sample, in
+// nanoseconds.
+func (t *StandardTimer) StdDev() float64 {
+	return t.histogram.StdDev()
+}
+
+// Time records the wall-clock duration of the execution of f as an event
+// which happened at ts.
+func (t *StandardTimer) Time(ts time.Time, f func()) {
+	start := time.Now()
+	f()
+	t.Update(ts, int64(time.Since(start)))
+}
+
+// Update records the duration d, in nanoseconds, of an event which happened
+// at ts, unless ts is late and the late policy discards it.
+func (t *StandardTimer) Update(ts time.Time, d int64) {
+	if !t.admit(ts, t.GetMaxTime()) {
+		return
+	}
+	t.histogram.Update(ts, d)
+	t.meter.Mark(ts, 1)
+}
+
+// UpdateSince records the duration of an event which started at start and
+// ended at end.
+func (t *StandardTimer) UpdateSince(start time.Time, end time.Time) {
+	t.Update(end, int64(end.Sub(start)))
+}
+
+// Unit returns the unit durations are emitted in.
+func (t *StandardTimer) Unit() time.Duration {
+	return t.unit
+}
+
+// Variance returns the variance of the values in the sample, in nanoseconds
+// squared.
+func (t *StandardTimer) Variance() float64 {
+	return t.histogram.Variance()
+}
+
+func (t *StandardTimer) GetMaxTime() time.Time {
+	return t.histogram.GetMaxTime()
+}
+
+func (t *StandardTimer) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, t.GetDatapoints(ct, currentTime))
+}
+
+func (t *StandardTimer) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	ts := datapointTime(t, ct, currentTime)
+
+	dps := t.meter.GetDatapoints(ct, currentTime)
+	for i := range dps {
+		dps[i].Kind = TimerKind
+		dps[i].Time = ts
+	}
+	dps = append(dps, t.histogram.Options().datapoints(t.histogram, ts, TimerKind, t.unit)...)
+
+	return tagDatapoints(dps, t.tags)
+}
+
+func (t *StandardTimer) NbKeys() int {
+	return t.meter.NbKeys() + t.histogram.NbKeys()
+}
+
+func (t *StandardTimer) Stale(ts time.Time) bool {
+	return t.histogram.Stale(ts)
+}
+
+func (t *StandardTimer) PushKeysTime(ts time.Time) bool {
+	return t.histogram.PushKeysTime(ts) || t.meter.PushKeysTime(ts)
+}
+
+func (t *StandardTimer) Tags() Tags {
+	return t.tags
+}
+
+func (t *StandardTimer) ZeroOut() {
+	t.histogram.ZeroOut()
+	t.meter.ZeroOut()
+}
+
+// timerEncodingVersion is the version of the encoding of StandardTimers.
+const timerEncodingVersion = 1
+
+// MarshalBinary encodes the timer, its histogram and its meter.
+func (t *StandardTimer) MarshalBinary() ([]byte, error) {
+	histogram, err := snapshot(t.histogram)
+	if err != nil {
+		return nil, err
+	}
+	meter, err := snapshot(t.meter)
+	if err != nil {
+		return nil, err
+	}
+	w := &binaryWriter{}
+	w.putHeader(timerEncoding, timerEncodingVersion)
+	w.putDuration(t.unit)
+	w.putTags(t.tags)
+	t.lateTracker.marshal(w)
+	w.putBytes(histogram)
+	w.putBytes(meter)
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the timer, its histogram and its meter by the
+// ones encoded in data by MarshalBinary.  It must not run concurrently with
+// updates.
+func (t *StandardTimer) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(timerEncoding, timerEncodingVersion)
+	unit := r.duration()
+	tags := r.tags()
+	late, dropped := unmarshalLateCounts(r)
+	encodedHistogram := r.bytes()
+	encodedMeter := r.bytes()
+	if err := r.end(); err != nil {
+		return err
+	}
+	h := &StandardHistogram{}
+	if err := h.UnmarshalBinary(encodedHistogram); err != nil {
+		return err
+	}
+	m := &StandardMeter{}
+	if err := m.UnmarshalBinary(encodedMeter); err != nil {
+		return err
+	}
+
+	t.histogram = h
+	t.meter = m
+	t.unit = unit
+	t.tags = tags
+	t.lateTracker.restore(late, dropped)
+	return nil
+}
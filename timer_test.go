@@ -0,0 +1,97 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func BenchmarkTimer(b *testing.B) {
+	tm := NewTimer(time.Unix(0, 0), NewUniformSample(1028), 60, 10, time.Millisecond)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tm.Update(time.Unix(int64(i), 0), 1)
+	}
+}
+
+func TestTimerUpdateSince(t *testing.T) {
+	tm := NewTimer(time.Unix(0, 0), NewUniformSample(100), 60, 10, time.Millisecond)
+	start := time.Unix(10, 0)
+	tm.UpdateSince(start, start.Add(250*time.Millisecond))
+	if count := tm.Count(); 1 != count {
+		t.Errorf("tm.Count(): 1 != %v\n", count)
+	}
+	if max := tm.Max(); int64(250*time.Millisecond) != max {
+		t.Errorf("tm.Max(): 250ms != %v\n", max)
+	}
+	if maxTime := tm.GetMaxTime(); !maxTime.Equal(start.Add(250 * time.Millisecond)) {
+		t.Errorf("tm.GetMaxTime(): %v\n", maxTime)
+	}
+}
+
+func TestTimerTime(t *testing.T) {
+	tm := NewTimer(time.Unix(0, 0), NewUniformSample(100), 60, 10, time.Millisecond)
+	tm.Time(time.Unix(10, 0), func() { time.Sleep(2 * time.Millisecond) })
+	if max := tm.Max(); int64(2*time.Millisecond) > max {
+		t.Errorf("tm.Max(): 2ms > %v\n", max)
+	}
+}
+
+func TestTimerGetKeys(t *testing.T) {
+	tm := NewTimer(time.Unix(0, 0), NewUniformSample(100), 60, 10, time.Millisecond)
+	for i := 1; i <= 4; i++ {
+		tm.Update(time.Unix(int64(i), 0), int64(i)*int64(time.Millisecond))
+	}
+	keys := tm.GetKeys(time.Unix(60, 0), "put foo.%s %d %s", false)
+	expected := []string{
+		"put foo.count 4 4",
+		"put foo.rate._1min 4 0.066667",
+		"put foo.rate._5min 4 0.066667",
+		"put foo.rate._15min 4 0.066667",
+		"put foo.min 4 1.000000",
+		"put foo.max 4 4.000000",
+		"put foo.mean 4 2.500000",
+		"put foo.std-dev 4 1.118034",
+		"put foo.p50 4 2.500000",
+		"put foo.p75 4 3.750000",
+		"put foo.p95 4 4.000000",
+		"put foo.p99 4 4.000000",
+		"put foo.p999 4 4.000000",
+		"put foo.sample_size 4 4",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Fatal(keys)
+	}
+	if n := tm.NbKeys(); len(expected) != n {
+		t.Errorf("tm.NbKeys(): %v != %v\n", len(expected), n)
+	}
+	for _, dp := range tm.GetDatapoints(time.Unix(90, 0), true) {
+		if TimerKind != dp.Kind {
+			t.Errorf("%s kind: timer != %v\n", dp.Suffix, dp.Kind)
+		}
+	}
+}
+
+func TestTimerUnit(t *testing.T) {
+	tm := NewTimer(time.Unix(0, 0), NewUniformSample(100), 60, 10, time.Second)
+	tm.Update(time.Unix(1, 0), int64(1500*time.Millisecond))
+	for _, dp := range tm.GetDatapoints(time.Unix(1, 0), true) {
+		if "max" == dp.Suffix && 1.5 != dp.Float {
+			t.Errorf("max: 1.5 != %v\n", dp.Float)
+		}
+	}
+}
+
+func TestGetOrRegisterTimer(t *testing.T) {
+	r := NewRegistry(60, 10)
+	now := time.Unix(10, 0)
+	s := NewUniformSample(100)
+	tm, err := NewRegisteredTimer("foo", r, now, s, time.Millisecond)
+	if nil != err {
+		t.Fatal(err)
+	}
+	tm.Update(now, 47)
+	if tm := GetOrRegisterTimer("foo", r, now, s, time.Millisecond); 1 != tm.Count() {
+		t.Fatal(tm)
+	}
+}
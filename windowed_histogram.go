@@ -0,0 +1,350 @@
+package timemetrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WindowedHistograms aggregate values into tumbling event-time windows, such
+// as each minute of event time, keeping one Sample per open window.  A window
+// closes once the watermark, the newest event time minus the allowed
+// lateness, passes its end.  Closed windows are emitted once, each as a
+// series of histogram keys stamped with the start of the window.
+type WindowedHistogram interface {
+	AdvanceWatermark(time.Time)
+	ClosedWindows() int
+	Dropped() int64
+	OpenWindows() int
+	Update(time.Time, int64)
+	Watermark() time.Time
+	Width() time.Duration
+	GetMaxTime() time.Time
+	GetKeys(time.Time, string, bool) []string
+	GetDatapoints(time.Time, bool) []Datapoint
+	NbKeys() int
+	Stale(time.Time) bool
+	PushKeysTime(time.Time) bool
+	Tags() Tags
+	ZeroOut()
+}
+
+// GetOrRegisterWindowedHistogram returns an existing WindowedHistogram or
+// constructs and registers a new StandardWindowedHistogram stamped with the
+// event time t.
+func GetOrRegisterWindowedHistogram(name string, r Registry, t time.Time, width time.Duration, allowedLateness time.Duration, newSample func(time.Time) Sample) WindowedHistogram {
+	return GetOrRegisterWindowedHistogramWithOptions(name, nil, r, t, width, allowedLateness, newSample, DefaultHistogramOptions())
+}
+
+// GetOrRegisterWindowedHistogramWithOptions returns an existing
+// WindowedHistogram or constructs and registers a new tagged
+// StandardWindowedHistogram emitting the keys selected by opts.
+func GetOrRegisterWindowedHistogramWithOptions(name string, tags Tags, r Registry, t time.Time, width time.Duration, allowedLateness time.Duration, newSample func(time.Time) Sample, opts HistogramOptions) WindowedHistogram {
+	return r.GetOrRegister(name, tags, t, func(t time.Time, tags Tags, interval int, staleThreshold int) Metric {
+		h := NewWindowedHistogramWithOptions(width, allowedLateness, newSample, staleThreshold, tags, opts).(*StandardWindowedHistogram)
+		h.lastUpdate = t
+		return h
+	}).(WindowedHistogram)
+}
+
+// NewWindowedHistogram constructs a new StandardWindowedHistogram of windows
+// of the given width, each sampled by a Sample built by newSample from the
+// start of the window.
+func NewWindowedHistogram(width time.Duration, allowedLateness time.Duration, newSample func(time.Time) Sample, staleThreshold int) WindowedHistogram {
+	return NewWindowedHistogramWithOptions(width, allowedLateness, newSample, staleThreshold, nil, DefaultHistogramOptions())
+}
+
+// NewWindowedHistogramWithOptions constructs a new tagged
+// StandardWindowedHistogram emitting the keys selected by opts for each
+// window.
+func NewWindowedHistogramWithOptions(width time.Duration, allowedLateness time.Duration, newSample func(time.Time) Sample, staleThreshold int, tags Tags, opts HistogramOptions) WindowedHistogram {
+	return &StandardWindowedHistogram{
+		width:           width,
+		allowedLateness: allowedLateness,
+		newSample:       newSample,
+		open:            make(map[int64]*histogramWindow),
+		staleThreshold:  staleThreshold,
+		tags:            copyTags(tags),
+		options:         opts.copy(),
+	}
+}
+
+// StandardWindowedHistogram is the standard implementation of a
+// WindowedHistogram and uses a StandardHistogram per window.
+type StandardWindowedHistogram struct {
+	dropped         int64 // /!\ this should be the first member to ensure 64-bit alignment
+	width           time.Duration
+	allowedLateness time.Duration
+	newSample       func(time.Time) Sample
+	open            map[int64]*histogramWindow // keyed by window start, in unix nanoseconds
+	closed          []*histogramWindow         // sorted by window start
+	watermark       time.Time
+	lastUpdate      time.Time
+	staleThreshold  int
+	tags            Tags
+	options         HistogramOptions
+	mutex           sync.Mutex
+}
+
+// histogramWindow is the histogram of a single window.
+type histogramWindow struct {
+	start     time.Time
+	histogram *StandardHistogram
+}
+
+// AdvanceWatermark moves the watermark to t if it is newer, closing the
+// windows it passes the end of.
+func (h *StandardWindowedHistogram) AdvanceWatermark(t time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.advanceWatermark(t)
+}
+
+// ClosedWindows returns the number of closed windows waiting to be emitted.
+func (h *StandardWindowedHistogram) ClosedWindows() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.closed)
+}
+
+// Dropped returns the number of values dropped because their window was
+// already closed.
+func (h *StandardWindowedHistogram) Dropped() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
+
+// OpenWindows returns the number of windows still accepting values.
+func (h *StandardWindowedHistogram) OpenWindows() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.open)
+}
+
+// Update samples a new value in the window of its event time t.
+func (h *StandardWindowedHistogram) Update(t time.Time, v int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	start := t.Truncate(h.width)
+	if !start.Add(h.width).After(h.watermark) {
+		atomic.AddInt64(&h.dropped, 1)
+		return
+	}
+	if t.After(h.lastUpdate) {
+		h.lastUpdate = t
+	}
+
+	w, ok := h.open[start.UnixNano()]
+	if !ok {
+		w = &histogramWindow{
+			start:     start,
+			histogram: NewHistogramWithOptions(h.newSample(start), h.staleThreshold, nil, h.options).(*StandardHistogram),
+		}
+		h.open[start.UnixNano()] = w
+	}
+	w.histogram.Update(t, v)
+
+	h.advanceWatermark(t.Add(-h.allowedLateness))
+}
+
+// Watermark returns the event time before which windows are closed.
+func (h *StandardWindowedHistogram) Watermark() time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.watermark
+}
+
+// Width returns the width of the windows.
+func (h *StandardWindowedHistogram) Width() time.Duration {
+	return h.width
+}
+
+func (h *StandardWindowedHistogram) GetMaxTime() time.Time {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.lastUpdate
+}
+
+func (h *StandardWindowedHistogram) GetKeys(ct time.Time, name string, currentTime bool) []string {
+	return formatDatapoints(name, h.GetDatapoints(ct, currentTime))
+}
+
+// GetDatapoints returns the keys of every closed window, stamped with the
+// start of the window whatever currentTime, and forgets those windows.
+func (h *StandardWindowedHistogram) GetDatapoints(ct time.Time, currentTime bool) []Datapoint {
+	h.mutex.Lock()
+	closed := h.closed
+	h.closed = nil
+	h.mutex.Unlock()
+
+	dps := make([]Datapoint, 0, len(closed)*h.options.nbKeys())
+	for _, w := range closed {
+		dps = append(dps, h.options.datapoints(w.histogram, w.start, HistogramKind, 0)...)
+	}
+
+	return tagDatapoints(dps, h.tags)
+}
+
+// NbKeys returns the number of keys emitted per closed window.
+func (h *StandardWindowedHistogram) NbKeys() int {
+	return h.options.nbKeys()
+}
+
+func (h *StandardWindowedHistogram) Stale(t time.Time) bool {
+	return t.Sub(h.GetMaxTime()) > time.Duration(h.staleThreshold)*time.Minute
+}
+
+func (h *StandardWindowedHistogram) PushKeysTime(t time.Time) bool {
+	return h.ClosedWindows() > 0
+}
+
+func (h *StandardWindowedHistogram) Tags() Tags {
+	return h.tags
+}
+
+// ZeroOut closes all open windows: no more values are expected for them once
+// the histogram went stale.
+func (h *StandardWindowedHistogram) ZeroOut() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.lastUpdate.After(h.watermark) {
+		h.advanceWatermark(h.lastUpdate.Truncate(h.width).Add(h.width))
+	}
+}
+
+// windowedHistogramEncodingVersion is the version of the encoding of
+// StandardWindowedHistograms.
+const windowedHistogramEncodingVersion = 1
+
+// MarshalBinary encodes the windowed histogram, its watermark and its open
+// and closed windows, along with an empty Sample built by its newSample
+// function as a template for the samples of new windows.
+func (h *StandardWindowedHistogram) MarshalBinary() ([]byte, error) {
+	template, err := snapshot(h.newSample(time.Time{}))
+	if err != nil {
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	w := &binaryWriter{}
+	w.putHeader(windowedHistogramEncoding, windowedHistogramEncodingVersion)
+	w.putUvarint(uint64(atomic.LoadInt64(&h.dropped)))
+	w.putDuration(h.width)
+	w.putDuration(h.allowedLateness)
+	w.putTimestamp(h.watermark)
+	w.putTimestamp(h.lastUpdate)
+	w.putVarint(int64(h.staleThreshold))
+	w.putTags(h.tags)
+	h.options.marshal(w)
+	w.putBytes(template)
+
+	open := make([]*histogramWindow, 0, len(h.open))
+	for _, window := range h.open {
+		open = append(open, window)
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].start.Before(open[j].start) })
+	for _, windows := range [][]*histogramWindow{open, h.closed} {
+		w.putUvarint(uint64(len(windows)))
+		for _, window := range windows {
+			histogram, err := window.histogram.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			w.putTimestamp(window.start)
+			w.putBytes(histogram)
+		}
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary replaces the windowed histogram and its windows by the ones
+// encoded in data by MarshalBinary.  A windowed histogram built by its
+// constructor keeps its newSample function; otherwise new windows get a copy
+// of the encoded template.
+func (h *StandardWindowedHistogram) UnmarshalBinary(data []byte) error {
+	r := &binaryReader{buf: data}
+	r.header(windowedHistogramEncoding, windowedHistogramEncodingVersion)
+	dropped := int64(r.uvarint())
+	width := r.duration()
+	allowedLateness := r.duration()
+	watermark := r.timestamp()
+	lastUpdate := r.timestamp()
+	staleThreshold := int(r.varint())
+	tags := r.tags()
+	options := unmarshalHistogramOptions(r)
+	template := r.bytes()
+	var windows [2][]*histogramWindow
+	for i := range windows {
+		windows[i] = make([]*histogramWindow, r.count(3))
+		for j := range windows[i] {
+			start := r.timestamp()
+			encoded := r.bytes()
+			if r.err != nil {
+				return r.err
+			}
+			histogram := &StandardHistogram{}
+			if err := histogram.UnmarshalBinary(encoded); err != nil {
+				return err
+			}
+			windows[i][j] = &histogramWindow{start: start, histogram: histogram}
+		}
+	}
+	if err := r.end(); err != nil {
+		return err
+	}
+	if width <= 0 {
+		return InvalidEncoding(fmt.Sprintf("window width %v", width))
+	}
+	if _, err := unmarshalSample(template); err != nil {
+		return err
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	atomic.StoreInt64(&h.dropped, dropped)
+	h.width = width
+	h.allowedLateness = allowedLateness
+	h.watermark = watermark
+	h.lastUpdate = lastUpdate
+	h.staleThreshold = staleThreshold
+	h.tags = tags
+	h.options = options
+	if h.newSample == nil {
+		h.newSample = func(start time.Time) Sample {
+			s, _ := unmarshalSample(template)
+			s.Clear(start)
+			return s
+		}
+	}
+	h.open = make(map[int64]*histogramWindow, len(windows[0]))
+	for _, window := range windows[0] {
+		h.open[window.start.UnixNano()] = window
+	}
+	h.closed = windows[1]
+	return nil
+}
+
+// advanceWatermark moves the watermark to t if it is newer and closes the
+// windows ending before it, with the mutex held.
+func (h *StandardWindowedHistogram) advanceWatermark(t time.Time) {
+	if !t.After(h.watermark) {
+		return
+	}
+	h.watermark = t
+
+	var closed []*histogramWindow
+	for key, w := range h.open {
+		if !w.start.Add(h.width).After(h.watermark) {
+			closed = append(closed, w)
+			delete(h.open, key)
+		}
+	}
+	if len(closed) == 0 {
+		return
+	}
+	h.closed = append(h.closed, closed...)
+	sort.Slice(h.closed, func(i, j int) bool { return h.closed[i].start.Before(h.closed[j].start) })
+}
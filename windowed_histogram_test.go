@@ -0,0 +1,152 @@
+package timemetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestWindowedHistogram(lateness time.Duration) WindowedHistogram {
+	opts := HistogramOptions{Stats: StatMin | StatMax | StatSampleSize}
+	return NewWindowedHistogramWithOptions(time.Minute, lateness, func(time.Time) Sample {
+		return NewUniformSample(100)
+	}, 10, nil, opts)
+}
+
+func TestWindowedHistogramTumbling(t *testing.T) {
+	h := newTestWindowedHistogram(0)
+	h.Update(time.Unix(0, 0), 1)
+	h.Update(time.Unix(30, 0), 3)
+	if n := h.OpenWindows(); 1 != n {
+		t.Errorf("h.OpenWindows(): 1 != %v\n", n)
+	}
+	if h.PushKeysTime(time.Unix(30, 0)) {
+		t.Error("h.PushKeysTime(): expected false with no closed window\n")
+	}
+
+	// Crossing into the next window closes the first one.
+	h.Update(time.Unix(60, 0), 5)
+	if n := h.ClosedWindows(); 1 != n {
+		t.Errorf("h.ClosedWindows(): 1 != %v\n", n)
+	}
+	if !h.PushKeysTime(time.Unix(60, 0)) {
+		t.Error("h.PushKeysTime(): expected true with a closed window\n")
+	}
+
+	keys := h.GetKeys(time.Unix(90, 0), "%s %d %s", true)
+	expected := []string{"min 0 1", "max 0 3", "sample_size 0 2"}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h.GetKeys(): %v != %v\n", expected, keys)
+	}
+	if n := h.ClosedWindows(); 0 != n {
+		t.Errorf("h.ClosedWindows(): 0 != %v after GetKeys\n", n)
+	}
+	if keys := h.GetKeys(time.Unix(90, 0), "%s %d %s", true); 0 != len(keys) {
+		t.Errorf("h.GetKeys(): closed window emitted twice: %v\n", keys)
+	}
+}
+
+func TestWindowedHistogramSeveralWindows(t *testing.T) {
+	h := newTestWindowedHistogram(0)
+	h.Update(time.Unix(10, 0), 1)
+	h.Update(time.Unix(70, 0), 2)
+	h.Update(time.Unix(200, 0), 3)
+
+	keys := h.GetKeys(time.Unix(200, 0), "%s %d %s", false)
+	expected := []string{
+		"min 0 1", "max 0 1", "sample_size 0 1",
+		"min 60 2", "max 60 2", "sample_size 60 1",
+	}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h.GetKeys(): %v != %v\n", expected, keys)
+	}
+}
+
+func TestWindowedHistogramAllowedLateness(t *testing.T) {
+	h := newTestWindowedHistogram(30 * time.Second)
+	h.Update(time.Unix(10, 0), 1)
+	h.Update(time.Unix(80, 0), 2)
+	if n := h.ClosedWindows(); 0 != n {
+		t.Errorf("h.ClosedWindows(): 0 != %v within allowed lateness\n", n)
+	}
+	if w := h.Watermark(); !time.Unix(50, 0).Equal(w) {
+		t.Errorf("h.Watermark(): %v != %v\n", time.Unix(50, 0), w)
+	}
+
+	// Late but within the allowed lateness: still counted in its window.
+	h.Update(time.Unix(50, 0), 4)
+	h.Update(time.Unix(95, 0), 2)
+	keys := h.GetKeys(time.Unix(95, 0), "%s %d %s", false)
+	expected := []string{"min 0 1", "max 0 4", "sample_size 0 2"}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h.GetKeys(): %v != %v\n", expected, keys)
+	}
+
+	// Too late: the window is closed.
+	h.Update(time.Unix(20, 0), 8)
+	if n := h.Dropped(); 1 != n {
+		t.Errorf("h.Dropped(): 1 != %v\n", n)
+	}
+	if n := h.OpenWindows(); 1 != n {
+		t.Errorf("h.OpenWindows(): 1 != %v\n", n)
+	}
+}
+
+func TestWindowedHistogramAdvanceWatermark(t *testing.T) {
+	h := newTestWindowedHistogram(time.Hour)
+	h.Update(time.Unix(10, 0), 1)
+	h.AdvanceWatermark(time.Unix(59, 0))
+	if n := h.ClosedWindows(); 0 != n {
+		t.Errorf("h.ClosedWindows(): 0 != %v\n", n)
+	}
+	h.AdvanceWatermark(time.Unix(60, 0))
+	if n := h.ClosedWindows(); 1 != n {
+		t.Errorf("h.ClosedWindows(): 1 != %v\n", n)
+	}
+	h.AdvanceWatermark(time.Unix(0, 0))
+	if w := h.Watermark(); !time.Unix(60, 0).Equal(w) {
+		t.Errorf("h.Watermark(): went back to %v\n", w)
+	}
+}
+
+func TestWindowedHistogramZeroOut(t *testing.T) {
+	h := newTestWindowedHistogram(time.Hour)
+	h.Update(time.Unix(10, 0), 1)
+	h.Update(time.Unix(70, 0), 2)
+	if !h.Stale(time.Unix(70+11*60, 0)) {
+		t.Error("h.Stale(): expected true\n")
+	}
+	h.ZeroOut()
+	if n := h.OpenWindows(); 0 != n {
+		t.Errorf("h.OpenWindows(): 0 != %v\n", n)
+	}
+	if n := h.ClosedWindows(); 2 != n {
+		t.Errorf("h.ClosedWindows(): 2 != %v\n", n)
+	}
+}
+
+func TestWindowedHistogramTags(t *testing.T) {
+	h := NewWindowedHistogramWithOptions(time.Minute, 0, func(time.Time) Sample {
+		return NewUniformSample(100)
+	}, 10, Tags{"host": "web1"}, HistogramOptions{Stats: StatMax})
+	h.Update(time.Unix(0, 0), 1)
+	h.Update(time.Unix(60, 0), 1)
+	keys := h.GetKeys(time.Unix(60, 0), "%s %d %s\n", false)
+	expected := []string{"max 0 1 host=web1\n"}
+	if !reflect.DeepEqual(expected, keys) {
+		t.Errorf("h.GetKeys(): %v != %v\n", expected, keys)
+	}
+}
+
+func TestGetOrRegisterWindowedHistogram(t *testing.T) {
+	r := NewRegistry(60, 10)
+	newSample := func(time.Time) Sample { return NewUniformSample(100) }
+	h := GetOrRegisterWindowedHistogram("foo", r, time.Unix(0, 0), time.Minute, 0, newSample)
+	h.Update(time.Unix(1, 0), 47)
+	if h2 := GetOrRegisterWindowedHistogram("foo", r, time.Unix(0, 0), time.Minute, 0, newSample); h != h2 {
+		t.Fatal(h2)
+	}
+	if m := r.Get("foo", nil); m != h {
+		t.Fatal(m)
+	}
+}